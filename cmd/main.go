@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"gitserver/internal/core"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -32,9 +35,46 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	err := run(args)
+
+	if *memprofile != "" {
+		f, err := os.Create(*memprofile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not create memory profile: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write memory profile: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if errors.Is(err, errUsage) {
+		pprof.StopCPUProfile()
+		os.Exit(129)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		pprof.StopCPUProfile()
+		os.Exit(1)
+	}
+}
+
+// errUsage is returned for a command line a command does not accept, once
+// its usage has been printed. Like git, the process then exits with 129.
+var errUsage = errors.New("invalid usage")
+
+// usageError prints usage and returns errUsage.
+func usageError(usage string) error {
+	fmt.Println(usage)
+	return errUsage
+}
+
+func run(args []string) error {
 	if len(args) < 1 {
-		fmt.Println("Usage: mygitserver [command]")
-		return
+		return usageError("Usage: mygitserver [command]")
 	}
 	command := args[0]
 
@@ -44,68 +84,963 @@ func main() {
 
 	case "add":
 		if len(args) < 2 {
-			fmt.Println("Usage: mygitserver add [files...]")
-			return
+			return usageError("Usage: mygitserver add [files...]")
 		}
 		core.AddFile(args[1:])
 
 	case "commit":
-		if len(args) < 3 || args[1] != "-m" {
-			fmt.Println("Usage: mygitserver commit -m \"message\"")
-			return
+		opts, err := parseCommitArgs(args[1:])
+		if err != nil {
+			fmt.Println(err)
+			return usageError("Usage: mygitserver commit [-m \"message\"]... [-F file]")
 		}
-		core.CommitChanges(args[2:])
+		return core.Commit(opts)
+
+	case "config":
+		return runConfig(args[1:])
 
 	case "branch":
-		if len(args) == 1 {
-			core.ListBranches()
-		} else if len(args) == 2 {
-			core.CreateBranch(args[1])
-		} else {
-			fmt.Println("Usage: mygitserver branch [branch-name]")
+		return runBranch(args[1:])
+
+	case "tag":
+		return runTag(args[1:])
+
+	case "reflog":
+		return runReflog(args[1:])
+
+	case "worktree":
+		return runWorktree(args[1:])
+
+	case "gc":
+		var opts core.GCOptions
+		for _, arg := range args[1:] {
+			if value, ok := strings.CutPrefix(arg, "--prune="); ok {
+				opts.Prune = value
+			} else {
+				return usageError("Usage: mygitserver gc [--prune=<date>]")
+			}
 		}
+		return core.GC(opts)
+
+	case "pack-refs":
+		var opts core.PackRefsOptions
+		for _, arg := range args[1:] {
+			switch arg {
+			case "--all":
+				opts.All = true
+			case "--no-prune":
+				opts.NoPrune = true
+			default:
+				return usageError("Usage: mygitserver pack-refs [--all] [--no-prune]")
+			}
+		}
+		return core.PackRefs(opts)
+
+	case "show-ref":
+		dereference := false
+		var patterns []string
+		for _, arg := range args[1:] {
+			if arg == "-d" || arg == "--dereference" {
+				dereference = true
+			} else {
+				patterns = append(patterns, arg)
+			}
+		}
+		return core.ShowRefs(patterns, dereference)
+
+	case "update-ref":
+		return runUpdateRef(args[1:])
 
 	case "checkout":
-		if len(args) < 2 {
-			fmt.Println("Usage: mygitserver checkout [branch-name]")
-			return
+		var opts core.CheckoutOptions
+		var positional []string
+		for _, arg := range args[1:] {
+			switch arg {
+			case "-f", "--force":
+				opts.Force = true
+			case "-m", "--merge":
+				opts.Merge = true
+			case "--detach":
+				opts.Detach = true
+			case "--ignore-other-worktrees":
+				opts.IgnoreOtherWorktrees = true
+			default:
+				if style, ok := strings.CutPrefix(arg, "--conflict="); ok {
+					opts.Merge, opts.ConflictStyle = true, style
+					continue
+				}
+				positional = append(positional, arg)
+			}
 		}
-		core.SwitchBranch(args[1])
+		if opts.Detach && len(positional) == 0 {
+			positional = []string{"HEAD"}
+		}
+		if len(positional) != 1 {
+			return usageError("Usage: mygitserver checkout [-f | -m] [--conflict=<style>] [--detach] [--ignore-other-worktrees] <branch-name | commit>")
+		}
+		return core.Checkout(positional[0], opts)
 
 	case "merge":
-		if len(args) < 2 {
-			fmt.Println("Usage: mygitserver merge [branch]")
-			return
-		}
-		core.MergeBranch(args[1])
+		return runMerge(args[1:])
+
+	case "cherry-pick":
+		return runSequencer(cherryPickUsage, true, core.CherryPick, args[1:])
+
+	case "revert":
+		return runSequencer(revertUsage, false, core.Revert, args[1:])
+
+	case "rerere":
+		return runRerere(args[1:])
+
+	case "mergetool":
+		return runMergetool(args[1:])
+
+	case "difftool":
+		return runDifftool(args[1:])
 
 	case "rebase":
-		fmt.Println("Rebase functionality not implemented yet")
+		return runRebase(args[1:])
 
 	case "status":
 		core.Status()
 
 	case "log":
-		core.Log()
+		opts, err := parseLogArgs(args[1:])
+		if err != nil {
+			fmt.Println(err)
+			return usageError("Usage: mygitserver log [--format=<format>] [--trailer <key>[(=|:)<value>]]... [--notes[=<ref>] | --no-notes] [<revision-range>...]")
+		}
+		return core.Log(opts)
+
+	case "notes":
+		return runNotes(args[1:])
+
+	case "rev-parse":
+		short := false
+		var revisions []string
+		for _, arg := range args[1:] {
+			if arg == "--short" {
+				short = true
+			} else {
+				revisions = append(revisions, arg)
+			}
+		}
+		if len(revisions) == 0 {
+			return usageError("Usage: mygitserver rev-parse [--short] <revision>...")
+		}
+		return core.RevParse(revisions, short)
+
+	case "check-ref-format":
+		var opts core.CheckRefFormatOptions
+		var names []string
+		for _, arg := range args[1:] {
+			switch arg {
+			case "--branch":
+				opts.Branch = true
+			case "--allow-onelevel":
+				opts.AllowOneLevel = true
+			case "--normalize":
+				opts.Normalize = true
+			default:
+				names = append(names, arg)
+			}
+		}
+		if len(names) != 1 {
+			return usageError("Usage: mygitserver check-ref-format [--branch] [--allow-onelevel] [--normalize] <refname>")
+		}
+		return core.CheckRefFormat(names[0], opts)
+
+	case "interpret-trailers":
+		return runInterpretTrailers(args[1:])
 
 	case "diff":
 		core.Diff()
 
 	default:
-		fmt.Println("Unknown command")
+		return fmt.Errorf("unknown command '%s'", command)
 	}
+	return nil
+}
 
-	if *memprofile != "" {
-		f, err := os.Create(*memprofile)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "could not create memory profile: %v\n", err)
-			os.Exit(1)
+// parseCommitArgs accepts repeated -m options, each starting a new paragraph.
+// Words following a -m value are appended to that paragraph, so the old
+// unquoted form `commit -m fix the bug` keeps working.
+func parseCommitArgs(args []string) (core.CommitOptions, error) {
+	var opts core.CommitOptions
+	inMessage := false
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-m" || arg == "--message":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("option '%s' requires a value", arg)
+			}
+			i++
+			opts.Messages = append(opts.Messages, args[i])
+			inMessage = true
+		case strings.HasPrefix(arg, "--message="):
+			opts.Messages = append(opts.Messages, strings.TrimPrefix(arg, "--message="))
+			inMessage = true
+		case arg == "-F" || arg == "--file":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("option '%s' requires a value", arg)
+			}
+			i++
+			opts.File = args[i]
+			inMessage = false
+		case strings.HasPrefix(arg, "--file="):
+			opts.File = strings.TrimPrefix(arg, "--file=")
+			inMessage = false
+		case arg == "--trailer":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("option '%s' requires a value", arg)
+			}
+			i++
+			trailer, err := core.ParseTrailerArg(args[i])
+			if err != nil {
+				return opts, err
+			}
+			opts.Trailers = append(opts.Trailers, trailer)
+			inMessage = false
+		case arg == "-s" || arg == "--signoff":
+			opts.Signoff = true
+			inMessage = false
+		case inMessage && !strings.HasPrefix(arg, "-"):
+			last := len(opts.Messages) - 1
+			opts.Messages[last] += " " + arg
+		default:
+			return opts, fmt.Errorf("unknown option '%s'", arg)
 		}
-		defer f.Close()
-		runtime.GC() 
-		if err := pprof.WriteHeapProfile(f); err != nil {
-			fmt.Fprintf(os.Stderr, "could not write memory profile: %v\n", err)
-			os.Exit(1)
+	}
+	return opts, nil
+}
+
+func runConfig(args []string) error {
+	global, unset, list := false, false, false
+	var rest []string
+	for _, arg := range args {
+		switch arg {
+		case "--global":
+			global = true
+		case "--unset":
+			unset = true
+		case "-l", "--list":
+			list = true
+		default:
+			rest = append(rest, arg)
+		}
+	}
+
+	switch {
+	case list:
+		return core.ConfigList()
+	case unset && len(rest) == 1:
+		return core.ConfigUnset(rest[0], global)
+	case !unset && len(rest) == 1:
+		return core.ConfigGet(rest[0])
+	case !unset && len(rest) == 2:
+		return core.ConfigSet(rest[0], rest[1], global)
+	}
+	return usageError("Usage: mygitserver config [--global] [--unset] [--list] <key> [value]")
+}
+
+func parseLogArgs(args []string) (core.LogOptions, error) {
+	var opts core.LogOptions
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case strings.HasPrefix(arg, "--format="):
+			opts.Format = strings.TrimPrefix(arg, "--format=")
+		case strings.HasPrefix(arg, "--pretty=format:"):
+			opts.Format = strings.TrimPrefix(arg, "--pretty=format:")
+		case arg == "--oneline":
+			opts.Format = "%h %s"
+		case arg == "--notes":
+			opts.NoNotes = false
+		case strings.HasPrefix(arg, "--notes="):
+			opts.NotesRefs = append(opts.NotesRefs, strings.TrimPrefix(arg, "--notes="))
+			opts.NoNotes = false
+		case arg == "--no-notes":
+			opts.NoNotes = true
+			opts.NotesRefs = nil
+		case arg == "--trailer":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("option '%s' requires a value", arg)
+			}
+			i++
+			// Like --trailer for commit, the filter is "key=value" or
+			// "key: value"; a bare key matches any value.
+			filter := core.Trailer{Key: strings.TrimSpace(args[i])}
+			if sep := strings.IndexAny(args[i], "=:"); sep >= 0 {
+				filter = core.Trailer{Key: strings.TrimSpace(args[i][:sep]), Value: strings.TrimSpace(args[i][sep+1:])}
+			}
+			opts.TrailerFilters = append(opts.TrailerFilters, filter)
+		case arg == "--":
+			opts.Revisions = append(opts.Revisions, args[i+1:]...)
+			return opts, nil
+		case strings.HasPrefix(arg, "-"):
+			return opts, fmt.Errorf("unknown option '%s'", arg)
+		default:
+			opts.Revisions = append(opts.Revisions, arg)
+		}
+	}
+	return opts, nil
+}
+
+func runInterpretTrailers(args []string) error {
+	var opts core.InterpretTrailersOptions
+	var files []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--trailer":
+			if i+1 >= len(args) {
+				return fmt.Errorf("option '%s' requires a value", arg)
+			}
+			i++
+			trailer, err := core.ParseTrailerArg(args[i])
+			if err != nil {
+				return err
+			}
+			opts.Trailers = append(opts.Trailers, trailer)
+		case strings.HasPrefix(arg, "--if-exists="):
+			opts.IfExists = strings.TrimPrefix(arg, "--if-exists=")
+		case arg == "--only-trailers" || arg == "--parse":
+			opts.OnlyTrailers = true
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			return usageError("Usage: mygitserver interpret-trailers [--trailer <key>=<value>]... [--if-exists=<action>] [--only-trailers] [file...]")
+		default:
+			files = append(files, arg)
 		}
 	}
+	return core.InterpretTrailers(files, opts)
+}
+
+const notesUsage = `Usage: mygitserver notes [--ref <notes-ref>] add [-f] [-m <msg>]... [-F <file>] [<commit>]
+       mygitserver notes [--ref <notes-ref>] show [<commit>]
+       mygitserver notes [--ref <notes-ref>] edit [<commit>]
+       mygitserver notes [--ref <notes-ref>] remove [<commit>...]
+       mygitserver notes [--ref <notes-ref>] list [<commit>]
+       mygitserver notes [--ref <notes-ref>] merge [-s <strategy>] <notes-ref>`
+
+const tagUsage = `Usage: mygitserver tag [-n[<num>]] [-l [<pattern>...]]
+       mygitserver tag [-a | -s] [-f] [-m <msg> | -F <file>] <tagname> [<commit>]
+       mygitserver tag -d <tagname>...
+       mygitserver tag -v <tagname>...`
+
+func runTag(args []string) error {
+	var opts core.TagOptions
+	var positional []string
+	mode, lines := "", 0
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-a" || arg == "--annotate":
+			opts.Annotate = true
+		case arg == "-s" || arg == "--sign":
+			opts.Sign = true
+		case arg == "-f" || arg == "--force":
+			opts.Force = true
+		case (arg == "-m" || arg == "--message" || arg == "-F" || arg == "--file") && i+1 < len(args):
+			i++
+			if arg == "-m" || arg == "--message" {
+				opts.Message.Messages = append(opts.Message.Messages, args[i])
+			} else {
+				opts.Message.File = args[i]
+			}
+		case arg == "-l" || arg == "--list":
+			mode = "list"
+		case arg == "-d" || arg == "--delete":
+			mode = "delete"
+		case arg == "-v" || arg == "--verify":
+			mode = "verify"
+		case strings.HasPrefix(arg, "-n"):
+			lines = 1
+			if n, err := strconv.Atoi(arg[2:]); err == nil {
+				lines = n
+			}
+			if mode == "" {
+				mode = "list"
+			}
+		case strings.HasPrefix(arg, "-"):
+			return usageError(tagUsage)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	switch {
+	case mode == "list" || (mode == "" && len(positional) == 0):
+		return core.ListTags(positional, lines)
+	case mode == "delete" && len(positional) > 0:
+		return core.DeleteTags(positional)
+	case mode == "verify" && len(positional) > 0:
+		return core.VerifyTags(positional)
+	case mode == "" && len(positional) <= 2:
+		target := ""
+		if len(positional) == 2 {
+			target = positional[1]
+		}
+		return core.CreateTag(positional[0], target, opts)
+	}
+	return usageError(tagUsage)
+}
+
+const reflogUsage = `Usage: mygitserver reflog [show] [<ref>]
+       mygitserver reflog expire [--expire=<time>] [--expire-unreachable=<time>] [--all] [<ref>...]
+       mygitserver reflog delete <ref>@{<n>}...`
+
+func runReflog(args []string) error {
+	subcommand := "show"
+	if len(args) > 0 && (args[0] == "show" || args[0] == "expire" || args[0] == "delete") {
+		subcommand, args = args[0], args[1:]
+	}
+
+	switch subcommand {
+	case "show":
+		if len(args) > 1 {
+			break
+		}
+		ref := ""
+		if len(args) == 1 {
+			ref = args[0]
+		}
+		return core.ReflogShow(ref)
+
+	case "expire":
+		var opts core.ReflogExpireOptions
+		var refs []string
+		for _, arg := range args {
+			switch {
+			case strings.HasPrefix(arg, "--expire="):
+				opts.Expire = strings.TrimPrefix(arg, "--expire=")
+			case strings.HasPrefix(arg, "--expire-unreachable="):
+				opts.ExpireUnreachable = strings.TrimPrefix(arg, "--expire-unreachable=")
+			case arg == "--all":
+				opts.All = true
+			case strings.HasPrefix(arg, "-"):
+				return usageError(reflogUsage)
+			default:
+				refs = append(refs, arg)
+			}
+		}
+		return core.ReflogExpire(refs, opts)
+
+	case "delete":
+		if len(args) == 0 {
+			break
+		}
+		return core.ReflogDelete(args)
+	}
+	return usageError(reflogUsage)
+}
+
+const updateRefUsage = `Usage: mygitserver update-ref [-m <reason>] <ref> <new-value> [<old-value>]
+       mygitserver update-ref [-m <reason>] -d <ref> [<old-value>]
+       mygitserver update-ref [-m <reason>] --stdin`
+
+func runUpdateRef(args []string) error {
+	reason := "update-ref"
+	del, stdin := false, false
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-m" && i+1 < len(args):
+			i++
+			reason = args[i]
+		case arg == "-d":
+			del = true
+		case arg == "--stdin":
+			stdin = true
+		case strings.HasPrefix(arg, "-"):
+			return usageError(updateRefUsage)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	switch {
+	case stdin && !del && len(positional) == 0:
+		return core.UpdateRefStdin(os.Stdin, reason)
+	case del && (len(positional) == 1 || len(positional) == 2):
+		var old *string
+		if len(positional) == 2 {
+			old = &positional[1]
+		}
+		return core.UpdateRef(positional[0], "", old, true, reason)
+	case !del && !stdin && (len(positional) == 2 || len(positional) == 3):
+		var old *string
+		if len(positional) == 3 {
+			old = &positional[2]
+		}
+		return core.UpdateRef(positional[0], positional[1], old, false, reason)
+	}
+	return usageError(updateRefUsage)
+}
+
+const mergeUsage = `Usage: mygitserver merge [--ff | --no-ff | --ff-only] [--squash] [-s <strategy>] [-X <option>] <branch>...
+       mygitserver merge --abort
+       mygitserver merge --continue
+
+Strategies: ort (default), recursive, ours, octopus (default for several branches)
+Strategy options: -X ours, -X theirs`
+
+func runMerge(args []string) error {
+	if len(args) == 1 && args[0] == "--abort" {
+		return core.MergeAbort()
+	}
+	if len(args) == 1 && args[0] == "--continue" {
+		return core.MergeContinue()
+	}
+	var opts core.MergeOptions
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--ff":
+			opts.FastForward = "ff"
+		case arg == "--no-ff":
+			opts.FastForward = "no-ff"
+		case arg == "--ff-only":
+			opts.FastForward = "only"
+		case arg == "--squash":
+			opts.Squash = true
+		case arg == "--no-squash":
+			opts.Squash = false
+		case (arg == "-s" || arg == "--strategy") && i+1 < len(args):
+			i++
+			opts.Strategy = args[i]
+		case strings.HasPrefix(arg, "--strategy="):
+			opts.Strategy = strings.TrimPrefix(arg, "--strategy=")
+		case (arg == "-X" || arg == "--strategy-option") && i+1 < len(args):
+			i++
+			opts.StrategyOptions = append(opts.StrategyOptions, args[i])
+		case strings.HasPrefix(arg, "--strategy-option="):
+			opts.StrategyOptions = append(opts.StrategyOptions, strings.TrimPrefix(arg, "--strategy-option="))
+		case strings.HasPrefix(arg, "-X") && len(arg) > 2:
+			opts.StrategyOptions = append(opts.StrategyOptions, arg[2:])
+		case strings.HasPrefix(arg, "-"):
+			return usageError(mergeUsage)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 {
+		return usageError(mergeUsage)
+	}
+	return core.Merge(positional, opts)
+}
+
+const cherryPickUsage = `Usage: mygitserver cherry-pick [-x] [-n | --no-commit] [-m <parent-number>] <commit>...
+       mygitserver cherry-pick (--continue | --skip | --abort)`
+
+const revertUsage = `Usage: mygitserver revert [-n | --no-commit] [-m <parent-number>] <commit>...
+       mygitserver revert (--continue | --skip | --abort)`
+
+// runSequencer parses the arguments shared by cherry-pick and revert; only
+// cherry-pick, which sets allowRecordOrigin, takes -x.
+func runSequencer(usage string, allowRecordOrigin bool, start func([]string, core.PickOptions) error, args []string) error {
+	if len(args) == 1 {
+		switch args[0] {
+		case "--continue":
+			return core.SequencerContinue()
+		case "--skip":
+			return core.SequencerSkip()
+		case "--abort":
+			return core.SequencerAbort()
+		}
+	}
+	var opts core.PickOptions
+	var revisions []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-x" && allowRecordOrigin:
+			opts.RecordOrigin = true
+		case arg == "-n" || arg == "--no-commit":
+			opts.NoCommit = true
+		case (arg == "-m" || arg == "--mainline") && i+1 < len(args):
+			i++
+			parent, err := strconv.Atoi(args[i])
+			if err != nil || parent < 1 {
+				return fmt.Errorf("switch 'm' expects a numerical value")
+			}
+			opts.Mainline = parent
+		case strings.HasPrefix(arg, "-"):
+			return usageError(usage)
+		default:
+			revisions = append(revisions, arg)
+		}
+	}
+	if len(revisions) == 0 {
+		return usageError(usage)
+	}
+	return start(revisions, opts)
+}
+
+const rebaseUsage = `Usage: mygitserver rebase [-i | --interactive] [--rebase-todo-file <file>] [--onto <newbase>] <upstream> [<branch>]
+       mygitserver rebase (--continue | --skip | --abort)
+
+-i opens the list of commits to replay in the editor: reorder the lines,
+delete them, or change "pick" to "edit", "squash" or "drop".
+--rebase-todo-file reads that list from a file instead.`
+
+func runRebase(args []string) error {
+	if len(args) == 1 {
+		switch args[0] {
+		case "--continue":
+			return core.ResumeRebase()
+		case "--skip":
+			return core.SkipRebase()
+		case "--abort":
+			return core.AbortRebase()
+		}
+	}
+	var opts core.RebaseOptions
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-i" || arg == "--interactive":
+			opts.Interactive = true
+		case arg == "--onto" && i+1 < len(args):
+			i++
+			opts.Onto = args[i]
+		case strings.HasPrefix(arg, "--onto="):
+			opts.Onto = strings.TrimPrefix(arg, "--onto=")
+		case arg == "--rebase-todo-file" && i+1 < len(args):
+			i++
+			opts.TodoFile = args[i]
+		case strings.HasPrefix(arg, "--rebase-todo-file="):
+			opts.TodoFile = strings.TrimPrefix(arg, "--rebase-todo-file=")
+		case strings.HasPrefix(arg, "-"):
+			return usageError(rebaseUsage)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 || len(positional) > 2 {
+		return usageError(rebaseUsage)
+	}
+	if len(positional) == 2 {
+		opts.Branch = positional[1]
+	}
+	return core.Rebase(positional[0], opts)
+}
+
+const rerereUsage = `Usage: mygitserver rerere
+       mygitserver rerere status
+       mygitserver rerere diff
+       mygitserver rerere forget <path>...
+
+Enable with "mygitserver config rerere.enabled true"; set rerere.autoUpdate
+to also stage the conflicts it resolves.`
+
+func runRerere(args []string) error {
+	if len(args) == 0 {
+		return core.Rerere()
+	}
+	switch args[0] {
+	case "status":
+		return core.RerereStatus()
+	case "diff":
+		return core.RerereDiff()
+	case "forget":
+		if len(args) > 1 {
+			return core.RerereForget(args[1:])
+		}
+	}
+	return usageError(rerereUsage)
+}
+
+const mergetoolUsage = `Usage: mygitserver mergetool [-t <tool> | --tool=<tool>] [<file>...]
+       mygitserver mergetool --tool-help`
+
+func runMergetool(args []string) error {
+	var opts core.MergetoolOptions
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--tool-help":
+			return core.ToolHelp("mergetool")
+		case (arg == "-t" || arg == "--tool") && i+1 < len(args):
+			i++
+			opts.Tool = args[i]
+		case strings.HasPrefix(arg, "--tool="):
+			opts.Tool = strings.TrimPrefix(arg, "--tool=")
+		case strings.HasPrefix(arg, "-"):
+			return usageError(mergetoolUsage)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	return core.Mergetool(paths, opts)
+}
+
+const difftoolUsage = `Usage: mygitserver difftool [-t <tool> | --tool=<tool>] [--staged] [<commit> [<commit>]] [-- <path>...]
+       mygitserver difftool --tool-help`
+
+func runDifftool(args []string) error {
+	var opts core.DifftoolOptions
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--tool-help":
+			return core.ToolHelp("difftool")
+		case (arg == "-t" || arg == "--tool") && i+1 < len(args):
+			i++
+			opts.Tool = args[i]
+		case strings.HasPrefix(arg, "--tool="):
+			opts.Tool = strings.TrimPrefix(arg, "--tool=")
+		case arg == "--staged" || arg == "--cached":
+			opts.Staged = true
+		case arg == "--":
+			paths = append(paths, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "-"):
+			return usageError(difftoolUsage)
+		default:
+			opts.Commits = append(opts.Commits, arg)
+		}
+	}
+	return core.Difftool(paths, opts)
+}
+
+const worktreeUsage = `Usage: mygitserver worktree add [-f] [--detach] [-b <new-branch>] <path> [<commit-ish>]
+       mygitserver worktree list
+       mygitserver worktree remove [-f] <worktree>
+       mygitserver worktree prune [-n] [-v]`
+
+func runWorktree(args []string) error {
+	if len(args) == 0 {
+		return usageError(worktreeUsage)
+	}
+	var opts core.WorktreeAddOptions
+	dryRun, verbose := false, false
+	var positional []string
+	for i := 1; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-b" && i+1 < len(args):
+			i++
+			opts.NewBranch = args[i]
+		case arg == "--detach":
+			opts.Detach = true
+		case arg == "-f" || arg == "--force":
+			opts.Force = true
+		case arg == "-n" || arg == "--dry-run":
+			dryRun = true
+		case arg == "-v" || arg == "--verbose":
+			verbose = true
+		case strings.HasPrefix(arg, "-"):
+			return usageError(worktreeUsage)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	switch {
+	case args[0] == "add" && (len(positional) == 1 || len(positional) == 2):
+		commitish := ""
+		if len(positional) == 2 {
+			commitish = positional[1]
+		}
+		return core.WorktreeAdd(positional[0], commitish, opts)
+	case args[0] == "list" && len(positional) == 0:
+		return core.WorktreeList()
+	case args[0] == "remove" && len(positional) == 1:
+		return core.WorktreeRemove(positional[0], opts.Force)
+	case args[0] == "prune" && len(positional) == 0:
+		return core.WorktreePrune(dryRun, verbose)
+	}
+	return usageError(worktreeUsage)
+}
+
+const branchUsage = `Usage: mygitserver branch [-v | -vv] [--merged [<commit>]] [--no-merged [<commit>]] [--contains [<commit>]]
+       mygitserver branch [-f] <branch-name> [<start-point>]
+       mygitserver branch (-u <upstream> | --set-upstream-to=<upstream>) [<branch-name>]
+       mygitserver branch --unset-upstream [<branch-name>]
+       mygitserver branch (-d | -D) <branch-name>...
+       mygitserver branch (-m | -M) [<old-branch>] <new-branch>`
+
+func runBranch(args []string) error {
+	var list core.BranchListOptions
+	var positional []string
+	mode, force, upstream := "", false, ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// --merged, --no-merged and --contains take an optional commit,
+		// defaulting to HEAD.
+		optionalCommit := func() string {
+			if _, value, ok := strings.Cut(arg, "="); ok {
+				return value
+			}
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				return args[i]
+			}
+			return "HEAD"
+		}
+		switch {
+		case arg == "-v" || arg == "--verbose":
+			list.Upstream = list.Verbose
+			list.Verbose = true
+		case arg == "-vv":
+			list.Verbose, list.Upstream = true, true
+		case (arg == "-u" || arg == "--set-upstream-to") && i+1 < len(args):
+			i++
+			mode, upstream = "upstream", args[i]
+		case strings.HasPrefix(arg, "--set-upstream-to="):
+			mode, upstream = "upstream", strings.TrimPrefix(arg, "--set-upstream-to=")
+		case arg == "--unset-upstream":
+			mode = "unset-upstream"
+		case arg == "--merged" || strings.HasPrefix(arg, "--merged="):
+			mode = "list"
+			list.Merged = optionalCommit()
+		case arg == "--no-merged" || strings.HasPrefix(arg, "--no-merged="):
+			mode = "list"
+			list.NoMerged = optionalCommit()
+		case arg == "--contains" || strings.HasPrefix(arg, "--contains="):
+			mode = "list"
+			list.Contains = optionalCommit()
+		case arg == "-d" || arg == "--delete":
+			mode = "delete"
+		case arg == "-D":
+			mode, force = "delete", true
+		case arg == "-m" || arg == "--move":
+			mode = "move"
+		case arg == "-M":
+			mode, force = "move", true
+		case arg == "-f" || arg == "--force":
+			force = true
+		case strings.HasPrefix(arg, "-"):
+			return usageError(branchUsage)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	branch := ""
+	if len(positional) == 1 {
+		branch = positional[0]
+	}
+	switch {
+	case mode == "upstream" && len(positional) <= 1:
+		return core.SetUpstream(branch, upstream)
+	case mode == "unset-upstream" && len(positional) <= 1:
+		return core.UnsetUpstream(branch)
+	case mode == "delete" && len(positional) > 0:
+		return core.DeleteBranch(positional, force)
+	case mode == "move" && len(positional) == 1:
+		return core.RenameBranch("", positional[0], force)
+	case mode == "move" && len(positional) == 2:
+		return core.RenameBranch(positional[0], positional[1], force)
+	case (mode == "" || mode == "list") && len(positional) == 0:
+		return core.ListBranches(list)
+	case mode == "" && (len(positional) == 1 || len(positional) == 2):
+		startPoint := ""
+		if len(positional) == 2 {
+			startPoint = positional[1]
+		}
+		if force {
+			return core.ForceCreateBranch(positional[0], startPoint)
+		}
+		return core.CreateBranchAt(positional[0], startPoint)
+	}
+	return usageError(branchUsage)
+}
+
+func runNotes(args []string) error {
+	notesRef := ""
+	for len(args) > 0 && strings.HasPrefix(args[0], "--ref") {
+		if value, ok := strings.CutPrefix(args[0], "--ref="); ok {
+			notesRef = value
+			args = args[1:]
+		} else if len(args) > 1 {
+			notesRef = args[1]
+			args = args[2:]
+		} else {
+			break
+		}
+	}
+	if len(args) == 0 {
+		return core.NotesList(notesRef, "")
+	}
+
+	subcommand, rest := args[0], args[1:]
+	commitArg := func() (string, bool) {
+		switch len(rest) {
+		case 0:
+			return "HEAD", true
+		case 1:
+			return rest[0], true
+		}
+		return "", false
+	}
+
+	switch subcommand {
+	case "add":
+		var message core.CommitOptions
+		force := false
+		var positional []string
+		for i := 0; i < len(rest); i++ {
+			switch arg := rest[i]; {
+			case arg == "-f" || arg == "--force":
+				force = true
+			case (arg == "-m" || arg == "-F") && i+1 < len(rest):
+				i++
+				if arg == "-m" {
+					message.Messages = append(message.Messages, rest[i])
+				} else {
+					message.File = rest[i]
+				}
+			case strings.HasPrefix(arg, "-"):
+				return usageError(notesUsage)
+			default:
+				positional = append(positional, arg)
+			}
+		}
+		rest = positional
+		commit, ok := commitArg()
+		if !ok {
+			break
+		}
+		return core.NotesAdd(notesRef, commit, message, force)
+
+	case "show", "edit", "list":
+		commit, ok := commitArg()
+		if !ok {
+			break
+		}
+		switch subcommand {
+		case "show":
+			return core.NotesShow(notesRef, commit)
+		case "edit":
+			return core.NotesEdit(notesRef, commit)
+		}
+		if len(rest) == 0 {
+			commit = ""
+		}
+		return core.NotesList(notesRef, commit)
+
+	case "remove":
+		return core.NotesRemove(notesRef, rest)
+
+	case "merge":
+		strategy := ""
+		var positional []string
+		for i := 0; i < len(rest); i++ {
+			if (rest[i] == "-s" || rest[i] == "--strategy") && i+1 < len(rest) {
+				i++
+				strategy = rest[i]
+			} else if value, ok := strings.CutPrefix(rest[i], "--strategy="); ok {
+				strategy = value
+			} else {
+				positional = append(positional, rest[i])
+			}
+		}
+		if len(positional) != 1 {
+			break
+		}
+		return core.NotesMerge(notesRef, positional[0], strategy)
+	}
+
+	return usageError(notesUsage)
 }
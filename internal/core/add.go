@@ -6,32 +6,102 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func AddFile(paths []string) {
+	index, conflicts, err := readIndexStages(indexPath())
+	if err != nil {
+		fmt.Println("Error reading index:", err)
+		return
+	}
+	// Staging a conflicted path, or its deletion, marks it resolved.
+	tracked := make(map[string]string, len(index)+len(conflicts))
+	for path, hash := range index {
+		tracked[path] = hash
+	}
+	for path := range conflicts {
+		tracked[path] = ""
+	}
+
 	for _, path := range paths {
-		if _, err := os.Stat(path); err != nil {
+		files, err := expandAddPath(path, tracked)
+		if err != nil {
 			fmt.Printf("File %s does not exist.\n", path)
 			continue
 		}
 
-		hash, err := generateFileHash(path)
-		if err != nil {
-			fmt.Println("Error hashing file:", err)
-			continue
-		}
+		for _, file := range files {
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				delete(index, normalizePath(file))
+				delete(conflicts, normalizePath(file))
+				fmt.Printf("File %s removed from staging.\n", file)
+				continue
+			}
+
+			hash, err := generateFileHash(file)
+			if err != nil {
+				fmt.Println("Error hashing file:", err)
+				continue
+			}
+
+			objectPath := repoPath("objects", hash)
+			if _, err := os.Stat(objectPath); os.IsNotExist(err) {
+				if err := copyFileToObject(file, objectPath); err != nil {
+					fmt.Println("Error storing file:", err)
+					continue
+				}
+			}
 
-		objectPath := filepath.Join(".git", "objects", hash)
-		if _, err := os.Stat(objectPath); os.IsNotExist(err) {
-			if err := copyFileToObject(path, objectPath); err != nil {
-				fmt.Println("Error storing file:", err)
+			key := normalizePath(file)
+			if _, conflicted := conflicts[key]; conflicted {
+				delete(conflicts, key)
+				index[key] = hash
+				fmt.Printf("File %s marked as resolved (hash: %s).\n", file, hash)
 				continue
 			}
-			fmt.Printf("File %s added to staging (hash: %s).\n", path, hash)
-		} else {
-			fmt.Printf("File %s already staged (hash: %s).\n", path, hash)
+			if index[key] == hash {
+				fmt.Printf("File %s already staged (hash: %s).\n", file, hash)
+				continue
+			}
+			index[key] = hash
+			fmt.Printf("File %s added to staging (hash: %s).\n", file, hash)
+		}
+	}
+
+	if err := writeIndexStages(index, conflicts); err != nil {
+		fmt.Println("Error writing index:", err)
+	}
+}
+
+// expandAddPath returns the files to stage for path: the file itself, every
+// file below a directory, or a tracked file that was deleted from disk.
+func expandAddPath(path string, index map[string]string) ([]string, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if _, tracked := index[normalizePath(path)]; tracked {
+			return []string{path}, nil
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	files, err := listWorkingDirectoryFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	prefix := normalizePath(path) + "/"
+	for tracked := range index {
+		if _, err := os.Stat(filepath.FromSlash(tracked)); os.IsNotExist(err) && (prefix == "./" || strings.HasPrefix(tracked, prefix)) {
+			files = append(files, tracked)
 		}
 	}
+	return files, nil
 }
 
 func generateFileHash(filePath string) (string, error) {
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Attributes are assigned to paths by .mygitattributes files, as git does
+// with .gitattributes:
+//
+//	*.json    merge=json
+//	go.sum    merge=union
+//	*.png     -merge
+//	docs/**   merge=text
+//
+// Each line is a pattern followed by attributes: "name" sets one, "-name"
+// unsets it, "!name" makes it unspecified again and "name=value" gives it
+// a value. A pattern without a slash matches the file name at any depth;
+// one with a slash matches the path relative to the file's directory, with
+// "**" matching any number of directories. A file applies to the paths
+// below its directory; deeper files take precedence over shallower ones,
+// later lines over earlier ones, and .mygitserver/info/attributes over all.
+
+const attributesFileName = ".mygitattributes"
+
+// Values of set and unset attributes; an unspecified attribute is "".
+const (
+	attrSet   = "\x00set"
+	attrUnset = "\x00unset"
+)
+
+type attrRule struct {
+	pattern string
+	attrs   map[string]string
+}
+
+// attributeChecker looks attributes up, reading each attributes file once.
+type attributeChecker struct {
+	files map[string][]attrRule
+}
+
+func newAttributeChecker() *attributeChecker {
+	return &attributeChecker{files: make(map[string][]attrRule)}
+}
+
+func (c *attributeChecker) rules(file string) []attrRule {
+	if rules, ok := c.files[file]; ok {
+		return rules
+	}
+	content, _ := ioutil.ReadFile(file)
+	rules := parseAttributes(string(content))
+	c.files[file] = rules
+	return rules
+}
+
+func parseAttributes(content string) []attrRule {
+	var rules []attrRule
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule := attrRule{pattern: fields[0], attrs: make(map[string]string)}
+		for _, attr := range fields[1:] {
+			switch {
+			case strings.HasPrefix(attr, "-"):
+				rule.attrs[attr[1:]] = attrUnset
+			case strings.HasPrefix(attr, "!"):
+				rule.attrs[attr[1:]] = ""
+			default:
+				if name, value, ok := strings.Cut(attr, "="); ok {
+					rule.attrs[name] = value
+				} else {
+					rule.attrs[attr] = attrSet
+				}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// get returns the value of attribute name for path: attrSet, attrUnset,
+// "" when unspecified, or the value it was given.
+func (c *attributeChecker) get(file, name string) string {
+	lookup := func(rules []attrRule, rel string) (string, bool) {
+		for i := len(rules) - 1; i >= 0; i-- {
+			if value, ok := rules[i].attrs[name]; ok && matchAttrPattern(rules[i].pattern, rel) {
+				return value, true
+			}
+		}
+		return "", false
+	}
+
+	file = normalizePath(file)
+	if value, ok := lookup(c.rules(repoPath("info", "attributes")), file); ok {
+		return value
+	}
+	for dir := path.Dir(file); ; dir = path.Dir(dir) {
+		rel, attrFile := file, attributesFileName
+		if dir != "." {
+			rel, attrFile = strings.TrimPrefix(file, dir+"/"), dir+"/"+attributesFileName
+		}
+		if value, ok := lookup(c.rules(attrFile), rel); ok {
+			return value
+		}
+		if dir == "." || dir == "/" {
+			return ""
+		}
+	}
+}
+
+// matchAttrPattern matches rel, a path relative to the attributes file,
+// against pattern.
+func matchAttrPattern(pattern, rel string) bool {
+	if anchored, ok := strings.CutPrefix(pattern, "/"); ok {
+		return matchGlobPath(anchored, rel)
+	}
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchGlobPath(pattern, rel)
+}
+
+// matchGlobPath matches name component by component, "**" standing for
+// any number of components.
+func matchGlobPath(pattern, name string) bool {
+	patterns, parts := strings.Split(pattern, "/"), strings.Split(name, "/")
+	var match func(i, j int) bool
+	match = func(i, j int) bool {
+		if i == len(patterns) {
+			return j == len(parts)
+		}
+		if patterns[i] == "**" {
+			for k := j; k <= len(parts); k++ {
+				if match(i+1, k) {
+					return true
+				}
+			}
+			return false
+		}
+		if j == len(parts) {
+			return false
+		}
+		ok, _ := path.Match(patterns[i], parts[j])
+		return ok && match(i+1, j+1)
+	}
+	return match(0, 0)
+}
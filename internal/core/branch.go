@@ -5,93 +5,390 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
-func ListBranches() {
-	headContent, err := ioutil.ReadFile(".mygitserver/HEAD")
+// BranchListOptions filters and formats the branch listing. Merged and
+// NoMerged keep only branches whose tip is (or is not) reachable from the
+// named commit; Contains keeps branches whose history includes it. Verbose
+// adds each tip's abbreviated hash and subject, and how far the branch is
+// ahead of or behind its upstream; Upstream (-vv) also names the upstream.
+type BranchListOptions struct {
+	Verbose  bool
+	Upstream bool
+	Merged   string
+	NoMerged string
+	Contains string
+}
+
+// ListBranches prints the local branches, marking the current one.
+func ListBranches(opts BranchListOptions) error {
+	headRef, detached, err := readHead()
 	if err != nil {
-		fmt.Println("Error reading HEAD:", err)
-		return
+		return fmt.Errorf("could not read HEAD: %v", err)
 	}
-
-	headRef := strings.TrimSpace(string(headContent))
-	var currentBranch string
-	if strings.HasPrefix(headRef, "ref: ") {
-		currentBranch = strings.TrimPrefix(headRef, "ref: refs/heads/")
-	} else {
-		currentBranch = "detached"
+	branches, err := listRefs("refs/heads/")
+	if err != nil {
+		return fmt.Errorf("could not read branches: %v", err)
 	}
 
-	branchesPath := filepath.Join(".mygitserver", "refs", "heads")
-	files, err := ioutil.ReadDir(branchesPath)
+	filter, err := newBranchFilter(opts)
 	if err != nil {
-		fmt.Println("Error reading branches:", err)
-		return
+		return err
+	}
+	names := make([]string, 0, len(branches))
+	width := 0
+	for ref, hash := range branches {
+		keep, err := filter(hash)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+		name := strings.TrimPrefix(ref, "refs/heads/")
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	sort.Strings(names)
+
+	var detachedLine string
+	if detached {
+		if keep, err := filter(headRef); err != nil {
+			return err
+		} else if keep {
+			head, _ := describeHead()
+			detachedLine = "(" + head + ")"
+			if len(detachedLine) > width {
+				width = len(detachedLine)
+			}
+		}
 	}
 
 	fmt.Println("Branches:")
-	for _, file := range files {
-		branchName := file.Name()
-		if branchName == currentBranch {
-			fmt.Printf("* %s\n", branchName)
-		} else {
-			fmt.Printf("  %s\n", branchName)
+	if detachedLine != "" {
+		printBranchLine("*", detachedLine, headRef, width, opts.Verbose, "")
+	}
+	for _, name := range names {
+		marker := " "
+		if !detached && headRef == "refs/heads/"+name {
+			marker = "*"
 		}
+		tracking := ""
+		if opts.Verbose {
+			info, err := branchTracking(name)
+			if err != nil {
+				return err
+			}
+			if info != nil {
+				tracking = info.summary(opts.Upstream)
+			}
+		}
+		printBranchLine(marker, name, branches["refs/heads/"+name], width, opts.Verbose, tracking)
 	}
+	return nil
 }
 
-func SwitchBranch(branchName string) {
-	branchPath := filepath.Join(".mygitserver", "refs", "heads", branchName)
-	if _, err := os.Stat(branchPath); os.IsNotExist(err) {
-		fmt.Printf("Branch '%s' does not exist.\n", branchName)
+func printBranchLine(marker, name, hash string, width int, verbose bool, tracking string) {
+	if !verbose {
+		fmt.Printf("%s %s\n", marker, name)
 		return
 	}
+	subject := ""
+	if hash != "" {
+		if commit, err := readCommit(hash); err == nil {
+			subject = commit.Subject()
+		}
+	}
+	if tracking != "" {
+		subject = tracking + " " + subject
+	}
+	fmt.Printf("%s %-*s %-7s %s\n", marker, width, name, shortHash(hash), subject)
+}
 
-	headContent := fmt.Sprintf("ref: refs/heads/%s", branchName)
-	err := ioutil.WriteFile(".mygitserver/HEAD", []byte(headContent), 0644)
+// newBranchFilter returns a predicate over branch tips implementing the
+// --merged, --no-merged and --contains options.
+func newBranchFilter(opts BranchListOptions) (func(hash string) (bool, error), error) {
+	var merged, notMerged map[string]bool
+	var contains string
+	var err error
+	if opts.Merged != "" {
+		if merged, err = reachableFrom(opts.Merged); err != nil {
+			return nil, err
+		}
+	}
+	if opts.NoMerged != "" {
+		if notMerged, err = reachableFrom(opts.NoMerged); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Contains != "" {
+		if contains, err = resolveCommit(opts.Contains); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(hash string) (bool, error) {
+		if merged != nil && !merged[hash] {
+			return false, nil
+		}
+		if notMerged != nil && (hash == "" || notMerged[hash]) {
+			return false, nil
+		}
+		if contains != "" {
+			if hash == "" {
+				return false, nil
+			}
+			return isAncestor(contains, hash)
+		}
+		return true, nil
+	}, nil
+}
+
+func reachableFrom(revision string) (map[string]bool, error) {
+	hash, err := resolveCommit(revision)
 	if err != nil {
-		fmt.Println("Error updating HEAD:", err)
-		return
+		return nil, err
 	}
+	return ancestors(hash)
+}
 
-	fmt.Printf("Switched to branch '%s'\n", branchName)
+// SwitchBranch checks out branchName, refusing to overwrite local changes.
+func SwitchBranch(branchName string) error {
+	return Checkout(branchName, CheckoutOptions{})
 }
 
-func CreateBranch(branchName string) {
-	if branchName == "" {
-		fmt.Println("Branch name cannot be empty")
-		return
+// CreateBranch creates branchName at the current HEAD commit.
+func CreateBranch(branchName string) error {
+	return CreateBranchAt(branchName, "")
+}
+
+// CreateBranchAt creates branchName pointing at startPoint, or at HEAD when
+// startPoint is empty.
+func CreateBranchAt(branchName, startPoint string) error {
+	return createBranch(branchName, startPoint, false)
+}
+
+// ForceCreateBranch points branchName at startPoint whether or not it
+// already exists, as "branch -f" does. The checked-out branch cannot be
+// moved this way because the working tree would no longer match it.
+func ForceCreateBranch(branchName, startPoint string) error {
+	return createBranch(branchName, startPoint, true)
+}
+
+func createBranch(branchName, startPoint string, force bool) error {
+	if err := checkBranchName(branchName); err != nil {
+		return err
 	}
 
-	branchPath := filepath.Join(".mygitserver", "refs", "heads", branchName)
-	if _, err := os.Stat(branchPath); err == nil {
-		fmt.Printf("Branch '%s' already exists.\n", branchName)
-		return
+	ref := "refs/heads/" + branchName
+	exists := refExists(ref)
+	if exists && !force {
+		return fmt.Errorf("branch '%s' already exists", branchName)
+	}
+	if exists {
+		if headRef, detached, err := readHead(); err == nil && !detached && headRef == ref {
+			return fmt.Errorf("cannot force update the current branch '%s'", branchName)
+		}
+		if where, ok := branchCheckedOutElsewhere(ref); ok {
+			return fmt.Errorf("cannot force update the branch '%s' checked out at '%s'", branchName, where)
+		}
 	}
 
-	headContent, err := ioutil.ReadFile(".mygitserver/HEAD")
+	var commitHash string
+	var err error
+	if startPoint == "" {
+		commitHash, err = headCommit()
+	} else {
+		commitHash, err = resolveCommit(startPoint)
+	}
 	if err != nil {
-		fmt.Println("Error reading HEAD:", err)
-		return
+		return fmt.Errorf("could not resolve start point: %v", err)
+	}
+
+	reason := "branch: Created from "
+	if exists {
+		reason = "branch: Reset to "
+	}
+	if startPoint == "" {
+		startPoint = "HEAD"
+	}
+	if err := updateRef(ref, commitHash, reason+startPoint); err != nil {
+		return fmt.Errorf("could not create branch: %v", err)
 	}
 
-	headRef := strings.TrimSpace(string(headContent))
-	if strings.HasPrefix(headRef, "ref: ") {
-		currentBranch := strings.TrimPrefix(headRef, "ref: ")
-		currentBranchCommit, err := ioutil.ReadFile(filepath.Join(".mygitserver", currentBranch))
+	if exists {
+		fmt.Printf("Branch '%s' reset to commit %s\n", branchName, commitHash)
+	} else {
+		fmt.Printf("Branch '%s' created, pointing to commit %s\n", branchName, commitHash)
+	}
+	return nil
+}
+
+// DeleteBranch removes the named branches. Unless force is set, a branch
+// whose commits are not all reachable from HEAD is kept, since deleting it
+// would lose work. The checked-out branch can never be deleted.
+func DeleteBranch(names []string, force bool) error {
+	headRef, detached, err := readHead()
+	if err != nil {
+		return fmt.Errorf("could not read HEAD: %v", err)
+	}
+	head, err := headCommit()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := checkBranchName(name); err != nil {
+			return err
+		}
+		ref := "refs/heads/" + name
+		if !refExists(ref) {
+			return fmt.Errorf("branch '%s' not found", name)
+		}
+		if !detached && headRef == ref {
+			return fmt.Errorf("cannot delete branch '%s' checked out at the current HEAD", name)
+		}
+		if where, ok := branchCheckedOutElsewhere(ref); ok {
+			return fmt.Errorf("cannot delete branch '%s' checked out at '%s'", name, where)
+		}
+		hash, err := readRef(ref)
 		if err != nil {
-			fmt.Printf("Error reading current branch commit for %s: %v\n", currentBranch, err)
-			return
+			return err
 		}
-		headRef = string(currentBranchCommit)
+		if !force && hash != "" {
+			merged := false
+			if head != "" {
+				if merged, err = isAncestor(hash, head); err != nil {
+					return err
+				}
+			}
+			if !merged {
+				return fmt.Errorf("the branch '%s' is not fully merged.\nIf you are sure you want to delete it, run 'mygitserver branch -D %s'", name, name)
+			}
+		}
+
+		if err := deleteRef(ref); err != nil {
+			return fmt.Errorf("could not delete branch '%s': %v", name, err)
+		}
+		if err := removeReflog(ref); err != nil {
+			return err
+		}
+		if err := renameConfigSubsection("branch", name, ""); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted branch %s (was %s).\n", name, shortHash(hash))
 	}
+	return nil
+}
 
-	err = ioutil.WriteFile(branchPath, []byte(headRef), 0644)
+// RenameBranch renames oldName (the current branch when empty) to newName,
+// carrying its reflog and branch.<name>.* settings along and updating HEAD
+// if it pointed at the old name. An existing newName is only replaced when
+// force is set.
+func RenameBranch(oldName, newName string, force bool) error {
+	headRef, detached, err := readHead()
 	if err != nil {
-		fmt.Println("Error creating branch:", err)
-		return
+		return fmt.Errorf("could not read HEAD: %v", err)
+	}
+	if oldName == "" {
+		if detached {
+			return fmt.Errorf("cannot rename the current branch while not on any")
+		}
+		oldName = strings.TrimPrefix(headRef, "refs/heads/")
+	}
+	if err := checkBranchName(oldName); err != nil {
+		return err
+	}
+	if err := checkBranchName(newName); err != nil {
+		return err
+	}
+
+	oldRef, newRef := "refs/heads/"+oldName, "refs/heads/"+newName
+	if !refExists(oldRef) {
+		return fmt.Errorf("no branch named '%s'", oldName)
+	}
+	if oldRef != newRef && refExists(newRef) {
+		if !force {
+			return fmt.Errorf("a branch named '%s' already exists", newName)
+		}
+		if _, ok := branchCheckedOut(newRef); ok {
+			return fmt.Errorf("cannot force update the current branch '%s'", newName)
+		}
+	}
+
+	hash, err := readRef(oldRef)
+	if err != nil {
+		return err
+	}
+	if oldRef != newRef {
+		// The old ref goes first so that "a" can be renamed to "a/b".
+		if err := deleteRef(oldRef); err != nil {
+			return fmt.Errorf("could not rename branch: %v", err)
+		}
+		if err := writeRef(newRef, hash); err != nil {
+			writeRef(oldRef, hash)
+			return fmt.Errorf("could not rename branch: %v", err)
+		}
+		if err := moveReflog(oldRef, newRef); err != nil {
+			return err
+		}
+		reason := fmt.Sprintf("Branch: renamed %s to %s", oldRef, newRef)
+		if err := appendReflog(newRef, hash, hash, reason); err != nil {
+			return err
+		}
+		if !detached && headRef == oldRef {
+			if err := appendReflog("HEAD", hash, hash, reason); err != nil {
+				return err
+			}
+		}
+		if err := renameConfigSubsection("branch", newName, ""); err != nil {
+			return err
+		}
+		if err := renameConfigSubsection("branch", oldName, newName); err != nil {
+			return err
+		}
 	}
 
-	fmt.Printf("Branch '%s' created, pointing to commit %s\n", branchName, strings.TrimSpace(headRef))
+	// Every worktree that has the branch checked out follows the rename.
+	worktrees, err := listWorktrees()
+	if err != nil {
+		return err
+	}
+	for _, wt := range worktrees {
+		if wt.Detached || wt.Head != oldRef || wt.Prunable != "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(wt.GitDir, "HEAD"), []byte("ref: "+newRef), 0644); err != nil {
+			return fmt.Errorf("could not update HEAD of '%s': %v", wt.Path, err)
+		}
+	}
+	fmt.Printf("Branch '%s' renamed to '%s'\n", oldName, newName)
+	return nil
+}
+
+// moveReflog renames the reflog of oldRef to belong to newRef, replacing
+// any log newRef had.
+func moveReflog(oldRef, newRef string) error {
+	content, err := ioutil.ReadFile(reflogPath(oldRef))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := removeReflog(oldRef); err != nil {
+		return err
+	}
+	if err := removeReflog(newRef); err != nil {
+		return err
+	}
+	if content == nil {
+		return nil
+	}
+	newPath := reflogPath(newRef)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(newPath, content, 0644)
 }
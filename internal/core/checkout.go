@@ -0,0 +1,351 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CheckoutOptions controls what happens to local modifications of files
+// that differ between the current and the target commit. By default the
+// checkout is refused. Force discards all local changes; Merge does a
+// three-way merge of the local version into the target version. Detach
+// checks out a branch's tip without attaching HEAD to the branch.
+// IgnoreOtherWorktrees allows checking out a branch that another worktree
+// already has checked out. ConflictStyle overrides merge.conflictStyle for
+// the conflicts of a --merge checkout.
+type CheckoutOptions struct {
+	Force                bool
+	Merge                bool
+	Detach               bool
+	IgnoreOtherWorktrees bool
+	ConflictStyle        string
+}
+
+// Checkout switches to target and updates the working directory and index
+// to match it. A branch name attaches HEAD to that branch, and "HEAD" stays
+// on the current one; any other commit name (including an abbreviated hash)
+// leaves HEAD detached at the commit.
+func Checkout(target string, opts CheckoutOptions) error {
+	if opts.Force && opts.Merge {
+		return fmt.Errorf("--force and --merge are incompatible")
+	}
+	if !opts.Force {
+		if err := checkNoUnmergedPaths("checking out"); err != nil {
+			return err
+		}
+	}
+
+	currentRef, wasDetached, err := readHead()
+	if err != nil {
+		return fmt.Errorf("could not read HEAD: %v", err)
+	}
+	// "HEAD" stays on the current branch rather than detaching at its tip.
+	if (target == "" || target == "HEAD") && !opts.Detach && !wasDetached {
+		target = strings.TrimPrefix(currentRef, "refs/heads/")
+	}
+
+	ref := "refs/heads/" + target
+	onBranch := !opts.Detach && checkBranchName(target) == nil && refExists(ref)
+	var newCommit string
+	if onBranch {
+		newCommit, err = readRef(ref)
+	} else {
+		newCommit, err = resolveCommit(target)
+	}
+	if err != nil {
+		return err
+	}
+	if onBranch && !wasDetached && currentRef == ref && !opts.Force {
+		fmt.Printf("Already on '%s'\n", target)
+		return nil
+	}
+	if onBranch && !opts.IgnoreOtherWorktrees {
+		if where, ok := branchCheckedOutElsewhere(ref); ok {
+			return fmt.Errorf("'%s' is already checked out at '%s'", target, where)
+		}
+	}
+
+	oldCommit, err := headCommit()
+	if err != nil {
+		return err
+	}
+	label := target
+	if !onBranch {
+		label = shortHash(newCommit)
+	}
+	if err := switchWorkingTree(oldCommit, newCommit, label, opts); err != nil {
+		return err
+	}
+
+	from := strings.TrimPrefix(currentRef, "refs/heads/")
+	if wasDetached {
+		from = shortHash(currentRef)
+	}
+	headRef := ""
+	if onBranch {
+		headRef = ref
+	}
+	if err := switchHead(headRef, oldCommit, newCommit, fmt.Sprintf("checkout: moving from %s to %s", from, target)); err != nil {
+		return err
+	}
+	// Switching away abandons a merge in progress.
+	clearMergeState()
+
+	if wasDetached && oldCommit != newCommit {
+		warnOrphanedCommits(oldCommit, newCommit)
+	}
+	if onBranch {
+		fmt.Printf("Switched to branch '%s'\n", target)
+		return nil
+	}
+
+	commit, err := readCommit(newCommit)
+	if err != nil {
+		return err
+	}
+	if !wasDetached {
+		fmt.Printf("Note: switching to '%s'.\n\n", target)
+		fmt.Println("You are in 'detached HEAD' state. You can look around and make commits,")
+		fmt.Println("but they will be lost when you switch away unless you create a branch for them:")
+		fmt.Println()
+		fmt.Println("  mygitserver branch <new-branch-name>")
+		fmt.Println()
+	}
+	fmt.Printf("HEAD is now at %s %s\n", shortHash(newCommit), commit.Subject())
+	return nil
+}
+
+// warnOrphanedCommits tells the user about commits that were only reachable
+// from the detached HEAD being left.
+func warnOrphanedCommits(oldCommit, newCommit string) {
+	reachable, err := ancestors(newCommit)
+	if err != nil {
+		return
+	}
+	refs, err := listRefs("refs/")
+	if err != nil {
+		return
+	}
+	for _, hash := range refs {
+		if hash == "" || reachable[hash] {
+			continue
+		}
+		fromRef, err := ancestors(hash)
+		if err != nil {
+			continue
+		}
+		for commit := range fromRef {
+			reachable[commit] = true
+		}
+	}
+
+	var lost []string
+	queue := []string{oldCommit}
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if current == "" || seen[current] || reachable[current] {
+			continue
+		}
+		seen[current] = true
+		lost = append(lost, current)
+		if commit, err := readCommit(current); err == nil {
+			queue = append(queue, commit.Parents...)
+		}
+	}
+	if len(lost) == 0 {
+		return
+	}
+
+	fmt.Printf("Warning: you are leaving %d commit(s) behind, not connected to\nany of your branches:\n\n", len(lost))
+	for _, hash := range lost {
+		if commit, err := readCommit(hash); err == nil {
+			fmt.Printf("  %s %s\n", shortHash(hash), commit.Subject())
+		}
+	}
+	fmt.Println("\nIf you want to keep them by creating a new branch, this may be a good time")
+	fmt.Println("to do so with:")
+	fmt.Printf("\n  mygitserver branch <new-branch-name> %s\n\n", shortHash(oldCommit))
+}
+
+// switchWorkingTree moves the working directory and index from the tree of
+// oldCommit to the tree of newCommit. Paths that are the same in both trees
+// keep their local modifications. label names the target in conflict
+// markers written by a --merge checkout.
+func switchWorkingTree(oldCommit, newCommit, label string, opts CheckoutOptions) error {
+	oldTree, err := commitTree(oldCommit)
+	if err != nil {
+		return err
+	}
+	newTree, err := commitTree(newCommit)
+	if err != nil {
+		return err
+	}
+	index, err := readIndex()
+	if err != nil {
+		return fmt.Errorf("could not read index: %v", err)
+	}
+
+	if opts.Force {
+		return resetWorkingTree(oldTree, newTree, index)
+	}
+
+	var changed, dirty, blocked, untracked []string
+	for _, path := range unionKeys(oldTree, newTree) {
+		if oldTree[path] == newTree[path] {
+			continue
+		}
+		changed = append(changed, path)
+
+		indexHash, inIndex := index[path]
+		workHash, exists := workingFileHash(path)
+		if inIndex == (newTree[path] != "") && indexHash == newTree[path] && exists == inIndex && workHash == indexHash {
+			continue // already matches the target
+		}
+		switch {
+		case !inIndex && oldTree[path] == "" && exists:
+			untracked = append(untracked, path)
+		case indexHash != oldTree[path] || (inIndex && (!exists || workHash != indexHash)):
+			dirty = append(dirty, path)
+			if !opts.Merge {
+				blocked = append(blocked, path)
+			}
+		}
+	}
+
+	if len(untracked) > 0 {
+		fmt.Println("The following untracked working tree files would be overwritten by checkout:")
+		for _, path := range untracked {
+			fmt.Printf("\t%s\n", path)
+		}
+		return fmt.Errorf("please move or remove them before you switch branches")
+	}
+	if len(blocked) > 0 {
+		fmt.Println("Your local changes to the following files would be overwritten by checkout:")
+		for _, path := range blocked {
+			fmt.Printf("\t%s\n", path)
+		}
+		return fmt.Errorf("please commit your changes, or use --merge or --force")
+	}
+
+	isDirty := make(map[string]bool)
+	for _, path := range dirty {
+		isDirty[path] = true
+	}
+	fileOpts, err := newMergeFileOptions("local", shortHash(oldCommit), label)
+	if err != nil {
+		return err
+	}
+	if opts.ConflictStyle != "" {
+		if err := checkConflictStyle(opts.ConflictStyle); err != nil {
+			return err
+		}
+		fileOpts.Style = opts.ConflictStyle
+	}
+
+	var conflicts []string
+	for _, path := range changed {
+		target := newTree[path]
+		if isDirty[path] {
+			conflict, err := mergeLocalChanges(path, oldTree[path], target, fileOpts)
+			if err != nil {
+				return err
+			}
+			if conflict {
+				conflicts = append(conflicts, path)
+			}
+		} else if target == "" {
+			if err := removeWorkingFile(path); err != nil {
+				return err
+			}
+		} else if err := writeWorkingFile(path, target); err != nil {
+			return err
+		}
+
+		if target == "" {
+			delete(index, path)
+		} else {
+			index[path] = target
+		}
+	}
+
+	if err := writeIndex(index); err != nil {
+		return fmt.Errorf("could not write index: %v", err)
+	}
+	for _, path := range conflicts {
+		fmt.Printf("CONFLICT (content): Merge conflict in %s\n", path)
+	}
+	return nil
+}
+
+// mergeLocalChanges carries the working copy of path over to the target blob
+// with a three-way merge against the blob it was based on.
+func mergeLocalChanges(path, baseHash, targetHash string, opts mergeFileOptions) (bool, error) {
+	base, err := readBlob(baseHash)
+	if err != nil {
+		return false, err
+	}
+	target, err := readBlob(targetHash)
+	if err != nil {
+		return false, err
+	}
+	local, err := ioutil.ReadFile(filepath.FromSlash(path))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	merged, conflict := mergeFileContents(base, local, target, opts)
+	if len(merged) == 0 && targetHash == "" {
+		return conflict, removeWorkingFile(path)
+	}
+	return conflict, writeWorkingContent(path, merged)
+}
+
+// resetWorkingTree makes the working directory and index match newTree,
+// throwing away local changes to tracked files.
+func resetWorkingTree(oldTree, newTree, index map[string]string) error {
+	conflicts, err := readIndexConflicts()
+	if err != nil {
+		return err
+	}
+	conflicted := make(map[string]string, len(conflicts))
+	for path := range conflicts {
+		conflicted[path] = path
+	}
+	for _, path := range unionKeys(oldTree, newTree, index, conflicted) {
+		target := newTree[path]
+		if target == "" {
+			if err := removeWorkingFile(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if hash, ok := workingFileHash(path); ok && hash == target {
+			continue
+		}
+		if err := writeWorkingFile(path, target); err != nil {
+			return err
+		}
+	}
+
+	fresh := make(map[string]string, len(newTree))
+	for path, hash := range newTree {
+		fresh[path] = hash
+	}
+	if err := writeIndexStages(fresh, nil); err != nil {
+		return fmt.Errorf("could not write index: %v", err)
+	}
+	return nil
+}
+
+// readBlob returns the content of a blob; an empty hash is an absent file.
+func readBlob(hash string) ([]byte, error) {
+	if hash == "" {
+		return nil, nil
+	}
+	return readObject(hash)
+}
@@ -2,20 +2,215 @@ package core
 
 import (
 	"fmt"
-	"gitserver/internal/utils"
 	"io/ioutil"
-	"time"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
-func CommitChanges(message []string) {
-	commitHash := utils.GenerateHash(time.Now().String())
-	commitMessage := utils.JoinMessage(message)
+// CommitOptions selects where the commit message comes from. Each entry of
+// Messages is a separate paragraph (one per -m). File names a message file,
+// "-" meaning standard input. With neither set the editor is opened.
+// Trailers, and a Signed-off-by trailer when Signoff is set, are appended to
+// the final message.
+type CommitOptions struct {
+	Messages []string
+	File     string
+	Trailers []Trailer
+	Signoff  bool
+}
+
+// CommitChanges records a commit whose message is made of the given
+// paragraphs.
+func CommitChanges(message []string) error {
+	return Commit(CommitOptions{Messages: message})
+}
+
+func Commit(opts CommitOptions) error {
+	if len(opts.Messages) > 0 && opts.File != "" {
+		return fmt.Errorf("options -m and -F cannot be used together")
+	}
+	if err := checkNoUnmergedPaths("committing"); err != nil {
+		return err
+	}
+	if err := rerereRecord(); err != nil {
+		return err
+	}
+
+	message, err := commitMessage(opts)
+	if err != nil {
+		return err
+	}
+	message, err = addCommitTrailers(message, opts)
+	if err != nil {
+		return err
+	}
+
+	parent, err := headCommit()
+	if err != nil {
+		return fmt.Errorf("could not resolve HEAD: %v", err)
+	}
 
-	ioutil.WriteFile(fmt.Sprintf(".git/objects/%s", commitHash), []byte(commitMessage), 0644)
+	index, err := readIndex()
+	if err != nil {
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	tree, err := writeTree(index)
+	if err != nil {
+		return fmt.Errorf("could not write tree: %v", err)
+	}
 
-	err := ioutil.WriteFile(".git/HEAD", []byte(commitHash), 0644)
+	commit := &commitObject{Tree: tree, Message: message}
+	if parent != "" {
+		commit.Parents = []string{parent}
+	}
+	// Concluding a merge records the merged commits as further parents.
+	merging, isMerge := mergeHeads()
+	commit.Parents = append(commit.Parents, merging...)
+	commitHash, err := writeCommit(commit)
 	if err != nil {
-		fmt.Println("Error updating HEAD:", err)
+		return fmt.Errorf("could not write commit object: %v", err)
+	}
+
+	reason := "commit: "
+	if parent == "" {
+		reason = "commit (initial): "
+	} else if isMerge {
+		reason = "commit (merge): "
+	}
+	if err := updateHeadFrom(parent, commitHash, reason+commit.Subject()); err != nil {
+		return fmt.Errorf("could not update HEAD: %v", err)
 	}
+	// A pending merge, squash or stopped cherry-pick has been concluded by
+	// this commit.
+	clearMergeState()
+	clearPickState()
+	os.Remove(repoPath("SQUASH_MSG"))
 	fmt.Println("Commit successful:", commitHash)
+	return nil
+}
+
+func commitMessage(opts CommitOptions) (string, error) {
+	if len(opts.Messages) > 0 {
+		message := cleanupMessage(strings.Join(opts.Messages, "\n\n"), false)
+		if message == "" {
+			return "", fmt.Errorf("aborting commit due to empty commit message")
+		}
+		return message, nil
+	}
+
+	if opts.File != "" {
+		var content []byte
+		var err error
+		if opts.File == "-" {
+			content, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			content, err = ioutil.ReadFile(opts.File)
+		}
+		if err != nil {
+			return "", fmt.Errorf("could not read log file '%s': %v", opts.File, err)
+		}
+		message := cleanupMessage(string(content), false)
+		if message == "" {
+			return "", fmt.Errorf("aborting commit due to empty commit message")
+		}
+		return message, nil
+	}
+
+	return editCommitMessage()
+}
+
+func addCommitTrailers(message string, opts CommitOptions) (string, error) {
+	message, err := AddTrailers(message, opts.Trailers, TrailerAddIfDifferentNeighbor)
+	if err != nil {
+		return "", err
+	}
+	if opts.Signoff {
+		signoff := Trailer{Key: "Signed-off-by", Value: currentIdentity()}
+		return AddTrailers(message, []Trailer{signoff}, TrailerAddIfDifferent)
+	}
+	return message, nil
+}
+
+// editCommitMessage opens the editor on the message prepared by a merge or
+// squash merge, or else the commit.template contents (if any), followed by
+// a commented status summary.
+func editCommitMessage() (string, error) {
+	template, prepared := "", ""
+	if content, err := ioutil.ReadFile(repoPath("MERGE_MSG")); err == nil {
+		prepared = string(content)
+	} else if content, err := ioutil.ReadFile(repoPath("SQUASH_MSG")); err == nil {
+		prepared = string(content)
+	} else if templatePath, ok := getConfig("commit.template"); ok && templatePath != "" {
+		content, err := ioutil.ReadFile(expandHome(templatePath))
+		if err != nil {
+			return "", fmt.Errorf("could not read commit message template '%s': %v", templatePath, err)
+		}
+		template = string(content)
+	}
+
+	buffer := prepared + template
+	if !strings.HasSuffix(buffer, "\n") {
+		buffer += "\n"
+	}
+	buffer += commitTemplateComments()
+
+	edited, err := editBuffer("COMMIT_EDITMSG", buffer)
+	if err != nil {
+		return "", err
+	}
+
+	message := cleanupMessage(edited, true)
+	if message == "" {
+		return "", fmt.Errorf("aborting commit due to empty commit message")
+	}
+	if template != "" && message == cleanupMessage(template, true) {
+		return "", fmt.Errorf("aborting commit; you did not edit the message")
+	}
+	return message, nil
+}
+
+func commitTemplateComments() string {
+	var b strings.Builder
+	b.WriteString("\n")
+	b.WriteString("# Please enter the commit message for your changes. Lines starting\n")
+	b.WriteString("# with '#' will be ignored, and an empty message aborts the commit.\n")
+	b.WriteString("#\n")
+
+	summary, err := collectStatus()
+	if err != nil {
+		return b.String()
+	}
+	fmt.Fprintf(&b, "# %s\n", summary.headLine())
+	for _, line := range summary.Tracking {
+		fmt.Fprintf(&b, "# %s\n", line)
+	}
+	sections := []struct {
+		title string
+		files []string
+	}{
+		{"Unmerged paths:", summary.Unmerged},
+		{"Changes to be committed:", summary.Staged},
+		{"Changes not staged for commit:", summary.Modified},
+		{"Untracked files:", summary.Untracked},
+	}
+	for _, section := range sections {
+		if len(section.files) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "#\n# %s\n", section.title)
+		for _, file := range section.files {
+			fmt.Fprintf(&b, "#\t%s\n", file)
+		}
+	}
+	return b.String()
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, strings.TrimPrefix(path, "~"))
+		}
+	}
+	return path
 }
@@ -0,0 +1,380 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configEntry is a single "name = value" line of a config file, together with
+// the section it appeared in.
+type configEntry struct {
+	Section    string
+	Subsection string
+	Name       string
+	Value      string
+}
+
+func (e configEntry) key() string {
+	if e.Subsection != "" {
+		return e.Section + "." + e.Subsection + "." + e.Name
+	}
+	return e.Section + "." + e.Name
+}
+
+// configFile holds the entries of a git-style ini file in the order they were
+// read, so it can be written back without shuffling sections around.
+type configFile struct {
+	path    string
+	entries []configEntry
+}
+
+func repoConfigPath() string {
+	return repoPath("config")
+}
+
+func globalConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".mygitserverconfig")
+}
+
+func configPath(global bool) (string, error) {
+	if !global {
+		return repoConfigPath(), nil
+	}
+	path := globalConfigPath()
+	if path == "" {
+		return "", fmt.Errorf("cannot determine home directory for global config")
+	}
+	return path, nil
+}
+
+// splitConfigKey splits "section.subsection.name" into its parts. Section
+// and variable names are case-insensitive, subsections are not.
+func splitConfigKey(key string) (section, subsection, name string, err error) {
+	first := strings.Index(key, ".")
+	last := strings.LastIndex(key, ".")
+	if first <= 0 || last == len(key)-1 {
+		return "", "", "", fmt.Errorf("key does not contain a section: %s", key)
+	}
+	section = strings.ToLower(key[:first])
+	name = strings.ToLower(key[last+1:])
+	if first != last {
+		subsection = key[first+1 : last]
+	}
+	return section, subsection, name, nil
+}
+
+func readConfigFile(path string) (*configFile, error) {
+	cfg := &configFile{path: path}
+	if path == "" {
+		return cfg, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	section, subsection := "", ""
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.Index(line, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("bad config line %d in %s", lineNo, path)
+			}
+			header := strings.TrimSpace(line[1:end])
+			subsection = ""
+			if quote := strings.Index(header, "\""); quote >= 0 {
+				subsection = strings.Trim(strings.TrimSpace(header[quote:]), "\"")
+				subsection = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(subsection)
+				header = strings.TrimSpace(header[:quote])
+			} else if dot := strings.Index(header, "."); dot >= 0 {
+				subsection = header[dot+1:]
+				header = header[:dot]
+			}
+			section = strings.ToLower(header)
+			line = strings.TrimSpace(line[end+1:])
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+		}
+
+		if section == "" {
+			return nil, fmt.Errorf("bad config line %d in %s", lineNo, path)
+		}
+
+		name, value := line, "true"
+		if eq := strings.Index(line, "="); eq >= 0 {
+			name = strings.TrimSpace(line[:eq])
+			value = parseConfigValue(line[eq+1:])
+		}
+		cfg.entries = append(cfg.entries, configEntry{
+			Section:    section,
+			Subsection: subsection,
+			Name:       strings.ToLower(name),
+			Value:      value,
+		})
+	}
+	return cfg, scanner.Err()
+}
+
+// parseConfigValue strips quoting, escapes and trailing comments from the
+// right-hand side of a config assignment.
+func parseConfigValue(raw string) string {
+	var value strings.Builder
+	inQuotes := false
+	raw = strings.TrimSpace(raw)
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '\\' && i+1 < len(raw):
+			i++
+			switch raw[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			default:
+				value.WriteByte(raw[i])
+			}
+		case (c == '#' || c == ';') && !inQuotes:
+			return strings.TrimSpace(value.String())
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return value.String()
+}
+
+func formatConfigValue(value string) string {
+	needsQuotes := value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;")
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`).Replace(value)
+	if needsQuotes {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+func (cfg *configFile) get(key string) (string, bool) {
+	section, subsection, name, err := splitConfigKey(key)
+	if err != nil {
+		return "", false
+	}
+	value, found := "", false
+	for _, entry := range cfg.entries {
+		if entry.Section == section && entry.Subsection == subsection && entry.Name == name {
+			value, found = entry.Value, true
+		}
+	}
+	return value, found
+}
+
+func (cfg *configFile) set(key, value string) error {
+	section, subsection, name, err := splitConfigKey(key)
+	if err != nil {
+		return err
+	}
+	lastInSection := -1
+	for i, entry := range cfg.entries {
+		if entry.Section != section || entry.Subsection != subsection {
+			continue
+		}
+		if entry.Name == name {
+			cfg.entries[i].Value = value
+			return nil
+		}
+		lastInSection = i
+	}
+
+	entry := configEntry{Section: section, Subsection: subsection, Name: name, Value: value}
+	if lastInSection < 0 {
+		cfg.entries = append(cfg.entries, entry)
+		return nil
+	}
+	cfg.entries = append(cfg.entries[:lastInSection+1], append([]configEntry{entry}, cfg.entries[lastInSection+1:]...)...)
+	return nil
+}
+
+func (cfg *configFile) unset(key string) bool {
+	section, subsection, name, err := splitConfigKey(key)
+	if err != nil {
+		return false
+	}
+	removed := false
+	kept := cfg.entries[:0]
+	for _, entry := range cfg.entries {
+		if entry.Section == section && entry.Subsection == subsection && entry.Name == name {
+			removed = true
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	cfg.entries = kept
+	return removed
+}
+
+func (cfg *configFile) write() error {
+	var out strings.Builder
+	section, subsection, started := "", "", false
+	for _, entry := range cfg.entries {
+		if !started || entry.Section != section || entry.Subsection != subsection {
+			section, subsection, started = entry.Section, entry.Subsection, true
+			if subsection != "" {
+				escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(subsection)
+				fmt.Fprintf(&out, "[%s \"%s\"]\n", section, escaped)
+			} else {
+				fmt.Fprintf(&out, "[%s]\n", section)
+			}
+		}
+		fmt.Fprintf(&out, "\t%s = %s\n", entry.Name, formatConfigValue(entry.Value))
+	}
+	return ioutil.WriteFile(cfg.path, []byte(out.String()), 0644)
+}
+
+// loadConfig returns the global entries followed by the repository entries,
+// so that later (repository) values win over earlier (global) ones.
+func loadConfig() *configFile {
+	merged := &configFile{}
+	for _, path := range []string{globalConfigPath(), repoConfigPath()} {
+		cfg, err := readConfigFile(path)
+		if err != nil {
+			fmt.Println("Warning: ignoring unreadable config:", err)
+			continue
+		}
+		merged.entries = append(merged.entries, cfg.entries...)
+	}
+	return merged
+}
+
+func getConfig(key string) (string, bool) {
+	return loadConfig().get(key)
+}
+
+func getConfigBool(key string, defaultValue bool) bool {
+	value, ok := getConfig(key)
+	if !ok {
+		return defaultValue
+	}
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true
+	case "false", "no", "off", "0", "":
+		return false
+	}
+	return defaultValue
+}
+
+func setConfig(key, value string, global bool) error {
+	path, err := configPath(global)
+	if err != nil {
+		return err
+	}
+	cfg, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := cfg.set(key, value); err != nil {
+		return err
+	}
+	return cfg.write()
+}
+
+func unsetConfig(key string, global bool) error {
+	path, err := configPath(global)
+	if err != nil {
+		return err
+	}
+	cfg, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if !cfg.unset(key) {
+		return fmt.Errorf("key '%s' is not set", key)
+	}
+	return cfg.write()
+}
+
+// renameConfigSubsection moves every "[section "from"]" entry of the
+// repository config to subsection to, or drops them when to is empty. It is
+// used to keep branch.<name>.* settings with a renamed or deleted branch.
+func renameConfigSubsection(section, from, to string) error {
+	cfg, err := readConfigFile(repoConfigPath())
+	if err != nil {
+		return err
+	}
+	changed := false
+	kept := cfg.entries[:0]
+	for _, entry := range cfg.entries {
+		if entry.Section == section && entry.Subsection == from {
+			changed = true
+			if to == "" {
+				continue
+			}
+			entry.Subsection = to
+		}
+		kept = append(kept, entry)
+	}
+	cfg.entries = kept
+	if !changed {
+		return nil
+	}
+	return cfg.write()
+}
+
+// ConfigGet prints the effective value of key.
+func ConfigGet(key string) error {
+	value, ok := getConfig(key)
+	if !ok {
+		return fmt.Errorf("key '%s' is not set", key)
+	}
+	fmt.Println(value)
+	return nil
+}
+
+// ConfigSet stores key in the repository config, or in the user's global
+// config when global is set.
+func ConfigSet(key, value string, global bool) error {
+	return setConfig(key, value, global)
+}
+
+// ConfigUnset removes key from the repository or global config.
+func ConfigUnset(key string, global bool) error {
+	return unsetConfig(key, global)
+}
+
+// ConfigList prints every effective "key=value" pair.
+func ConfigList() error {
+	values := make(map[string]string)
+	for _, entry := range loadConfig().entries {
+		values[entry.key()] = entry.Value
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s=%s\n", key, values[key])
+	}
+	return nil
+}
@@ -1,9 +1,12 @@
 package core
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -163,3 +166,2191 @@ func TestMergeBranch(t *testing.T) {
 		t.Fatalf("Main branch was not updated with the merge commit")
 	}
 }
+
+func headCommitMessage(t *testing.T) string {
+	hash, err := headCommit()
+	if err != nil || hash == "" {
+		t.Fatalf("Failed to resolve HEAD commit: %v", err)
+	}
+	commit, err := readCommit(hash)
+	if err != nil {
+		t.Fatalf("Failed to read HEAD commit: %v", err)
+	}
+	return commit.Message
+}
+
+func TestCommitMultipleParagraphs(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	if err := CommitChanges([]string{"Subject line  ", "Body paragraph\nwith two lines"}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	want := "Subject line\n\nBody paragraph\nwith two lines\n"
+	if got := headCommitMessage(t); got != want {
+		t.Fatalf("Unexpected commit message %q, want %q", got, want)
+	}
+}
+
+// setTestEditor makes script, run by sh with the file to edit as $1, the
+// editor. VISUAL and the global config would take precedence over EDITOR,
+// so they are cleared for the rest of the test.
+func setTestEditor(t *testing.T, script string) {
+	t.Setenv("VISUAL", "")
+	t.Setenv("HOME", t.TempDir())
+	editor := filepath.Join(t.TempDir(), "editor")
+	if err := ioutil.WriteFile(editor, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatalf("Failed to write the editor script: %v", err)
+	}
+	t.Setenv("EDITOR", editor)
+}
+
+func TestCommitWithEditorAndTemplate(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	templatePath := filepath.Join(".mygitserver", "template.txt")
+	if err := ioutil.WriteFile(templatePath, []byte("# Describe the change\n"), 0644); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+	if err := setConfig("commit.template", templatePath, false); err != nil {
+		t.Fatalf("Failed to set commit.template: %v", err)
+	}
+
+	// The "editor" prepends a subject and leaves trailing whitespace behind.
+	setTestEditor(t, `{ echo 'Edited subject   '; cat "$1"; } >"$1.new" && mv "$1.new" "$1"`)
+	if err := Commit(CommitOptions{}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if got := headCommitMessage(t); got != "Edited subject\n" {
+		t.Fatalf("Unexpected commit message %q", got)
+	}
+
+	// Leaving the template untouched aborts the commit.
+	setTestEditor(t, "true")
+	if err := Commit(CommitOptions{}); err == nil {
+		t.Fatalf("Expected commit with an empty message to be aborted")
+	}
+}
+
+func TestParseAndAddTrailers(t *testing.T) {
+	message := "Fix crash\n\nLonger description.\n\nReviewed-by: Alice <alice@example.com>\nChange-Id: I123\n  continued\n"
+
+	trailers := ParseTrailers(message)
+	want := []Trailer{
+		{Key: "Reviewed-by", Value: "Alice <alice@example.com>"},
+		{Key: "Change-Id", Value: "I123 continued"},
+	}
+	if len(trailers) != len(want) {
+		t.Fatalf("Expected %d trailers, got %v", len(want), trailers)
+	}
+	for i := range want {
+		if trailers[i] != want[i] {
+			t.Fatalf("Trailer %d: got %v, want %v", i, trailers[i], want[i])
+		}
+	}
+
+	if got := ParseTrailers("Subject: looks like a trailer\n"); len(got) != 0 {
+		t.Fatalf("Subject line must not be parsed as a trailer, got %v", got)
+	}
+
+	added, err := AddTrailers("Subject\n\nBody text\n", []Trailer{{Key: "Co-authored-by", Value: "Bob <bob@example.com>"}}, "")
+	if err != nil {
+		t.Fatalf("AddTrailers failed: %v", err)
+	}
+	if added != "Subject\n\nBody text\n\nCo-authored-by: Bob <bob@example.com>\n" {
+		t.Fatalf("Unexpected message after adding trailer: %q", added)
+	}
+
+	replaced, err := AddTrailers(message, []Trailer{{Key: "change-id", Value: "I456"}}, TrailerReplace)
+	if err != nil {
+		t.Fatalf("AddTrailers failed: %v", err)
+	}
+	if got := ParseTrailers(replaced); len(got) != 2 || got[1].Value != "I456" {
+		t.Fatalf("Expected Change-Id to be replaced, got %v", got)
+	}
+
+	// A closing paragraph that merely contains a colon is prose, so new
+	// trailers start a block of their own.
+	for _, prose := range []string{"Subject\n\nSee http://example.com/issue\n", "Subject\n\nNote: this only matters on Windows\nand nowhere else.\n"} {
+		if got := ParseTrailers(prose); len(got) != 0 {
+			t.Fatalf("Expected no trailers in %q, got %v", prose, got)
+		}
+		signed, err := AddTrailers(prose, []Trailer{{Key: "Signed-off-by", Value: "Bob <bob@example.com>"}}, "")
+		if err != nil {
+			t.Fatalf("AddTrailers failed: %v", err)
+		}
+		if want := prose + "\nSigned-off-by: Bob <bob@example.com>\n"; signed != want {
+			t.Fatalf("Expected %q, got %q", want, signed)
+		}
+	}
+
+	// A known trailer makes a paragraph with a few other lines a trailer
+	// block, and those lines are kept when trailers are added.
+	mixed := "Subject\n\nBody.\n\nSigned-off-by: Alice <alice@example.com>\n(cherry picked from commit abc)\n"
+	if got := ParseTrailers(mixed); len(got) != 1 || got[0].Key != "Signed-off-by" {
+		t.Fatalf("Expected the Signed-off-by trailer, got %v", got)
+	}
+	added, err = AddTrailers(mixed, []Trailer{{Key: "Signed-off-by", Value: "Bob <bob@example.com>"}}, "")
+	if err != nil {
+		t.Fatalf("AddTrailers failed: %v", err)
+	}
+	if added != mixed+"Signed-off-by: Bob <bob@example.com>\n" {
+		t.Fatalf("Unexpected message after adding to a mixed block: %q", added)
+	}
+}
+
+func TestCommitSignoffAndTrailers(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	if err := setConfig("user.name", "Jane Doe", false); err != nil {
+		t.Fatalf("Failed to set user.name: %v", err)
+	}
+	if err := setConfig("user.email", "jane@example.com", false); err != nil {
+		t.Fatalf("Failed to set user.email: %v", err)
+	}
+
+	err := Commit(CommitOptions{
+		Messages: []string{"Add feature"},
+		Trailers: []Trailer{{Key: "Change-Id", Value: "I42"}},
+		Signoff:  true,
+	})
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	hash, _ := headCommit()
+	commit, err := readCommit(hash)
+	if err != nil {
+		t.Fatalf("Failed to read commit: %v", err)
+	}
+	if commit.Message != "Add feature\n\nChange-Id: I42\nSigned-off-by: Jane Doe <jane@example.com>\n" {
+		t.Fatalf("Unexpected commit message %q", commit.Message)
+	}
+
+	got := formatCommit("%s|%(trailers:key=Signed-off-by,valueonly)|%an", hash, commit, nil)
+	if got != "Add feature|Jane Doe <jane@example.com>|Jane Doe" {
+		t.Fatalf("Unexpected formatted commit %q", got)
+	}
+	if matchesTrailerFilters(commit, []Trailer{{Key: "Reviewed-by"}}) {
+		t.Fatalf("Commit without Reviewed-by must not match the filter")
+	}
+
+	// A trailer named in the config also marks a mostly prose paragraph as
+	// the trailer block.
+	if err := setConfig("trailer.ticket.key", "Ticket", false); err != nil {
+		t.Fatalf("Failed to set trailer.ticket.key: %v", err)
+	}
+	if got := ParseTrailers("Subject\n\nTicket: 12\nfixed upstream\nsee the thread\n"); len(got) != 1 || got[0].Value != "12" {
+		t.Fatalf("Expected the configured Ticket trailer, got %v", got)
+	}
+}
+
+func TestNotesAddAndMerge(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	if err := CommitChanges([]string{"Annotated commit"}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	commitHash, _ := headCommit()
+
+	if err := NotesAdd("", "HEAD", CommitOptions{Messages: []string{"CI: passed"}}, false); err != nil {
+		t.Fatalf("NotesAdd failed: %v", err)
+	}
+	if text, ok := noteFor(defaultNotesRef, commitHash); !ok || text != "CI: passed\n" {
+		t.Fatalf("Unexpected note %q", text)
+	}
+	if after, _ := headCommit(); after != commitHash {
+		t.Fatalf("Adding a note must not change the annotated commit")
+	}
+	if err := NotesAdd("", "HEAD", CommitOptions{Messages: []string{"again"}}, false); err == nil {
+		t.Fatalf("Expected adding a second note without -f to fail")
+	}
+
+	// Diverge: another notes ref starts from the same history and both sides
+	// change the note.
+	tip, _ := readRef(defaultNotesRef)
+	if err := writeRef("refs/notes/review", tip); err != nil {
+		t.Fatalf("Failed to create notes ref: %v", err)
+	}
+	if err := NotesAdd("review", "HEAD", CommitOptions{Messages: []string{"Review: https://example.com/1"}}, true); err != nil {
+		t.Fatalf("NotesAdd failed: %v", err)
+	}
+	if err := NotesAdd("", "HEAD", CommitOptions{Messages: []string{"CI: passed on retry"}}, true); err != nil {
+		t.Fatalf("NotesAdd failed: %v", err)
+	}
+
+	if err := NotesMerge("", "review", NotesMergeManual); err == nil {
+		t.Fatalf("Expected manual notes merge to report a conflict")
+	}
+	if err := NotesMerge("", "review", NotesMergeUnion); err != nil {
+		t.Fatalf("NotesMerge failed: %v", err)
+	}
+	text, _ := noteFor(defaultNotesRef, commitHash)
+	if text != "CI: passed on retry\n\nReview: https://example.com/1\n" {
+		t.Fatalf("Unexpected merged note %q", text)
+	}
+
+	if err := NotesRemove("", nil); err != nil {
+		t.Fatalf("NotesRemove failed: %v", err)
+	}
+	if _, ok := noteFor(defaultNotesRef, commitHash); ok {
+		t.Fatalf("Note still present after removal")
+	}
+}
+
+func writeTestFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatalf("Failed to create directory for %s: %v", name, err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		os.Remove(name)
+		if dir := filepath.Dir(name); dir != "." {
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func readTestFile(t *testing.T, name string) string {
+	t.Helper()
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", name, err)
+	}
+	return string(content)
+}
+
+func TestCheckoutUpdatesWorkingTree(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	writeTestFile(t, "checkout_a.txt", "main version\n")
+	AddFile([]string{"checkout_a.txt"})
+	CommitChanges([]string{"Initial commit"})
+	CreateBranch("feature")
+
+	if err := SwitchBranch("feature"); err != nil {
+		t.Fatalf("Checkout of feature failed: %v", err)
+	}
+	writeTestFile(t, "checkout_a.txt", "feature version\n")
+	writeTestFile(t, "checkout_dir/b.txt", "only on feature\n")
+	AddFile([]string{"checkout_a.txt", "checkout_dir"})
+	CommitChanges([]string{"Feature commit"})
+
+	if err := SwitchBranch("main"); err != nil {
+		t.Fatalf("Checkout of main failed: %v", err)
+	}
+	if got := readTestFile(t, "checkout_a.txt"); got != "main version\n" {
+		t.Fatalf("checkout_a.txt not restored on main, got %q", got)
+	}
+	if _, err := os.Stat("checkout_dir/b.txt"); !os.IsNotExist(err) {
+		t.Fatalf("checkout_dir/b.txt should have been removed on main")
+	}
+	index, _ := readIndex()
+	if _, staged := index["checkout_dir/b.txt"]; staged {
+		t.Fatalf("Index still contains checkout_dir/b.txt after switching to main")
+	}
+
+	// A local modification to a file that differs between the branches
+	// blocks the checkout.
+	writeTestFile(t, "checkout_a.txt", "local edit\n")
+	if err := SwitchBranch("feature"); err == nil {
+		t.Fatalf("Expected checkout to refuse overwriting local changes")
+	}
+	if head, _, _ := readHead(); head != "refs/heads/main" {
+		t.Fatalf("HEAD moved despite refused checkout: %s", head)
+	}
+
+	if err := Checkout("feature", CheckoutOptions{Force: true}); err != nil {
+		t.Fatalf("Forced checkout failed: %v", err)
+	}
+	if got := readTestFile(t, "checkout_a.txt"); got != "feature version\n" {
+		t.Fatalf("Forced checkout did not discard local changes, got %q", got)
+	}
+	if got := readTestFile(t, "checkout_dir/b.txt"); got != "only on feature\n" {
+		t.Fatalf("checkout_dir/b.txt not restored on feature, got %q", got)
+	}
+}
+
+func TestDetachedHeadCheckout(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	writeTestFile(t, "detached.txt", "first\n")
+	AddFile([]string{"detached.txt"})
+	CommitChanges([]string{"First"})
+	first, _ := headCommit()
+
+	writeTestFile(t, "detached.txt", "second\n")
+	AddFile([]string{"detached.txt"})
+	CommitChanges([]string{"Second"})
+
+	if err := Checkout(first[:8], CheckoutOptions{}); err != nil {
+		t.Fatalf("Checkout of abbreviated hash failed: %v", err)
+	}
+	ref, detached, _ := readHead()
+	if !detached || ref != first {
+		t.Fatalf("Expected HEAD detached at %s, got %s (detached=%v)", first, ref, detached)
+	}
+	if got := readTestFile(t, "detached.txt"); got != "first\n" {
+		t.Fatalf("Working tree not updated for detached checkout, got %q", got)
+	}
+
+	// Commits made on a detached HEAD move HEAD itself, not a branch.
+	writeTestFile(t, "detached.txt", "experiment\n")
+	AddFile([]string{"detached.txt"})
+	CommitChanges([]string{"Experiment"})
+	experiment, _ := headCommit()
+	if parent := getParentCommit(experiment); parent != first {
+		t.Fatalf("Detached commit has parent %s, want %s", parent, first)
+	}
+	if main, _ := readRef("refs/heads/main"); main == experiment {
+		t.Fatalf("Commit on detached HEAD must not move main")
+	}
+
+	if err := SwitchBranch("main"); err != nil {
+		t.Fatalf("Switching back to main failed: %v", err)
+	}
+	if ref, detached, _ := readHead(); detached || ref != "refs/heads/main" {
+		t.Fatalf("Expected HEAD to be attached to main, got %s", ref)
+	}
+
+	// "HEAD" names the current branch, not its tip.
+	if err := Checkout("HEAD", CheckoutOptions{}); err != nil {
+		t.Fatalf("Checkout of HEAD failed: %v", err)
+	}
+	if ref, detached, _ := readHead(); detached || ref != "refs/heads/main" {
+		t.Fatalf("Checkout of HEAD must stay on main, got %s", ref)
+	}
+
+	// A name escaping refs/heads/ is not a branch.
+	CreateTag("v1", "", TagOptions{})
+	if err := Checkout("../tags/v1", CheckoutOptions{}); err == nil {
+		t.Fatalf("Expected checkout of a traversal name to fail")
+	}
+	if ref, detached, _ := readHead(); detached || ref != "refs/heads/main" {
+		t.Fatalf("A refused checkout must leave HEAD alone, got %s", ref)
+	}
+	if _, ok := dwimRef("heads/../tags/v1"); ok {
+		t.Fatalf("Expected a traversal name not to resolve to a ref")
+	}
+}
+
+func TestAbbreviatedHashAmbiguity(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	CommitChanges([]string{"Real commit"})
+	hash, _ := headCommit()
+	content, _ := readObject(hash)
+
+	// Plant a second commit-looking object that shares the first 6 characters.
+	twin := hash[:6] + "0000000000000000000000000000000000"
+	if twin == hash {
+		twin = hash[:6] + "1111111111111111111111111111111111"
+	}
+	if err := ioutil.WriteFile(filepath.Join(".mygitserver", "objects", twin), content, 0644); err != nil {
+		t.Fatalf("Failed to plant object: %v", err)
+	}
+
+	_, err := resolveCommit(hash[:6])
+	if err == nil {
+		t.Fatalf("Expected ambiguous prefix to fail")
+	}
+	if !strings.Contains(err.Error(), hash) || !strings.Contains(err.Error(), twin) {
+		t.Fatalf("Ambiguity error should list both candidates, got: %v", err)
+	}
+	if resolved, err := resolveCommit(hash[:12]); err != nil || resolved != hash {
+		t.Fatalf("Longer prefix should resolve uniquely, got %s, %v", resolved, err)
+	}
+}
+
+func TestResolveRevisionExpressions(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	writeTestFile(t, "rev.txt", "one\n")
+	AddFile([]string{"rev.txt"})
+	CommitChanges([]string{"First revision"})
+	first, _ := headCommit()
+	CommitChanges([]string{"Second revision"})
+	second, _ := headCommit()
+	CommitChanges([]string{"Third revision"})
+	third, _ := headCommit()
+
+	if err := CreateBranchAt("side", "HEAD~1"); err != nil {
+		t.Fatalf("CreateBranchAt with HEAD~1 failed: %v", err)
+	}
+	if err := SwitchBranch("side"); err != nil {
+		t.Fatalf("Checkout of side failed: %v", err)
+	}
+	CommitChanges([]string{"Side revision"})
+	side, _ := headCommit()
+	if err := SwitchBranch("main"); err != nil {
+		t.Fatalf("Checkout of main failed: %v", err)
+	}
+	MergeBranch("side")
+	merge, _ := headCommit()
+
+	cases := map[string]string{
+		"HEAD":           merge,
+		"main^":          third,
+		"HEAD~1":         third,
+		"HEAD~2":         second,
+		"HEAD^2":         side,
+		"main^2~1":       second,
+		"side^^":         first,
+		"HEAD^0":         merge,
+		":/Second":       second,
+		first[:7] + "~0": first,
+	}
+	for expr, want := range cases {
+		got, err := resolveCommit(expr)
+		if err != nil || got != want {
+			t.Errorf("resolveCommit(%q) = %s, %v; want %s", expr, got, err, want)
+		}
+	}
+
+	if _, err := resolveCommit("HEAD~9"); err == nil {
+		t.Errorf("Expected HEAD~9 to fail on a short history")
+	}
+	if blob, err := resolveRevision("HEAD:rev.txt"); err != nil || blob != readIndexEntry(t, "rev.txt") {
+		t.Errorf("HEAD:rev.txt resolved to %s, %v", blob, err)
+	}
+	if err := RevParse([]string{"HEAD:sub/../rev.txt"}, false); err != nil {
+		t.Errorf("Expected a path with '..' to resolve as a path, got %v", err)
+	}
+	mergeCommit, _ := readCommit(merge)
+	if tree, err := resolveRevision("HEAD^{tree}"); err != nil || tree != mergeCommit.Tree {
+		t.Errorf("HEAD^{tree} = %s, %v; want %s", tree, err, mergeCommit.Tree)
+	}
+
+	walk := func(args ...string) []string {
+		include, exclude, err := resolveRevisionRange(args)
+		if err != nil {
+			t.Fatalf("resolveRevisionRange(%v) failed: %v", args, err)
+		}
+		commits, err := walkCommits(include, exclude)
+		if err != nil {
+			t.Fatalf("walkCommits failed: %v", err)
+		}
+		return commits
+	}
+	if got := walk("main..side"); len(got) != 0 {
+		t.Errorf("main..side should be empty after the merge, got %v", got)
+	}
+	if got := walk("side..main"); len(got) != 2 || got[0] != merge {
+		t.Errorf("side..main = %v, want [%s %s]", got, merge, third)
+	}
+	if got := walk("HEAD~1...side"); len(got) != 2 {
+		t.Errorf("HEAD~1...side = %v, want the third and side commits", got)
+	}
+
+	// @{n} reads the reflog of the ref.
+	logPath := reflogPath("refs/heads/main")
+	os.MkdirAll(filepath.Dir(logPath), 0755)
+	log := zeroHash + " " + first + " Test <test@example.com> 2024-01-01T00:00:00Z\tcommit\n" +
+		first + " " + second + " Test <test@example.com> 2024-01-01T00:01:00Z\tcommit\n"
+	if err := ioutil.WriteFile(logPath, []byte(log), 0644); err != nil {
+		t.Fatalf("Failed to write reflog: %v", err)
+	}
+	if got, err := resolveCommit("main@{1}"); err != nil || got != first {
+		t.Errorf("main@{1} = %s, %v; want %s", got, err, first)
+	}
+	if _, err := resolveCommit("main@{5}"); err == nil {
+		t.Errorf("Expected main@{5} to fail")
+	}
+}
+
+func readIndexEntry(t *testing.T, path string) string {
+	index, err := readIndex()
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	return index[path]
+}
+
+func TestBranchDeleteRenameAndForce(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	CommitChanges([]string{"Base"})
+	base, _ := headCommit()
+	CreateBranch("merged")
+	CreateBranch("topic")
+	SwitchBranch("topic")
+	CommitChanges([]string{"Topic work"})
+	topic, _ := headCommit()
+	SwitchBranch("main")
+
+	if err := DeleteBranch([]string{"main"}, true); err == nil {
+		t.Fatalf("Expected deleting the current branch to fail")
+	}
+	if err := DeleteBranch([]string{"topic"}, false); err == nil || !strings.Contains(err.Error(), "not fully merged") {
+		t.Fatalf("Expected unmerged branch to be kept, got %v", err)
+	}
+	if err := DeleteBranch([]string{"merged"}, false); err != nil {
+		t.Fatalf("Deleting a merged branch failed: %v", err)
+	}
+	if refExists("refs/heads/merged") {
+		t.Fatalf("Branch 'merged' still exists after deletion")
+	}
+
+	filter, err := newBranchFilter(BranchListOptions{NoMerged: "HEAD", Contains: "HEAD"})
+	if err != nil {
+		t.Fatalf("newBranchFilter failed: %v", err)
+	}
+	if keep, _ := filter(topic); !keep {
+		t.Fatalf("topic should be listed as unmerged and containing HEAD")
+	}
+	if keep, _ := filter(base); keep {
+		t.Fatalf("main should not be listed as unmerged")
+	}
+
+	if err := ConfigSet("branch.main.remote", "origin", false); err != nil {
+		t.Fatalf("ConfigSet failed: %v", err)
+	}
+	if err := RenameBranch("", "trunk", false); err != nil {
+		t.Fatalf("Renaming the current branch failed: %v", err)
+	}
+	if ref, _, _ := readHead(); ref != "refs/heads/trunk" {
+		t.Fatalf("HEAD should follow the rename, got %s", ref)
+	}
+	if remote, _ := getConfig("branch.trunk.remote"); remote != "origin" {
+		t.Fatalf("Branch config did not follow the rename, got %q", remote)
+	}
+	if err := RenameBranch("topic", "trunk", false); err == nil {
+		t.Fatalf("Expected renaming onto an existing branch to fail without force")
+	}
+
+	if err := ForceCreateBranch("trunk", "topic"); err == nil {
+		t.Fatalf("Expected force-moving the current branch to fail")
+	}
+	if err := ForceCreateBranch("topic", "trunk"); err != nil {
+		t.Fatalf("Force-moving topic failed: %v", err)
+	}
+	if hash, _ := readRef("refs/heads/topic"); hash != base {
+		t.Fatalf("topic should point at %s after branch -f, got %s", base, hash)
+	}
+
+	// Names that climb out of refs/heads are rejected before touching disk.
+	if err := CreateTag("v1", "", TagOptions{}); err != nil {
+		t.Fatalf("Creating tag failed: %v", err)
+	}
+	for _, name := range []string{"../tags/v1", "../../config"} {
+		if err := DeleteBranch([]string{name}, true); err == nil {
+			t.Fatalf("Expected deleting branch '%s' to be rejected", name)
+		}
+		if err := RenameBranch(name, "escaped", true); err == nil {
+			t.Fatalf("Expected renaming branch '%s' to be rejected", name)
+		}
+	}
+	if !refExists("refs/tags/v1") {
+		t.Fatalf("Tag deleted through a branch name")
+	}
+	if _, err := os.Stat(repoPath("config")); err != nil {
+		t.Fatalf("Repository config deleted through a branch name: %v", err)
+	}
+}
+
+func TestHierarchicalBranchNames(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	CommitChanges([]string{"Base"})
+	if err := CreateBranch("feature/login"); err != nil {
+		t.Fatalf("Creating feature/login failed: %v", err)
+	}
+	if err := SwitchBranch("feature/login"); err != nil {
+		t.Fatalf("Checkout of feature/login failed: %v", err)
+	}
+	SwitchBranch("main")
+
+	branches, _ := listRefs("refs/heads/")
+	if _, ok := branches["refs/heads/feature/login"]; !ok || len(branches) != 2 {
+		t.Fatalf("Expected main and feature/login, got %v", branches)
+	}
+	if err := CreateBranch("feature"); err == nil {
+		t.Fatalf("Expected 'feature' to clash with feature/login")
+	}
+	if err := CreateBranch("feature/login/x"); err == nil {
+		t.Fatalf("Expected 'feature/login/x' to clash with feature/login")
+	}
+
+	for _, name := range []string{"..", "a b", "x.lock", ".hidden", "a//b", "a/", "a~1", "a^", "a:b", "a?", "a*", "a[", "a@{1}", "@", "-x", "HEAD", "a\\b", "end."} {
+		if err := CreateBranch(name); err == nil {
+			t.Errorf("Expected branch name %q to be rejected", name)
+		}
+	}
+
+	if err := DeleteBranch([]string{"feature/login"}, true); err != nil {
+		t.Fatalf("Deleting feature/login failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(".mygitserver", "refs", "heads", "feature")); !os.IsNotExist(err) {
+		t.Fatalf("Empty refs/heads/feature directory should be removed")
+	}
+	if err := CreateBranch("feature"); err != nil {
+		t.Fatalf("Creating 'feature' after deleting feature/login failed: %v", err)
+	}
+	if err := RenameBranch("feature", "feature/renamed", false); err != nil {
+		t.Fatalf("Renaming 'feature' into its own namespace failed: %v", err)
+	}
+	if !refExists("refs/heads/feature/renamed") {
+		t.Fatalf("feature/renamed missing after rename")
+	}
+
+	if err := checkRefFormat("main", true); err != nil {
+		t.Errorf("One-level name should be allowed with allowOneLevel: %v", err)
+	}
+	if err := checkRefFormat("main", false); err == nil {
+		t.Errorf("One-level name should be rejected by default")
+	}
+}
+
+func TestTags(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	if _, err := os.Stat(filepath.Join(".mygitserver", "refs", "tags")); err != nil {
+		t.Fatalf("refs/tags not created by InitializeRepository")
+	}
+
+	CommitChanges([]string{"Release commit"})
+	release, _ := headCommit()
+	CommitChanges([]string{"Later commit"})
+
+	if err := CreateTag("v1.0-light", "HEAD~1", TagOptions{}); err != nil {
+		t.Fatalf("Creating lightweight tag failed: %v", err)
+	}
+	if hash, _ := readRef("refs/tags/v1.0-light"); hash != release {
+		t.Fatalf("Lightweight tag should point straight at the commit, got %s", hash)
+	}
+
+	opts := TagOptions{Message: CommitOptions{Messages: []string{"Release 1.0"}}}
+	if err := CreateTag("v1.0", release, opts); err != nil {
+		t.Fatalf("Creating annotated tag failed: %v", err)
+	}
+	tagHash, _ := readRef("refs/tags/v1.0")
+	if objectType(tagHash) != "tag" {
+		t.Fatalf("Annotated tag should point at a tag object")
+	}
+	tag, err := readTag(tagHash)
+	if err != nil || tag.Object != release || tag.Type != "commit" || tag.Tag != "v1.0" || tag.Tagger == "" || tag.Message != "Release 1.0\n" {
+		t.Fatalf("Unexpected tag object %+v, %v", tag, err)
+	}
+
+	for _, expr := range []string{"v1.0", "v1.0^{}", "v1.0^{commit}", "tags/v1.0", "v1.0-light", "v1.0~0"} {
+		if got, err := resolveCommit(expr); err != nil || got != release {
+			t.Errorf("resolveCommit(%q) = %s, %v; want %s", expr, got, err, release)
+		}
+	}
+	if got, err := resolveRevision("v1.0^{tag}"); err != nil || got != tagHash {
+		t.Errorf("v1.0^{tag} = %s, %v; want %s", got, err, tagHash)
+	}
+	if _, err := resolveRevision("v1.0-light^{tag}"); err == nil {
+		t.Errorf("Expected ^{tag} on a lightweight tag to fail")
+	}
+
+	if err := CreateTag("v1.0", "", TagOptions{}); err == nil {
+		t.Fatalf("Expected creating an existing tag to fail without force")
+	}
+	if err := CreateTag("bad..name", "", TagOptions{}); err == nil {
+		t.Fatalf("Expected an invalid tag name to be rejected")
+	}
+	if err := VerifyTags([]string{"v1.0"}); err == nil || !strings.Contains(err.Error(), "no signature") {
+		t.Fatalf("Expected unsigned tag to fail verification, got %v", err)
+	}
+
+	// A stand-in for gpg that "signs" with the sha1 of the payload.
+	gpg := filepath.Join(t.TempDir(), "fake-gpg")
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = --detach-sign ]; then\n" +
+		"  echo '-----BEGIN PGP SIGNATURE-----'; sha1sum | cut -d' ' -f1; echo '-----END PGP SIGNATURE-----'\n" +
+		"else\n" +
+		"  [ \"$(sha1sum | cut -d' ' -f1)\" = \"$(sed -n 2p \"$2\")\" ]\n" +
+		"fi\n"
+	if err := ioutil.WriteFile(gpg, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write fake gpg: %v", err)
+	}
+	ConfigSet("gpg.program", gpg, false)
+
+	signed := TagOptions{Sign: true, Message: CommitOptions{Messages: []string{"Signed release"}}}
+	if err := CreateTag("v1.1", "", signed); err != nil {
+		t.Fatalf("Creating signed tag failed: %v", err)
+	}
+	if err := VerifyTags([]string{"v1.1"}); err != nil {
+		t.Fatalf("Verifying signed tag failed: %v", err)
+	}
+	signedHash, _ := readRef("refs/tags/v1.1")
+	content, _ := readObject(signedHash)
+	forged := strings.Replace(string(content), "Signed release", "Forged release", 1)
+	ioutil.WriteFile(filepath.Join(".mygitserver", "objects", signedHash), []byte(forged), 0644)
+	if err := VerifyTags([]string{"v1.1"}); err == nil {
+		t.Fatalf("Expected verification of a modified tag to fail")
+	}
+
+	if err := DeleteTags([]string{"v1.0-light"}); err != nil {
+		t.Fatalf("Deleting tag failed: %v", err)
+	}
+	if refExists("refs/tags/v1.0-light") {
+		t.Fatalf("Tag still exists after deletion")
+	}
+	if err := DeleteTags([]string{"../heads/main"}); err == nil {
+		t.Fatalf("Expected deleting tag '../heads/main' to be rejected")
+	}
+	if !refExists("refs/heads/main") {
+		t.Fatalf("Branch deleted through a tag name")
+	}
+}
+
+func TestReflogAndGC(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	writeTestFile(t, "reflog.txt", "one\n")
+	AddFile([]string{"reflog.txt"})
+	CommitChanges([]string{"First"})
+	first, _ := headCommit()
+	writeTestFile(t, "reflog.txt", "two\n")
+	AddFile([]string{"reflog.txt"})
+	CommitChanges([]string{"Second"})
+	second, _ := headCommit()
+	CreateBranch("other")
+	SwitchBranch("other")
+
+	entries, err := readReflog("refs/heads/main")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected 2 entries in main's reflog, got %v, %v", entries, err)
+	}
+	if entries[0].Old != zeroHash || entries[0].New != first || entries[0].Message != "commit (initial): First" {
+		t.Fatalf("Unexpected first reflog entry %+v", entries[0])
+	}
+	if entries[1].Old != first || entries[1].New != second || entries[1].Identity == "" || entries[1].Timestamp == "" {
+		t.Fatalf("Unexpected second reflog entry %+v", entries[1])
+	}
+	head, _ := readReflog("HEAD")
+	if last := head[len(head)-1]; last.Message != "checkout: moving from main to other" {
+		t.Fatalf("Checkout not recorded in HEAD reflog: %+v", last)
+	}
+
+	// Losing a tip with branch -f can be undone through @{n}.
+	if err := ForceCreateBranch("main", first); err != nil {
+		t.Fatalf("branch -f failed: %v", err)
+	}
+	if lost, err := resolveCommit("main@{1}"); err != nil || lost != second {
+		t.Fatalf("main@{1} = %s, %v; want %s", lost, err, second)
+	}
+	SwitchBranch("main")
+	if err := ForceCreateBranch("other", first); err != nil {
+		t.Fatalf("branch -f on other failed: %v", err)
+	}
+
+	// second is only reachable through reflogs, so gc must keep it.
+	if err := GC(GCOptions{Prune: "now"}); err != nil {
+		t.Fatalf("gc failed: %v", err)
+	}
+	if _, err := readCommit(second); err != nil {
+		t.Fatalf("gc removed a commit still referenced by a reflog")
+	}
+
+	if err := ReflogExpire(nil, ReflogExpireOptions{Expire: "now", All: true}); err != nil {
+		t.Fatalf("reflog expire failed: %v", err)
+	}
+	if entries, _ := readReflog("refs/heads/main"); len(entries) != 0 {
+		t.Fatalf("Expected main's reflog to be empty after expiring, got %d entries", len(entries))
+	}
+	if err := GC(GCOptions{Prune: "now"}); err != nil {
+		t.Fatalf("gc failed: %v", err)
+	}
+	if _, err := readObject(second); err == nil {
+		t.Fatalf("gc kept an unreachable commit")
+	}
+	if _, err := readCommit(first); err != nil {
+		t.Fatalf("gc removed a reachable commit: %v", err)
+	}
+	if _, err := readObject(readIndexEntry(t, "reflog.txt")); err != nil {
+		t.Fatalf("gc removed a staged blob: %v", err)
+	}
+}
+
+func TestPackedRefs(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	CommitChanges([]string{"First"})
+	first, _ := headCommit()
+	CreateBranch("feature/a")
+	CreateTag("v1", "", TagOptions{Message: CommitOptions{Messages: []string{"Version 1"}}})
+	tagHash, _ := readRef("refs/tags/v1")
+
+	if err := PackRefs(PackRefsOptions{All: true}); err != nil {
+		t.Fatalf("pack-refs failed: %v", err)
+	}
+	if looseRefExists("refs/heads/feature/a") || looseRefExists("refs/tags/v1") {
+		t.Fatalf("Loose refs should be pruned after packing")
+	}
+	packed, err := readPackedRefs()
+	if err != nil || packed["refs/tags/v1"].Hash != tagHash || packed["refs/tags/v1"].Peeled != first {
+		t.Fatalf("Tag not packed with its peeled value: %+v, %v", packed["refs/tags/v1"], err)
+	}
+
+	// Every reader sees packed refs.
+	if !refExists("refs/heads/feature/a") {
+		t.Fatalf("Packed branch not found")
+	}
+	if got, err := resolveCommit("v1"); err != nil || got != first {
+		t.Fatalf("Packed tag resolves to %s, %v", got, err)
+	}
+	if peeled, _ := peeledValue("refs/tags/v1"); peeled != first {
+		t.Fatalf("peeledValue = %s, want %s", peeled, first)
+	}
+	branches, _ := listRefs("refs/heads/")
+	if len(branches) != 2 || branches["refs/heads/feature/a"] != first {
+		t.Fatalf("listRefs should merge packed and loose refs, got %v", branches)
+	}
+	if err := CreateBranch("feature"); err == nil {
+		t.Fatalf("Expected 'feature' to clash with packed feature/a")
+	}
+
+	// A loose ref overrides the packed one.
+	CommitChanges([]string{"Second"})
+	second, _ := headCommit()
+	if err := ForceCreateBranch("feature/a", second); err != nil {
+		t.Fatalf("branch -f failed: %v", err)
+	}
+	if got, _ := readRef("refs/heads/feature/a"); got != second {
+		t.Fatalf("Loose ref should override packed value, got %s", got)
+	}
+
+	if err := DeleteBranch([]string{"feature/a"}, true); err != nil {
+		t.Fatalf("Deleting packed branch failed: %v", err)
+	}
+	if refExists("refs/heads/feature/a") {
+		t.Fatalf("Deleted branch still visible through packed-refs")
+	}
+	if err := DeleteTags([]string{"v1"}); err != nil {
+		t.Fatalf("Deleting packed tag failed: %v", err)
+	}
+	if packed, _ := readPackedRefs(); len(packed) != 1 {
+		t.Fatalf("Expected only main left in packed-refs, got %v", packed)
+	}
+}
+
+func TestRefTransactions(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	CommitChanges([]string{"First"})
+	first, _ := headCommit()
+	CommitChanges([]string{"Second"})
+	second, _ := headCommit()
+	CreateBranchAt("a", first)
+	CreateBranchAt("b", first)
+
+	// A stale expected value aborts the whole transaction.
+	input := "update refs/heads/a " + second + " " + first + "\n" +
+		"update refs/heads/b " + second + " " + second + "\n"
+	if err := UpdateRefStdin(strings.NewReader(input), "test"); err == nil || !strings.Contains(err.Error(), "expected") {
+		t.Fatalf("Expected compare-and-swap failure, got %v", err)
+	}
+	if a, _ := readRef("refs/heads/a"); a != first {
+		t.Fatalf("refs/heads/a changed although the transaction failed")
+	}
+
+	input = "update refs/heads/a " + second + " " + first + "\n" +
+		"create refs/heads/c " + second + "\n" +
+		"delete refs/heads/b " + first + "\n" +
+		"verify refs/heads/main " + second + "\n"
+	if err := UpdateRefStdin(strings.NewReader(input), "test"); err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	if a, _ := readRef("refs/heads/a"); a != second {
+		t.Fatalf("refs/heads/a not updated")
+	}
+	if c, _ := readRef("refs/heads/c"); c != second || refExists("refs/heads/b") {
+		t.Fatalf("create/delete not applied")
+	}
+	if entries, _ := readReflog("refs/heads/a"); entries[len(entries)-1].Message != "test" {
+		t.Fatalf("Transaction did not write the reflog")
+	}
+
+	// A held lock makes concurrent writers fail instead of racing.
+	lock := filepath.Join(".mygitserver", "refs", "heads", "a.lock")
+	ioutil.WriteFile(lock, nil, 0644)
+	old := second
+	if err := UpdateRef("refs/heads/a", first, &old, false, "test"); err == nil || !strings.Contains(err.Error(), "lock") {
+		t.Fatalf("Expected lock failure, got %v", err)
+	}
+	os.Remove(lock)
+	branches, _ := listRefs("refs/heads/")
+	if _, ok := branches["refs/heads/a.lock"]; ok {
+		t.Fatalf("Lock files must not be listed as refs")
+	}
+
+	// Commits check that HEAD has not moved underneath them.
+	if err := updateHeadFrom(first, first, "stale"); err == nil {
+		t.Fatalf("Expected updateHeadFrom with a stale old value to fail")
+	}
+	if err := updateHeadFrom(second, first, "reset"); err != nil {
+		t.Fatalf("updateHeadFrom failed: %v", err)
+	}
+	if head, _ := headCommit(); head != first {
+		t.Fatalf("HEAD not moved by updateHeadFrom")
+	}
+}
+
+func TestWorktrees(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	writeTestFile(t, "wt.txt", "one\n")
+	AddFile([]string{"wt.txt"})
+	CommitChanges([]string{"First"})
+	first, _ := headCommit()
+
+	path := filepath.Join(t.TempDir(), "feature")
+	if err := WorktreeAdd(path, "", WorktreeAddOptions{}); err != nil {
+		t.Fatalf("worktree add failed: %v", err)
+	}
+	if err := Checkout("feature", CheckoutOptions{}); err == nil || !strings.Contains(err.Error(), "already checked out") {
+		t.Fatalf("Expected checkout of a branch used by another worktree to fail, got %v", err)
+	}
+	if err := DeleteBranch([]string{"feature"}, true); err == nil {
+		t.Fatalf("Expected deleting a branch checked out in a worktree to fail")
+	}
+
+	main, _ := os.Getwd()
+	if err := os.Chdir(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, "wt.txt"); got != "one\n" {
+		os.Chdir(main)
+		t.Fatalf("worktree not populated, wt.txt = %q", got)
+	}
+	ioutil.WriteFile("wt.txt", []byte("two\n"), 0644)
+	AddFile([]string{"wt.txt"})
+	CommitChanges([]string{"Second"})
+	second, _ := headCommit()
+	os.Chdir(main)
+
+	// Refs and objects are shared, HEAD and the index are not.
+	if hash, _ := readRef("refs/heads/feature"); hash != second || second == first {
+		t.Fatalf("Commit in the worktree did not move the shared branch")
+	}
+	if head, _ := headCommit(); head != first {
+		t.Fatalf("Main worktree HEAD moved")
+	}
+	linkedIndex, _ := readIndexFile(filepath.Join(".mygitserver", "worktrees", "feature", "index"))
+	if linkedIndex["wt.txt"] == "" || linkedIndex["wt.txt"] == readIndexEntry(t, "wt.txt") {
+		t.Fatalf("Worktrees must have separate indexes")
+	}
+	if err := ForceCreateBranch("feature", first); err == nil {
+		t.Fatalf("Expected force-moving a branch checked out in a worktree to fail")
+	}
+
+	ioutil.WriteFile(filepath.Join(path, "untracked.txt"), []byte("x"), 0644)
+	if err := WorktreeRemove(path, false); err == nil {
+		t.Fatalf("Expected removing a dirty worktree to fail")
+	}
+	if err := WorktreeRemove(path, true); err != nil {
+		t.Fatalf("worktree remove failed: %v", err)
+	}
+	if err := Checkout("feature", CheckoutOptions{}); err != nil {
+		t.Fatalf("Branch still locked after its worktree was removed: %v", err)
+	}
+	Checkout("main", CheckoutOptions{})
+
+	// A worktree whose directory vanished is pruned.
+	gone := filepath.Join(t.TempDir(), "gone")
+	if err := WorktreeAdd(gone, "main", WorktreeAddOptions{Detach: true}); err != nil {
+		t.Fatalf("worktree add --detach failed: %v", err)
+	}
+	os.RemoveAll(gone)
+	if err := WorktreePrune(false, false); err != nil {
+		t.Fatalf("worktree prune failed: %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(".mygitserver", "worktrees")); len(entries) != 0 {
+		t.Fatalf("Stale worktree not pruned")
+	}
+}
+
+func TestUpstreamTracking(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	CommitChanges([]string{"First"})
+	first, _ := headCommit()
+	writeRef("refs/remotes/origin/main", first)
+
+	if err := SetUpstream("", "origin/main"); err != nil {
+		t.Fatalf("SetUpstream failed: %v", err)
+	}
+	if remote, _ := getConfig("branch.main.remote"); remote != "origin" {
+		t.Fatalf("branch.main.remote = %q", remote)
+	}
+	if merge, _ := getConfig("branch.main.merge"); merge != "refs/heads/main" {
+		t.Fatalf("branch.main.merge = %q", merge)
+	}
+	summary, _ := collectStatus()
+	if len(summary.Tracking) != 1 || summary.Tracking[0] != "Your branch is up to date with 'origin/main'." {
+		t.Fatalf("Unexpected tracking status %q", summary.Tracking)
+	}
+
+	CommitChanges([]string{"Second"})
+	CommitChanges([]string{"Third"})
+	CreateBranchAt("other", first)
+	Checkout("other", CheckoutOptions{})
+	CommitChanges([]string{"Other"})
+	other, _ := headCommit()
+	Checkout("main", CheckoutOptions{})
+	writeRef("refs/remotes/origin/main", other)
+
+	info, err := branchTracking("main")
+	if err != nil || info.Ahead != 2 || info.Behind != 1 {
+		t.Fatalf("Expected ahead 2, behind 1, got %+v (%v)", info, err)
+	}
+	if got := info.summary(true); got != "[origin/main: ahead 2, behind 1]" {
+		t.Fatalf("Unexpected -vv summary %q", got)
+	}
+	summary, _ = collectStatus()
+	if len(summary.Tracking) != 2 || !strings.Contains(summary.Tracking[0], "have diverged") {
+		t.Fatalf("Unexpected tracking status %q", summary.Tracking)
+	}
+
+	// A local branch can be the upstream too.
+	if err := SetUpstream("other", "main"); err != nil {
+		t.Fatalf("SetUpstream to a local branch failed: %v", err)
+	}
+	if info, _ := branchTracking("other"); info == nil || info.Upstream != "main" || info.Ahead != 1 || info.Behind != 2 {
+		t.Fatalf("Unexpected local tracking %+v", info)
+	}
+	if err := SetUpstream("other", "nowhere"); err == nil {
+		t.Fatalf("Expected a missing upstream to be rejected")
+	}
+
+	deleteRef("refs/remotes/origin/main")
+	if info, _ := branchTracking("main"); info == nil || !info.Gone {
+		t.Fatalf("Expected the upstream to be reported gone")
+	}
+	if err := UnsetUpstream("main"); err != nil {
+		t.Fatalf("UnsetUpstream failed: %v", err)
+	}
+	if info, _ := branchTracking("main"); info != nil {
+		t.Fatalf("Upstream still configured after unset")
+	}
+}
+
+func TestThreeWayMerge(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	writeTestFile(t, "m1.txt", "one\n")
+	writeTestFile(t, "m2.txt", "two\n")
+	writeTestFile(t, "m3.txt", "three\n")
+	AddFile([]string{"m1.txt", "m2.txt", "m3.txt"})
+	CommitChanges([]string{"Base"})
+
+	CreateBranch("feature")
+	SwitchBranch("feature")
+	writeTestFile(t, "m2.txt", "two on feature\n")
+	os.Remove("m3.txt")
+	writeTestFile(t, "m4.txt", "four\n")
+	AddFile([]string{"m2.txt", "m3.txt", "m4.txt"})
+	CommitChanges([]string{"Feature work"})
+	feature, _ := headCommit()
+
+	SwitchBranch("main")
+	writeTestFile(t, "m1.txt", "one on main\n")
+	AddFile([]string{"m1.txt"})
+	CommitChanges([]string{"Main work"})
+	main, _ := headCommit()
+
+	if err := MergeBranch("feature"); err != nil {
+		t.Fatalf("Clean merge failed: %v", err)
+	}
+	merged, _ := headCommit()
+	commit, _ := readCommit(merged)
+	if len(commit.Parents) != 2 || commit.Parents[0] != main || commit.Parents[1] != feature {
+		t.Fatalf("Merge commit has parents %v", commit.Parents)
+	}
+	tree, _ := commitTree(merged)
+	if len(tree) != 3 || tree["m3.txt"] != "" {
+		t.Fatalf("Unexpected merged tree %v", tree)
+	}
+	if readTestFile(t, "m1.txt") != "one on main\n" || readTestFile(t, "m2.txt") != "two on feature\n" || readTestFile(t, "m4.txt") != "four\n" {
+		t.Fatalf("Working tree does not hold the merged files")
+	}
+	if _, err := os.Stat("m3.txt"); !os.IsNotExist(err) {
+		t.Fatalf("File deleted on feature still present after merge")
+	}
+
+	// Both sides editing the same file stops with a conflict.
+	SwitchBranch("feature")
+	writeTestFile(t, "m1.txt", "one on feature\n")
+	AddFile([]string{"m1.txt"})
+	CommitChanges([]string{"Feature edits m1"})
+	SwitchBranch("main")
+
+	writeTestFile(t, "m1.txt", "dirty\n")
+	if err := MergeBranch("feature"); err == nil || !strings.Contains(err.Error(), "commit your changes") {
+		t.Fatalf("Expected merge over local changes to be refused, got %v", err)
+	}
+	writeTestFile(t, "m1.txt", "one on main\n")
+
+	err := MergeBranch("feature")
+	if err == nil || !strings.Contains(err.Error(), "automatic merge failed") {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+	if head, _ := headCommit(); head != merged {
+		t.Fatalf("A conflicted merge must not create a commit")
+	}
+	content := readTestFile(t, "m1.txt")
+	if !strings.Contains(content, "<<<<<<< main") || !strings.Contains(content, ">>>>>>> feature") {
+		t.Fatalf("Conflict markers missing from m1.txt:\n%s", content)
+	}
+}
+
+func TestMergeFastForwardAndSquash(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	writeTestFile(t, "ff.txt", "base\n")
+	AddFile([]string{"ff.txt"})
+	CommitChanges([]string{"Base"})
+	CreateBranch("feature")
+	SwitchBranch("feature")
+	writeTestFile(t, "ff.txt", "feature\n")
+	AddFile([]string{"ff.txt"})
+	CommitChanges([]string{"Feature"})
+	feature, _ := headCommit()
+	SwitchBranch("main")
+
+	if err := Merge([]string{"feature"}, MergeOptions{FastForward: "only"}); err != nil {
+		t.Fatalf("Fast-forward merge failed: %v", err)
+	}
+	if head, _ := headCommit(); head != feature {
+		t.Fatalf("Expected main to be fast-forwarded to feature")
+	}
+	if readTestFile(t, "ff.txt") != "feature\n" {
+		t.Fatalf("Working tree not updated by the fast-forward")
+	}
+	if err := MergeBranch("feature"); err != nil {
+		t.Fatalf("Merging an already merged branch failed: %v", err)
+	}
+	if head, _ := headCommit(); head != feature {
+		t.Fatalf("Merging an already merged branch must not create a commit")
+	}
+
+	SwitchBranch("feature")
+	writeTestFile(t, "ff2.txt", "two\n")
+	AddFile([]string{"ff2.txt"})
+	CommitChanges([]string{"Feature two"})
+	SwitchBranch("main")
+	if err := Merge([]string{"feature"}, MergeOptions{FastForward: "no-ff"}); err != nil {
+		t.Fatalf("--no-ff merge failed: %v", err)
+	}
+	noFF, _ := headCommit()
+	if commit, _ := readCommit(noFF); len(commit.Parents) != 2 {
+		t.Fatalf("--no-ff must create a merge commit")
+	}
+
+	// merge.ff=only refuses a real merge.
+	SwitchBranch("feature")
+	writeTestFile(t, "ff3.txt", "three\n")
+	AddFile([]string{"ff3.txt"})
+	CommitChanges([]string{"Feature three"})
+	SwitchBranch("main")
+	ConfigSet("merge.ff", "only", false)
+	if err := MergeBranch("feature"); err == nil || !strings.Contains(err.Error(), "fast-forward") {
+		t.Fatalf("Expected merge.ff=only to refuse a non-fast-forward merge, got %v", err)
+	}
+	ConfigUnset("merge.ff", false)
+
+	if err := Merge([]string{"feature"}, MergeOptions{Squash: true}); err != nil {
+		t.Fatalf("Squash merge failed: %v", err)
+	}
+	if head, _ := headCommit(); head != noFF {
+		t.Fatalf("A squash merge must not move HEAD")
+	}
+	if readIndexEntry(t, "ff3.txt") == "" {
+		t.Fatalf("Squash merge did not stage the changes")
+	}
+	if msg := readTestFile(t, filepath.Join(".mygitserver", "SQUASH_MSG")); !strings.Contains(msg, "Feature three") {
+		t.Fatalf("SQUASH_MSG does not list the squashed commits:\n%s", msg)
+	}
+	CommitChanges([]string{"Squashed feature"})
+	squashed, _ := headCommit()
+	if commit, _ := readCommit(squashed); len(commit.Parents) != 1 {
+		t.Fatalf("A squash commit must have a single parent")
+	}
+	if _, err := os.Stat(filepath.Join(".mygitserver", "SQUASH_MSG")); !os.IsNotExist(err) {
+		t.Fatalf("SQUASH_MSG not removed by the commit")
+	}
+
+	// A branch that merged an older hotfix still fast-forwards: walking back
+	// from it reaches the hotfix's base before HEAD.
+	commitOn := func(name, content, message string) {
+		writeTestFile(t, name, content)
+		AddFile([]string{name})
+		CommitChanges([]string{message})
+	}
+	CreateBranchAt("hotfix", feature)
+	CreateBranch("topic")
+	SwitchBranch("hotfix")
+	commitOn("hotfix.txt", "fix\n", "Hotfix")
+	SwitchBranch("topic")
+	commitOn("s.txt", "1\n", "S1")
+	commitOn("s.txt", "2\n", "S2")
+	commitOn("s.txt", "3\n", "S3")
+	if err := MergeBranch("hotfix"); err != nil {
+		t.Fatalf("Merging the hotfix failed: %v", err)
+	}
+	topic, _ := headCommit()
+	if base, _ := mergeBase(squashed, topic); base != squashed {
+		t.Fatalf("Expected the merge base to be main's tip, got %s", base)
+	}
+	SwitchBranch("main")
+	if err := Merge([]string{"topic"}, MergeOptions{FastForward: "only"}); err != nil {
+		t.Fatalf("Expected topic to fast-forward, got %v", err)
+	}
+	if head, _ := headCommit(); head != topic {
+		t.Fatalf("Expected main to be fast-forwarded to topic")
+	}
+	if err := MergeBranch("hotfix"); err != nil {
+		t.Fatalf("Merging an already merged hotfix failed: %v", err)
+	}
+	if head, _ := headCommit(); head != topic {
+		t.Fatalf("Merging an already merged hotfix must not create a commit")
+	}
+}
+
+func TestMergeStrategies(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	commitFile := func(name, content, message string) {
+		writeTestFile(t, name, content)
+		AddFile([]string{name})
+		CommitChanges([]string{message})
+	}
+	commitFile("s.txt", "one\ntwo\nthree\n", "Base")
+	CreateBranch("left")
+	CreateBranch("right")
+
+	// Criss-cross: each side merges the other's first commit.
+	SwitchBranch("left")
+	commitFile("s.txt", "ONE\ntwo\nthree\n", "Left one")
+	CreateBranch("left1")
+	SwitchBranch("right")
+	commitFile("s.txt", "one\ntwo\nTHREE\n", "Right three")
+	if err := Merge([]string{"left1"}, MergeOptions{FastForward: "no-ff"}); err != nil {
+		t.Fatalf("Merge into right failed: %v", err)
+	}
+	SwitchBranch("left")
+	if err := Merge([]string{"right~1"}, MergeOptions{FastForward: "no-ff"}); err != nil {
+		t.Fatalf("Merge into left failed: %v", err)
+	}
+	commitFile("l.txt", "left\n", "Left file")
+	SwitchBranch("right")
+	commitFile("r.txt", "right\n", "Right file")
+	leftTip, _ := resolveCommit("left")
+	rightTip, _ := resolveCommit("right")
+	if bases, _ := mergeBases(leftTip, rightTip); len(bases) != 2 {
+		t.Fatalf("Expected two merge bases for a criss-cross, got %v", bases)
+	}
+	include, exclude, _ := resolveRevisionRange([]string{"left...right"})
+	if symmetric, _ := walkCommits(include, exclude); len(symmetric) != 4 {
+		t.Fatalf("Expected left...right to exclude both merge bases, got %d commits", len(symmetric))
+	}
+	SwitchBranch("left")
+	if err := Merge([]string{"right"}, MergeOptions{Strategy: "recursive"}); err != nil {
+		t.Fatalf("Criss-cross merge failed: %v", err)
+	}
+	if readTestFile(t, "s.txt") != "ONE\ntwo\nTHREE\n" || readTestFile(t, "r.txt") != "right\n" {
+		t.Fatalf("Criss-cross merge produced the wrong tree")
+	}
+
+	// -X theirs resolves conflicting hunks to the merged branch.
+	CreateBranch("topic")
+	SwitchBranch("topic")
+	commitFile("s.txt", "ONE\ntwo\ntopic\n", "Topic")
+	SwitchBranch("left")
+	commitFile("s.txt", "ONE\ntwo\nleft\n", "Left")
+	if err := Merge([]string{"topic"}, MergeOptions{StrategyOptions: []string{"bogus"}}); err == nil {
+		t.Fatalf("Expected an unknown strategy option to be rejected")
+	}
+	if err := Merge([]string{"topic"}, MergeOptions{StrategyOptions: []string{"theirs"}}); err != nil {
+		t.Fatalf("-X theirs merge failed: %v", err)
+	}
+	if got := readTestFile(t, "s.txt"); got != "ONE\ntwo\ntopic\n" {
+		t.Fatalf("-X theirs kept the wrong side:\n%s", got)
+	}
+
+	// The ours strategy records the merge but keeps HEAD's tree.
+	SwitchBranch("topic")
+	commitFile("o.txt", "topic only\n", "Topic file")
+	SwitchBranch("left")
+	before, _ := headCommit()
+	beforeTree, _ := commitTree(before)
+	if err := Merge([]string{"topic"}, MergeOptions{Strategy: "ours"}); err != nil {
+		t.Fatalf("Ours merge failed: %v", err)
+	}
+	head, _ := headCommit()
+	if commit, _ := readCommit(head); len(commit.Parents) != 2 {
+		t.Fatalf("Ours merge must record both parents")
+	}
+	if tree, _ := commitTree(head); len(tree) != len(beforeTree) || tree["o.txt"] != "" {
+		t.Fatalf("Ours merge changed the tree: %v", tree)
+	}
+	if err := Merge([]string{"topic"}, MergeOptions{Strategy: "resolve"}); err == nil {
+		t.Fatalf("Expected an unknown strategy to be rejected")
+	}
+
+	// Octopus merges several branches into one commit.
+	for _, name := range []string{"o1", "o2", "o3"} {
+		CreateBranch(name)
+		SwitchBranch(name)
+		commitFile(name+".txt", name+"\n", "Add "+name)
+		SwitchBranch("left")
+	}
+	if err := Merge([]string{"o1", "o2", "o3"}, MergeOptions{}); err != nil {
+		t.Fatalf("Octopus merge failed: %v", err)
+	}
+	head, _ = headCommit()
+	if commit, _ := readCommit(head); len(commit.Parents) != 4 || !strings.HasPrefix(commit.Message, "Merge branches 'o1', 'o2' and 'o3'") {
+		t.Fatalf("Unexpected octopus commit: parents %v, message %q", commit.Parents, commit.Message)
+	}
+	for _, name := range []string{"o1", "o2", "o3"} {
+		if readTestFile(t, name+".txt") != name+"\n" {
+			t.Fatalf("%s.txt missing after the octopus merge", name)
+		}
+	}
+
+	// Octopus refuses conflicts without touching anything.
+	for _, name := range []string{"c1", "c2"} {
+		CreateBranch(name)
+		SwitchBranch(name)
+		commitFile("s.txt", name+"\n", "Edit on "+name)
+		SwitchBranch("left")
+	}
+	if err := Merge([]string{"c1", "c2"}, MergeOptions{}); err == nil || !strings.Contains(err.Error(), "octopus") {
+		t.Fatalf("Expected a conflicting octopus merge to fail, got %v", err)
+	}
+	if now, _ := headCommit(); now != head {
+		t.Fatalf("A failed octopus merge must not move HEAD")
+	}
+	if _, ok := mergeHeads(); ok {
+		t.Fatalf("A failed octopus merge must not leave merge state")
+	}
+}
+
+func TestCherryPickAndRevert(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	commitFile := func(name, content, message string) string {
+		writeTestFile(t, name, content)
+		AddFile([]string{name})
+		CommitChanges([]string{message})
+		hash, _ := headCommit()
+		return hash
+	}
+	commitFile("p.txt", "one\ntwo\nthree\n", "Base")
+	CreateBranch("release")
+	fix := commitFile("p.txt", "one\ntwo\nthree fixed\n", "Fix three")
+	second := commitFile("q.txt", "q\n", "Add q")
+	third := commitFile("r.txt", "r\n", "Add r")
+
+	SwitchBranch("release")
+	commitFile("p.txt", "ONE\ntwo\nthree\n", "Release tweak")
+	if err := CherryPick([]string{fix}, PickOptions{RecordOrigin: true}); err != nil {
+		t.Fatalf("Cherry-pick failed: %v", err)
+	}
+	if readTestFile(t, "p.txt") != "ONE\ntwo\nthree fixed\n" {
+		t.Fatalf("Cherry-pick did not merge the fix")
+	}
+	picked, _ := headCommit()
+	commit, _ := readCommit(picked)
+	original, _ := readCommit(fix)
+	if !strings.Contains(commit.Message, "(cherry picked from commit "+fix+")") || commit.Author != original.Author {
+		t.Fatalf("Unexpected cherry-picked commit: author %q, message %q", commit.Author, commit.Message)
+	}
+
+	// A range is picked oldest first.
+	if err := CherryPick([]string{fix + ".." + third}, PickOptions{}); err != nil {
+		t.Fatalf("Range cherry-pick failed: %v", err)
+	}
+	head, _ := headCommit()
+	commit, _ = readCommit(head)
+	if commit.Subject() != "Add r" {
+		t.Fatalf("Expected the newest commit of the range last, got %q", commit.Subject())
+	}
+	if commit, _ := readCommit(commit.Parents[0]); commit.Subject() != "Add q" {
+		t.Fatalf("Expected 'Add q' picked before 'Add r'")
+	}
+
+	if err := Revert([]string{"HEAD"}, PickOptions{}); err != nil {
+		t.Fatalf("Revert failed: %v", err)
+	}
+	if _, err := os.Stat("r.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Revert did not remove r.txt")
+	}
+	head, _ = headCommit()
+	if commit, _ := readCommit(head); !strings.HasPrefix(commit.Message, "Revert \"Add r\"") {
+		t.Fatalf("Unexpected revert message %q", commit.Message)
+	}
+
+	// --no-commit stages the change only.
+	if err := CherryPick([]string{third}, PickOptions{NoCommit: true}); err != nil {
+		t.Fatalf("--no-commit cherry-pick failed: %v", err)
+	}
+	if now, _ := headCommit(); now != head || readIndexEntry(t, "r.txt") == "" {
+		t.Fatalf("--no-commit must stage without committing")
+	}
+	CommitChanges([]string{"Re-add r"})
+
+	// A conflict stops the sequencer until --continue.
+	SwitchBranch("main")
+	conflicting := commitFile("p.txt", "one main\ntwo\nthree fixed\n", "Main edits one")
+	after := commitFile("s.txt", "s\n", "Add s")
+	SwitchBranch("release")
+	err := CherryPick([]string{conflicting, after}, PickOptions{})
+	if err == nil || !strings.Contains(err.Error(), "could not apply") {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+	if _, ok := pickHead(); !ok {
+		t.Fatalf("CHERRY_PICK_HEAD not recorded")
+	}
+	if err := CherryPick([]string{after}, PickOptions{}); err == nil {
+		t.Fatalf("Expected a second cherry-pick to be refused while one is in progress")
+	}
+	if err := SequencerContinue(); err == nil {
+		t.Fatalf("Expected --continue to refuse unresolved conflicts")
+	}
+	writeTestFile(t, "p.txt", "ONE\ntwo\nthree resolved\n")
+	AddFile([]string{"p.txt"})
+	if err := SequencerContinue(); err != nil {
+		t.Fatalf("--continue failed: %v", err)
+	}
+	if readTestFile(t, "s.txt") != "s\n" || sequencerInProgress() {
+		t.Fatalf("--continue did not finish the remaining picks")
+	}
+	head, _ = headCommit()
+	if commit, _ := readCommit(head); commit.Subject() != "Add s" {
+		t.Fatalf("Expected 'Add s' at HEAD, got %q", commit.Subject())
+	}
+
+	// --skip drops the conflicting commit; --abort returns to the start.
+	SwitchBranch("main")
+	conflicting = commitFile("p.txt", "one again\ntwo\nthree fixed\n", "Main edits one again")
+	SwitchBranch("release")
+	before, _ := headCommit()
+	if err := CherryPick([]string{conflicting, second}, PickOptions{}); err == nil {
+		t.Fatalf("Expected a conflict")
+	}
+	if err := SequencerSkip(); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Fatalf("Expected the already applied 'Add q' to come out empty, got %v", err)
+	}
+	if err := SequencerContinue(); err == nil || !strings.Contains(err.Error(), "now empty") {
+		t.Fatalf("Expected --continue to refuse recording an empty commit, got %v", err)
+	}
+	if now, _ := headCommit(); now != before {
+		t.Fatalf("--continue recorded an empty commit")
+	}
+	if err := SequencerAbort(); err != nil {
+		t.Fatalf("--abort failed: %v", err)
+	}
+	if now, _ := headCommit(); now != before || readTestFile(t, "p.txt") != "ONE\ntwo\nthree resolved\n" || sequencerInProgress() {
+		t.Fatalf("--abort did not restore the original state")
+	}
+	if _, ok := pickHead(); ok {
+		t.Fatalf("--abort left CHERRY_PICK_HEAD behind")
+	}
+
+	// Once the stopped pick is committed by hand, --skip has nothing to drop
+	// and must not lose the next commit.
+	SwitchBranch("main")
+	conflicting = commitFile("p.txt", "one more\ntwo\nthree fixed\n", "Main edits one more")
+	next := commitFile("t.txt", "t\n", "Add t")
+	SwitchBranch("release")
+	if err := CherryPick([]string{conflicting, next}, PickOptions{}); err == nil {
+		t.Fatalf("Expected a conflict")
+	}
+	writeTestFile(t, "p.txt", "ONE MORE\ntwo\nthree resolved\n")
+	AddFile([]string{"p.txt"})
+	CommitChanges([]string{"Resolve one more"})
+	if err := SequencerSkip(); err == nil || !strings.Contains(err.Error(), "nothing to skip") {
+		t.Fatalf("Expected --skip to refuse after a manual commit, got %v", err)
+	}
+	if err := SequencerContinue(); err != nil {
+		t.Fatalf("--continue failed: %v", err)
+	}
+	if readTestFile(t, "t.txt") != "t\n" || sequencerInProgress() {
+		t.Fatalf("--continue did not apply the commit after the one committed by hand")
+	}
+
+	// Merge commits need a mainline.
+	commitFile("rel.txt", "release only\n", "Release file")
+	SwitchBranch("main")
+	Merge([]string{"release"}, MergeOptions{StrategyOptions: []string{"ours"}})
+	mergeCommit, _ := headCommit()
+	if err := Revert([]string{mergeCommit}, PickOptions{}); err == nil || !strings.Contains(err.Error(), "no -m option") {
+		t.Fatalf("Expected reverting a merge without -m to fail, got %v", err)
+	}
+	SequencerAbort()
+	if err := Revert([]string{mergeCommit}, PickOptions{Mainline: 1}); err != nil {
+		t.Fatalf("Revert -m 1 failed: %v", err)
+	}
+	if _, err := os.Stat("rel.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Reverting the merge against its first parent must remove rel.txt")
+	}
+	if _, err := os.Stat("s.txt"); err != nil {
+		t.Fatalf("s.txt exists on both sides and must survive reverting the merge")
+	}
+}
+
+func TestRerere(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	commitFile := func(name, content, message string) {
+		writeTestFile(t, name, content)
+		AddFile([]string{name})
+		CommitChanges([]string{message})
+	}
+	ConfigSet("rerere.enabled", "true", false)
+	commitFile("rr.txt", "top\nmiddle\nbottom\n", "Base")
+	CreateBranch("feature")
+	SwitchBranch("feature")
+	commitFile("rr.txt", "top\nmiddle on feature\nbottom\n", "Feature")
+	SwitchBranch("main")
+	commitFile("rr.txt", "top\nmiddle on main\nbottom\n", "Main")
+	CreateBranch("retry")
+
+	if err := MergeBranch("feature"); err == nil {
+		t.Fatalf("Expected a conflict")
+	}
+	if entries := readMergeRR(); len(entries) != 1 || entries[0].Path != "rr.txt" {
+		t.Fatalf("Expected rr.txt to be watched, got %v", entries)
+	}
+	resolution := "top\nmiddle on both\nbottom\n"
+	writeTestFile(t, "rr.txt", resolution)
+	AddFile([]string{"rr.txt"})
+	if err := MergeContinue(); err != nil {
+		t.Fatalf("Merge --continue failed: %v", err)
+	}
+	if len(readMergeRR()) != 0 {
+		t.Fatalf("MERGE_RR left behind after the resolution was recorded")
+	}
+
+	// The same conflict in another merge is resolved from the cache.
+	SwitchBranch("retry")
+	if err := MergeBranch("feature"); err == nil {
+		t.Fatalf("Expected the merge to stop for review")
+	}
+	if got := readTestFile(t, "rr.txt"); got != resolution {
+		t.Fatalf("Recorded resolution not applied, got:\n%s", got)
+	}
+
+	// forget drops the resolution and watches the path again.
+	if err := RerereForget([]string{"rr.txt"}); err != nil {
+		t.Fatalf("rerere forget failed: %v", err)
+	}
+	if entries := readMergeRR(); len(entries) != 1 {
+		t.Fatalf("Expected rr.txt to be watched after forget, got %v", entries)
+	}
+	if err := RerereForget([]string{"rr.txt"}); err == nil {
+		t.Fatalf("Expected a second forget to find no resolution")
+	}
+	MergeAbort()
+
+	// The fingerprint does not depend on which side was merged into which.
+	ours := []byte("a\n<<<<<<< main\nx\n=======\ny\n>>>>>>> topic\nb\n")
+	theirs := []byte("a\n<<<<<<< topic\ny\n||||||| base\nz\n=======\nx\n>>>>>>> main\nb\n")
+	normalizedOurs, idOurs, ok1 := normalizeConflicts(ours, defaultConflictMarkerSize)
+	normalizedTheirs, idTheirs, ok2 := normalizeConflicts(theirs, defaultConflictMarkerSize)
+	if !ok1 || !ok2 || idOurs != idTheirs || string(normalizedOurs) != string(normalizedTheirs) {
+		t.Fatalf("Expected swapped sides to normalize alike:\n%s\n%s", normalizedOurs, normalizedTheirs)
+	}
+}
+
+func TestMergetoolAndDifftool(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	commitFile := func(name, content, message string) {
+		writeTestFile(t, name, content)
+		AddFile([]string{name})
+		CommitChanges([]string{message})
+	}
+	commitFile("mt.txt", "base\n", "Base")
+	CreateBranch("feature")
+	SwitchBranch("feature")
+	commitFile("mt.txt", "feature\n", "Feature")
+	SwitchBranch("main")
+	commitFile("mt.txt", "main\n", "Main")
+	MergeBranch("feature")
+
+	if err := Mergetool(nil, MergetoolOptions{}); err == nil || !strings.Contains(err.Error(), "no mergetool configured") {
+		t.Fatalf("Expected a missing tool to be reported, got %v", err)
+	}
+
+	// A tool that leaves the file alone has not resolved it.
+	ConfigSet("mergetool.noop.cmd", "true", false)
+	if err := Mergetool(nil, MergetoolOptions{Tool: "noop"}); err == nil {
+		t.Fatalf("Expected an unchanged file to count as unresolved")
+	}
+	if conflicts, _ := readIndexConflicts(); len(conflicts) != 1 {
+		t.Fatalf("An unresolved path must stay conflicted")
+	}
+
+	// A trusted exit code is believed even when the file changed, and the
+	// file is put back as it was.
+	conflicted := readTestFile(t, "mt.txt")
+	ConfigSet("mergetool.failing.cmd", `cat "$REMOTE" > "$MERGED"; exit 1`, false)
+	ConfigSet("mergetool.failing.trustExitCode", "true", false)
+	if err := Mergetool(nil, MergetoolOptions{Tool: "failing"}); err == nil {
+		t.Fatalf("Expected a failing exit code to be trusted")
+	}
+	if got := readTestFile(t, "mt.txt"); got != conflicted {
+		t.Fatalf("Expected the file to be restored after a failed merge, got:\n%s", got)
+	}
+
+	ConfigSet("merge.tool", "combine", false)
+	ConfigSet("mergetool.combine.cmd", `cat "$BASE" "$LOCAL" "$REMOTE" > "$MERGED"`, false)
+	if err := Mergetool(nil, MergetoolOptions{}); err != nil {
+		t.Fatalf("Mergetool failed: %v", err)
+	}
+	if got := readTestFile(t, "mt.txt"); got != "base\nmain\nfeature\n" {
+		t.Fatalf("Tool did not see the base, local and remote versions:\n%s", got)
+	}
+	if conflicts, _ := readIndexConflicts(); len(conflicts) != 0 || readIndexEntry(t, "mt.txt") == "" {
+		t.Fatalf("Resolved path not staged")
+	}
+	if _, err := os.Stat("mt.txt.orig"); err != nil {
+		t.Fatalf("Expected a backup of the conflicted file")
+	}
+	if files, _ := filepath.Glob("mt_*.txt"); len(files) != 0 {
+		t.Fatalf("Temporary files left behind: %v", files)
+	}
+	os.Remove("mt.txt.orig")
+	if err := MergeContinue(); err != nil {
+		t.Fatalf("Concluding the merge failed: %v", err)
+	}
+
+	// difftool shows each changed path, old version first.
+	writeTestFile(t, "mt.txt", "edited\n")
+	ConfigSet("difftool.record.cmd", `cat "$LOCAL" "$REMOTE" >> .mygitserver/difftool.log`, false)
+	if err := Difftool(nil, DifftoolOptions{Tool: "record"}); err != nil {
+		t.Fatalf("Difftool failed: %v", err)
+	}
+	if got := readTestFile(t, ".mygitserver/difftool.log"); got != "base\nmain\nfeature\nedited\n" {
+		t.Fatalf("Unexpected difftool input:\n%s", got)
+	}
+	if err := Difftool(nil, DifftoolOptions{Tool: "record", Commits: []string{"HEAD~1", "HEAD"}}); err != nil {
+		t.Fatalf("Difftool between commits failed: %v", err)
+	}
+	if got := readTestFile(t, ".mygitserver/difftool.log"); !strings.HasSuffix(got, "main\nbase\nmain\nfeature\n") {
+		t.Fatalf("Unexpected difftool input for two commits:\n%s", got)
+	}
+}
+
+func TestMergeDrivers(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	commitFiles := func(files map[string]string, message string) {
+		for name, content := range files {
+			writeTestFile(t, name, content)
+			AddFile([]string{name})
+		}
+		CommitChanges([]string{message})
+	}
+	ConfigSet("merge.upper.driver", "tr a-z A-Z < %B > %A", false)
+	commitFiles(map[string]string{
+		attributesFileName: "*.json merge=json\n*.yml merge=yaml\ngo.mod merge=gomod\ngo.sum merge=union\n*.up merge=upper\n",
+		"config.json":      "{\n\t\"name\": \"app\",\n\t\"server\": {\n\t\t\"port\": 80\n\t}\n}\n",
+		"config.yml":       "name: app\nserver:\n  port: 80\n  host: localhost\n",
+		"go.mod":           "module example.com/app\n\ngo 1.22\n\nrequire (\n\tgithub.com/a/a v1.0.0\n\tgithub.com/b/b v1.0.0\n)\n",
+		"go.sum":           "github.com/a/a v1.0.0 h1:a\ngithub.com/b/b v1.0.0 h1:b\n",
+		"note.up":          "base\n",
+	}, "Base")
+	CreateBranch("feature")
+	SwitchBranch("feature")
+	commitFiles(map[string]string{
+		"config.json": "{\n\t\"name\": \"app\",\n\t\"server\": {\n\t\t\"port\": 80,\n\t\t\"tls\": true\n\t},\n\t\"debug\": false\n}\n",
+		"config.yml":  "name: app\nserver:\n  port: 80\n  host: localhost\n  tls: true\n# logging\nlog: info\n",
+		"go.mod":      "module example.com/app\n\ngo 1.22\n\nrequire (\n\tgithub.com/a/a v1.2.0\n\tgithub.com/b/b v1.0.0\n\tgithub.com/c/c v0.1.0\n)\n",
+		"go.sum":      "github.com/a/a v1.0.0 h1:a\ngithub.com/b/b v1.0.0 h1:b\ngithub.com/c/c v0.1.0 h1:c\n",
+		"note.up":     "feature\n",
+	}, "Feature")
+	SwitchBranch("main")
+	commitFiles(map[string]string{
+		"config.json": "{\n\t\"name\": \"app\",\n\t\"server\": {\n\t\t\"port\": 8080\n\t},\n\t\"workers\": 4\n}\n",
+		"config.yml":  "name: app\nserver:\n  port: 8080\n  host: localhost\nworkers: 4\n",
+		"go.mod":      "module example.com/app\n\ngo 1.22\n\nrequire (\n\tgithub.com/a/a v1.1.0\n\tgithub.com/b/b v1.0.0\n\tgithub.com/d/d v0.2.0\n)\n",
+		"go.sum":      "github.com/a/a v1.0.0 h1:a\ngithub.com/b/b v1.0.0 h1:b\ngithub.com/d/d v0.2.0 h1:d\n",
+		"note.up":     "main\n",
+	}, "Main")
+
+	if err := MergeBranch("feature"); err != nil {
+		t.Fatalf("Expected the drivers to merge cleanly: %v", err)
+	}
+	expected := map[string]string{
+		"config.json": "{\n\t\"name\": \"app\",\n\t\"server\": {\n\t\t\"port\": 8080,\n\t\t\"tls\": true\n\t},\n\t\"debug\": false,\n\t\"workers\": 4\n}\n",
+		"config.yml":  "name: app\nserver:\n  port: 8080\n  host: localhost\n  tls: true\n# logging\nlog: info\nworkers: 4\n",
+		"go.mod":      "module example.com/app\n\ngo 1.22\n\nrequire (\n\tgithub.com/a/a v1.2.0\n\tgithub.com/b/b v1.0.0\n\tgithub.com/c/c v0.1.0\n\tgithub.com/d/d v0.2.0\n)\n",
+		"go.sum":      "github.com/a/a v1.0.0 h1:a\ngithub.com/b/b v1.0.0 h1:b\ngithub.com/d/d v0.2.0 h1:d\ngithub.com/c/c v0.1.0 h1:c\n",
+		"note.up":     "FEATURE\n",
+	}
+	for name, want := range expected {
+		if got := readTestFile(t, name); got != want {
+			t.Errorf("Unexpected %s after merge:\n%s\nwant:\n%s", name, got, want)
+		}
+	}
+
+	// A key changed differently on both sides falls back to a line merge.
+	base := []byte(`{"a": 1, "b": 1}`)
+	if _, conflict, _ := (jsonDriver{}).merge("x.json", base, []byte(`{"a": 2, "b": 1}`), []byte(`{"a": 3, "b": 1}`), mergeFileOptions{}); !conflict {
+		t.Errorf("Expected conflicting JSON values to conflict")
+	}
+	if merged, conflict, _ := (jsonDriver{}).merge("x.json", base, []byte(`{"a": 2, "b": 1}`), []byte(`{"a": 1}`), mergeFileOptions{}); conflict || string(merged) != "{\n  \"a\": 2\n}" {
+		t.Errorf("Expected a removed key to stay removed, got %q", merged)
+	}
+
+	attrs := newAttributeChecker()
+	attrs.files[attributesFileName] = parseAttributes("*.bin -merge\ndocs/** merge=union\n/top.txt merge=union\n")
+	for path, want := range map[string]string{"a/b.bin": attrUnset, "docs/x/y.md": "union", "top.txt": "union", "sub/top.txt": ""} {
+		if got := attrs.get(path, "merge"); got != want {
+			t.Errorf("merge attribute of %s: expected %q, got %q", path, want, got)
+		}
+	}
+
+	// A set merge attribute asks for the line merge; only paths without one
+	// use merge.default.
+	ConfigSet("merge.default", "union", false)
+	attrs = newAttributeChecker()
+	attrs.files[attributesFileName] = parseAttributes("*.txt merge\n")
+	if driver := mergeDriverFor(attrs, "a.txt"); driver != (textDriver{}) {
+		t.Errorf("Expected a set merge attribute to select the text driver, got %T", driver)
+	}
+	if driver := mergeDriverFor(attrs, "a.md"); driver != (unionDriver{}) {
+		t.Errorf("Expected merge.default to apply without a merge attribute, got %T", driver)
+	}
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{{"v1.2.0", "v1.10.0", -1}, {"v1.0.0", "v1.0.0-rc.1", 1}, {"v0.0.0-20240101-abc", "v0.0.0-20230101-def", 1}} {
+		if got := compareModuleVersions(c.a, c.b); got != c.want {
+			t.Errorf("compareModuleVersions(%s, %s) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestRebase(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	commitFile := func(name, content, message string) {
+		writeTestFile(t, name, content)
+		AddFile([]string{name})
+		CommitChanges([]string{message})
+	}
+	subjects := func(rev string) []string {
+		hash, err := resolveCommit(rev)
+		if err != nil {
+			t.Fatalf("Could not resolve %s: %v", rev, err)
+		}
+		var subjects []string
+		for hash != "" {
+			commit, _ := readCommit(hash)
+			subjects = append(subjects, commit.Subject())
+			hash = getParentCommit(hash)
+		}
+		return subjects
+	}
+
+	commitFile("rb.txt", "one\ntwo\nthree\n", "Base")
+	CreateBranch("topic")
+	SwitchBranch("topic")
+	commitFile("topic.txt", "topic\n", "Topic one")
+	commitFile("rb.txt", "one\ntwo on topic\nthree\n", "Topic two")
+	SwitchBranch("main")
+	commitFile("main.txt", "main\n", "Main one")
+
+	// A clean rebase replays the topic commits on main and moves the branch.
+	if err := Rebase("main", RebaseOptions{Branch: "topic"}); err != nil {
+		t.Fatalf("Rebase failed: %v", err)
+	}
+	if got := strings.Join(subjects("topic"), ","); got != "Topic two,Topic one,Main one,Base" {
+		t.Fatalf("Unexpected history after rebase: %s", got)
+	}
+	if ref, detached, _ := readHead(); detached || ref != "refs/heads/topic" {
+		t.Fatalf("Expected HEAD back on topic, got %s", ref)
+	}
+	if rebaseInProgress() {
+		t.Fatalf("Rebase state left behind")
+	}
+	if err := Rebase("main", RebaseOptions{}); err != nil {
+		t.Fatalf("Rebase of an up to date branch failed: %v", err)
+	}
+
+	// A conflict stops the rebase until it is resolved and continued.
+	SwitchBranch("main")
+	commitFile("rb.txt", "one\ntwo on main\nthree\n", "Main two")
+	SwitchBranch("topic")
+	if err := Rebase("main", RebaseOptions{}); err == nil {
+		t.Fatalf("Expected the rebase to stop on a conflict")
+	}
+	summary, _ := collectStatus()
+	if !summary.Detached || len(summary.InProgress) == 0 || !strings.Contains(strings.Join(summary.InProgress, "\n"), "You are currently rebasing branch 'topic'") {
+		t.Fatalf("Expected status to show the rebase, got %v", summary.InProgress)
+	}
+	if err := ResumeRebase(); err == nil {
+		t.Fatalf("Expected --continue to refuse unmerged paths")
+	}
+	writeTestFile(t, "rb.txt", "one\ntwo on both\nthree\n")
+	AddFile([]string{"rb.txt"})
+	if err := ResumeRebase(); err != nil {
+		t.Fatalf("Rebase --continue failed: %v", err)
+	}
+	if got := strings.Join(subjects("topic"), ","); got != "Topic two,Topic one,Main two,Main one,Base" {
+		t.Fatalf("Unexpected history after continue: %s", got)
+	}
+	if got := readTestFile(t, "rb.txt"); got != "one\ntwo on both\nthree\n" {
+		t.Fatalf("Resolution lost, got %q", got)
+	}
+
+	// --skip drops the conflicting commit, --abort restores the branch.
+	SwitchBranch("main")
+	commitFile("rb.txt", "one\ntwo again\nthree\n", "Main three")
+	SwitchBranch("topic")
+	before, _ := resolveCommit("topic")
+	if err := Rebase("main", RebaseOptions{}); err == nil {
+		t.Fatalf("Expected a conflict")
+	}
+	if err := AbortRebase(); err != nil {
+		t.Fatalf("Rebase --abort failed: %v", err)
+	}
+	if after, _ := resolveCommit("HEAD"); after != before || readTestFile(t, "rb.txt") != "one\ntwo on both\nthree\n" {
+		t.Fatalf("Abort did not restore topic")
+	}
+	if ref, detached, _ := readHead(); detached || ref != "refs/heads/topic" {
+		t.Fatalf("Expected HEAD back on topic after abort, got %s", ref)
+	}
+	if err := Rebase("main", RebaseOptions{}); err == nil {
+		t.Fatalf("Expected a conflict")
+	}
+	if err := SkipRebase(); err != nil {
+		t.Fatalf("Rebase --skip failed: %v", err)
+	}
+	if got := strings.Join(subjects("topic"), ","); got != "Topic one,Main three,Main two,Main one,Base" {
+		t.Fatalf("Unexpected history after skip: %s", got)
+	}
+
+	// --onto moves only the commits after upstream.
+	CreateBranch("side")
+	SwitchBranch("side")
+	commitFile("side.txt", "side\n", "Side one")
+	if err := Rebase("topic", RebaseOptions{Onto: "main~2"}); err != nil {
+		t.Fatalf("Rebase --onto failed: %v", err)
+	}
+	if got := strings.Join(subjects("side"), ","); got != "Side one,Main one,Base" {
+		t.Fatalf("Unexpected history after --onto: %s", got)
+	}
+	if err := ResumeRebase(); err == nil {
+		t.Fatalf("Expected --continue without a rebase to fail")
+	}
+
+	// A step that cannot be applied at all stays on the todo list.
+	commitFile("later.txt", "later\n", "Side two")
+	sideOne, _ := resolveCommit("side~1")
+	sideTwo, _ := resolveCommit("side")
+	todoFile := filepath.Join(repoPath(), "todo-test")
+	ioutil.WriteFile(todoFile, []byte("edit "+sideOne+"\npick "+sideTwo+"\n"), 0644)
+	if err := Rebase("main", RebaseOptions{TodoFile: todoFile}); err != nil {
+		t.Fatalf("Rebase stopping to edit failed: %v", err)
+	}
+	writeTestFile(t, "later.txt", "untracked\n")
+	if err := ResumeRebase(); err == nil || !strings.Contains(err.Error(), "move or remove") {
+		t.Fatalf("Expected the untracked file to block the next step, got %v", err)
+	}
+	if todo, _ := readRebaseTodo("todo"); len(todo) != 1 || todo[0].Hash != sideTwo {
+		t.Fatalf("Expected the blocked step back on the todo list, got %v", todo)
+	}
+	os.Remove("later.txt")
+	if err := ResumeRebase(); err != nil {
+		t.Fatalf("Rebase --continue failed: %v", err)
+	}
+	if got := strings.Join(subjects("side"), ","); got != "Side two,Side one,Main three,Main two,Main one,Base" {
+		t.Fatalf("Unexpected history after the blocked step: %s", got)
+	}
+}
+
+func TestRebaseTodoList(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	commitFile := func(name, content, message string) string {
+		writeTestFile(t, name, content)
+		AddFile([]string{name})
+		CommitChanges([]string{message})
+		hash, _ := headCommit()
+		return hash
+	}
+	subjects := func(rev string) string {
+		hash, _ := resolveCommit(rev)
+		var subjects []string
+		for hash != "" {
+			commit, _ := readCommit(hash)
+			subjects = append(subjects, commit.Subject())
+			hash = getParentCommit(hash)
+		}
+		return strings.Join(subjects, ",")
+	}
+
+	commitFile("todo-base.txt", "base\n", "Base")
+	CreateBranch("topic")
+	SwitchBranch("topic")
+	first := commitFile("todo-1.txt", "1\n", "First")
+	second := commitFile("todo-2.txt", "2\n", "Second")
+	third := commitFile("todo-3.txt", "3\n", "Third")
+
+	// Every bad line is reported with its number.
+	_, err := parseRebaseTodo("# comment\nfrob " + first + "\npick\npick nosuchcommit\npick " + second + "\np " + second[:7] + " again\n")
+	if err == nil {
+		t.Fatalf("Expected an invalid todo list to be rejected")
+	}
+	for _, want := range []string{"line 2: unknown command 'frob'", "line 3: missing commit", "line 4: 'nosuchcommit' is not a commit", "line 6: commit " + shortHash(second) + " is already listed on line 5"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in %v", want, err)
+		}
+	}
+	if _, err := parseRebaseTodo("drop " + first + "\nsquash " + second + "\n"); err == nil || !strings.Contains(err.Error(), "line 2: cannot 'squash'") {
+		t.Errorf("Expected a leading squash to be rejected, got %v", err)
+	}
+
+	// Removing every line aborts before anything changes.
+	setTestEditor(t, `grep -v '^pick' "$1" >"$1.new"; mv "$1.new" "$1"`)
+	if err := Rebase("main", RebaseOptions{Interactive: true}); err == nil || rebaseInProgress() {
+		t.Fatalf("Expected an empty todo list to abort the rebase, got %v", err)
+	}
+
+	// The list is edited in the editor: drop a commit, squash another.
+	setTestEditor(t, `sed -e '/ Second$/d' -e 's/^pick \(.*\) Third$/s \1 Third/' "$1" >"$1.new" && mv "$1.new" "$1"`)
+	if err := Rebase("main", RebaseOptions{Interactive: true}); err != nil {
+		t.Fatalf("Interactive rebase failed: %v", err)
+	}
+	if got := subjects("topic"); got != "First,Base" {
+		t.Fatalf("Unexpected history after the edited rebase: %s", got)
+	}
+	hash, _ := headCommit()
+	head, _ := readCommit(hash)
+	if head.Message != "First\n\nThird\n" {
+		t.Fatalf("Expected the squashed messages to be combined, got %q", head.Message)
+	}
+	if _, err := os.Stat("todo-2.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Dropped commit still in the working tree")
+	}
+
+	// A todo file reorders the steps and stops to edit a commit.
+	todoFile := filepath.Join(repoPath(), "todo-test")
+	ioutil.WriteFile(todoFile, []byte("pick "+third+" Third\nedit "+first+"\n"), 0644)
+	if err := Rebase("main", RebaseOptions{TodoFile: todoFile}); err != nil {
+		t.Fatalf("Rebase with a todo file failed: %v", err)
+	}
+	summary, _ := collectStatus()
+	if !strings.Contains(strings.Join(summary.InProgress, "\n"), "editing a commit") {
+		t.Fatalf("Expected status to show the edit stop, got %v", summary.InProgress)
+	}
+	writeTestFile(t, "todo-1.txt", "1 amended\n")
+	AddFile([]string{"todo-1.txt"})
+	if err := ResumeRebase(); err != nil {
+		t.Fatalf("Rebase --continue after edit failed: %v", err)
+	}
+	if got := subjects("topic"); got != "First,Third,Base" {
+		t.Fatalf("Unexpected history after the todo file rebase: %s", got)
+	}
+	hash, _ = resolveCommit("topic")
+	tree, _ := commitTree(hash)
+	if content, _ := readBlob(tree["todo-1.txt"]); string(content) != "1 amended\n" {
+		t.Fatalf("Edit was not amended into the commit, got %q", content)
+	}
+	if err := Rebase("main", RebaseOptions{TodoFile: filepath.Join(repoPath(), "missing")}); err == nil {
+		t.Fatalf("Expected a missing todo file to fail")
+	}
+}
+
+func TestMergeFileContentsLineLevel(t *testing.T) {
+	base := []byte("a\nb\nc\nd\ne\nf\ng\n")
+	ours := []byte("a\nB\nc\nd\ne\nf\ng\n")
+	theirs := []byte("a\nb\nc\nd\ne\nF\ng\n")
+	opts := mergeFileOptions{OursLabel: "main", BaseLabel: "base", TheirsLabel: "topic"}
+	merged, conflict := mergeFileContents(base, ours, theirs, opts)
+	if conflict || string(merged) != "a\nB\nc\nd\ne\nF\ng\n" {
+		t.Fatalf("Non-overlapping hunks should merge cleanly, got conflict=%v:\n%s", conflict, merged)
+	}
+
+	ours = []byte("a\nx\ny\nOURS\nz\ng\n")
+	theirs = []byte("a\nx\ny\nTHEIRS\nz\ng\n")
+	merged, conflict = mergeFileContents(base, ours, theirs, opts)
+	want := "a\nx\ny\n<<<<<<< main\nOURS\n=======\nTHEIRS\n>>>>>>> topic\nz\ng\n"
+	if !conflict || string(merged) != want {
+		t.Fatalf("Unexpected merge-style conflict:\n%s", merged)
+	}
+
+	opts.Style = conflictStyleDiff3
+	merged, _ = mergeFileContents(base, ours, theirs, opts)
+	want = "a\n<<<<<<< main\nx\ny\nOURS\nz\n||||||| base\nb\nc\nd\ne\nf\n=======\nx\ny\nTHEIRS\nz\n>>>>>>> topic\ng\n"
+	if string(merged) != want {
+		t.Fatalf("Unexpected diff3-style conflict:\n%s", merged)
+	}
+
+	opts.Style = conflictStyleZdiff3
+	opts.MarkerSize = 3
+	merged, _ = mergeFileContents(base, ours, theirs, opts)
+	want = "a\nx\ny\n<<< main\nOURS\n||| base\nb\nc\nd\ne\nf\n===\nTHEIRS\n>>> topic\nz\ng\n"
+	if string(merged) != want {
+		t.Fatalf("Unexpected zdiff3-style conflict:\n%s", merged)
+	}
+
+	if _, err := newMergeFileOptions("a", "b", "c"); err != nil {
+		t.Fatalf("Default merge options rejected: %v", err)
+	}
+}
+
+func TestCommonLinesMemory(t *testing.T) {
+	// A rewrite of every line is the worst case: the edit distance is the
+	// size of both inputs together.
+	var a, b []string
+	for i := 0; i < 4000; i++ {
+		a = append(a, fmt.Sprintf("old %d\n", i))
+		b = append(b, fmt.Sprintf("new %d\n", i))
+	}
+	a[2000], b[2000] = "kept\n", "kept\n"
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	pairs := commonLines(a, b)
+	runtime.ReadMemStats(&after)
+	if len(pairs) != 1 || pairs[0] != [2]int{2000, 2000} {
+		t.Fatalf("Expected only the kept line to match, got %v", pairs)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Fatalf("Diffing 4000 rewritten lines allocated %d bytes", allocated)
+	}
+}
+
+func TestMergeConflictStateAbortAndContinue(t *testing.T) {
+	setupTestRepo(t)
+	defer cleanupTestRepo(t)
+
+	writeTestFile(t, "c1.txt", "base\n")
+	AddFile([]string{"c1.txt"})
+	CommitChanges([]string{"Base"})
+	CreateBranch("feature")
+	SwitchBranch("feature")
+	writeTestFile(t, "c1.txt", "feature\n")
+	AddFile([]string{"c1.txt"})
+	CommitChanges([]string{"Feature"})
+	feature, _ := headCommit()
+	SwitchBranch("main")
+	writeTestFile(t, "c1.txt", "main\n")
+	AddFile([]string{"c1.txt"})
+	CommitChanges([]string{"Main"})
+	main, _ := headCommit()
+
+	if err := MergeBranch("feature"); err == nil {
+		t.Fatalf("Expected a conflict")
+	}
+	conflicts, _ := readIndexConflicts()
+	if stages, ok := conflicts["c1.txt"]; !ok || stages.Base() == "" || stages.Ours() == "" || stages.Theirs() == "" {
+		t.Fatalf("Expected base/ours/theirs stages for c1.txt, got %v", conflicts)
+	}
+	if readIndexEntry(t, "c1.txt") != "" {
+		t.Fatalf("A conflicted path must not have a normal index entry")
+	}
+	if heads, ok := mergeHeads(); !ok || heads[0] != feature {
+		t.Fatalf("MERGE_HEAD not recorded")
+	}
+	summary, _ := collectStatus()
+	if len(summary.Unmerged) != 1 || !strings.Contains(summary.Unmerged[0], "both modified") || len(summary.Staged) != 0 {
+		t.Fatalf("Unexpected status for a conflicted merge: %+v", summary)
+	}
+	if err := MergeContinue(); err == nil || !strings.Contains(err.Error(), "unmerged") {
+		t.Fatalf("Expected --continue to refuse unresolved conflicts, got %v", err)
+	}
+	if err := CommitChanges([]string{"Too early"}); err == nil {
+		t.Fatalf("Expected commit to refuse unresolved conflicts")
+	}
+
+	if err := MergeAbort(); err != nil {
+		t.Fatalf("merge --abort failed: %v", err)
+	}
+	if readTestFile(t, "c1.txt") != "main\n" {
+		t.Fatalf("merge --abort did not restore c1.txt")
+	}
+	if _, ok := mergeHeads(); ok {
+		t.Fatalf("MERGE_HEAD left behind by --abort")
+	}
+	if conflicts, _ := readIndexConflicts(); len(conflicts) != 0 {
+		t.Fatalf("Conflict stages left behind by --abort")
+	}
+
+	MergeBranch("feature")
+	writeTestFile(t, "c1.txt", "resolved\n")
+	AddFile([]string{"c1.txt"})
+	if summary, _ := collectStatus(); len(summary.Unmerged) != 0 || len(summary.InProgress) == 0 || !strings.Contains(summary.InProgress[0], "still merging") {
+		t.Fatalf("Unexpected status after resolving: %+v", summary)
+	}
+	if err := MergeContinue(); err != nil {
+		t.Fatalf("merge --continue failed: %v", err)
+	}
+	merged, _ := headCommit()
+	commit, _ := readCommit(merged)
+	if len(commit.Parents) != 2 || commit.Parents[0] != main || commit.Parents[1] != feature {
+		t.Fatalf("Concluded merge has parents %v", commit.Parents)
+	}
+	if commit.Subject() != "Merge branch 'feature' into 'main'" || strings.Contains(commit.Message, "Conflicts") {
+		t.Fatalf("Unexpected merge message %q", commit.Message)
+	}
+	if _, ok := mergeHeads(); ok {
+		t.Fatalf("MERGE_HEAD left behind by --continue")
+	}
+
+	// A change staged to a path the merge does not touch is carried by a
+	// fast-forward, and refused by a real merge, whose commit would take it.
+	SwitchBranch("feature")
+	writeTestFile(t, "c2.txt", "feature\n")
+	AddFile([]string{"c2.txt"})
+	CommitChanges([]string{"Feature two"})
+	SwitchBranch("main")
+	CreateBranch("ahead")
+	SwitchBranch("ahead")
+	writeTestFile(t, "c3.txt", "ahead\n")
+	AddFile([]string{"c3.txt"})
+	CommitChanges([]string{"Ahead"})
+	SwitchBranch("main")
+	writeTestFile(t, "u.txt", "staged\n")
+	AddFile([]string{"u.txt"})
+	staged := readIndexEntry(t, "u.txt")
+	if err := MergeBranch("feature"); err == nil || !strings.Contains(err.Error(), "uncommitted changes") {
+		t.Fatalf("Expected the merge to refuse a dirty index, got %v", err)
+	}
+	if head, _ := headCommit(); head != merged || readIndexEntry(t, "u.txt") != staged {
+		t.Fatalf("A refused merge must leave HEAD and the index alone")
+	}
+	if err := MergeBranch("ahead"); err != nil {
+		t.Fatalf("Fast-forward with a staged change failed: %v", err)
+	}
+	if readIndexEntry(t, "u.txt") != staged || readIndexEntry(t, "c3.txt") == "" {
+		t.Fatalf("The fast-forward did not keep the staged change")
+	}
+}
@@ -3,29 +3,18 @@ package core
 import (
 	"fmt"
 	"gitserver/internal/utils"
-	"io/ioutil"
-	"path/filepath"
 	"strings"
 )
 
 func Diff() {
-	headContent, err := ioutil.ReadFile(".mygitserver/HEAD")
+	commitHash, err := headCommit()
 	if err != nil {
-		fmt.Println("Error reading HEAD:", err)
+		fmt.Println("Error reading commit hash:", err)
 		return
 	}
-
-	headRef := strings.TrimSpace(string(headContent))
-	var currentBranch string
-	if strings.HasPrefix(headRef, "ref: ") {
-		currentBranch = strings.TrimPrefix(headRef, "ref: refs/heads/")
-	} else {
-		currentBranch = "detached"
-	}
-
-	commitHash, err := ioutil.ReadFile(filepath.Join(".mygitserver", "refs", "heads", currentBranch))
+	committedFiles, err := commitTree(commitHash)
 	if err != nil {
-		fmt.Println("Error reading commit hash:", err)
+		fmt.Println("Error reading commit tree:", err)
 		return
 	}
 
@@ -39,6 +28,7 @@ func Diff() {
 
 	var unstagedChanges []string
 	for _, file := range workingFiles {
+		file = normalizePath(file)
 		currentHash, err := utils.GenerateFileHash(file)
 		if err != nil {
 			fmt.Println("Error generating file hash for", file, ":", err)
@@ -53,10 +43,8 @@ func Diff() {
 	}
 
 	var stagedChanges []string
-	for file, stagedHash := range stagedFiles {
-		committedFilePath := filepath.Join(".mygitserver", "objects", strings.TrimSpace(string(commitHash)))
-		committedHash, err := utils.GenerateFileHash(committedFilePath)
-		if err != nil || stagedHash != committedHash {
+	for _, file := range unionKeys(stagedFiles, committedFiles) {
+		if stagedFiles[file] != committedFiles[file] {
 			stagedChanges = append(stagedChanges, file)
 		}
 	}
@@ -79,3 +67,80 @@ func Diff() {
 		fmt.Println("No differences found.")
 	}
 }
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// unifiedDiff formats the changes turning a into b as a unified diff, or
+// returns "" when they are the same.
+func unifiedDiff(a, b []string, fromName, toName string) string {
+	type diffLine struct {
+		kind         byte // ' ', '-' or '+'
+		text         string
+		aLine, bLine int // lines of a and b before this one
+	}
+	var lines []diffLine
+	i, j := 0, 0
+	for _, pair := range append(commonLines(a, b), [2]int{len(a), len(b)}) {
+		for ; i < pair[0]; i++ {
+			lines = append(lines, diffLine{'-', a[i], i, j})
+		}
+		for ; j < pair[1]; j++ {
+			lines = append(lines, diffLine{'+', b[j], i, j})
+		}
+		if i < len(a) && j < len(b) {
+			lines = append(lines, diffLine{' ', a[i], i, j})
+			i, j = i+1, j+1
+		}
+	}
+
+	var out strings.Builder
+	for start := 0; start < len(lines); {
+		for start < len(lines) && lines[start].kind == ' ' {
+			start++
+		}
+		if start == len(lines) {
+			break
+		}
+		// A hunk runs until the changes are more than twice the context
+		// apart.
+		end := start
+		for k := start; k < len(lines) && k-end <= 2*diffContext; k++ {
+			if lines[k].kind != ' ' {
+				end = k
+			}
+		}
+		first, last := max(0, start-diffContext), min(len(lines), end+diffContext+1)
+		hunk := lines[first:last]
+
+		aLen, bLen := 0, 0
+		for _, line := range hunk {
+			if line.kind != '+' {
+				aLen++
+			}
+			if line.kind != '-' {
+				bLen++
+			}
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		aStart, bStart := hunk[0].aLine, hunk[0].bLine
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, line := range hunk {
+			out.WriteByte(line.kind)
+			out.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = last
+	}
+	return out.String()
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func editorCommand() string {
+	if editor, ok := getConfig("core.editor"); ok && editor != "" {
+		return editor
+	}
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if editor := os.Getenv(env); editor != "" {
+			return editor
+		}
+	}
+	return "vi"
+}
+
+// launchEditor opens path in the user's editor and waits for it to exit. The
+// editor string goes through the shell so that values like "code --wait"
+// work as expected.
+func launchEditor(path string) error {
+	editor := editorCommand()
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("there was a problem with the editor '%s': %v", editor, err)
+	}
+	return nil
+}
+
+// editBuffer writes content to .mygitserver/<name>, lets the user edit it and
+// returns the result.
+func editBuffer(name, content string) (string, error) {
+	path := repoPath(name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		return "", err
+	}
+	if err := launchEditor(path); err != nil {
+		return "", err
+	}
+	edited, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(edited), nil
+}
+
+// cleanupMessage strips trailing whitespace from every line, collapses runs
+// of blank lines and drops leading and trailing blank lines. Lines starting
+// with '#' are removed as well when stripComments is set.
+func cleanupMessage(message string, stripComments bool) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(message, "\n") {
+		if stripComments && strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,199 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultPruneExpire keeps unreachable objects younger than two weeks, so
+// an object written by a command that is still running is never pruned.
+const defaultPruneExpire = "2.weeks.ago"
+
+// operationStateFiles hold commit hashes of operations in progress; the
+// objects they name must survive a gc.
+var operationStateFiles = []string{"ORIG_HEAD", "MERGE_HEAD", "CHERRY_PICK_HEAD", "REVERT_HEAD", "rebase", "sequencer"}
+
+// GCOptions controls GC. Prune overrides gc.pruneExpire as the age after
+// which unreachable objects are deleted ("now" deletes them all, "never"
+// keeps them).
+type GCOptions struct {
+	Prune string
+}
+
+// GC expires old reflog entries and deletes objects that are no longer
+// reachable from any ref, HEAD, reflog entry, the index or an operation in
+// progress.
+func GC(opts GCOptions) error {
+	if err := ReflogExpire(nil, ReflogExpireOptions{All: true}); err != nil {
+		return err
+	}
+
+	prune := opts.Prune
+	if prune == "" {
+		prune = configOrDefault("gc.pruneExpire", defaultPruneExpire)
+	}
+	cutoff, err := parseExpiry(prune)
+	if err != nil {
+		return err
+	}
+
+	reachable, err := reachableObjects()
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(repoPath("objects"))
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, file := range files {
+		if file.IsDir() || reachable[file.Name()] || !file.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(repoPath("objects", file.Name())); err != nil {
+			return err
+		}
+		removed++
+	}
+	fmt.Printf("Removed %d unreachable objects, kept %d\n", removed, len(files)-removed)
+	return nil
+}
+
+// gcRoots lists the objects GC starts marking from.
+func gcRoots() ([]string, error) {
+	var roots []string
+	refs, err := listRefs("refs/")
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range refs {
+		roots = append(roots, hash)
+	}
+	worktrees, err := listWorktrees()
+	if err != nil {
+		return nil, err
+	}
+	for _, wt := range worktrees {
+		roots = append(roots, wt.headCommit())
+	}
+
+	logs, err := listReflogs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range logs {
+		entries, err := readReflog(ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			roots = append(roots, entry.Old, entry.New)
+		}
+	}
+
+	// Every worktree has its own index, HEAD log and operations in progress.
+	for _, wt := range worktrees {
+		if wt.Prunable != "" {
+			continue
+		}
+		index, err := readIndexFile(filepath.Join(wt.GitDir, "index"))
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range index {
+			roots = append(roots, hash)
+		}
+		if wt.GitDir != currentWorktreeGitDir() {
+			entries, err := readReflogFile(filepath.Join(wt.GitDir, "logs", "HEAD"), "HEAD")
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				roots = append(roots, entry.Old, entry.New)
+			}
+		}
+		for _, name := range operationStateFiles {
+			hashes, err := hashesInStateFile(filepath.Join(wt.GitDir, name))
+			if err != nil {
+				return nil, err
+			}
+			roots = append(roots, hashes...)
+		}
+	}
+	return roots, nil
+}
+
+// hashesInStateFile returns every full object hash mentioned in path, or in
+// the files below it when path is a directory.
+func hashesInStateFile(path string) ([]string, error) {
+	var hashes []string
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		for _, field := range strings.Fields(string(content)) {
+			if isFullHash(field) {
+				hashes = append(hashes, field)
+			}
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// reachableObjects marks every object reachable from the gc roots: commits
+// lead to their tree and parents, trees to their entries and tags to the
+// tagged object.
+func reachableObjects() (map[string]bool, error) {
+	queue, err := gcRoots()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		hash := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if hash == "" || hash == zeroHash || seen[hash] {
+			continue
+		}
+		if _, err := readObject(hash); err != nil {
+			continue
+		}
+		seen[hash] = true
+
+		switch objectType(hash) {
+		case "commit":
+			commit, err := readCommit(hash)
+			if err != nil {
+				return nil, err
+			}
+			queue = append(queue, commit.Tree)
+			queue = append(queue, commit.Parents...)
+		case "tree":
+			tree, err := readTree(hash)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range tree {
+				queue = append(queue, entry)
+			}
+		case "tag":
+			tag, err := readTag(hash)
+			if err != nil {
+				return nil, err
+			}
+			queue = append(queue, tag.Object)
+		}
+	}
+	return seen, nil
+}
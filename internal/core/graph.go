@@ -0,0 +1,101 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ancestors returns every commit reachable from hash, including hash itself.
+func ancestors(hash string) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	queue := []string{hash}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if current == "" || seen[current] {
+			continue
+		}
+		seen[current] = true
+		commit, err := readCommit(current)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, commit.Parents...)
+	}
+	return seen, nil
+}
+
+// isAncestor reports whether ancestor is reachable from descendant.
+func isAncestor(ancestor, descendant string) (bool, error) {
+	reachable, err := ancestors(descendant)
+	if err != nil {
+		return false, err
+	}
+	return reachable[ancestor], nil
+}
+
+// mergeBase returns a best common ancestor of a and b. When criss-cross
+// merges leave several, it picks one of them.
+func mergeBase(a, b string) (string, error) {
+	bases, err := mergeBases(a, b)
+	if err != nil {
+		return "", err
+	}
+	if len(bases) == 0 {
+		return "", fmt.Errorf("no common commit found between '%s' and '%s'", shortHash(a), shortHash(b))
+	}
+	return bases[0], nil
+}
+
+// mergeBases returns every best common ancestor of a and b: the commits
+// reachable from both that are not ancestors of another such commit.
+// Criss-cross histories have more than one.
+func mergeBases(a, b string) ([]string, error) {
+	fromA, err := ancestors(a)
+	if err != nil {
+		return nil, err
+	}
+	fromB, err := ancestors(b)
+	if err != nil {
+		return nil, err
+	}
+	common := make(map[string]bool)
+	for hash := range fromA {
+		if fromB[hash] {
+			common[hash] = true
+		}
+	}
+
+	// Everything reachable from a common commit's parents is redundant. A
+	// walk can stop at a commit already marked, whose history has been
+	// marked by the walk that reached it.
+	redundant := make(map[string]bool)
+	for hash := range common {
+		commit, err := readCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		queue := append([]string(nil), commit.Parents...)
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			if current == "" || redundant[current] {
+				continue
+			}
+			redundant[current] = true
+			parent, err := readCommit(current)
+			if err != nil {
+				return nil, err
+			}
+			queue = append(queue, parent.Parents...)
+		}
+	}
+	var bases []string
+	for hash := range common {
+		if !redundant[hash] {
+			bases = append(bases, hash)
+		}
+	}
+	sort.Strings(bases)
+	return bases, nil
+}
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"fmt"
+	"gitserver/internal/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The index (staging area) lives in .mygitserver/index and uses the same
+// "<hash> <path>" line format as tree objects, so committing it is a matter
+// of writing it out as a tree.
+//
+// A path left conflicted by a merge has no such entry. Instead the index
+// records the versions being merged as "<stage>:<hash> <path>" lines, with
+// stage 1 the merge base, 2 ours and 3 theirs; a side that does not have the
+// file has no line.
+
+// conflictStages holds the base, ours and theirs blobs of a conflicted path.
+// An empty hash means that version does not have the file.
+type conflictStages [3]string
+
+func (c conflictStages) Base() string   { return c[0] }
+func (c conflictStages) Ours() string   { return c[1] }
+func (c conflictStages) Theirs() string { return c[2] }
+
+// describe names the kind of conflict as status shows it.
+func (c conflictStages) describe() string {
+	switch {
+	case c.Ours() == "" && c.Theirs() == "":
+		return "both deleted"
+	case c.Ours() == "":
+		return "deleted by us"
+	case c.Theirs() == "":
+		return "deleted by them"
+	case c.Base() == "":
+		return "both added"
+	}
+	return "both modified"
+}
+
+func indexPath() string {
+	return repoPath("index")
+}
+
+func readIndex() (map[string]string, error) {
+	return readIndexFile(indexPath())
+}
+
+// readIndexFile parses an index file, which may belong to another worktree.
+func readIndexFile(path string) (map[string]string, error) {
+	entries, _, err := readIndexStages(path)
+	return entries, err
+}
+
+// readIndexConflicts returns the conflicted paths of the index.
+func readIndexConflicts() (map[string]conflictStages, error) {
+	_, conflicts, err := readIndexStages(indexPath())
+	return conflicts, err
+}
+
+// readIndexStages parses both the normal entries and the conflict stages of
+// an index file.
+func readIndexStages(path string) (map[string]string, map[string]conflictStages, error) {
+	entries := make(map[string]string)
+	conflicts := make(map[string]conflictStages)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return entries, conflicts, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		hash, path, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, nil, fmt.Errorf("malformed index line %q", line)
+		}
+		stage, staged, isStage := strings.Cut(hash, ":")
+		if !isStage {
+			entries[path] = hash
+			continue
+		}
+		if stage != "1" && stage != "2" && stage != "3" {
+			return nil, nil, fmt.Errorf("malformed index line %q", line)
+		}
+		stages := conflicts[path]
+		stages[stage[0]-'1'] = staged
+		conflicts[path] = stages
+	}
+	return entries, conflicts, nil
+}
+
+// writeIndex replaces the normal entries of the index. Conflicts on paths
+// that now have an entry count as resolved and are dropped; the others are
+// kept.
+func writeIndex(entries map[string]string) error {
+	conflicts, err := readIndexConflicts()
+	if err != nil {
+		return err
+	}
+	for path := range conflicts {
+		if _, resolved := entries[path]; resolved {
+			delete(conflicts, path)
+		}
+	}
+	return writeIndexStages(entries, conflicts)
+}
+
+// writeIndexStages replaces the whole index, conflicts included.
+func writeIndexStages(entries map[string]string, conflicts map[string]conflictStages) error {
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	for _, path := range paths {
+		fmt.Fprintf(&b, "%s %s\n", entries[path], path)
+	}
+	conflicted := make([]string, 0, len(conflicts))
+	for path := range conflicts {
+		conflicted = append(conflicted, path)
+	}
+	sort.Strings(conflicted)
+	for _, path := range conflicted {
+		for stage, hash := range conflicts[path] {
+			if hash != "" {
+				fmt.Fprintf(&b, "%d:%s %s\n", stage+1, hash, path)
+			}
+		}
+	}
+	return ioutil.WriteFile(indexPath(), []byte(b.String()), 0644)
+}
+
+// stageWorkingFiles adds the working copies of paths to the index, marking
+// any conflicts on them resolved.
+func stageWorkingFiles(paths []string) error {
+	index, conflicts, err := readIndexStages(indexPath())
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hash, err := writeObject(content)
+		if err != nil {
+			return err
+		}
+		index[path] = hash
+		delete(conflicts, path)
+	}
+	return writeIndexStages(index, conflicts)
+}
+
+// unmergedPaths lists the paths of conflicts, sorted.
+func unmergedPaths(conflicts map[string]conflictStages) []string {
+	paths := make([]string, 0, len(conflicts))
+	for path := range conflicts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// normalizePath turns a user-supplied path into the slash-separated,
+// repository-relative form used as index and tree keys.
+func normalizePath(path string) string {
+	return filepath.ToSlash(filepath.Clean(path))
+}
+
+// safeTreePath rejects tree paths that would escape the working directory or
+// write into the repository directory.
+func safeTreePath(path string) error {
+	if path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "/") {
+		return fmt.Errorf("refusing to check out unsafe path '%s'", path)
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == ".." || part == "." || part == "" || part == ".mygitserver" {
+			return fmt.Errorf("refusing to check out unsafe path '%s'", path)
+		}
+	}
+	return nil
+}
+
+// workingFileHash hashes a file in the working directory. ok is false when
+// the file does not exist.
+func workingFileHash(path string) (string, bool) {
+	hash, err := utils.GenerateFileHash(filepath.FromSlash(path))
+	if err != nil {
+		return "", false
+	}
+	return hash, true
+}
+
+// writeWorkingFile replaces the working copy of path with the blob hash.
+func writeWorkingFile(path, hash string) error {
+	content, err := readObject(hash)
+	if err != nil {
+		return err
+	}
+	return writeWorkingContent(path, content)
+}
+
+// writeWorkingContent replaces the working copy of path with content.
+func writeWorkingContent(path string, content []byte) error {
+	if err := safeTreePath(path); err != nil {
+		return err
+	}
+	fsPath := filepath.FromSlash(path)
+	if err := os.MkdirAll(filepath.Dir(fsPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fsPath, content, 0644)
+}
+
+// removeWorkingFile deletes path and any parent directories left empty.
+func removeWorkingFile(path string) error {
+	if err := safeTreePath(path); err != nil {
+		return err
+	}
+	fsPath := filepath.FromSlash(path)
+	if err := os.Remove(fsPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(fsPath); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// commitTree returns the path-to-blob mapping recorded in a commit. An empty
+// hash (an unborn branch) yields an empty tree.
+func commitTree(hash string) (map[string]string, error) {
+	if hash == "" {
+		return map[string]string{}, nil
+	}
+	commit, err := readCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	return readTree(commit.Tree)
+}
@@ -1,96 +1,277 @@
 package core
 
 import (
-	"bufio"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
 	"strings"
 )
 
-func Log() {
-	headContent, err := ioutil.ReadFile(filepath.Join(".mygitserver", "HEAD"))
+// LogOptions controls which commits Log prints and how. Revisions selects
+// the history to show (see resolveRevisionRange); it defaults to HEAD.
+// Commits are only shown when they carry every trailer in TrailerFilters; a
+// filter with an empty Value matches any value for that key. Format uses
+// the placeholders described at formatCommit; empty selects the default
+// layout. Notes from NotesRefs (the default notes ref when empty) are shown
+// unless NoNotes is set.
+type LogOptions struct {
+	Revisions      []string
+	TrailerFilters []Trailer
+	Format         string
+	NotesRefs      []string
+	NoNotes        bool
+}
+
+// commitNote is a note shown alongside a commit in the log.
+type commitNote struct {
+	Ref  string
+	Text string
+}
+
+func Log(opts LogOptions) error {
+	include, exclude, err := resolveRevisionRange(opts.Revisions)
 	if err != nil {
-		fmt.Println("Error reading HEAD:", err)
-		return
+		return err
 	}
 
-	currentBranch := strings.TrimSpace(strings.TrimPrefix(string(headContent), "ref: refs/heads/"))
-	branchPath := filepath.Join(".mygitserver", "refs", "heads", currentBranch)
+	if len(opts.Revisions) == 0 {
+		headRef, detached, err := readHead()
+		if err != nil {
+			return fmt.Errorf("could not read HEAD: %v", err)
+		}
+		hash, err := headCommit()
+		if err != nil {
+			return fmt.Errorf("could not resolve HEAD: %v", err)
+		}
+		if hash != "" {
+			include = []string{hash}
+		}
+		if opts.Format == "" {
+			if detached {
+				fmt.Printf("Commit history for detached HEAD at %s:\n", shortHash(headRef))
+			} else {
+				fmt.Printf("Commit history for branch '%s':\n", strings.TrimPrefix(headRef, "refs/heads/"))
+			}
+		}
+	}
 
-	commitHash, err := ioutil.ReadFile(branchPath)
+	commits, err := walkCommits(include, exclude)
 	if err != nil {
-		fmt.Printf("Error reading branch '%s': %v\n", currentBranch, err)
-		return
+		return fmt.Errorf("could not read commit history: %v", err)
 	}
-
-	fmt.Printf("Commit history for branch '%s':\n", currentBranch)
-	for len(commitHash) > 0 {
-		commitFilePath := filepath.Join(".mygitserver", "objects", strings.TrimSpace(string(commitHash)))
-		commitContent, err := ioutil.ReadFile(commitFilePath)
+	for _, hash := range commits {
+		commit, err := readCommit(hash)
 		if err != nil {
-			fmt.Printf("Error reading commit object: %v\n", err)
-			return
+			return fmt.Errorf("could not read commit object: %v", err)
+		}
+		if !matchesTrailerFilters(commit, opts.TrailerFilters) {
+			continue
+		}
+		notes := logNotes(opts, hash)
+		if opts.Format == "" {
+			printCommit(hash, commit, notes)
+		} else {
+			fmt.Println(formatCommit(opts.Format, hash, commit, notes))
 		}
+	}
+	return nil
+}
 
-		fmt.Printf("Commit: %s\n", strings.TrimSpace(string(commitHash)))
-		fmt.Println(commitContent)
+func logNotes(opts LogOptions, hash string) []commitNote {
+	if opts.NoNotes {
+		return nil
+	}
+	refs := opts.NotesRefs
+	if len(refs) == 0 {
+		refs = []string{""}
+	}
+	var notes []commitNote
+	for _, ref := range refs {
+		ref = expandNotesRef(ref)
+		if text, ok := noteFor(ref, hash); ok {
+			notes = append(notes, commitNote{Ref: ref, Text: text})
+		}
+	}
+	return notes
+}
 
-		scanner := bufio.NewScanner(strings.NewReader(string(commitContent)))
-		parentHash := ""
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.HasPrefix(line, "parent:") {
-				parentHash = strings.TrimSpace(strings.TrimPrefix(line, "parent:"))
+func matchesTrailerFilters(commit *commitObject, filters []Trailer) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	trailers := ParseTrailers(commit.Message)
+	for _, filter := range filters {
+		found := false
+		for _, trailer := range trailers {
+			if strings.EqualFold(trailer.Key, filter.Key) && (filter.Value == "" || trailer.Value == filter.Value) {
+				found = true
 				break
 			}
 		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
 
-		commitHash = []byte(parentHash)
-		if len(parentHash) == 0 {
-			break
+func printCommit(commitHash string, commit *commitObject, notes []commitNote) {
+	fmt.Printf("commit %s\n", commitHash)
+	if len(commit.Parents) > 1 {
+		fmt.Printf("Merge: %s\n", strings.Join(commit.Parents, " "))
+	}
+	fmt.Printf("Author: %s\n", commit.Author)
+	fmt.Printf("Date:   %s\n\n", commit.Timestamp)
+	for _, line := range strings.Split(strings.TrimRight(commit.Message, "\n"), "\n") {
+		fmt.Printf("    %s\n", line)
+	}
+	for _, note := range notes {
+		if note.Ref == defaultNotesRef {
+			fmt.Printf("\nNotes:\n")
+		} else {
+			fmt.Printf("\nNotes (%s):\n", strings.TrimPrefix(note.Ref, "refs/notes/"))
+		}
+		for _, line := range strings.Split(strings.TrimRight(note.Text, "\n"), "\n") {
+			fmt.Printf("    %s\n", line)
 		}
 	}
+	fmt.Println()
 }
 
-func printCommit(commitHash string) {
-	commitPath := filepath.Join(".mygitserver", "objects", commitHash)
-	file, err := os.Open(commitPath)
-	if err != nil {
-		fmt.Println("Error reading commit:", err)
-		return
+// formatCommit expands a --format string. Supported placeholders:
+//
+//	%H, %h       full and abbreviated commit hash
+//	%P           parent hashes
+//	%s, %b, %B   subject, body and raw message
+//	%an, %ae     author name and email
+//	%ad          author date
+//	%N           commit notes
+//	%n, %%       newline and a literal percent sign
+//	%(trailers[:options])
+//	             the message trailers; options are a comma-separated list of
+//	             key=<key> (repeatable), valueonly and separator=<sep>
+func formatCommit(format, hash string, commit *commitObject, notes []commitNote) string {
+	var out strings.Builder
+	authorName, authorEmail := splitIdentity(commit.Author)
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			out.WriteByte(format[i])
+			continue
+		}
+		rest := format[i+1:]
+		switch {
+		case strings.HasPrefix(rest, "an"):
+			out.WriteString(authorName)
+			i += 2
+		case strings.HasPrefix(rest, "ae"):
+			out.WriteString(authorEmail)
+			i += 2
+		case strings.HasPrefix(rest, "ad"):
+			out.WriteString(commit.Timestamp)
+			i += 2
+		case strings.HasPrefix(rest, "(trailers"):
+			end := strings.Index(rest, ")")
+			if end < 0 {
+				out.WriteByte('%')
+				continue
+			}
+			out.WriteString(formatTrailersPlaceholder(rest[len("(trailers"):end], commit))
+			i += end + 1
+		default:
+			i++
+			switch rest[0] {
+			case 'H':
+				out.WriteString(hash)
+			case 'h':
+				out.WriteString(shortHash(hash))
+			case 'P':
+				out.WriteString(strings.Join(commit.Parents, " "))
+			case 's':
+				out.WriteString(commit.Subject())
+			case 'b':
+				out.WriteString(commitBody(commit.Message))
+			case 'B':
+				out.WriteString(commit.Message)
+			case 'N':
+				for _, note := range notes {
+					out.WriteString(note.Text)
+				}
+			case 'n':
+				out.WriteByte('\n')
+			case '%':
+				out.WriteByte('%')
+			default:
+				out.WriteByte('%')
+				out.WriteByte(rest[0])
+			}
+		}
 	}
-	defer file.Close()
+	return out.String()
+}
 
-	scanner := bufio.NewScanner(file)
-	fmt.Printf("commit %s\n", commitHash)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "message:") {
-			fmt.Printf("    %s\n", strings.TrimPrefix(line, "message: "))
-		} else if strings.HasPrefix(line, "timestamp:") {
-			fmt.Printf("    Date: %s\n", strings.TrimPrefix(line, "timestamp: "))
+func formatTrailersPlaceholder(spec string, commit *commitObject) string {
+	var keys []string
+	valueOnly := false
+	separator := "\n"
+	if strings.HasPrefix(spec, ":") {
+		for _, option := range strings.Split(spec[1:], ",") {
+			switch {
+			case strings.HasPrefix(option, "key="):
+				keys = append(keys, strings.TrimPrefix(option, "key="))
+			case option == "valueonly":
+				valueOnly = true
+			case strings.HasPrefix(option, "separator="):
+				separator = strings.NewReplacer("%n", "\n").Replace(strings.TrimPrefix(option, "separator="))
+			}
 		}
 	}
-	fmt.Println()
+
+	var parts []string
+	for _, trailer := range ParseTrailers(commit.Message) {
+		if len(keys) > 0 {
+			wanted := false
+			for _, key := range keys {
+				if strings.EqualFold(key, trailer.Key) {
+					wanted = true
+				}
+			}
+			if !wanted {
+				continue
+			}
+		}
+		if valueOnly {
+			parts = append(parts, trailer.Value)
+		} else {
+			parts = append(parts, trailer.String())
+		}
+	}
+	return strings.Join(parts, separator)
+}
+
+// commitBody returns the message without its subject paragraph.
+func commitBody(message string) string {
+	_, body, found := strings.Cut(message, "\n\n")
+	if !found {
+		return ""
+	}
+	return body
+}
+
+// splitIdentity splits "Name <email>" into its two parts.
+func splitIdentity(identity string) (string, string) {
+	open := strings.LastIndex(identity, "<")
+	if open < 0 {
+		return strings.TrimSpace(identity), ""
+	}
+	return strings.TrimSpace(identity[:open]), strings.TrimSuffix(identity[open+1:], ">")
 }
 
 func getParentCommit(commitHash string) string {
-	commitPath := filepath.Join(".mygitserver", "objects", commitHash)
-	file, err := os.Open(commitPath)
+	commit, err := readCommit(commitHash)
 	if err != nil {
 		fmt.Println("Error reading commit:", err)
 		return ""
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "parent:") {
-			return strings.TrimSpace(strings.TrimPrefix(line, "parent: "))
-		}
+	if len(commit.Parents) == 0 {
+		return ""
 	}
-	return ""
+	return commit.Parents[0]
 }
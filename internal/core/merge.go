@@ -2,60 +2,637 @@ package core
 
 import (
 	"fmt"
-	"gitserver/internal/utils"
 	"io/ioutil"
-	"path/filepath"
+	"os"
 	"strings"
 )
 
-func MergeBranch(sourceBranch string) {
-	headContent, err := ioutil.ReadFile(".mygitserver/HEAD")
+// mergeConflict is a path the three-way merge could not resolve. Kind is
+// "content" when both sides edited the file, "add/add" when both added it
+// differently and "modify/delete" when one side deleted what the other
+// changed.
+type mergeConflict struct {
+	Path string
+	Kind string
+}
+
+// treeMergeResult is the outcome of merging two trees against their base.
+// Entries holds the cleanly merged paths and Stages the base, ours and
+// theirs versions of the conflicted ones. Contents holds what the working
+// copy of each conflicted path should contain, usually the file with
+// conflict markers.
+type treeMergeResult struct {
+	Entries   map[string]string
+	Stages    map[string]conflictStages
+	Contents  map[string][]byte
+	Conflicts []mergeConflict
+}
+
+// mergeTrees does a three-way merge of the flat trees ours and theirs,
+// which both descend from base. A path changed on one side only takes that
+// side's version; paths changed on both sides have their contents merged by
+// the merge driver their attributes select. Blobs for cleanly merged
+// contents are written to the object store.
+func mergeTrees(base, ours, theirs map[string]string, opts mergeFileOptions) (*treeMergeResult, error) {
+	attrs := newAttributeChecker()
+	result := &treeMergeResult{
+		Entries:  make(map[string]string),
+		Stages:   make(map[string]conflictStages),
+		Contents: make(map[string][]byte),
+	}
+	for _, path := range unionKeys(base, ours, theirs) {
+		b, o, t := base[path], ours[path], theirs[path]
+		merged := o
+		switch {
+		case o == t, b == t:
+		case b == o:
+			merged = t
+		case o == "" || t == "":
+			// One side deleted the file, the other changed it. The changed
+			// version stays in the working tree for the user to judge.
+			kept := o
+			if kept == "" {
+				kept = t
+			}
+			content, err := readBlob(kept)
+			if err != nil {
+				return nil, err
+			}
+			result.Contents[path] = content
+			result.Stages[path] = conflictStages{b, o, t}
+			result.Conflicts = append(result.Conflicts, mergeConflict{Path: path, Kind: "modify/delete"})
+			continue
+		default:
+			baseContent, err := readBlob(b)
+			if err != nil {
+				return nil, err
+			}
+			oursContent, err := readBlob(o)
+			if err != nil {
+				return nil, err
+			}
+			theirsContent, err := readBlob(t)
+			if err != nil {
+				return nil, err
+			}
+			content, conflict, err := mergeDriverFor(attrs, path).merge(path, baseContent, oursContent, theirsContent, opts)
+			if err != nil {
+				return nil, err
+			}
+			if conflict {
+				kind := "content"
+				if b == "" {
+					kind = "add/add"
+				}
+				result.Contents[path] = content
+				result.Stages[path] = conflictStages{b, o, t}
+				result.Conflicts = append(result.Conflicts, mergeConflict{Path: path, Kind: kind})
+				continue
+			}
+			if merged, err = writeObject(content); err != nil {
+				return nil, err
+			}
+		}
+		if merged != "" {
+			result.Entries[path] = merged
+		}
+	}
+	return result, nil
+}
+
+// touchedPaths lists the paths whose working copy a merge result rewrites.
+func (r *treeMergeResult) touchedPaths(ours map[string]string) []string {
+	conflicted := make(map[string]string, len(r.Stages))
+	for path := range r.Stages {
+		conflicted[path] = path
+	}
+	var paths []string
+	for _, path := range unionKeys(ours, r.Entries, conflicted) {
+		if _, isConflict := r.Stages[path]; isConflict || ours[path] != r.Entries[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// checkMergeOverwrites refuses a merge that would overwrite staged or
+// unstaged changes, or untracked files, in the paths it has to rewrite.
+func checkMergeOverwrites(ours map[string]string, result *treeMergeResult) error {
+	index, err := readIndex()
+	if err != nil {
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	var dirty, untracked []string
+	for _, path := range result.touchedPaths(ours) {
+		indexHash, inIndex := index[path]
+		workHash, exists := workingFileHash(path)
+		switch {
+		case !inIndex && ours[path] == "" && exists:
+			untracked = append(untracked, path)
+		case indexHash != ours[path] || (inIndex && (!exists || workHash != indexHash)):
+			dirty = append(dirty, path)
+		}
+	}
+	if len(dirty) > 0 {
+		fmt.Println("Your local changes to the following files would be overwritten by merge:")
+		for _, path := range dirty {
+			fmt.Printf("\t%s\n", path)
+		}
+		return fmt.Errorf("please commit your changes or stash them before you merge")
+	}
+	if len(untracked) > 0 {
+		fmt.Println("The following untracked working tree files would be overwritten by merge:")
+		for _, path := range untracked {
+			fmt.Printf("\t%s\n", path)
+		}
+		return fmt.Errorf("please move or remove them before you merge")
+	}
+	return nil
+}
+
+// applyMergeResult writes the merged files into the working tree and the
+// merged entries and conflict stages into the index. Only the paths the
+// merge rewrites change in the index; changes staged to other paths stay.
+func applyMergeResult(ours map[string]string, result *treeMergeResult) error {
+	index, conflicts, err := readIndexStages(indexPath())
 	if err != nil {
-		fmt.Println("Error reading HEAD:", err)
-		return
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	for _, path := range result.touchedPaths(ours) {
+		delete(conflicts, path)
+		if hash := result.Entries[path]; hash == "" {
+			delete(index, path)
+		} else {
+			index[path] = hash
+		}
+		if content, conflicted := result.Contents[path]; conflicted {
+			if err := writeWorkingContent(path, content); err != nil {
+				return err
+			}
+			continue
+		}
+		if hash := result.Entries[path]; hash == "" {
+			if err := removeWorkingFile(path); err != nil {
+				return err
+			}
+		} else if err := writeWorkingFile(path, hash); err != nil {
+			return err
+		}
+	}
+	for path, stages := range result.Stages {
+		conflicts[path] = stages
+	}
+	if err := writeIndexStages(index, conflicts); err != nil {
+		return fmt.Errorf("could not write index: %v", err)
 	}
+	return nil
+}
+
+// MergeOptions controls Merge. FastForward is "ff" to fast-forward when
+// the current branch is an ancestor of the source, "no-ff" to always create
+// a merge commit and "only" to refuse anything but a fast-forward; when
+// empty, merge.ff decides ("false" and "only" select the latter two). Squash
+// stages the merged changes without committing them or recording the merge.
+// Strategy names the merge strategy (see mergeStrategies) and
+// StrategyOptions holds its -X options.
+type MergeOptions struct {
+	FastForward     string
+	Squash          bool
+	Strategy        string
+	StrategyOptions []string
+}
 
-	headRef := strings.TrimSpace(string(headContent))
-	if !strings.HasPrefix(headRef, "ref: ") {
-		fmt.Println("HEAD is not pointing to a branch")
-		return
+// MergeBranch merges sourceBranch into the current branch with the default
+// options.
+func MergeBranch(sourceBranch string) error {
+	return Merge([]string{sourceBranch}, MergeOptions{})
+}
+
+// fastForwardMode resolves the fast-forward policy of opts.
+func fastForwardMode(opts MergeOptions) (string, error) {
+	mode := opts.FastForward
+	if mode == "" {
+		mode = "ff"
+		switch value, _ := getConfig("merge.ff"); strings.ToLower(value) {
+		case "false", "no":
+			mode = "no-ff"
+		case "only":
+			mode = "only"
+		}
+	}
+	switch mode {
+	case "ff", "no-ff", "only":
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid fast-forward mode '%s'", mode)
+}
+
+// describeMergeSources names the merged branches the way merge commit
+// messages do: "branch 'a'" or "branches 'a', 'b' and 'c'".
+func describeMergeSources(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = "'" + name + "'"
+	}
+	if len(quoted) == 1 {
+		return "branch " + quoted[0]
 	}
-	currentBranch := strings.TrimPrefix(headRef, "ref: refs/heads/")
+	return "branches " + strings.Join(quoted[:len(quoted)-1], ", ") + " and " + quoted[len(quoted)-1]
+}
 
-	sourceBranchRef := filepath.Join(".mygitserver", "refs", "heads", sourceBranch)
-	sourceCommitHash, err := ioutil.ReadFile(sourceBranchRef)
+// Merge merges the sources into the current branch. When a single source
+// descends from HEAD the branch is fast-forwarded; otherwise the merge
+// strategy combines the trees. A clean result is recorded as a merge
+// commit with HEAD and every source as parents, while conflicts are left
+// in the working tree and listed.
+func Merge(sources []string, opts MergeOptions) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("no branch to merge")
+	}
+	mode, err := fastForwardMode(opts)
 	if err != nil {
-		fmt.Printf("Error reading commit for branch %s: %v\n", sourceBranch, err)
-		return
+		return err
+	}
+	if opts.Squash && opts.FastForward == "no-ff" {
+		return fmt.Errorf("you cannot combine --squash with --no-ff")
+	}
+	favor, err := parseStrategyOptions(opts.StrategyOptions)
+	if err != nil {
+		return err
+	}
+	if opts.Strategy != "" {
+		if _, err := lookupMergeStrategy(opts.Strategy); err != nil {
+			return err
+		}
 	}
 
-	currentBranchRef := filepath.Join(".mygitserver", "refs", "heads", currentBranch)
-	currentCommitHash, err := ioutil.ReadFile(currentBranchRef)
+	if err := checkNoMergeInProgress(); err != nil {
+		return err
+	}
+
+	headRef, detached, err := readHead()
 	if err != nil {
-		fmt.Printf("Error reading commit for branch %s: %v\n", currentBranch, err)
-		return
+		return fmt.Errorf("could not read HEAD: %v", err)
+	}
+	currentBranch := strings.TrimPrefix(headRef, "refs/heads/")
+	if detached {
+		currentBranch = "HEAD"
+	}
+
+	currentCommitHash, err := headCommit()
+	if err != nil {
+		return fmt.Errorf("could not read commit for %s: %v", currentBranch, err)
+	}
+	var remotes, names []string
+	for _, source := range sources {
+		hash, err := resolveCommit(source)
+		if err != nil {
+			return fmt.Errorf("could not read commit for branch %s: %v", source, err)
+		}
+		remotes, names = append(remotes, hash), append(names, source)
+	}
+	if currentCommitHash == "" {
+		// Nothing to merge with on an unborn branch: take the source as is.
+		if len(remotes) > 1 {
+			return fmt.Errorf("can merge only exactly one commit into empty head")
+		}
+		return fastForward(currentCommitHash, remotes[0], names[0])
+	}
+
+	// Sources HEAD already contains have nothing to add. Ancestry is checked
+	// directly: the first shared commit found walking back from a source
+	// that merged an older branch need not be the one HEAD points at.
+	var pending, pendingNames []string
+	for i, remote := range remotes {
+		if _, err := mergeBase(currentCommitHash, remote); err != nil {
+			return fmt.Errorf("refusing to merge unrelated histories")
+		}
+		merged, err := isAncestor(remote, currentCommitHash)
+		if err != nil {
+			return err
+		}
+		if merged {
+			if len(remotes) > 1 {
+				fmt.Printf("Already up to date with %s\n", names[i])
+			}
+			continue
+		}
+		pending, pendingNames = append(pending, remote), append(pendingNames, names[i])
+	}
+	remotes, names = pending, pendingNames
+
+	canFastForward := false
+	if len(remotes) == 1 {
+		if canFastForward, err = isAncestor(currentCommitHash, remotes[0]); err != nil {
+			return err
+		}
+	}
+	switch {
+	case len(remotes) == 0:
+		fmt.Println("Already up to date.")
+		return nil
+	case canFastForward && mode != "no-ff" && !opts.Squash:
+		return fastForward(currentCommitHash, remotes[0], names[0])
+	case mode == "only":
+		return fmt.Errorf("not possible to fast-forward, aborting")
+	}
+
+	strategyName := opts.Strategy
+	if strategyName == "" {
+		strategyName = defaultMergeStrategy(len(remotes))
+	}
+	strategy, err := lookupMergeStrategy(strategyName)
+	if err != nil {
+		return err
+	}
+	fileOpts, err := newMergeFileOptions(currentBranch, "", "")
+	if err != nil {
+		return err
+	}
+	fileOpts.Favor = favor
+	oursTree, err := commitTree(currentCommitHash)
+	if err != nil {
+		return err
+	}
+	// The merge commit is written from the index, so staged changes would
+	// be swept into it.
+	index, err := readIndex()
+	if err != nil {
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	for _, path := range unionKeys(index, oursTree) {
+		if index[path] != oursTree[path] {
+			return fmt.Errorf("your index contains uncommitted changes; commit or stash them before you merge")
+		}
+	}
+	result, err := strategy.merge(mergeInput{
+		Head:        currentCommitHash,
+		HeadName:    currentBranch,
+		Remotes:     remotes,
+		RemoteNames: names,
+		FileOpts:    fileOpts,
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkMergeOverwrites(oursTree, result); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(repoPath("ORIG_HEAD"), []byte(currentCommitHash+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := applyMergeResult(oursTree, result); err != nil {
+		return err
+	}
+	if opts.Squash {
+		if err := writeSquashMessage(currentCommitHash, remotes); err != nil {
+			return err
+		}
+	}
+	mergeCommitMessage := fmt.Sprintf("Merge %s into '%s'", describeMergeSources(names), currentBranch)
+	if len(result.Conflicts) > 0 {
+		if !opts.Squash {
+			if err := writeMergeState(remotes, mergeCommitMessage, mode, result); err != nil {
+				return err
+			}
+		}
+		for _, conflict := range result.Conflicts {
+			fmt.Printf("CONFLICT (%s): Merge conflict in %s\n", conflict.Kind, conflict.Path)
+		}
+		if err := rerereConflicts(result); err != nil {
+			return err
+		}
+		return fmt.Errorf("automatic merge failed; fix conflicts and then commit the result")
+	}
+	if opts.Squash {
+		fmt.Println("Squash commit -- not updating HEAD")
+		fmt.Println("Automatic merge went well; stopped before committing as requested")
+		return nil
 	}
 
-	mergeCommitMessage := fmt.Sprintf("Merge branch '%s' into '%s'", sourceBranch, currentBranch)
-	newCommitHash := createMergeCommit(string(currentCommitHash), string(sourceCommitHash), mergeCommitMessage)
+	newCommitHash := createMergeCommit(append([]string{currentCommitHash}, remotes...), mergeCommitMessage)
+	if newCommitHash == "" {
+		return fmt.Errorf("could not create the merge commit")
+	}
+
+	reason := fmt.Sprintf("merge %s: Merge made by the '%s' strategy.", strings.Join(names, " "), strategyName)
+	if err := updateHeadFrom(currentCommitHash, newCommitHash, reason); err != nil {
+		return fmt.Errorf("could not update current branch: %v", err)
+	}
+
+	fmt.Printf("Successfully merged %s into '%s'. New commit: %s\n", describeMergeSources(names), currentBranch, newCommitHash)
+	return nil
+}
 
-	err = ioutil.WriteFile(currentBranchRef, []byte(newCommitHash), 0644)
+// fastForward moves the current branch from ours to theirs, a descendant
+// of it, updating the working tree and index on the way.
+func fastForward(ours, theirs, sourceBranch string) error {
+	oursTree, err := commitTree(ours)
 	if err != nil {
-		fmt.Println("Error updating current branch:", err)
-		return
+		return err
+	}
+	theirsTree, err := commitTree(theirs)
+	if err != nil {
+		return err
+	}
+	result, err := mergeTrees(oursTree, oursTree, theirsTree, mergeFileOptions{})
+	if err != nil {
+		return err
+	}
+	if err := checkMergeOverwrites(oursTree, result); err != nil {
+		return err
+	}
+	if ours != "" {
+		if err := ioutil.WriteFile(repoPath("ORIG_HEAD"), []byte(ours+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Updating %s..%s\n", shortHash(ours), shortHash(theirs))
+	}
+	if err := applyMergeResult(oursTree, result); err != nil {
+		return err
+	}
+	if err := updateHeadFrom(ours, theirs, fmt.Sprintf("merge %s: Fast-forward", sourceBranch)); err != nil {
+		return fmt.Errorf("could not update current branch: %v", err)
 	}
+	fmt.Println("Fast-forward")
+	return nil
+}
 
-	fmt.Printf("Successfully merged branch '%s' into '%s'. New commit: %s\n", sourceBranch, currentBranch, newCommitHash)
+// writeSquashMessage prepares SQUASH_MSG, which the next commit offers as
+// its message, listing the commits a squash merge brought in.
+func writeSquashMessage(ours string, theirs []string) error {
+	commits, err := walkCommits(theirs, []string{ours})
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("Squashed commit of the following:\n")
+	for _, hash := range commits {
+		commit, err := readCommit(hash)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "\ncommit %s\n", hash)
+		fmt.Fprintf(&b, "Author: %s\n", commit.Author)
+		fmt.Fprintf(&b, "Date:   %s\n\n", commit.Timestamp)
+		for _, line := range strings.Split(strings.TrimRight(commit.Message, "\n"), "\n") {
+			fmt.Fprintf(&b, "    %s\n", line)
+		}
+	}
+	return ioutil.WriteFile(repoPath("SQUASH_MSG"), []byte(b.String()), 0644)
 }
 
-func createMergeCommit(parent1, parent2, message string) string {
-	commitContent := fmt.Sprintf("Parent 1: %s\nParent 2: %s\nMessage: %s", parent1, parent2, message)
-	newCommitHash := utils.GenerateHash(commitContent)
+func createMergeCommit(parents []string, message string) string {
+	index, err := readIndex()
+	if err != nil {
+		fmt.Println("Error reading index:", err)
+		return ""
+	}
+	tree, err := writeTree(index)
+	if err != nil {
+		fmt.Println("Error writing merge tree:", err)
+		return ""
+	}
 
-	err := ioutil.WriteFile(filepath.Join(".mygitserver", "objects", newCommitHash), []byte(commitContent), 0644)
+	commit := &commitObject{
+		Tree:    tree,
+		Parents: parents,
+		Message: message + "\n",
+	}
+	newCommitHash, err := writeCommit(commit)
 	if err != nil {
 		fmt.Println("Error writing new merge commit:", err)
 	}
 
 	return newCommitHash
 }
+
+// A merge stopped by conflicts is recorded in MERGE_HEAD (the commits being
+// merged), MERGE_MSG (the prepared commit message) and MERGE_MODE (the
+// fast-forward mode), so that the next commit concludes it.
+var mergeStateFiles = []string{"MERGE_HEAD", "MERGE_MSG", "MERGE_MODE"}
+
+// mergeHeads returns the commits recorded in MERGE_HEAD, if a merge is in
+// progress.
+func mergeHeads() ([]string, bool) {
+	content, err := ioutil.ReadFile(repoPath("MERGE_HEAD"))
+	if err != nil {
+		return nil, false
+	}
+	return strings.Fields(string(content)), true
+}
+
+func writeMergeState(theirs []string, message, mode string, result *treeMergeResult) error {
+	var b strings.Builder
+	b.WriteString(message + "\n\n# Conflicts:\n")
+	for _, conflict := range result.Conflicts {
+		fmt.Fprintf(&b, "#\t%s\n", conflict.Path)
+	}
+	files := map[string]string{
+		"MERGE_HEAD": strings.Join(theirs, "\n") + "\n",
+		"MERGE_MSG":  b.String(),
+		"MERGE_MODE": mode + "\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(repoPath(name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func clearMergeState() {
+	for _, name := range mergeStateFiles {
+		os.Remove(repoPath(name))
+	}
+	os.Remove(repoPath("MERGE_RR"))
+}
+
+// checkNoMergeInProgress refuses to start an operation while a merge is
+// unfinished or the index has unresolved conflicts.
+func checkNoMergeInProgress() error {
+	if _, ok := mergeHeads(); ok {
+		return fmt.Errorf("you have not concluded your merge (MERGE_HEAD exists); please commit your changes or abort the merge")
+	}
+	return checkNoUnmergedPaths("merging")
+}
+
+// checkNoUnmergedPaths fails with the list of conflicted paths, if any, as
+// the reason action is not possible.
+func checkNoUnmergedPaths(action string) error {
+	conflicts, err := readIndexConflicts()
+	if err != nil {
+		return err
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	fmt.Println("Unmerged paths:")
+	for _, path := range unmergedPaths(conflicts) {
+		fmt.Printf("\t%s\n", path)
+	}
+	return fmt.Errorf("%s is not possible because you have unmerged files; fix them up in the work tree, then use 'mygitserver add <file>' as appropriate to mark resolution", action)
+}
+
+// MergeAbort gives up a merge stopped by conflicts, restoring the index and
+// the files the merge touched to HEAD.
+func MergeAbort() error {
+	if _, ok := mergeHeads(); !ok {
+		return fmt.Errorf("there is no merge to abort (MERGE_HEAD missing)")
+	}
+	head, err := headCommit()
+	if err != nil {
+		return err
+	}
+	headTree, err := commitTree(head)
+	if err != nil {
+		return err
+	}
+	index, conflicts, err := readIndexStages(indexPath())
+	if err != nil {
+		return err
+	}
+
+	// The merge refused to touch files with local changes, so every path
+	// where the index differs from HEAD was written by it.
+	conflicted := make(map[string]string, len(conflicts))
+	for path := range conflicts {
+		conflicted[path] = path
+	}
+	for _, path := range unionKeys(headTree, index, conflicted) {
+		if _, conflicted := conflicts[path]; !conflicted && index[path] == headTree[path] {
+			continue
+		}
+		if headTree[path] == "" {
+			if err := removeWorkingFile(path); err != nil {
+				return err
+			}
+		} else if err := writeWorkingFile(path, headTree[path]); err != nil {
+			return err
+		}
+	}
+	if err := writeIndexStages(headTree, nil); err != nil {
+		return fmt.Errorf("could not write index: %v", err)
+	}
+	rerereClear()
+	clearMergeState()
+	fmt.Printf("Merge aborted; HEAD is at %s\n", shortHash(head))
+	return nil
+}
+
+// MergeContinue concludes a merge whose conflicts have been resolved by
+// committing it with the prepared message.
+func MergeContinue() error {
+	if _, ok := mergeHeads(); !ok {
+		return fmt.Errorf("there is no merge in progress (MERGE_HEAD missing)")
+	}
+	if err := checkNoUnmergedPaths("committing"); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(repoPath("MERGE_MSG"))
+	if err != nil {
+		return fmt.Errorf("could not read MERGE_MSG: %v", err)
+	}
+	return Commit(CommitOptions{Messages: []string{cleanupMessage(string(content), true)}})
+}
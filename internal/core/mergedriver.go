@@ -0,0 +1,425 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Files changed on both sides of a merge are combined by the merge driver
+// their merge attribute names:
+//
+//	*.json   merge=json
+//	go.mod   merge=gomod
+//	go.sum   merge=union
+//
+// "text", the default unless merge.default says otherwise, merges line by
+// line; "binary" (also "-merge") keeps our version and reports a conflict;
+// "union" keeps the lines of both sides where they conflict. "json" and
+// "yaml" merge objects key by key and "gomod" merges require directives by
+// module path; what they cannot reconcile is merged line by line instead.
+//
+// Any other name runs the command configured as merge.<name>.driver, with
+// %O, %A and %B replaced by files holding the base, our and their version,
+// %L by the conflict marker size and %P by the path. The command leaves the
+// result in %A and exits non-zero when conflicts remain. A driver command
+// can also replace the json, yaml and gomod drivers.
+
+// mergeDriver merges three versions of the file at path. Drivers are
+// registered in mergeDrivers under the name the merge attribute selects
+// them by.
+type mergeDriver interface {
+	merge(path string, base, ours, theirs []byte, opts mergeFileOptions) (merged []byte, conflict bool, err error)
+}
+
+var mergeDrivers = map[string]mergeDriver{
+	"text":   textDriver{},
+	"binary": binaryDriver{},
+	"union":  unionDriver{},
+	"json":   jsonDriver{},
+	"yaml":   yamlDriver{},
+	"gomod":  goModDriver{},
+}
+
+// mergeDriverFor returns the driver for path according to its merge
+// attribute. A set attribute picks the line merge and only an unspecified
+// one consults merge.default. Names without a driver fall back to a line
+// merge, as git does.
+func mergeDriverFor(attrs *attributeChecker, path string) mergeDriver {
+	name := attrs.get(path, "merge")
+	switch name {
+	case "":
+		name = configOrDefault("merge.default", "text")
+	case attrSet:
+		name = "text"
+	case attrUnset:
+		name = "binary"
+	}
+	switch name {
+	case "text", "binary", "union":
+		return mergeDrivers[name]
+	}
+	if command, ok := getConfig("merge." + name + ".driver"); ok {
+		return externalDriver{name: name, command: command}
+	}
+	if driver, ok := mergeDrivers[name]; ok {
+		return driver
+	}
+	return mergeDrivers["text"]
+}
+
+type textDriver struct{}
+
+func (textDriver) merge(path string, base, ours, theirs []byte, opts mergeFileOptions) ([]byte, bool, error) {
+	merged, conflict := mergeFileContents(base, ours, theirs, opts)
+	return merged, conflict, nil
+}
+
+type binaryDriver struct{}
+
+func (binaryDriver) merge(path string, base, ours, theirs []byte, opts mergeFileOptions) ([]byte, bool, error) {
+	switch {
+	case bytes.Equal(base, theirs), opts.Favor == favorOurs:
+		return ours, false, nil
+	case bytes.Equal(base, ours), opts.Favor == favorTheirs:
+		return theirs, false, nil
+	}
+	return ours, true, nil
+}
+
+type unionDriver struct{}
+
+func (unionDriver) merge(path string, base, ours, theirs []byte, opts mergeFileOptions) ([]byte, bool, error) {
+	opts.Favor = favorUnion
+	merged, conflict := mergeFileContents(base, ours, theirs, opts)
+	return merged, conflict, nil
+}
+
+// externalDriver runs a merge.<name>.driver command.
+type externalDriver struct {
+	name    string
+	command string
+}
+
+func (d externalDriver) merge(path string, base, ours, theirs []byte, opts mergeFileOptions) ([]byte, bool, error) {
+	tmpDir, err := ioutil.TempDir("", "mygitserver-merge")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ext := filepath.Ext(path)
+	files := map[byte]string{
+		'O': filepath.Join(tmpDir, "BASE"+ext),
+		'A': filepath.Join(tmpDir, "OURS"+ext),
+		'B': filepath.Join(tmpDir, "THEIRS"+ext),
+	}
+	for placeholder, content := range map[byte][]byte{'O': base, 'A': ours, 'B': theirs} {
+		if err := ioutil.WriteFile(files[placeholder], content, 0644); err != nil {
+			return nil, false, err
+		}
+	}
+	markerSize := opts.MarkerSize
+	if markerSize <= 0 {
+		markerSize = defaultConflictMarkerSize
+	}
+
+	var command strings.Builder
+	for i := 0; i < len(d.command); i++ {
+		if d.command[i] != '%' || i+1 == len(d.command) {
+			command.WriteByte(d.command[i])
+			continue
+		}
+		i++
+		switch d.command[i] {
+		case 'O', 'A', 'B':
+			command.WriteString(shellQuote(files[d.command[i]]))
+		case 'L':
+			command.WriteString(strconv.Itoa(markerSize))
+		case 'P':
+			command.WriteString(shellQuote(path))
+		default:
+			command.WriteByte(d.command[i])
+		}
+	}
+
+	cmd := exec.Command("sh", "-c", command.String())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+	if _, exited := runErr.(*exec.ExitError); runErr != nil && !exited {
+		return nil, false, fmt.Errorf("could not run merge driver '%s': %v", d.name, runErr)
+	}
+	merged, err := ioutil.ReadFile(files['A'])
+	if err != nil {
+		return nil, false, err
+	}
+	return merged, runErr != nil, nil
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// goModDriver merges the require directives of go.mod files by module
+// path, so that dependencies added or upgraded on both sides do not
+// conflict; a module upgraded differently on each side gets the higher
+// version, as the go command's version selection would pick. The rest of
+// the file is merged line by line. The merged requirements are written
+// sorted, split into direct and indirect blocks when ours was.
+type goModDriver struct{}
+
+type goModule struct {
+	Version  string
+	Indirect bool
+}
+
+// goModRequirePlaceholder stands in for the require directives while the
+// rest of the file is merged.
+const goModRequirePlaceholder = "\x00require\n"
+
+type goModFile struct {
+	skeleton   []byte
+	requires   map[string]goModule
+	directives int
+}
+
+func (goModDriver) merge(path string, base, ours, theirs []byte, opts mergeFileOptions) ([]byte, bool, error) {
+	if merged, ok := mergeGoMod(base, ours, theirs, opts); ok {
+		return merged, false, nil
+	}
+	return textDriver{}.merge(path, base, ours, theirs, opts)
+}
+
+func mergeGoMod(base, ours, theirs []byte, opts mergeFileOptions) ([]byte, bool) {
+	baseMod, ok := parseGoMod(base)
+	if !ok {
+		return nil, false
+	}
+	oursMod, ok := parseGoMod(ours)
+	if !ok {
+		return nil, false
+	}
+	theirsMod, ok := parseGoMod(theirs)
+	if !ok {
+		return nil, false
+	}
+	skeleton, conflict := mergeFileContents(baseMod.skeleton, oursMod.skeleton, theirsMod.skeleton, opts)
+	if conflict {
+		return nil, false
+	}
+
+	requires := make(map[string]goModule)
+	for module := range mergeModuleSets(baseMod.requires, oursMod.requires, theirsMod.requires) {
+		b, o, t := baseMod.requires[module], oursMod.requires[module], theirsMod.requires[module]
+		merged := o
+		switch {
+		case o == t, b == t:
+		case b == o:
+			merged = t
+		case o.Version == "" || t.Version == "":
+			// Removed on one side, changed on the other.
+			return nil, false
+		default:
+			if compareModuleVersions(t.Version, o.Version) > 0 {
+				merged.Version = t.Version
+			}
+			merged.Indirect = o.Indirect && t.Indirect
+		}
+		if merged.Version != "" {
+			requires[module] = merged
+		}
+	}
+
+	block := renderGoModRequires(requires, oursMod.directives > 1)
+	if bytes.Contains(skeleton, []byte(goModRequirePlaceholder)) {
+		return bytes.Replace(skeleton, []byte(goModRequirePlaceholder), []byte(block), 1), true
+	}
+	if len(skeleton) > 0 && block != "" {
+		skeleton = append(ensureTrailingNewline(skeleton), '\n')
+	}
+	return append(skeleton, block...), true
+}
+
+func mergeModuleSets(sets ...map[string]goModule) map[string]bool {
+	modules := make(map[string]bool)
+	for _, set := range sets {
+		for module := range set {
+			modules[module] = true
+		}
+	}
+	return modules
+}
+
+// parseGoMod takes the require directives out of a go.mod file, leaving a
+// placeholder where the first one was. Comments inside require blocks are
+// not kept.
+func parseGoMod(content []byte) (*goModFile, bool) {
+	mod := &goModFile{requires: make(map[string]goModule)}
+	var skeleton bytes.Buffer
+	add := func(spec string) bool {
+		spec, comment, _ := strings.Cut(spec, "//")
+		fields := strings.Fields(spec)
+		if len(fields) != 2 {
+			return false
+		}
+		if _, dup := mod.requires[fields[0]]; dup {
+			return false
+		}
+		comment = strings.TrimSpace(comment)
+		mod.requires[fields[0]] = goModule{
+			Version:  fields[1],
+			Indirect: comment == "indirect" || strings.HasPrefix(comment, "indirect;"),
+		}
+		return true
+	}
+
+	inBlock := false
+	for _, line := range splitLines(content) {
+		trimmed := strings.TrimSpace(line)
+		if inBlock {
+			switch {
+			case trimmed == ")":
+				inBlock = false
+			case trimmed == "", strings.HasPrefix(trimmed, "//"):
+			case !add(trimmed):
+				return nil, false
+			}
+			continue
+		}
+		fields := strings.Fields(trimmed)
+		if len(fields) == 0 || fields[0] != "require" {
+			skeleton.WriteString(line)
+			continue
+		}
+		if mod.directives == 0 {
+			ensureNewline(&skeleton)
+			skeleton.WriteString(goModRequirePlaceholder)
+		}
+		mod.directives++
+		if len(fields) == 2 && fields[1] == "(" {
+			inBlock = true
+		} else if !add(strings.TrimSpace(strings.TrimPrefix(trimmed, "require"))) {
+			return nil, false
+		}
+	}
+	if inBlock {
+		return nil, false
+	}
+	mod.skeleton = skeleton.Bytes()
+	return mod, true
+}
+
+func renderGoModRequires(requires map[string]goModule, split bool) string {
+	var direct, indirect []string
+	for module, req := range requires {
+		if split && req.Indirect {
+			indirect = append(indirect, module)
+		} else {
+			direct = append(direct, module)
+		}
+	}
+	var b strings.Builder
+	for _, group := range [][]string{direct, indirect} {
+		if len(group) == 0 {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		sort.Strings(group)
+		b.WriteString("require (\n")
+		for _, module := range group {
+			fmt.Fprintf(&b, "\t%s %s", module, requires[module].Version)
+			if requires[module].Indirect {
+				b.WriteString(" // indirect")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(")\n")
+	}
+	return b.String()
+}
+
+// compareModuleVersions orders semantic versions such as v1.2.3,
+// v1.2.3-rc.1 or pseudo-versions, returning -1, 0 or 1. Versions that are
+// not semantic are compared as strings.
+func compareModuleVersions(a, b string) int {
+	type semver struct {
+		numbers [3]int
+		pre     []string
+	}
+	parse := func(v string) (semver, bool) {
+		var s semver
+		v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "+")
+		v, pre, hasPre := strings.Cut(v, "-")
+		if hasPre {
+			s.pre = strings.Split(pre, ".")
+		}
+		parts := strings.Split(v, ".")
+		if len(parts) > 3 {
+			return s, false
+		}
+		for i, part := range parts {
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return s, false
+			}
+			s.numbers[i] = n
+		}
+		return s, true
+	}
+	sign := func(n int) int {
+		switch {
+		case n < 0:
+			return -1
+		case n > 0:
+			return 1
+		}
+		return 0
+	}
+
+	x, okX := parse(a)
+	y, okY := parse(b)
+	if !okX || !okY {
+		return strings.Compare(a, b)
+	}
+	for i := range x.numbers {
+		if x.numbers[i] != y.numbers[i] {
+			return sign(x.numbers[i] - y.numbers[i])
+		}
+	}
+	// A release is newer than its pre-releases.
+	switch {
+	case len(x.pre) == 0 && len(y.pre) == 0:
+		return 0
+	case len(x.pre) == 0:
+		return 1
+	case len(y.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(x.pre) && i < len(y.pre); i++ {
+		if x.pre[i] == y.pre[i] {
+			continue
+		}
+		m, errM := strconv.Atoi(x.pre[i])
+		n, errN := strconv.Atoi(y.pre[i])
+		switch {
+		case errM == nil && errN == nil:
+			return sign(m - n)
+		case errM == nil:
+			return -1
+		case errN == nil:
+			return 1
+		}
+		return strings.Compare(x.pre[i], y.pre[i])
+	}
+	return sign(len(x.pre) - len(y.pre))
+}
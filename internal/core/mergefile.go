@@ -0,0 +1,371 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Conflict styles for mergeFileContents, chosen with merge.conflictStyle.
+// "merge" shows our and their side of each conflict, "diff3" adds the base
+// version between them, and "zdiff3" is diff3 with the lines both sides agree
+// on at the start and end of a conflict moved out of it.
+const (
+	conflictStyleMerge  = "merge"
+	conflictStyleDiff3  = "diff3"
+	conflictStyleZdiff3 = "zdiff3"
+)
+
+// defaultConflictMarkerSize is the length of the <<<<<<<, |||||||, =======
+// and >>>>>>> markers.
+const defaultConflictMarkerSize = 7
+
+// Sides a conflicting hunk can be resolved to, chosen with "merge -X".
+// favorUnion keeps the lines of both sides, ours first; it is what the
+// union merge driver does.
+const (
+	favorOurs   = "ours"
+	favorTheirs = "theirs"
+	favorUnion  = "union"
+)
+
+// mergeFileOptions labels the three versions in conflict markers and picks
+// how conflicts are written. Favor, when set, resolves conflicting hunks to
+// that side instead of writing markers.
+type mergeFileOptions struct {
+	OursLabel   string
+	BaseLabel   string
+	TheirsLabel string
+	Style       string
+	MarkerSize  int
+	Favor       string
+}
+
+// newMergeFileOptions returns options with the given labels and the style
+// and marker size configured through merge.conflictStyle and
+// merge.conflictMarkerSize.
+func newMergeFileOptions(oursLabel, baseLabel, theirsLabel string) (mergeFileOptions, error) {
+	opts := mergeFileOptions{
+		OursLabel:   oursLabel,
+		BaseLabel:   baseLabel,
+		TheirsLabel: theirsLabel,
+		Style:       configOrDefault("merge.conflictStyle", conflictStyleMerge),
+		MarkerSize:  defaultConflictMarkerSize,
+	}
+	if err := checkConflictStyle(opts.Style); err != nil {
+		return opts, err
+	}
+	if value, ok := getConfig("merge.conflictMarkerSize"); ok {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			return opts, fmt.Errorf("invalid merge.conflictMarkerSize '%s'", value)
+		}
+		opts.MarkerSize = size
+	}
+	return opts, nil
+}
+
+func checkConflictStyle(style string) error {
+	switch style {
+	case conflictStyleMerge, conflictStyleDiff3, conflictStyleZdiff3:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict style '%s'", style)
+}
+
+// mergeFileContents combines two versions of a file that both descend from
+// base, line by line. Hunks changed on one side only take that side's
+// lines, and hunks changed identically on both sides are taken once. Hunks
+// both sides changed differently are written between conflict markers, and
+// conflict is true, unless opts.Favor picks a side for them. Binary files
+// are not merged line by line: unless one side is unchanged or a side is
+// favored, our version is kept and reported as a conflict.
+func mergeFileContents(base, ours, theirs []byte, opts mergeFileOptions) (merged []byte, conflict bool) {
+	switch {
+	case bytes.Equal(ours, theirs):
+		return ours, false
+	case bytes.Equal(base, ours):
+		return theirs, false
+	case bytes.Equal(base, theirs):
+		return ours, false
+	case isBinary(base) || isBinary(ours) || isBinary(theirs):
+		if opts.Favor == favorTheirs {
+			return theirs, false
+		}
+		return ours, opts.Favor != favorOurs
+	}
+	if opts.MarkerSize <= 0 {
+		opts.MarkerSize = defaultConflictMarkerSize
+	}
+	if opts.Style == "" {
+		opts.Style = conflictStyleMerge
+	}
+
+	baseLines, oursLines, theirsLines := splitLines(base), splitLines(ours), splitLines(theirs)
+	var b bytes.Buffer
+	for _, chunk := range diff3Chunks(baseLines, oursLines, theirsLines) {
+		switch {
+		case chunk.stable, linesEqual(chunk.ours, chunk.theirs), linesEqual(chunk.base, chunk.theirs):
+			writeLines(&b, chunk.ours)
+		case linesEqual(chunk.base, chunk.ours):
+			writeLines(&b, chunk.theirs)
+		case opts.Favor == favorOurs:
+			writeLines(&b, chunk.ours)
+		case opts.Favor == favorTheirs:
+			writeLines(&b, chunk.theirs)
+		case opts.Favor == favorUnion:
+			writeLines(&b, chunk.ours)
+			ensureNewline(&b)
+			writeLines(&b, chunk.theirs)
+		default:
+			conflict = true
+			writeConflict(&b, chunk, opts)
+		}
+	}
+	return b.Bytes(), conflict
+}
+
+// isBinary treats content with a NUL byte in its first 8000 bytes as
+// binary, as git does.
+func isBinary(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// splitLines splits content after every newline; the last line may lack one.
+func splitLines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		end := bytes.IndexByte(content, '\n') + 1
+		if end == 0 {
+			end = len(content)
+		}
+		lines = append(lines, string(content[:end]))
+		content = content[end:]
+	}
+	return lines
+}
+
+func linesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(b *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		b.WriteString(line)
+	}
+}
+
+// writeConflict writes one conflicting hunk with markers in the requested
+// style.
+func writeConflict(b *bytes.Buffer, chunk diff3Chunk, opts mergeFileOptions) {
+	ours, theirs := chunk.ours, chunk.theirs
+	var suffix []string
+	if opts.Style != conflictStyleDiff3 {
+		// Lines both sides agree on are not part of the conflict.
+		prefix := 0
+		for prefix < len(ours) && prefix < len(theirs) && ours[prefix] == theirs[prefix] {
+			prefix++
+		}
+		writeLines(b, ours[:prefix])
+		ours, theirs = ours[prefix:], theirs[prefix:]
+		common := 0
+		for common < len(ours) && common < len(theirs) && ours[len(ours)-1-common] == theirs[len(theirs)-1-common] {
+			common++
+		}
+		suffix = ours[len(ours)-common:]
+		ours, theirs = ours[:len(ours)-common], theirs[:len(theirs)-common]
+	}
+
+	marker := func(char byte, label string) {
+		ensureNewline(b)
+		b.WriteString(strings.Repeat(string(char), opts.MarkerSize))
+		if label != "" {
+			b.WriteString(" " + label)
+		}
+		b.WriteString("\n")
+	}
+	marker('<', opts.OursLabel)
+	writeLines(b, ours)
+	if opts.Style != conflictStyleMerge {
+		marker('|', opts.BaseLabel)
+		writeLines(b, chunk.base)
+	}
+	marker('=', "")
+	writeLines(b, theirs)
+	marker('>', opts.TheirsLabel)
+	writeLines(b, suffix)
+}
+
+// ensureNewline terminates a last line that lacks a newline, so that a
+// marker written next starts on a line of its own.
+func ensureNewline(b *bytes.Buffer) {
+	if b.Len() > 0 && b.Bytes()[b.Len()-1] != '\n' {
+		b.WriteByte('\n')
+	}
+}
+
+func ensureTrailingNewline(content []byte) []byte {
+	if len(content) == 0 || content[len(content)-1] == '\n' {
+		return content
+	}
+	return append(append([]byte{}, content...), '\n')
+}
+
+// diff3Chunk is a run of lines in which either all three versions agree
+// (stable) or at least one side differs from the base.
+type diff3Chunk struct {
+	stable bool
+	base   []string
+	ours   []string
+	theirs []string
+}
+
+// diff3Chunks splits the three versions into alternating stable and
+// unstable chunks, using the lines each side has in common with the base.
+func diff3Chunks(base, ours, theirs []string) []diff3Chunk {
+	matchOurs := matchLines(base, ours)
+	matchTheirs := matchLines(base, theirs)
+
+	var chunks []diff3Chunk
+	b, o, t := 0, 0, 0
+	for b < len(base) || o < len(ours) || t < len(theirs) {
+		n := 0
+		for b+n < len(base) && matchOurs[b+n] == o+n && matchTheirs[b+n] == t+n {
+			n++
+		}
+		if n > 0 {
+			chunks = append(chunks, diff3Chunk{stable: true, base: base[b : b+n], ours: ours[o : o+n], theirs: theirs[t : t+n]})
+			b, o, t = b+n, o+n, t+n
+			continue
+		}
+
+		// The unstable chunk ends at the next base line both sides kept.
+		next := b
+		for next < len(base) && (matchOurs[next] < 0 || matchTheirs[next] < 0) {
+			next++
+		}
+		endOurs, endTheirs := len(ours), len(theirs)
+		if next < len(base) {
+			endOurs, endTheirs = matchOurs[next], matchTheirs[next]
+		}
+		chunks = append(chunks, diff3Chunk{base: base[b:next], ours: ours[o:endOurs], theirs: theirs[t:endTheirs]})
+		b, o, t = next, endOurs, endTheirs
+	}
+	return chunks
+}
+
+// matchLines returns, for every line of a, the index of the line of b it is
+// matched with in a longest common subsequence, or -1.
+func matchLines(a, b []string) []int {
+	match := make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+	for _, pair := range commonLines(a, b) {
+		match[pair[0]] = pair[1]
+	}
+	return match
+}
+
+// commonLines computes a longest common subsequence of a and b with Myers'
+// O(ND) algorithm and returns the matched index pairs in order.
+func commonLines(a, b []string) [][2]int {
+	var pairs [][2]int
+	myersMatches(a, b, 0, 0, &pairs)
+	return pairs
+}
+
+// myersMatches appends the pairs matched between a and b, offset by offA
+// and offB, to pairs. It uses the linear-space variant of Myers' search:
+// the snake in the middle of an optimal path splits the problem in two,
+// and each half is solved the same way, so memory stays proportional to
+// the input rather than to its size times the edit distance.
+func myersMatches(a, b []string, offA, offB int, pairs *[][2]int) {
+	// Lines shared at both ends need no search.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		*pairs = append(*pairs, [2]int{offA + prefix, offB + prefix})
+		prefix++
+	}
+	a, b, offA, offB = a[prefix:], b[prefix:], offA+prefix, offB+prefix
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	if len(a) > 0 && len(b) > 0 {
+		x, y, u, v := middleSnake(a, b)
+		myersMatches(a[:x], b[:y], offA, offB, pairs)
+		for i := 0; i < u-x; i++ {
+			*pairs = append(*pairs, [2]int{offA + x + i, offB + y + i})
+		}
+		myersMatches(a[u:], b[v:], offA+u, offB+v, pairs)
+	}
+	for i := 0; i < suffix; i++ {
+		*pairs = append(*pairs, [2]int{offA + len(a) + i, offB + len(b) + i})
+	}
+}
+
+// middleSnake searches forward from the start of a and b and backward from
+// their end at once, one edit distance at a time, until the two searches
+// meet. It returns the snake where they met, from (x, y) to (u, v), which
+// lies on an optimal path. The backward search works on the reversed
+// inputs, where diagonal k is diagonal delta-k of the forward search.
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	max := (n + m + 1) / 2
+	offset := max + 1
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			startX := x
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			forward[offset+k] = x
+			if c := delta - k; delta%2 != 0 && c >= -(d-1) && c <= d-1 && x+backward[offset+c] >= n {
+				return startX, startX - k, x, y
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			startX := x
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x, y = x+1, y+1
+			}
+			backward[offset+k] = x
+			if c := delta - k; delta%2 == 0 && c >= -d && c <= d && forward[offset+c]+x >= n {
+				return n - x, m - y, n - startX, m - (startX - k)
+			}
+		}
+	}
+	panic("middle snake not found")
+}
@@ -0,0 +1,389 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// structNode is a JSON object or YAML mapping as the structured merge
+// drivers see it: keys in document order, each with a value that is either
+// a nested mapping or an opaque leaf compared by its text. Arrays, scalars
+// and anything else the drivers do not look into are leaves.
+type structNode struct {
+	keys    []string
+	values  map[string]*structValue
+	trailer string
+}
+
+// structValue is a leaf when child is nil. For a YAML nested mapping, text
+// holds the lines that introduce it.
+type structValue struct {
+	text  string
+	child *structNode
+}
+
+func newStructNode() *structNode {
+	return &structNode{values: make(map[string]*structValue)}
+}
+
+// add appends key, failing when the mapping already has it.
+func (n *structNode) add(key string, value *structValue) bool {
+	if _, dup := n.values[key]; dup {
+		return false
+	}
+	n.keys = append(n.keys, key)
+	n.values[key] = value
+	return true
+}
+
+func structNodesEqual(a, b *structNode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if len(a.keys) != len(b.keys) || a.trailer != b.trailer {
+		return false
+	}
+	for i, key := range a.keys {
+		if b.keys[i] != key || !structValuesEqual(a.values[key], b.values[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+func structValuesEqual(a, b *structValue) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.text == b.text && structNodesEqual(a.child, b.child)
+}
+
+// mergeText resolves a three-way change to a string, failing when both
+// sides changed it differently.
+func mergeText(base, ours, theirs string) (string, bool) {
+	switch {
+	case ours == theirs, base == theirs:
+		return ours, true
+	case base == ours:
+		return theirs, true
+	}
+	return "", false
+}
+
+// mergeStructNodes merges two mappings key by key against base, which is
+// nil when the file was added on both sides. Keys added by theirs are
+// placed after the key that precedes them there. It fails when a key was
+// changed differently on both sides, or changed on one side and removed on
+// the other.
+func mergeStructNodes(base, ours, theirs *structNode) (*structNode, bool) {
+	if base == nil {
+		base = newStructNode()
+	}
+	keys := append([]string(nil), ours.keys...)
+	for i, key := range theirs.keys {
+		if _, ok := ours.values[key]; ok {
+			continue
+		}
+		at := len(keys)
+		if i == 0 {
+			at = 0
+		}
+		for j := range keys {
+			if i > 0 && keys[j] == theirs.keys[i-1] {
+				at = j + 1
+			}
+		}
+		keys = append(keys[:at], append([]string{key}, keys[at:]...)...)
+	}
+
+	trailer, ok := mergeText(base.trailer, ours.trailer, theirs.trailer)
+	if !ok {
+		return nil, false
+	}
+	merged := newStructNode()
+	merged.trailer = trailer
+	for _, key := range keys {
+		value, ok := mergeStructValues(base.values[key], ours.values[key], theirs.values[key])
+		if !ok {
+			return nil, false
+		}
+		if value != nil {
+			merged.add(key, value)
+		}
+	}
+	return merged, true
+}
+
+func mergeStructValues(base, ours, theirs *structValue) (*structValue, bool) {
+	switch {
+	case structValuesEqual(ours, theirs), structValuesEqual(base, theirs):
+		return ours, true
+	case structValuesEqual(base, ours):
+		return theirs, true
+	case ours == nil || theirs == nil || ours.child == nil || theirs.child == nil:
+		return nil, false
+	}
+	var baseText string
+	var baseChild *structNode
+	if base != nil {
+		baseText, baseChild = base.text, base.child
+	}
+	text, ok := mergeText(baseText, ours.text, theirs.text)
+	if !ok {
+		return nil, false
+	}
+	child, ok := mergeStructNodes(baseChild, ours.child, theirs.child)
+	if !ok {
+		return nil, false
+	}
+	return &structValue{text: text, child: child}, true
+}
+
+// mergeStructured parses the three versions with parse and merges them,
+// returning false when a version cannot be parsed or the merge fails. An
+// empty base stands for a file added on both sides.
+func mergeStructured(base, ours, theirs []byte, parse func([]byte) (*structNode, bool)) (*structNode, bool) {
+	var baseNode *structNode
+	if len(bytes.TrimSpace(base)) > 0 {
+		var ok bool
+		if baseNode, ok = parse(base); !ok {
+			return nil, false
+		}
+	}
+	oursNode, ok := parse(ours)
+	if !ok {
+		return nil, false
+	}
+	theirsNode, ok := parse(theirs)
+	if !ok {
+		return nil, false
+	}
+	return mergeStructNodes(baseNode, oursNode, theirsNode)
+}
+
+// jsonDriver merges JSON documents whose top level is an object, key by
+// key and recursively into nested objects. The result is indented the way
+// our version is.
+type jsonDriver struct{}
+
+func (jsonDriver) merge(path string, base, ours, theirs []byte, opts mergeFileOptions) ([]byte, bool, error) {
+	node, ok := mergeStructured(base, ours, theirs, parseJSONObject)
+	if !ok {
+		return textDriver{}.merge(path, base, ours, theirs, opts)
+	}
+	var b bytes.Buffer
+	writeJSONObject(&b, node, "", jsonIndent(ours))
+	if bytes.HasSuffix(ours, []byte("\n")) {
+		b.WriteString("\n")
+	}
+	return b.Bytes(), false, nil
+}
+
+func parseJSONObject(content []byte) (*structNode, bool) {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	if token, err := dec.Token(); err != nil || token != json.Delim('{') {
+		return nil, false
+	}
+	node := newStructNode()
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		key, _ := token.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, false
+		}
+		value := &structValue{}
+		if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '{' {
+			var ok bool
+			if value.child, ok = parseJSONObject(raw); !ok {
+				return nil, false
+			}
+		} else {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, raw); err != nil {
+				return nil, false
+			}
+			value.text = compact.String()
+		}
+		if !node.add(key, value) {
+			return nil, false
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false
+	}
+	return node, true
+}
+
+// jsonIndent is the indentation of the first indented line of content,
+// two spaces if there is none.
+func jsonIndent(content []byte) string {
+	for _, line := range splitLines(content) {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != line && strings.TrimSpace(trimmed) != "" {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return "  "
+}
+
+func writeJSONObject(b *bytes.Buffer, node *structNode, prefix, indent string) {
+	if len(node.keys) == 0 {
+		b.WriteString("{}")
+		return
+	}
+	b.WriteString("{\n")
+	for i, key := range node.keys {
+		var encoded bytes.Buffer
+		enc := json.NewEncoder(&encoded)
+		enc.SetEscapeHTML(false)
+		enc.Encode(key)
+		b.WriteString(prefix + indent + strings.TrimSuffix(encoded.String(), "\n") + ": ")
+		if value := node.values[key]; value.child != nil {
+			writeJSONObject(b, value.child, prefix+indent, indent)
+		} else {
+			json.Indent(b, []byte(value.text), prefix+indent, indent)
+		}
+		if i < len(node.keys)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(prefix + "}")
+}
+
+// yamlDriver merges YAML documents made of block mappings, key by key and
+// recursively into nested mappings. Sequences, multi-line scalars and flow
+// collections are compared as a whole; comments travel with the key that
+// follows them. Documents it cannot follow, such as ones with several
+// "---" sections or tab indentation, are merged line by line.
+type yamlDriver struct{}
+
+func (yamlDriver) merge(path string, base, ours, theirs []byte, opts mergeFileOptions) ([]byte, bool, error) {
+	node, ok := mergeStructured(base, ours, theirs, parseYAMLDocument)
+	if !ok {
+		return textDriver{}.merge(path, base, ours, theirs, opts)
+	}
+	var b strings.Builder
+	writeYAMLMapping(&b, node)
+	return []byte(b.String()), false, nil
+}
+
+func parseYAMLDocument(content []byte) (*structNode, bool) {
+	lines := splitLines(content)
+	for i, line := range lines {
+		lines[i] = ensureLineEnd(line)
+	}
+	return parseYAMLMapping(lines, 0)
+}
+
+func yamlIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func yamlSkippable(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+// yamlKey splits a "key: value" line, returning false for anything else.
+func yamlKey(line string) (key, rest string, ok bool) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.ContainsRune("-[]{}#&*!|>%@`?,", rune(trimmed[0])) {
+		return "", "", false
+	}
+	end := -1
+	if quote := trimmed[0]; quote == '"' || quote == '\'' {
+		closing := strings.IndexByte(trimmed[1:], quote)
+		if closing < 0 || !strings.HasPrefix(trimmed[closing+2:], ":") {
+			return "", "", false
+		}
+		end = closing + 2
+	} else {
+		for i := 0; i < len(trimmed); i++ {
+			if trimmed[i] == ':' && (i+1 == len(trimmed) || trimmed[i+1] == ' ') {
+				end = i
+				break
+			}
+		}
+	}
+	if end < 0 || end+1 < len(trimmed) && trimmed[end+1] != ' ' {
+		return "", "", false
+	}
+	return trimmed[:end], strings.TrimSpace(trimmed[end+1:]), true
+}
+
+// parseYAMLMapping parses lines holding a mapping whose keys are indented
+// by indent spaces. Each entry takes the comments before it, its key line
+// and every more indented line after it.
+func parseYAMLMapping(lines []string, indent int) (*structNode, bool) {
+	node := newStructNode()
+	var pending []string
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if yamlSkippable(line) {
+			pending = append(pending, line)
+			i++
+			continue
+		}
+		if strings.HasPrefix(line, "\t") || yamlIndent(line) != indent {
+			return nil, false
+		}
+		key, rest, ok := yamlKey(line)
+		if !ok {
+			return nil, false
+		}
+		end := i + 1
+		for end < len(lines) && (yamlSkippable(lines[end]) || yamlIndent(lines[end]) > indent) {
+			end++
+		}
+		// Comments after the entry belong to the next one.
+		for end > i+1 && yamlSkippable(lines[end-1]) {
+			end--
+		}
+		header := strings.Join(append(pending, line), "")
+		body := lines[i+1 : end]
+		pending = nil
+		i = end
+
+		value := &structValue{text: header + strings.Join(body, "")}
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			for _, child := range body {
+				if yamlSkippable(child) {
+					continue
+				}
+				if _, _, isKey := yamlKey(child); isKey {
+					if value.child, ok = parseYAMLMapping(body, yamlIndent(child)); !ok {
+						return nil, false
+					}
+					value.text = header
+				}
+				break
+			}
+		}
+		if !node.add(key, value) {
+			return nil, false
+		}
+	}
+	node.trailer = strings.Join(pending, "")
+	return node, true
+}
+
+func writeYAMLMapping(b *strings.Builder, node *structNode) {
+	for _, key := range node.keys {
+		value := node.values[key]
+		b.WriteString(value.text)
+		if value.child != nil {
+			writeYAMLMapping(b, value.child)
+		}
+	}
+	b.WriteString(node.trailer)
+}
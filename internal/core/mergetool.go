@@ -0,0 +1,429 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// External merge and diff tools are configured the way git configures them:
+//
+//	[merge]
+//		tool = meld
+//	[mergetool "mytool"]
+//		cmd = mytool --base "$BASE" "$LOCAL" "$REMOTE" -o "$MERGED"
+//		trustExitCode = true
+//
+// and likewise with diff.tool and [difftool "<name>"] sections, diff.tool
+// falling back to merge.tool. The command runs through the shell with
+// $BASE, $LOCAL, $REMOTE and $MERGED naming the files to work on. Tools in
+// knownTools need no cmd of their own.
+
+// knownTool holds the command lines of a tool that works out of the box.
+// trustExitCode says whether its exit code reliably tells a resolved merge
+// from an abandoned one.
+type knownTool struct {
+	merge         string
+	diff          string
+	trustExitCode bool
+}
+
+var knownTools = map[string]knownTool{
+	"vimdiff": {
+		merge: `vim -f -d -c '4wincmd w | wincmd J' "$LOCAL" "$BASE" "$REMOTE" "$MERGED"`,
+		diff:  `vim -R -f -d -c 'wincmd l' "$LOCAL" "$REMOTE"`,
+	},
+	"meld": {
+		merge: `meld "$LOCAL" "$BASE" "$REMOTE" --output "$MERGED"`,
+		diff:  `meld "$LOCAL" "$REMOTE"`,
+	},
+	"kdiff3": {
+		merge:         `kdiff3 --auto --L1 "$MERGED (Base)" --L2 "$MERGED (Local)" --L3 "$MERGED (Remote)" -o "$MERGED" "$BASE" "$LOCAL" "$REMOTE"`,
+		diff:          `kdiff3 --L1 "$MERGED (A)" --L2 "$MERGED (B)" "$LOCAL" "$REMOTE"`,
+		trustExitCode: true,
+	},
+	"vscode": {
+		merge: `code --wait --merge "$REMOTE" "$LOCAL" "$BASE" "$MERGED"`,
+		diff:  `code --wait --diff "$LOCAL" "$REMOTE"`,
+	},
+	"opendiff": {
+		merge: `opendiff "$LOCAL" "$REMOTE" -ancestor "$BASE" -merge "$MERGED" | cat`,
+		diff:  `opendiff "$LOCAL" "$REMOTE" | cat`,
+	},
+}
+
+// externalTool is a tool resolved from the configuration and knownTools.
+type externalTool struct {
+	Name          string
+	Cmd           string
+	TrustExitCode bool
+}
+
+// lookupTool resolves the merge ("mergetool") or diff ("difftool") tool
+// called name, or the configured default when name is empty.
+func lookupTool(section, name string) (*externalTool, error) {
+	if name == "" && section == "difftool" {
+		name, _ = getConfig("diff.tool")
+	}
+	if name == "" {
+		name, _ = getConfig("merge.tool")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no %s configured; set merge.tool or use --tool=<tool> (see --tool-help)", section)
+	}
+
+	tool := &externalTool{Name: name}
+	known, isKnown := knownTools[name]
+	if cmd, ok := getConfig(section + "." + name + ".cmd"); ok && cmd != "" {
+		tool.Cmd = cmd
+	} else if isKnown && section == "mergetool" {
+		tool.Cmd = known.merge
+	} else if isKnown {
+		tool.Cmd = known.diff
+	} else {
+		return nil, fmt.Errorf("unknown %s '%s'; configure %s.%s.cmd", section, name, section, name)
+	}
+	tool.TrustExitCode = getConfigBool(section+"."+name+".trustExitCode", known.trustExitCode)
+	return tool, nil
+}
+
+// run launches the tool on the given files and reports whether it exited
+// successfully; only failing to start it at all is an error.
+func (t *externalTool) run(base, local, remote, merged string) (bool, error) {
+	cmd := exec.Command("sh", "-c", t.Cmd)
+	cmd.Env = append(os.Environ(), "BASE="+base, "LOCAL="+local, "REMOTE="+remote, "MERGED="+merged)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if _, exited := err.(*exec.ExitError); err != nil && !exited {
+		return false, fmt.Errorf("could not run '%s': %v", t.Name, err)
+	}
+	return err == nil, nil
+}
+
+// ToolHelp lists the tools usable with mergetool or difftool: the ones
+// known out of the box and the ones configured with a cmd.
+func ToolHelp(section string) error {
+	configured := make(map[string]bool)
+	for _, entry := range loadConfig().entries {
+		if strings.EqualFold(entry.Section, section) && strings.EqualFold(entry.Name, "cmd") && entry.Subsection != "" {
+			configured[entry.Subsection] = true
+		}
+	}
+	var names []string
+	for name := range knownTools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("'%s --tool=<tool>' may be set to one of the following:\n", section)
+	for _, name := range names {
+		fmt.Printf("\t\t%s\n", name)
+	}
+	if len(configured) > 0 {
+		names = names[:0]
+		for name := range configured {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Println("\n\tuser-defined:")
+		for _, name := range names {
+			fmt.Printf("\t\t%s\n", name)
+		}
+	}
+	return nil
+}
+
+// toolTempName names a temporary version of path the way git does, e.g.
+// "dir/file_LOCAL_1234.go".
+func toolTempName(path, label string) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_%s_%d%s", strings.TrimSuffix(path, ext), label, os.Getpid(), ext)
+}
+
+// MergetoolOptions controls Mergetool. Tool overrides merge.tool.
+type MergetoolOptions struct {
+	Tool string
+}
+
+// Mergetool runs the merge tool on each unmerged path (or those of paths
+// that are unmerged). A path counts as resolved when the tool says so
+// through its exit code, if it is trusted, or else when the tool changed
+// the file and left no conflict markers; resolved paths are staged.
+// mergetool.keepBackup (default true) keeps the conflicted file as
+// <path>.orig.
+func Mergetool(paths []string, opts MergetoolOptions) error {
+	conflicts, err := readIndexConflicts()
+	if err != nil {
+		return err
+	}
+	var todo []string
+	for _, path := range unmergedPaths(conflicts) {
+		if len(paths) == 0 || matchesAnyPath(path, paths) {
+			todo = append(todo, path)
+		}
+	}
+	if len(todo) == 0 {
+		fmt.Println("No files need merging")
+		return nil
+	}
+	tool, err := lookupTool("mergetool", opts.Tool)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Merging:")
+	for _, path := range todo {
+		fmt.Println(path)
+	}
+	for _, path := range todo {
+		stages := conflicts[path]
+		fmt.Printf("\nNormal merge conflict for '%s':\n", path)
+		if stages.Ours() == "" || stages.Theirs() == "" {
+			fmt.Printf("  {local}: %s\n  {remote}: %s\n", describeStage(stages.Ours()), describeStage(stages.Theirs()))
+			return fmt.Errorf("'%s' was deleted on one side; resolve it by hand and stage the result", path)
+		}
+		resolved, err := runMergeTool(tool, path, stages)
+		if err != nil {
+			return err
+		}
+		if !resolved {
+			return fmt.Errorf("merge of %s failed", path)
+		}
+		if err := stageWorkingFiles([]string{path}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func describeStage(hash string) string {
+	if hash == "" {
+		return "deleted"
+	}
+	return "modified file"
+}
+
+// matchesAnyPath reports whether path is one of paths or lies below one of
+// them.
+func matchesAnyPath(path string, paths []string) bool {
+	for _, p := range paths {
+		p = strings.TrimSuffix(normalizePath(p), "/")
+		if p == "." || path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// runMergeTool writes the base, local and remote versions of path next to
+// it, runs the tool and reports whether path was resolved. When it was not,
+// path is restored to its content from before the tool ran. The temporary
+// files are always removed.
+func runMergeTool(tool *externalTool, path string, stages conflictStages) (bool, error) {
+	versions := []struct {
+		label string
+		hash  string
+	}{{"BASE", stages.Base()}, {"LOCAL", stages.Ours()}, {"REMOTE", stages.Theirs()}}
+	names := make(map[string]string)
+	for _, version := range versions {
+		content, err := readBlob(version.hash)
+		if err != nil {
+			return false, err
+		}
+		name := toolTempName(path, version.label)
+		if err := ioutil.WriteFile(name, content, 0644); err != nil {
+			return false, err
+		}
+		defer os.Remove(name)
+		names[version.label] = name
+	}
+
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if getConfigBool("mergetool.keepBackup", true) {
+		if err := ioutil.WriteFile(path+".orig", before, 0644); err != nil {
+			return false, err
+		}
+	}
+	ok, err := tool.run(names["BASE"], names["LOCAL"], names["REMOTE"], path)
+	resolved := err == nil && mergeToolResolved(tool, path, before, ok)
+	if !resolved {
+		// As in git, a failed merge leaves path as it was before the tool
+		// ran rather than whatever the tool wrote.
+		if restoreErr := ioutil.WriteFile(path, before, 0644); restoreErr != nil && err == nil {
+			err = restoreErr
+		}
+	}
+	return resolved, err
+}
+
+// mergeToolResolved decides from the tool's exit status, or when the exit
+// code is not trusted from the merged file, whether path was resolved.
+func mergeToolResolved(tool *externalTool, path string, before []byte, ok bool) bool {
+	if tool.TrustExitCode || !ok {
+		return ok
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	if bytes.Equal(before, after) {
+		fmt.Printf("%s seems unchanged.\n", path)
+		return false
+	}
+	if _, _, conflicted := normalizeConflicts(after, conflictMarkerSize()); conflicted {
+		fmt.Printf("%s still contains conflict markers.\n", path)
+		return false
+	}
+	return true
+}
+
+// DifftoolOptions controls Difftool. Tool overrides diff.tool and
+// merge.tool. Without commits the index is compared with the working tree,
+// or HEAD with the index when Staged is set; one commit is compared with
+// the working tree and two commits with each other.
+type DifftoolOptions struct {
+	Tool    string
+	Staged  bool
+	Commits []string
+}
+
+// Difftool runs the diff tool on every changed path, one at a time. With
+// a trusted exit code, a failing tool stops the remaining paths.
+func Difftool(paths []string, opts DifftoolOptions) error {
+	if len(opts.Commits) > 2 || (opts.Staged && len(opts.Commits) == 2) {
+		return fmt.Errorf("too many revisions to compare")
+	}
+	oldTree, newTree, err := difftoolTrees(opts)
+	if err != nil {
+		return err
+	}
+	tool, err := lookupTool("difftool", opts.Tool)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir("", "mygitserver-difftool")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, path := range unionKeys(oldTree, newTree) {
+		if oldTree[path] == newTree[path] || (len(paths) > 0 && !matchesAnyPath(path, paths)) {
+			continue
+		}
+		local, err := writeToolVersion(tmpDir, path, "LOCAL", oldTree[path])
+		if err != nil {
+			return err
+		}
+		remote := path
+		if newTree[path] != workingTreeVersion {
+			if remote, err = writeToolVersion(tmpDir, path, "REMOTE", newTree[path]); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Viewing: '%s'\n", path)
+		ok, err := tool.run(path, local, remote, path)
+		if err != nil {
+			return err
+		}
+		if !ok && tool.TrustExitCode {
+			return fmt.Errorf("external diff tool '%s' failed on '%s'", tool.Name, path)
+		}
+	}
+	return nil
+}
+
+// workingTreeVersion stands in difftoolTrees for a path whose new version
+// is the file in the working tree itself, which the tool is given directly.
+const workingTreeVersion = "working tree"
+
+// difftoolTrees returns the two sides of the comparison as path => blob
+// maps.
+func difftoolTrees(opts DifftoolOptions) (map[string]string, map[string]string, error) {
+	index, err := readIndex()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read index: %v", err)
+	}
+	working := func() (map[string]string, error) {
+		tree := make(map[string]string)
+		files, err := listWorkingDirectoryFiles(".")
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			file = normalizePath(file)
+			if _, tracked := index[file]; tracked {
+				tree[file] = workingTreeVersion
+				if hash, ok := workingFileHash(file); ok && hash == index[file] {
+					tree[file] = hash
+				}
+			}
+		}
+		return tree, nil
+	}
+
+	switch {
+	case len(opts.Commits) == 2:
+		oldTree, err := resolvedTree(opts.Commits[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		newTree, err := resolvedTree(opts.Commits[1])
+		return oldTree, newTree, err
+	case opts.Staged:
+		rev := "HEAD"
+		if len(opts.Commits) == 1 {
+			rev = opts.Commits[0]
+		}
+		oldTree, err := resolvedTree(rev)
+		return oldTree, index, err
+	case len(opts.Commits) == 1:
+		oldTree, err := resolvedTree(opts.Commits[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		newTree, err := working()
+		if err != nil {
+			return nil, nil, err
+		}
+		// Working copies that match the commit need no tool.
+		for path, hash := range newTree {
+			if hash == workingTreeVersion {
+				if current, ok := workingFileHash(path); ok && current == oldTree[path] {
+					newTree[path] = current
+				}
+			}
+		}
+		return oldTree, newTree, nil
+	}
+	newTree, err := working()
+	return index, newTree, err
+}
+
+func resolvedTree(rev string) (map[string]string, error) {
+	hash, err := resolveCommit(rev)
+	if err != nil {
+		return nil, fmt.Errorf("bad revision '%s'", rev)
+	}
+	return commitTree(hash)
+}
+
+// writeToolVersion writes the blob hash (empty for a missing file) into
+// dir under a name derived from path and returns the file name.
+func writeToolVersion(dir, path, label, hash string) (string, error) {
+	content, err := readBlob(hash)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, filepath.Base(toolTempName(path, label)))
+	return name, ioutil.WriteFile(name, content, 0644)
+}
@@ -0,0 +1,442 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Notes live outside the commits they annotate, so adding one never changes
+// a commit hash. A notes ref (refs/notes/commits by default) points at a
+// commit whose tree maps annotated commit IDs to note blobs; every change to
+// the notes is a new commit on that ref, which keeps notes history mergeable.
+
+const defaultNotesRef = "refs/notes/commits"
+
+// Strategies accepted by NotesMerge for notes changed on both sides.
+const (
+	NotesMergeManual      = "manual"
+	NotesMergeOurs        = "ours"
+	NotesMergeTheirs      = "theirs"
+	NotesMergeUnion       = "union"
+	NotesMergeCatSortUniq = "cat_sort_uniq"
+)
+
+// expandNotesRef turns a --ref argument into a full ref name. An empty name
+// selects core.notesRef, falling back to refs/notes/commits.
+func expandNotesRef(name string) string {
+	if name == "" {
+		if configured, ok := getConfig("core.notesRef"); ok && configured != "" {
+			name = configured
+		} else {
+			return defaultNotesRef
+		}
+	}
+	if strings.HasPrefix(name, "refs/notes/") {
+		return name
+	}
+	if strings.HasPrefix(name, "notes/") {
+		return "refs/" + name
+	}
+	return "refs/notes/" + name
+}
+
+// readNotesTree returns the notes commit a notes ref points at and its
+// commit-to-note mapping. Both are empty when the ref does not exist yet.
+func readNotesTree(notesRef string) (string, map[string]string, error) {
+	if !refExists(notesRef) {
+		return "", map[string]string{}, nil
+	}
+	tip, err := readRef(notesRef)
+	if err != nil || tip == "" {
+		return "", map[string]string{}, err
+	}
+	commit, err := readCommit(tip)
+	if err != nil {
+		return "", nil, err
+	}
+	notes, err := readTree(commit.Tree)
+	if err != nil {
+		return "", nil, err
+	}
+	return tip, notes, nil
+}
+
+// writeNotesTree records notes as a new commit on notesRef.
+func writeNotesTree(notesRef string, parents []string, notes map[string]string, message string) (string, error) {
+	tree, err := writeTree(notes)
+	if err != nil {
+		return "", err
+	}
+	commitHash, err := writeCommit(&commitObject{Tree: tree, Parents: parents, Message: message})
+	if err != nil {
+		return "", err
+	}
+	return commitHash, updateRef(notesRef, commitHash, "notes: "+strings.SplitN(message, "\n", 2)[0])
+}
+
+// updateNote sets (or, with empty text, removes) the note for commitHash and
+// records the change as a new notes commit made by the given subcommand.
+func updateNote(notesRef, commitHash, text, command string) error {
+	tip, notes, err := readNotesTree(notesRef)
+	if err != nil {
+		return err
+	}
+	if text == "" {
+		delete(notes, commitHash)
+	} else {
+		blob, err := writeObject([]byte(text))
+		if err != nil {
+			return err
+		}
+		notes[commitHash] = blob
+	}
+
+	var parents []string
+	if tip != "" {
+		parents = []string{tip}
+	}
+	message := fmt.Sprintf("Notes updated by 'mygitserver notes %s'\n", command)
+	_, err = writeNotesTree(notesRef, parents, notes, message)
+	return err
+}
+
+// noteFor returns the note text attached to commitHash under notesRef.
+func noteFor(notesRef, commitHash string) (string, bool) {
+	_, notes, err := readNotesTree(notesRef)
+	if err != nil {
+		return "", false
+	}
+	blob, ok := notes[commitHash]
+	if !ok {
+		return "", false
+	}
+	content, err := readObject(blob)
+	if err != nil {
+		return "", false
+	}
+	return string(content), true
+}
+
+// NotesAdd attaches a note to commitish. The text comes from the -m
+// paragraphs or the -F file in message, or from the editor when neither is
+// set. An existing note is only replaced when force is set.
+func NotesAdd(notesRef, commitish string, message CommitOptions, force bool) error {
+	notesRef = expandNotesRef(notesRef)
+	commitHash, err := resolveCommit(commitish)
+	if err != nil {
+		return err
+	}
+	if _, exists := noteFor(notesRef, commitHash); exists && !force {
+		return fmt.Errorf("cannot add notes: notes already exist for object %s; use -f to overwrite", commitHash)
+	}
+
+	var text string
+	switch {
+	case len(message.Messages) > 0:
+		text = cleanupMessage(strings.Join(message.Messages, "\n\n"), false)
+	case message.File != "":
+		content, err := readNoteInput(message.File)
+		if err != nil {
+			return fmt.Errorf("could not read '%s': %v", message.File, err)
+		}
+		text = cleanupMessage(content, false)
+	default:
+		if text, err = editNote(notesRef, commitHash, ""); err != nil {
+			return err
+		}
+	}
+	if text == "" {
+		return fmt.Errorf("aborting due to empty note")
+	}
+	if err := updateNote(notesRef, commitHash, text, "add"); err != nil {
+		return fmt.Errorf("could not write note: %v", err)
+	}
+	fmt.Printf("Added note to %s in %s\n", shortHash(commitHash), notesRef)
+	return nil
+}
+
+// NotesEdit opens the note for commitish in the editor, creating it if
+// needed. Clearing the buffer removes the note.
+func NotesEdit(notesRef, commitish string) error {
+	notesRef = expandNotesRef(notesRef)
+	commitHash, err := resolveCommit(commitish)
+	if err != nil {
+		return err
+	}
+	existing, _ := noteFor(notesRef, commitHash)
+	text, err := editNote(notesRef, commitHash, existing)
+	if err != nil {
+		return err
+	}
+	if text == "" {
+		if existing == "" {
+			return fmt.Errorf("aborting due to empty note")
+		}
+		if err := updateNote(notesRef, commitHash, "", "edit"); err != nil {
+			return fmt.Errorf("could not remove note: %v", err)
+		}
+		fmt.Printf("Removing note for object %s\n", commitHash)
+		return nil
+	}
+	if err := updateNote(notesRef, commitHash, text, "edit"); err != nil {
+		return fmt.Errorf("could not write note: %v", err)
+	}
+	fmt.Printf("Updated note for %s in %s\n", shortHash(commitHash), notesRef)
+	return nil
+}
+
+func editNote(notesRef, commitHash, existing string) (string, error) {
+	buffer := existing
+	if buffer != "" && !strings.HasSuffix(buffer, "\n") {
+		buffer += "\n"
+	}
+	buffer += fmt.Sprintf("\n# Write/edit the notes for the following object:\n#   %s (%s)\n# Lines starting with '#' will be ignored.\n", commitHash, notesRef)
+	edited, err := editBuffer("NOTES_EDITMSG", buffer)
+	if err != nil {
+		return "", err
+	}
+	return cleanupMessage(edited, true), nil
+}
+
+// NotesShow prints the note attached to commitish.
+func NotesShow(notesRef, commitish string) error {
+	notesRef = expandNotesRef(notesRef)
+	commitHash, err := resolveCommit(commitish)
+	if err != nil {
+		return err
+	}
+	text, ok := noteFor(notesRef, commitHash)
+	if !ok {
+		return fmt.Errorf("no note found for object %s", commitHash)
+	}
+	fmt.Print(text)
+	return nil
+}
+
+// NotesRemove deletes the notes attached to each commitish.
+func NotesRemove(notesRef string, commitishes []string) error {
+	notesRef = expandNotesRef(notesRef)
+	if len(commitishes) == 0 {
+		commitishes = []string{"HEAD"}
+	}
+	for _, commitish := range commitishes {
+		commitHash, err := resolveCommit(commitish)
+		if err != nil {
+			return err
+		}
+		if _, ok := noteFor(notesRef, commitHash); !ok {
+			return fmt.Errorf("object %s has no note", commitHash)
+		}
+		if err := updateNote(notesRef, commitHash, "", "remove"); err != nil {
+			return fmt.Errorf("could not remove note: %v", err)
+		}
+		fmt.Printf("Removing note for object %s\n", commitHash)
+	}
+	return nil
+}
+
+// NotesList prints "<note blob> <commit>" for every note, or just the note
+// blob for commitish when one is given.
+func NotesList(notesRef, commitish string) error {
+	notesRef = expandNotesRef(notesRef)
+	_, notes, err := readNotesTree(notesRef)
+	if err != nil {
+		return err
+	}
+	if commitish != "" {
+		commitHash, err := resolveCommit(commitish)
+		if err != nil {
+			return err
+		}
+		blob, ok := notes[commitHash]
+		if !ok {
+			return fmt.Errorf("no note found for object %s", commitHash)
+		}
+		fmt.Println(blob)
+		return nil
+	}
+
+	commits := make([]string, 0, len(notes))
+	for commitHash := range notes {
+		commits = append(commits, commitHash)
+	}
+	sort.Strings(commits)
+	for _, commitHash := range commits {
+		fmt.Printf("%s %s\n", notes[commitHash], commitHash)
+	}
+	return nil
+}
+
+// NotesMerge merges the notes in otherRef into notesRef. Notes changed on
+// only one side since the merge base are taken as-is; notes changed on both
+// sides are combined according to strategy.
+func NotesMerge(notesRef, otherRef, strategy string) error {
+	notesRef = expandNotesRef(notesRef)
+	otherRef = expandNotesRef(otherRef)
+	if strategy == "" {
+		strategy = NotesMergeManual
+		if configured, ok := getConfig("notes.mergeStrategy"); ok {
+			strategy = configured
+		}
+	}
+	switch strategy {
+	case NotesMergeManual, NotesMergeOurs, NotesMergeTheirs, NotesMergeUnion, NotesMergeCatSortUniq:
+	default:
+		return fmt.Errorf("unknown notes merge strategy '%s'", strategy)
+	}
+
+	localTip, localNotes, err := readNotesTree(notesRef)
+	if err != nil {
+		return err
+	}
+	remoteTip, remoteNotes, err := readNotesTree(otherRef)
+	if err != nil {
+		return err
+	}
+	if remoteTip == "" {
+		return fmt.Errorf("notes ref '%s' does not exist", otherRef)
+	}
+
+	if localTip == "" {
+		fmt.Printf("Fast-forward %s to %s\n", notesRef, shortHash(remoteTip))
+		return updateRef(notesRef, remoteTip, "notes: Fast-forward merge of "+otherRef)
+	}
+	if upToDate, err := isAncestor(remoteTip, localTip); err != nil {
+		return err
+	} else if upToDate {
+		fmt.Println("Already up to date.")
+		return nil
+	}
+	if fastForward, err := isAncestor(localTip, remoteTip); err != nil {
+		return err
+	} else if fastForward {
+		fmt.Printf("Fast-forward %s to %s\n", notesRef, shortHash(remoteTip))
+		return updateRef(notesRef, remoteTip, "notes: Fast-forward merge of "+otherRef)
+	}
+
+	baseNotes := map[string]string{}
+	if base, err := mergeBase(localTip, remoteTip); err == nil {
+		baseCommit, err := readCommit(base)
+		if err != nil {
+			return err
+		}
+		if baseNotes, err = readTree(baseCommit.Tree); err != nil {
+			return err
+		}
+	}
+
+	merged := make(map[string]string)
+	var conflicts []string
+	for _, commitHash := range unionKeys(baseNotes, localNotes, remoteNotes) {
+		base, local, remote := baseNotes[commitHash], localNotes[commitHash], remoteNotes[commitHash]
+		var result string
+		switch {
+		case local == remote:
+			result = local
+		case base == local:
+			result = remote
+		case base == remote:
+			result = local
+		default:
+			var ok bool
+			result, ok, err = combineNotes(strategy, local, remote)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				conflicts = append(conflicts, commitHash)
+				continue
+			}
+		}
+		if result != "" {
+			merged[commitHash] = result
+		}
+	}
+
+	if len(conflicts) > 0 {
+		fmt.Println("Conflicting notes for:")
+		for _, commitHash := range conflicts {
+			fmt.Printf("\t%s\n", commitHash)
+		}
+		return fmt.Errorf("automatic notes merge failed; rerun with -s ours, theirs, union or cat_sort_uniq")
+	}
+
+	message := fmt.Sprintf("Notes merged by 'mygitserver notes merge' from %s\n", otherRef)
+	mergeCommit, err := writeNotesTree(notesRef, []string{localTip, remoteTip}, merged, message)
+	if err != nil {
+		return fmt.Errorf("could not write merged notes: %v", err)
+	}
+	fmt.Printf("Merged notes from %s into %s (%s)\n", otherRef, notesRef, shortHash(mergeCommit))
+	return nil
+}
+
+// combineNotes resolves a note changed on both sides. ok is false when the
+// strategy leaves the conflict to the user.
+func combineNotes(strategy, local, remote string) (string, bool, error) {
+	switch strategy {
+	case NotesMergeOurs:
+		return local, true, nil
+	case NotesMergeTheirs:
+		return remote, true, nil
+	case NotesMergeManual:
+		return "", false, nil
+	}
+
+	// A note deleted on one side and changed on the other keeps the change.
+	if local == "" || remote == "" {
+		return local + remote, true, nil
+	}
+	localText, err := readObject(local)
+	if err != nil {
+		return "", false, err
+	}
+	remoteText, err := readObject(remote)
+	if err != nil {
+		return "", false, err
+	}
+
+	var text string
+	if strategy == NotesMergeUnion {
+		text = strings.TrimRight(string(localText), "\n") + "\n\n" + string(remoteText)
+	} else {
+		lines := strings.Split(strings.TrimRight(string(localText), "\n")+"\n"+strings.TrimRight(string(remoteText), "\n"), "\n")
+		sort.Strings(lines)
+		var unique []string
+		for i, line := range lines {
+			if i == 0 || line != lines[i-1] {
+				unique = append(unique, line)
+			}
+		}
+		text = strings.Join(unique, "\n") + "\n"
+	}
+	blob, err := writeObject([]byte(text))
+	return blob, err == nil, err
+}
+
+func unionKeys(maps ...map[string]string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range maps {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readNoteInput reads a note message file, "-" meaning standard input.
+func readNoteInput(path string) (string, error) {
+	if path == "-" {
+		content, err := ioutil.ReadAll(os.Stdin)
+		return string(content), err
+	}
+	content, err := ioutil.ReadFile(path)
+	return string(content), err
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"fmt"
+	"gitserver/internal/utils"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// commitObject is the parsed form of a commit stored under objects/. On disk
+// a commit is a block of "key: value" header lines, a blank line and the
+// free-form message.
+type commitObject struct {
+	Tree      string
+	Parents   []string
+	Author    string
+	Timestamp string
+	Message   string
+}
+
+func writeObject(content []byte) (string, error) {
+	hash := utils.GenerateHash(string(content))
+	objectPath := repoPath("objects", hash)
+	if _, err := os.Stat(objectPath); err == nil {
+		return hash, nil
+	}
+	if err := ioutil.WriteFile(objectPath, content, 0644); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func readObject(hash string) ([]byte, error) {
+	content, err := ioutil.ReadFile(repoPath("objects", hash))
+	if err != nil {
+		return nil, fmt.Errorf("could not read object '%s'", hash)
+	}
+	return content, nil
+}
+
+// writeTree stores a tree object mapping paths to object hashes. Trees are
+// flat: every line is "<hash> <path>", sorted by path.
+func writeTree(entries map[string]string) (string, error) {
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	for _, path := range paths {
+		fmt.Fprintf(&b, "%s %s\n", entries[path], path)
+	}
+	return writeObject([]byte(b.String()))
+}
+
+func readTree(hash string) (map[string]string, error) {
+	entries := make(map[string]string)
+	if hash == "" {
+		return entries, nil
+	}
+	content, err := readObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		objectHash, path, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("malformed tree '%s'", hash)
+		}
+		entries[path] = objectHash
+	}
+	return entries, nil
+}
+
+func (c *commitObject) serialize() []byte {
+	var b strings.Builder
+	if c.Tree != "" {
+		fmt.Fprintf(&b, "tree: %s\n", c.Tree)
+	}
+	for _, parent := range c.Parents {
+		fmt.Fprintf(&b, "parent: %s\n", parent)
+	}
+	fmt.Fprintf(&b, "author: %s\n", c.Author)
+	fmt.Fprintf(&b, "timestamp: %s\n", c.Timestamp)
+	b.WriteString("\n")
+	b.WriteString(c.Message)
+	return []byte(b.String())
+}
+
+// Subject returns the first line of the commit message.
+func (c *commitObject) Subject() string {
+	return strings.SplitN(c.Message, "\n", 2)[0]
+}
+
+func parseCommit(content []byte) (*commitObject, error) {
+	commit := &commitObject{}
+	header, message, _ := strings.Cut(string(content), "\n\n")
+	commit.Message = message
+	for _, line := range strings.Split(header, "\n") {
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, fmt.Errorf("malformed commit header line %q", line)
+		}
+		switch key {
+		case "tree":
+			commit.Tree = value
+		case "parent":
+			commit.Parents = append(commit.Parents, value)
+		case "author":
+			commit.Author = value
+		case "timestamp":
+			commit.Timestamp = value
+		}
+	}
+	return commit, nil
+}
+
+func readCommit(hash string) (*commitObject, error) {
+	content, err := readObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := parseCommit(content)
+	if err != nil {
+		return nil, fmt.Errorf("commit '%s': %v", hash, err)
+	}
+	return commit, nil
+}
+
+func writeCommit(commit *commitObject) (string, error) {
+	if commit.Author == "" {
+		commit.Author = currentIdentity()
+	}
+	if commit.Timestamp == "" {
+		commit.Timestamp = time.Now().Format(time.RFC3339)
+	}
+	return writeObject(commit.serialize())
+}
+
+// currentIdentity returns "Name <email>" from user.name and user.email,
+// falling back to the login name.
+func currentIdentity() string {
+	name, ok := getConfig("user.name")
+	if !ok || name == "" {
+		name = os.Getenv("USER")
+	}
+	if name == "" {
+		name = "unknown"
+	}
+	email, ok := getConfig("user.email")
+	if !ok || email == "" {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = "localhost"
+		}
+		email = name + "@" + host
+	}
+	return fmt.Sprintf("%s <%s>", name, email)
+}
+
+// objectType guesses the kind of an object from its content, since objects
+// are stored without a type header.
+func objectType(hash string) string {
+	content, err := readObject(hash)
+	if err != nil || len(content) == 0 {
+		return "blob"
+	}
+	if _, err := parseTag(content); err == nil {
+		return "tag"
+	}
+	if commit, err := parseCommit(content); err == nil && commit.Author != "" && commit.Timestamp != "" {
+		return "commit"
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		objectHash, path, ok := strings.Cut(line, " ")
+		if !ok || path == "" || !isFullHash(objectHash) {
+			return "blob"
+		}
+	}
+	return "tree"
+}
+
+// findObjectsByPrefix lists the objects whose hash starts with prefix.
+func findObjectsByPrefix(prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(repoPath("objects"))
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), prefix) {
+			matches = append(matches, file.Name())
+		}
+	}
+	return matches, nil
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
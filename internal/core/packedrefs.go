@@ -0,0 +1,248 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Refs are stored either as loose files under refs/ or as lines of the
+// packed-refs file:
+//
+//	# pack-refs with: peeled fully-peeled sorted
+//	<hash> refs/heads/main
+//	<hash> refs/tags/v1.0
+//	^<peeled hash>
+//
+// A "^" line records what the annotated tag on the line above points at, so
+// tags can be peeled without reading their objects. A loose ref always wins
+// over a packed ref of the same name.
+
+const packedRefsHeader = "# pack-refs with: peeled fully-peeled sorted"
+
+type packedRef struct {
+	Hash   string
+	Peeled string
+}
+
+func packedRefsPath() string {
+	return repoPath("packed-refs")
+}
+
+// packedRefsCache keeps the parsed packed-refs file for as long as the file
+// does not change, since every ref lookup consults it.
+var packedRefsCache struct {
+	path    string
+	modTime time.Time
+	size    int64
+	refs    map[string]packedRef
+}
+
+// readPackedRefs returns the refs stored in packed-refs. The result is
+// shared with the cache and must not be modified.
+func readPackedRefs() (map[string]packedRef, error) {
+	path := packedRefsPath()
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return map[string]packedRef{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if packedRefsCache.refs != nil && packedRefsCache.path == path && info.ModTime().Equal(packedRefsCache.modTime) && info.Size() == packedRefsCache.size {
+		return packedRefsCache.refs, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]packedRef)
+	last := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "^"):
+			if last == "" {
+				return nil, fmt.Errorf("packed-refs: peeled line %q without a ref", line)
+			}
+			entry := refs[last]
+			entry.Peeled = line[1:]
+			refs[last] = entry
+			last = ""
+		default:
+			hash, ref, ok := strings.Cut(line, " ")
+			if !ok || !isFullHash(hash) {
+				return nil, fmt.Errorf("packed-refs: malformed line %q", line)
+			}
+			refs[ref] = packedRef{Hash: hash}
+			last = ref
+		}
+	}
+
+	packedRefsCache.path = path
+	packedRefsCache.modTime = info.ModTime()
+	packedRefsCache.size = info.Size()
+	packedRefsCache.refs = refs
+	return refs, nil
+}
+
+// writePackedRefs replaces packed-refs with refs. The new file is written
+// next to the old one and renamed over it so readers never see a partial
+// file.
+func writePackedRefs(refs map[string]packedRef) error {
+	names := make([]string, 0, len(refs))
+	for ref := range refs {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(packedRefsHeader + "\n")
+	for _, ref := range names {
+		fmt.Fprintf(&b, "%s %s\n", refs[ref].Hash, ref)
+		if refs[ref].Peeled != "" {
+			fmt.Fprintf(&b, "^%s\n", refs[ref].Peeled)
+		}
+	}
+
+	tmp := packedRefsPath() + ".new"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	packedRefsCache.refs = nil
+	return os.Rename(tmp, packedRefsPath())
+}
+
+// removePackedRef drops ref from packed-refs, reporting whether it was there.
+func removePackedRef(ref string) (bool, error) {
+	packed, err := readPackedRefs()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := packed[ref]; !ok {
+		return false, nil
+	}
+	remaining := make(map[string]packedRef, len(packed)-1)
+	for name, entry := range packed {
+		if name != ref {
+			remaining[name] = entry
+		}
+	}
+	return true, writePackedRefs(remaining)
+}
+
+// peeledValue returns the packed peeled value of an annotated tag ref, or
+// peels the ref's current value when it is loose.
+func peeledValue(ref string) (string, error) {
+	hash, err := readRef(ref)
+	if err != nil {
+		return "", err
+	}
+	if !looseRefExists(ref) {
+		if packed, err := readPackedRefs(); err == nil && packed[ref].Hash == hash && packed[ref].Peeled != "" {
+			return packed[ref].Peeled, nil
+		}
+	}
+	return peelTag(hash)
+}
+
+// PackRefsOptions controls PackRefs. By default only tags and refs that are
+// already packed are packed, as branches move too often to be worth it; All
+// packs every ref. NoPrune leaves the loose files in place.
+type PackRefsOptions struct {
+	All     bool
+	NoPrune bool
+}
+
+// PackRefs moves loose refs into the packed-refs file, recording the peeled
+// value of annotated tags.
+func PackRefs(opts PackRefsOptions) error {
+	packed, err := readPackedRefs()
+	if err != nil {
+		return err
+	}
+	loose, err := listLooseRefs("refs/")
+	if err != nil {
+		return err
+	}
+
+	refs := make(map[string]packedRef, len(packed)+len(loose))
+	for ref, entry := range packed {
+		refs[ref] = entry
+	}
+	var pruned []string
+	for ref, hash := range loose {
+		_, wasPacked := packed[ref]
+		if !opts.All && !wasPacked && !strings.HasPrefix(ref, "refs/tags/") {
+			continue
+		}
+		if hash == "" {
+			// An unborn branch has nothing to pack.
+			continue
+		}
+		entry := packedRef{Hash: hash}
+		if objectType(hash) == "tag" {
+			if entry.Peeled, err = peelTag(hash); err != nil {
+				return err
+			}
+		}
+		refs[ref] = entry
+		pruned = append(pruned, ref)
+	}
+
+	if err := writePackedRefs(refs); err != nil {
+		return fmt.Errorf("could not write packed-refs: %v", err)
+	}
+	if !opts.NoPrune {
+		for _, ref := range pruned {
+			if err := removeLooseRef(ref); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Printf("Packed %d refs\n", len(pruned))
+	return nil
+}
+
+// ShowRefs prints every ref as "<hash> <ref>". With dereference, annotated
+// tags are followed by a "<peeled> <ref>^{}" line.
+func ShowRefs(patterns []string, dereference bool) error {
+	refs, err := listRefs("refs/")
+	if err != nil {
+		return err
+	}
+	for _, ref := range unionKeys(refs) {
+		if !matchesRefPattern(ref, patterns) {
+			continue
+		}
+		fmt.Printf("%s %s\n", refs[ref], ref)
+		if dereference && objectType(refs[ref]) == "tag" {
+			peeled, err := peeledValue(ref)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s %s^{}\n", peeled, ref)
+		}
+	}
+	return nil
+}
+
+// matchesRefPattern reports whether one of patterns matches the tail of
+// ref at a component boundary, as git show-ref does ("main" matches
+// refs/heads/main and refs/remotes/origin/main).
+func matchesRefPattern(ref string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ref == pattern || strings.HasSuffix(ref, "/"+pattern) {
+			return true
+		}
+	}
+	return false
+}
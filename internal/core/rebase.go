@@ -1,330 +1,698 @@
 package core
 
 import (
-	"bufio"
 	"fmt"
-	"gitserver/internal/utils"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"strings"
 )
 
-func AbortRebase() {
-	err := os.Remove(filepath.Join(".mygitserver", "rebase"))
-	if err != nil {
-		fmt.Println("Error aborting rebase:", err)
-		return
-	}
-
-	fmt.Println("Rebase aborted.")
+// A rebase replays the commits of the current branch that upstream does
+// not have on top of onto, which is upstream itself unless --onto names
+// another commit. HEAD is detached at onto while the commits are picked one
+// by one, and the branch is moved to the result once they all apply. The
+// state of a rebase in progress lives in the rebase directory:
+//
+//	rebase/head-name    the branch being rebased, or "detached HEAD"
+//	rebase/onto         the commit the branch is rebased onto
+//	rebase/orig-head    where the branch was before the rebase
+//	rebase/todo         the steps left, one "<action> <hash> <subject>"
+//	                    line each
+//	rebase/done         the steps taken so far
+//	rebase/stopped      the step that stopped the rebase, if one did
+//	rebase/interactive  present for an interactive rebase
+//
+// A step picks its commit ("pick"), melds it into the commit before it,
+// combining their messages ("squash"), picks it and stops so that it can
+// be amended ("edit"), or leaves it out ("drop"). A step stopped by
+// conflicts has its prepared message in MERGE_MSG.
+
+// RebaseOptions controls Rebase. Interactive lets the user edit the todo
+// list of steps before anything is changed. TodoFile reads the todo list
+// from a file instead of the editor, and implies Interactive. Onto rebases
+// onto that commit instead of upstream. Branch, when set, is checked out
+// first.
+type RebaseOptions struct {
+	Interactive bool
+	TodoFile    string
+	Onto        string
+	Branch      string
 }
 
-func getLatestCommitHash(branch string) (string, error) {
-	commitHashPath := filepath.Join(".mygitserver", "refs", "heads", branch)
-	commitHashBytes, err := ioutil.ReadFile(commitHashPath)
-	if err != nil {
-		return "", fmt.Errorf("could not read commit hash for branch '%s'", branch)
+// Rebase replays the commits of the current branch that are not in
+// upstream on top of it, or on top of opts.Onto.
+func Rebase(upstream string, opts RebaseOptions) error {
+	if rebaseInProgress() {
+		return fmt.Errorf("a rebase is already in progress; use 'mygitserver rebase --continue', '--skip' or '--abort'")
+	}
+	if err := checkNoSequencerInProgress(); err != nil {
+		return err
+	}
+	if _, ok := mergeHeads(); ok {
+		return fmt.Errorf("you have not concluded your merge (MERGE_HEAD exists); please commit your changes or abort the merge")
+	}
+	if err := checkNoUnmergedPaths("rebasing"); err != nil {
+		return err
+	}
+	if opts.Branch != "" {
+		if err := Checkout(opts.Branch, CheckoutOptions{}); err != nil {
+			return err
+		}
+	}
+	if err := checkCleanWorkTree("rebase"); err != nil {
+		return err
 	}
-	return strings.TrimSpace(string(commitHashBytes)), nil
-}
 
-func getCommitsAfter(baseCommit string, branch string) ([]string, error) {
-	commits, err := getCommitsFromBranch(branch)
+	head, err := headCommit()
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	var result []string
-	for _, commit := range commits {
-		if commit == baseCommit {
-			break
+	if head == "" {
+		return fmt.Errorf("cannot rebase a branch without commits")
+	}
+	upstreamHash, err := resolveCommit(upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream '%s'", upstream)
+	}
+	onto, ontoName := upstreamHash, upstream
+	if opts.Onto != "" {
+		if onto, err = resolveCommit(opts.Onto); err != nil {
+			return fmt.Errorf("does not point to a valid commit: '%s'", opts.Onto)
 		}
-		result = append(result, commit)
+		ontoName = opts.Onto
 	}
-	return result, nil
-}
-
-func findBaseCommit(sourceBranch, targetBranch string) (string, error) {
-	sourceCommits, err := getCommitsFromBranch(sourceBranch)
+	ref, detached, err := readHead()
 	if err != nil {
-		return "", err
+		return fmt.Errorf("could not read HEAD: %v", err)
+	}
+	headName := ref
+	if detached {
+		headName = "detached HEAD"
 	}
 
-	targetCommits, err := getCommitsFromBranch(targetBranch)
+	// Merge commits are left out, so the rest are replayed as a line.
+	commits, err := walkCommits([]string{head}, []string{upstreamHash})
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	for _, sourceCommit := range sourceCommits {
-		for _, targetCommit := range targetCommits {
-			if sourceCommit == targetCommit {
-				return sourceCommit, nil // Found common commit
-			}
+	var todo []todoItem
+	linear := true
+	for i := len(commits) - 1; i >= 0; i-- {
+		commit, err := readCommit(commits[i])
+		if err != nil {
+			return fmt.Errorf("could not read commit %s: %v", commits[i], err)
+		}
+		if len(commit.Parents) > 1 {
+			linear = false
+			continue
+		}
+		todo = append(todo, todoItem{Action: "pick", Hash: commits[i]})
+	}
+	if !opts.Interactive && opts.TodoFile == "" && linear && (len(todo) == 0 && head == onto || len(todo) > 0 && getParentCommit(todo[0].Hash) == onto) {
+		fmt.Printf("Current branch %s is up to date.\n", strings.TrimPrefix(headName, "refs/heads/"))
+		return nil
+	}
+	if opts.TodoFile != "" {
+		opts.Interactive = true
+		content, err := ioutil.ReadFile(opts.TodoFile)
+		if err != nil {
+			return fmt.Errorf("could not read todo file '%s': %v", opts.TodoFile, err)
+		}
+		if todo, err = parseRebaseTodo(string(content)); err != nil {
+			return err
+		}
+	} else if opts.Interactive {
+		if todo, err = editRebaseTodo(todo, upstreamHash, head, onto); err != nil {
+			return err
 		}
 	}
 
-	return "", fmt.Errorf("no common commit found between '%s' and '%s'", sourceBranch, targetBranch)
-}
-
-func getCommitsFromBranch(branch string) ([]string, error) {
-	var commits []string
-	commitHash, err := getLatestCommitHash(branch)
-	if err != nil {
-		return nil, err
+	if err := os.MkdirAll(repoPath("rebase"), 0755); err != nil {
+		return err
+	}
+	state := map[string]string{"head-name": headName, "onto": onto, "orig-head": head}
+	if opts.Interactive {
+		state["interactive"] = ""
+	}
+	for name, value := range state {
+		if err := ioutil.WriteFile(repoPath("rebase", name), []byte(value+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	if err := writeRebaseTodo("todo", todo); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(repoPath("ORIG_HEAD"), []byte(head+"\n"), 0644); err != nil {
+		return err
 	}
 
-	for commitHash != "" {
-		commits = append(commits, commitHash)
-		commitHash = getParentCommit(commitHash)
+	if err := switchWorkingTree(head, onto, shortHash(onto), CheckoutOptions{}); err != nil {
+		os.RemoveAll(repoPath("rebase"))
+		return err
+	}
+	if err := switchHead("", head, onto, "rebase (start): checkout "+ontoName); err != nil {
+		return err
 	}
-	return commits, nil
+	return runRebase()
 }
 
-func reapplyCommit(commitHash, baseCommitHash string) {
-	commitPath := filepath.Join(".mygitserver", "objects", commitHash)
-	commitContent, err := ioutil.ReadFile(commitPath)
+// InteractiveRebase rebases sourceBranch onto targetBranch, letting the
+// user edit the todo list first.
+func InteractiveRebase(sourceBranch, targetBranch string) error {
+	return Rebase(targetBranch, RebaseOptions{Interactive: true, Branch: sourceBranch})
+}
+
+// checkCleanWorkTree fails when tracked files have staged or unstaged
+// changes, which action would otherwise mix into the commits it makes.
+func checkCleanWorkTree(action string) error {
+	head, err := headCommit()
 	if err != nil {
-		fmt.Printf("Error reading commit '%s': %v\n", commitHash, err)
-		return
+		return err
 	}
-
-	newCommitContent := strings.Replace(string(commitContent), fmt.Sprintf("parent: %s", getParentCommit(commitHash)), fmt.Sprintf("parent: %s", baseCommitHash), 1)
-
-	newCommitHash := utils.GenerateHash(newCommitContent)
-
-	err = ioutil.WriteFile(filepath.Join(".mygitserver", "objects", newCommitHash), []byte(newCommitContent), 0644)
+	headTree, err := commitTree(head)
+	if err != nil {
+		return err
+	}
+	index, err := readIndex()
 	if err != nil {
-		fmt.Printf("Error writing new commit '%s': %v\n", newCommitHash, err)
-		return
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	for _, path := range unionKeys(index, headTree) {
+		if index[path] != headTree[path] {
+			return fmt.Errorf("cannot %s: your index contains uncommitted changes; commit or stash them", action)
+		}
 	}
+	for path, hash := range index {
+		if working, ok := workingFileHash(path); !ok || working != hash {
+			return fmt.Errorf("cannot %s: you have unstaged changes; commit or stash them", action)
+		}
+	}
+	return nil
+}
 
-	fmt.Printf("Reapplied commit '%s' as '%s'\n", commitHash, newCommitHash)
+// rebaseCommands maps the commands of a todo list, and their one-letter
+// abbreviations, to step actions.
+var rebaseCommands = map[string]string{
+	"p": "pick", "pick": "pick",
+	"e": "edit", "edit": "edit",
+	"s": "squash", "squash": "squash",
+	"d": "drop", "drop": "drop",
 }
 
-func squashCommit(previousCommitHash, commitHash string) {
-	previousCommitPath := filepath.Join(".mygitserver", "objects", previousCommitHash)
-	commitPath := filepath.Join(".mygitserver", "objects", commitHash)
+const rebaseTodoHelp = `
+# Commands:
+# p, pick <commit> = use commit
+# e, edit <commit> = use commit, but stop for amending
+# s, squash <commit> = use commit, but meld into previous commit
+# d, drop <commit> = remove commit
+#
+# These lines can be re-ordered; they are executed from top to bottom.
+#
+# If you remove a line here THAT COMMIT WILL BE LOST.
+#
+# However, if you remove everything, the rebase will be aborted.
+`
+
+// editRebaseTodo opens the todo list in the editor, one "pick" line per
+// commit followed by a commented summary, and returns the steps as edited.
+func editRebaseTodo(todo []todoItem, upstream, head, onto string) ([]todoItem, error) {
+	var b strings.Builder
+	for _, item := range todo {
+		subject := ""
+		if commit, err := readCommit(item.Hash); err == nil {
+			subject = commit.Subject()
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", item.Action, shortHash(item.Hash), subject)
+	}
+	fmt.Fprintf(&b, "\n# Rebase %s..%s onto %s (%d commands)\n#", shortHash(upstream), shortHash(head), shortHash(onto), len(todo))
+	b.WriteString(rebaseTodoHelp)
 
-	previousContent, err := ioutil.ReadFile(previousCommitPath)
+	edited, err := editBuffer("rebase-todo", b.String())
+	os.Remove(repoPath("rebase-todo"))
 	if err != nil {
-		fmt.Printf("Error reading commit '%s': %v\n", previousCommitHash, err)
-		return
+		return nil, err
 	}
+	return parseRebaseTodo(edited)
+}
 
-	commitContent, err := ioutil.ReadFile(commitPath)
-	if err != nil {
-		fmt.Printf("Error reading commit '%s': %v\n", commitHash, err)
-		return
+// parseRebaseTodo reads an edited todo list: "<command> <commit> [...]"
+// lines, with blank lines and '#' comments ignored. Every invalid line is
+// reported, by line number, in the error.
+func parseRebaseTodo(content string) ([]todoItem, error) {
+	var todo []todoItem
+	var problems []string
+	listed := make(map[string]int)
+	picked := false
+	for i, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		action, ok := rebaseCommands[fields[0]]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("line %d: unknown command '%s'", i+1, fields[0]))
+			continue
+		}
+		if len(fields) < 2 {
+			problems = append(problems, fmt.Sprintf("line %d: missing commit after '%s'", i+1, fields[0]))
+			continue
+		}
+		hash, err := resolveCommit(fields[1])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: '%s' is not a commit", i+1, fields[1]))
+			continue
+		}
+		if first, ok := listed[hash]; ok {
+			problems = append(problems, fmt.Sprintf("line %d: commit %s is already listed on line %d", i+1, shortHash(hash), first))
+			continue
+		}
+		listed[hash] = i + 1
+		if action == "squash" && !picked {
+			problems = append(problems, fmt.Sprintf("line %d: cannot 'squash' without a previous commit", i+1))
+			continue
+		}
+		picked = picked || action != "drop"
+		todo = append(todo, todoItem{Action: action, Hash: hash})
 	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid todo list:\n%s", strings.Join(problems, "\n"))
+	}
+	if len(todo) == 0 {
+		return nil, fmt.Errorf("nothing to do")
+	}
+	return todo, nil
+}
 
-	squashedContent := string(previousContent) + "\n" + string(commitContent)
+func rebaseInProgress() bool {
+	_, err := os.Stat(repoPath("rebase", "head-name"))
+	return err == nil
+}
 
-	newCommitHash := utils.GenerateHash(squashedContent)
+func readRebaseState(name string) string {
+	content, _ := ioutil.ReadFile(repoPath("rebase", name))
+	return strings.TrimSpace(string(content))
+}
 
-	err = ioutil.WriteFile(filepath.Join(".mygitserver", "objects", newCommitHash), []byte(squashedContent), 0644)
-	if err != nil {
-		fmt.Printf("Error writing squashed commit: %v\n", err)
-		return
+func writeRebaseTodo(name string, todo []todoItem) error {
+	var b strings.Builder
+	for _, item := range todo {
+		subject := ""
+		if commit, err := readCommit(item.Hash); err == nil {
+			subject = commit.Subject()
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", item.Action, item.Hash, subject)
 	}
-
-	fmt.Printf("Squashed commit '%s' with '%s' into '%s'\n", previousCommitHash, commitHash, newCommitHash)
+	return ioutil.WriteFile(repoPath("rebase", name), []byte(b.String()), 0644)
 }
 
-func editCommit(commitHash string) {
-	commitPath := filepath.Join(".mygitserver", "objects", commitHash)
-	content, err := ioutil.ReadFile(commitPath)
-	if err != nil {
-		fmt.Printf("Error reading commit '%s': %v\n", commitHash, err)
-		return
+func readRebaseTodo(name string) ([]todoItem, error) {
+	content, err := ioutil.ReadFile(repoPath("rebase", name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read rebase %s list: %v", name, err)
 	}
+	var todo []todoItem
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			todo = append(todo, todoItem{Action: fields[0], Hash: fields[1]})
+		}
+	}
+	return todo, nil
+}
 
-	fmt.Println("Current commit content:")
-	fmt.Println(string(content))
-
-	fmt.Println("Enter new commit content (leave empty to keep unchanged):")
-	reader := bufio.NewReader(os.Stdin)
-	newContent, _ := reader.ReadString('\n')
-	newContent = strings.TrimSpace(newContent)
-
-	if newContent != "" {
-		err = ioutil.WriteFile(commitPath, []byte(newContent), 0644)
+// runRebase takes the remaining steps in order, moving each to the done
+// list before it is taken, and finishes the rebase when none are left.
+func runRebase() error {
+	for {
+		todo, err := readRebaseTodo("todo")
 		if err != nil {
-			fmt.Printf("Error saving edited commit '%s': %v\n", commitHash, err)
-			return
+			return err
+		}
+		if len(todo) == 0 {
+			return finishRebase()
+		}
+		done, err := readRebaseTodo("done")
+		if err != nil {
+			return err
+		}
+		if err := writeRebaseTodo("done", append(done, todo[0])); err != nil {
+			return err
+		}
+		if err := writeRebaseTodo("todo", todo[1:]); err != nil {
+			return err
+		}
+		stopped, err := rebaseStep(todo[0])
+		if err != nil && !stopped {
+			// Nothing was recorded for --continue: put the step back so that
+			// it is tried again rather than lost.
+			if err := writeRebaseTodo("done", done); err != nil {
+				return err
+			}
+			if err := writeRebaseTodo("todo", todo); err != nil {
+				return err
+			}
+		}
+		if stopped || err != nil {
+			return err
 		}
-		fmt.Printf("Commit '%s' edited successfully.\n", commitHash)
-	} else {
-		fmt.Println("No changes made to the commit.")
 	}
 }
 
-func InteractiveRebase(sourceBranch, targetBranch string) {
-	targetCommitHash, err := getLatestCommitHash(targetBranch)
+// rebaseStep applies one step on top of HEAD. stopped reports that the
+// rebase stopped for the user, with or without an error: for conflicts,
+// which err describes, or to edit the commit. An error without stopped
+// means the step was not recorded and has to be taken again.
+func rebaseStep(item todoItem) (stopped bool, err error) {
+	if item.Action == "drop" {
+		return false, nil
+	}
+	commit, err := readCommit(item.Hash)
 	if err != nil {
-		fmt.Printf("Error getting latest commit for target branch '%s': %v\n", targetBranch, err)
-		return
+		return false, fmt.Errorf("could not read commit %s: %v", item.Hash, err)
 	}
-
-	baseCommitHash, err := findBaseCommit(sourceBranch, targetBranch)
+	head, err := headCommit()
 	if err != nil {
-		fmt.Printf("Error finding base commit between '%s' and '%s': %v\n", sourceBranch, targetBranch, err)
-		return
+		return false, err
 	}
-
-	sourceCommits, err := getCommitsAfter(baseCommitHash, sourceBranch)
+	headTree, err := commitTree(head)
 	if err != nil {
-		fmt.Printf("Error getting commits after base commit from source branch '%s': %v\n", sourceBranch, err)
-		return
-	}
-
-	actions := promptUserForActions(sourceCommits)
-
-	for _, action := range actions {
-		switch action.Action {
-		case "pick":
-			conflictResolved := resolveConflict(action.CommitHash, targetCommitHash)
-			if conflictResolved {
-				fmt.Printf("Conflict automatically resolved between '%s' and '%s'.\n", action.CommitHash, targetBranch)
-			} else {
-				fmt.Printf("Conflict detected while rebasing commit '%s' onto '%s'.\n", action.CommitHash, targetBranch)
-				fmt.Println("Resolve the conflicts and run 'gitserver rebase --continue' to resume, or 'gitserver rebase --abort' to abort.")
-				pauseRebase(action.CommitHash, targetCommitHash)
-				return
-			}
-			reapplyCommit(action.CommitHash, targetCommitHash)
-			targetCommitHash = action.CommitHash
-
-		case "squash":
-			if action.PreviousCommitHash == "" {
-				fmt.Println("Squash requires a previous commit to combine with.")
-				return
-			}
-			conflictResolved := resolveConflict(action.PreviousCommitHash, action.CommitHash)
-			if conflictResolved {
-				squashCommit(action.PreviousCommitHash, action.CommitHash)
-			} else {
-				fmt.Printf("Conflict detected during squash of '%s' and '%s'. Resolve the conflict and continue.\n", action.PreviousCommitHash, action.CommitHash)
-				pauseRebase(action.PreviousCommitHash, action.CommitHash)
-				return
-			}
+		return false, err
+	}
+	parentTree, err := commitTree(getParentCommit(item.Hash))
+	if err != nil {
+		return false, err
+	}
+	pickedTree, err := commitTree(item.Hash)
+	if err != nil {
+		return false, err
+	}
+	short := shortHash(item.Hash) + "... " + commit.Subject()
+	fileOpts, err := newMergeFileOptions("HEAD", "parent of "+short, short)
+	if err != nil {
+		return false, err
+	}
+	result, err := mergeTrees(parentTree, headTree, pickedTree, fileOpts)
+	if err != nil {
+		return false, err
+	}
+	if err := checkMergeOverwrites(headTree, result); err != nil {
+		return false, err
+	}
+	if err := applyMergeResult(headTree, result); err != nil {
+		return false, err
+	}
 
-		case "edit":
-			editCommit(action.CommitHash)
-		case "drop":
-			fmt.Printf("Dropping commit '%s'\n", action.CommitHash)
+	message := strings.TrimRight(commit.Message, "\n") + "\n"
+	if item.Action == "squash" {
+		current, err := readCommit(head)
+		if err != nil {
+			return true, err
 		}
+		message = strings.TrimRight(current.Message, "\n") + "\n\n" + message
+	}
+	if len(result.Conflicts) > 0 {
+		if err := writeRebaseStop(item, message, result); err != nil {
+			return true, err
+		}
+		for _, conflict := range result.Conflicts {
+			fmt.Printf("CONFLICT (%s): Merge conflict in %s\n", conflict.Kind, conflict.Path)
+		}
+		if err := rerereConflicts(result); err != nil {
+			return true, err
+		}
+		return true, fmt.Errorf("could not apply %s; fix conflicts, mark them with 'mygitserver add', then run 'mygitserver rebase --continue'", short)
 	}
 
-	err = ioutil.WriteFile(filepath.Join(".mygitserver", "refs", "heads", sourceBranch), []byte(targetCommitHash), 0644)
-	if err != nil {
-		fmt.Printf("Error updating source branch '%s' to new commit: %v\n", sourceBranch, err)
-		return
+	switch {
+	case item.Action == "squash":
+		err = amendHead(message, "rebase (squash)")
+	case treesEqual(result.Entries, headTree):
+		fmt.Printf("dropping %s -- patch contents already upstream\n", short)
+	default:
+		err = commitPicked("rebase ("+item.Action+")", message, commit.Author)
+	}
+	if err != nil || item.Action != "edit" {
+		return false, err
+	}
+	if err := writeRebaseStop(item, "", result); err != nil {
+		return true, err
+	}
+	fmt.Printf("Stopped at %s\n", short)
+	fmt.Println("You can amend the commit now: make your changes, add them and run")
+	fmt.Println()
+	fmt.Println("  mygitserver rebase --continue")
+	return true, nil
+}
+
+// writeRebaseStop records the step the rebase stopped at. A step stopped
+// by conflicts gets its message, with the conflicted paths listed, in
+// MERGE_MSG; a step stopped for editing has none.
+func writeRebaseStop(item todoItem, message string, result *treeMergeResult) error {
+	if err := ioutil.WriteFile(repoPath("rebase", "stopped"), []byte(item.Action+" "+item.Hash+"\n"), 0644); err != nil {
+		return err
+	}
+	if message == "" {
+		return nil
 	}
+	var b strings.Builder
+	b.WriteString(message)
+	b.WriteString("\n# Conflicts:\n")
+	for _, conflict := range result.Conflicts {
+		fmt.Fprintf(&b, "#\t%s\n", conflict.Path)
+	}
+	return ioutil.WriteFile(repoPath("MERGE_MSG"), []byte(b.String()), 0644)
+}
 
-	fmt.Printf("Successfully rebased branch '%s' onto '%s' interactively.\n", sourceBranch, targetBranch)
+func readRebaseStop() (todoItem, bool) {
+	fields := strings.Fields(readRebaseState("stopped"))
+	if len(fields) != 2 {
+		return todoItem{}, false
+	}
+	return todoItem{Action: fields[0], Hash: fields[1]}, true
 }
 
-func resolveConflict(commitHash1, commitHash2 string) bool {
-	commit1Path := filepath.Join(".mygitserver", "objects", commitHash1)
-	commit2Path := filepath.Join(".mygitserver", "objects", commitHash2)
+func clearRebaseStop() {
+	os.Remove(repoPath("rebase", "stopped"))
+	clearPickState()
+}
 
-	content1, err := ioutil.ReadFile(commit1Path)
+// amendHead replaces HEAD with a commit of the index that has the same
+// parents and author and the given message.
+func amendHead(message, reason string) error {
+	if err := rerereRecord(); err != nil {
+		return err
+	}
+	head, err := headCommit()
 	if err != nil {
-		fmt.Printf("Error reading commit '%s': %v\n", commitHash1, err)
-		return false
+		return err
 	}
-
-	content2, err := ioutil.ReadFile(commit2Path)
+	current, err := readCommit(head)
 	if err != nil {
-		fmt.Printf("Error reading commit '%s': %v\n", commitHash2, err)
-		return false
+		return err
 	}
-
-	if string(content1) == string(content2) {
-		return true
+	index, err := readIndex()
+	if err != nil {
+		return fmt.Errorf("could not read index: %v", err)
 	}
-
-	markConflict(commitHash1, commitHash2, string(content1), string(content2))
-	return false
+	tree, err := writeTree(index)
+	if err != nil {
+		return fmt.Errorf("could not write tree: %v", err)
+	}
+	commit := &commitObject{Tree: tree, Parents: current.Parents, Author: current.Author, Message: message}
+	hash, err := writeCommit(commit)
+	if err != nil {
+		return fmt.Errorf("could not write commit object: %v", err)
+	}
+	if err := updateHeadFrom(head, hash, reason+": "+commit.Subject()); err != nil {
+		return fmt.Errorf("could not update HEAD: %v", err)
+	}
+	fmt.Printf("[%s] %s\n", shortHash(hash), commit.Subject())
+	return nil
 }
 
-func markConflict(commitHash1, commitHash2, content1, content2 string) {
-	conflictContent := fmt.Sprintf("<<<<<<< %s\n%s\n=======\n%s\n>>>>>> %s\n",
-		commitHash1, content1, content2, commitHash2)
-
-	conflictFilePath := filepath.Join(".", "conflicted_file.txt")
-	err := ioutil.WriteFile(conflictFilePath, []byte(conflictContent), 0644)
+// amendEditedHead amends the changes staged during an edit stop into HEAD,
+// keeping its message.
+func amendEditedHead() error {
+	head, err := headCommit()
 	if err != nil {
-		fmt.Println("Error writing conflict file:", err)
-		return
+		return err
 	}
-
-	fmt.Println("Conflict detected and markers have been added to 'conflicted_file.txt'.")
-	fmt.Println("Please resolve the conflicts and run 'gitserver rebase --continue'.")
+	current, err := readCommit(head)
+	if err != nil {
+		return err
+	}
+	return amendHead(current.Message, "rebase (amend)")
 }
 
-func promptUserForActions(commits []string) []Action {
-	var actions []Action
-	fmt.Println("Interactive Rebase - Choose actions for each commit:")
-	fmt.Println("Available actions: 'pick', 'squash', 'edit', 'drop'")
-
-	previousCommit := ""
-	for _, commit := range commits {
-		fmt.Printf("Commit: %s - Choose action: ", commit)
-		reader := bufio.NewReader(os.Stdin)
-		action, _ := reader.ReadString('\n')
-		action = strings.TrimSpace(action)
+// indexMatchesHead reports whether the index has no staged changes.
+func indexMatchesHead() (bool, error) {
+	head, err := headCommit()
+	if err != nil {
+		return false, err
+	}
+	headTree, err := commitTree(head)
+	if err != nil {
+		return false, err
+	}
+	index, err := readIndex()
+	if err != nil {
+		return false, fmt.Errorf("could not read index: %v", err)
+	}
+	return treesEqual(index, headTree), nil
+}
 
-		if action == "squash" && previousCommit == "" {
-			fmt.Println("Error: Squash requires a previous commit to combine with.")
-			return nil
+// finishRebase moves the rebased branch to HEAD and attaches HEAD to it.
+func finishRebase() error {
+	head, err := headCommit()
+	if err != nil {
+		return err
+	}
+	headName, onto := readRebaseState("head-name"), readRebaseState("onto")
+	if headName != "detached HEAD" {
+		tx := newRefTransaction()
+		tx.update(headName, head, readRebaseState("orig-head"), true, fmt.Sprintf("rebase (finish): %s onto %s", headName, onto))
+		if err := tx.commit(); err != nil {
+			return fmt.Errorf("could not update %s: %v", headName, err)
 		}
+		if err := switchHead(headName, head, head, "rebase (finish): returning to "+headName); err != nil {
+			return err
+		}
+	}
+	os.RemoveAll(repoPath("rebase"))
+	fmt.Printf("Successfully rebased and updated %s.\n", headName)
+	return nil
+}
 
-		actions = append(actions, Action{
-			Action:             action,
-			CommitHash:         commit,
-			PreviousCommitHash: previousCommit,
-		})
-
-		previousCommit = commit
+// ResumeRebase continues a stopped rebase. A step stopped by conflicts is
+// committed, once they are resolved, with its prepared message; after an
+// edit stop, staged changes are amended into the commit.
+func ResumeRebase() error {
+	if !rebaseInProgress() {
+		return fmt.Errorf("no rebase in progress")
+	}
+	if err := checkNoUnmergedPaths("committing"); err != nil {
+		return err
+	}
+	if item, ok := readRebaseStop(); ok {
+		clean, err := indexMatchesHead()
+		if err != nil {
+			return err
+		}
+		// Only a step stopped by conflicts has a prepared message.
+		content, msgErr := ioutil.ReadFile(repoPath("MERGE_MSG"))
+		switch {
+		case msgErr == nil && (item.Action == "squash" || !clean):
+			message := cleanupMessage(string(content), true)
+			if message == "" {
+				return fmt.Errorf("aborting commit due to empty commit message")
+			}
+			if item.Action == "squash" {
+				err = amendHead(message, "rebase (squash)")
+				break
+			}
+			commit, err := readCommit(item.Hash)
+			if err != nil {
+				return fmt.Errorf("could not read commit %s: %v", item.Hash, err)
+			}
+			if err := commitPicked("rebase (continue)", message, commit.Author); err != nil {
+				return err
+			}
+		case msgErr != nil && !clean:
+			err = amendEditedHead()
+		}
+		if err != nil {
+			return err
+		}
+		clearRebaseStop()
 	}
-	return actions
+	return runRebase()
 }
 
-func pauseRebase(currentCommit, targetCommit string) {
-	err := ioutil.WriteFile(filepath.Join(".mygitserver", "rebase"), []byte(fmt.Sprintf("%s %s", currentCommit, targetCommit)), 0644)
-	if err != nil {
-		fmt.Println("Error saving rebase state:", err)
+// SkipRebase drops the step the rebase stopped at, resetting the files it
+// touched to HEAD, and carries on with the rest.
+func SkipRebase() error {
+	if !rebaseInProgress() {
+		return fmt.Errorf("no rebase in progress")
+	}
+	if err := resetToCommit(""); err != nil {
+		return err
 	}
-	fmt.Println("Rebase paused. Resolve conflicts and resume with 'gitserver rebase --continue'.")
+	rerereClear()
+	clearRebaseStop()
+	return runRebase()
 }
 
-func ResumeRebase() {
-	rebaseState, err := ioutil.ReadFile(filepath.Join(".mygitserver", "rebase"))
+// AbortRebase gives up the rebase, returning HEAD, the index and the
+// working tree to the branch as it was before the rebase started.
+func AbortRebase() error {
+	if !rebaseInProgress() {
+		return fmt.Errorf("no rebase in progress")
+	}
+	headName, origHead := readRebaseState("head-name"), readRebaseState("orig-head")
+	head, err := headCommit()
 	if err != nil {
-		fmt.Println("No rebase in progress.")
-		return
+		return err
 	}
-
-	parts := strings.Split(string(rebaseState), " ")
-	if len(parts) != 2 {
-		fmt.Println("Invalid rebase state.")
-		return
+	headTree, err := commitTree(head)
+	if err != nil {
+		return err
+	}
+	origTree, err := commitTree(origHead)
+	if err != nil {
+		return err
+	}
+	index, err := readIndex()
+	if err != nil {
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	if err := resetWorkingTree(headTree, origTree, index); err != nil {
+		return err
 	}
 
-	currentCommit := parts[0]
-	targetCommit := parts[1]
-
-	reapplyCommit(currentCommit, targetCommit)
-
-	os.Remove(filepath.Join(".mygitserver", "rebase"))
-
-	fmt.Println("Rebase continued successfully.")
+	ref := ""
+	if headName != "detached HEAD" {
+		ref = headName
+	}
+	if err := switchHead(ref, head, origHead, "rebase (abort): returning to "+headName); err != nil {
+		return err
+	}
+	rerereClear()
+	clearRebaseStop()
+	os.RemoveAll(repoPath("rebase"))
+	fmt.Println("Rebase aborted.")
+	return nil
 }
 
-type Action struct {
-	Action             string
-	CommitHash         string
-	PreviousCommitHash string
+// rebaseStatusLines describe the rebase in progress for Status.
+func rebaseStatusLines(conflicted bool) []string {
+	kind := "rebase"
+	if _, err := os.Stat(repoPath("rebase", "interactive")); err == nil {
+		kind = "interactive rebase"
+	}
+	onto := shortHash(readRebaseState("onto"))
+	branch := strings.TrimPrefix(readRebaseState("head-name"), "refs/heads/")
+	lines := []string{fmt.Sprintf("%s in progress; onto %s", kind, onto)}
+	if done, err := readRebaseTodo("done"); err == nil && len(done) > 0 {
+		last := done[len(done)-1]
+		lines = append(lines, fmt.Sprintf("Last command done: %s %s", last.Action, shortHash(last.Hash)))
+	}
+	if todo, err := readRebaseTodo("todo"); err == nil && len(todo) > 0 {
+		lines = append(lines, fmt.Sprintf("Next command to do: %s %s (%d remaining)", todo[0].Action, shortHash(todo[0].Hash), len(todo)))
+	}
+
+	item, stopped := readRebaseStop()
+	_, msgErr := os.Stat(repoPath("MERGE_MSG"))
+	if stopped && item.Action == "edit" && msgErr != nil {
+		return append(lines,
+			fmt.Sprintf("You are currently editing a commit while rebasing branch '%s' on '%s'.", branch, onto),
+			"  (make your changes, add them and run \"mygitserver rebase --continue\" to amend the commit)")
+	}
+	lines = append(lines, fmt.Sprintf("You are currently rebasing branch '%s' on '%s'.", branch, onto))
+	if conflicted {
+		lines = append(lines, "  (fix conflicts and then run \"mygitserver rebase --continue\")")
+	} else {
+		lines = append(lines, "  (all conflicts fixed: run \"mygitserver rebase --continue\")")
+	}
+	return append(lines,
+		"  (use \"mygitserver rebase --skip\" to skip this patch)",
+		"  (use \"mygitserver rebase --abort\" to check out the original branch)")
 }
@@ -0,0 +1,405 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zeroHash stands for "no commit" on either side of a reflog entry.
+const zeroHash = "0000000000000000000000000000000000000000"
+
+// reflogEntry is one line of .mygitserver/logs/<ref>:
+//
+//	<old> <new> <Name <email>> <timestamp>\t<message>
+type reflogEntry struct {
+	Old       string
+	New       string
+	Identity  string
+	Timestamp string
+	Message   string
+}
+
+func reflogPath(ref string) string {
+	return repoPath("logs", filepath.FromSlash(ref))
+}
+
+// appendReflog records that ref moved from oldHash to newHash. Empty hashes
+// (an unborn or deleted ref) are written as zeroHash.
+func appendReflog(ref, oldHash, newHash, reason string) error {
+	if oldHash == "" {
+		oldHash = zeroHash
+	}
+	if newHash == "" {
+		newHash = zeroHash
+	}
+	logPath := reflogPath(ref)
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reason = strings.ReplaceAll(reason, "\n", " ")
+	_, err = fmt.Fprintf(file, "%s %s %s %s\t%s\n", oldHash, newHash, currentIdentity(), time.Now().Format(time.RFC3339), reason)
+	return err
+}
+
+// removeReflog deletes the reflog of ref along with directories it leaves
+// empty, so a later ref can reuse the name as a directory or a file.
+func removeReflog(ref string) error {
+	logPath := reflogPath(ref)
+	if err := os.Remove(logPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	logsRoot := repoPath("logs")
+	for dir := filepath.Dir(logPath); strings.HasPrefix(dir, logsRoot+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// readReflog returns the entries recorded for ref, oldest first.
+func readReflog(ref string) ([]reflogEntry, error) {
+	return readReflogFile(reflogPath(ref), ref)
+}
+
+// readReflogFile parses the reflog at path; ref is only used in errors.
+func readReflogFile(path, ref string) ([]reflogEntry, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []reflogEntry
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		entry, err := parseReflogLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("reflog for '%s': %v", ref, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func parseReflogLine(line string) (reflogEntry, error) {
+	header, message, _ := strings.Cut(line, "\t")
+	fields := strings.SplitN(header, " ", 3)
+	if len(fields) != 3 {
+		return reflogEntry{}, fmt.Errorf("malformed entry %q", line)
+	}
+	rest := fields[2]
+	end := strings.LastIndex(rest, "> ")
+	if end < 0 {
+		return reflogEntry{}, fmt.Errorf("malformed entry %q", line)
+	}
+	return reflogEntry{
+		Old:       fields[0],
+		New:       fields[1],
+		Identity:  rest[:end+1],
+		Timestamp: rest[end+2:],
+		Message:   message,
+	}, nil
+}
+
+// reflogValue returns the value ref had n updates ago, so n == 0 is the
+// latest entry.
+func reflogValue(ref string, n int) (string, error) {
+	entries, err := readReflog(ref)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("no reflog for '%s'", ref)
+	}
+	if n >= len(entries) {
+		return "", fmt.Errorf("log for '%s' only has %d entries", ref, len(entries))
+	}
+	return entries[len(entries)-1-n].New, nil
+}
+
+// writeReflog replaces the reflog of ref with entries.
+func writeReflog(ref string, entries []reflogEntry) error {
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s %s %s %s\t%s\n", entry.Old, entry.New, entry.Identity, entry.Timestamp, entry.Message)
+	}
+	return ioutil.WriteFile(reflogPath(ref), []byte(b.String()), 0644)
+}
+
+// listReflogs returns every ref that has a reflog, HEAD included.
+func listReflogs() ([]string, error) {
+	root := filepath.Join(commonDir(), "logs")
+	var refs []string
+	if _, err := os.Stat(reflogPath("HEAD")); err == nil {
+		refs = append(refs, "HEAD")
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		// HEAD's log belongs to a worktree and was handled above.
+		if rel = filepath.ToSlash(rel); rel != "HEAD" {
+			refs = append(refs, rel)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// reflogRef maps a user-supplied name such as "HEAD", "main" or
+// "refs/notes/commits" to the ref whose log it means.
+func reflogRef(name string) (string, error) {
+	if name == "" || name == "HEAD" || name == "@" {
+		return "HEAD", nil
+	}
+	if ref, ok := dwimRef(name); ok {
+		return ref, nil
+	}
+	if _, err := os.Stat(reflogPath(name)); err == nil {
+		return name, nil
+	}
+	return "", fmt.Errorf("no reflog for '%s'", name)
+}
+
+// ReflogShow prints the reflog of name (HEAD when empty), newest first, as
+// "<hash> <name>@{<n>}: <reason>".
+func ReflogShow(name string) error {
+	ref, err := reflogRef(name)
+	if err != nil {
+		return err
+	}
+	entries, err := readReflog(ref)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = "HEAD"
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		fmt.Printf("%s %s@{%d}: %s\n", shortHash(entries[i].New), name, len(entries)-1-i, entries[i].Message)
+	}
+	return nil
+}
+
+// Default ages after which reflog entries are expired: gc.reflogExpire for
+// entries still reachable from the ref, gc.reflogExpireUnreachable for the
+// rest, as in git.
+const (
+	defaultReflogExpire            = "90.days.ago"
+	defaultReflogExpireUnreachable = "30.days.ago"
+)
+
+// ReflogExpireOptions controls ReflogExpire. Expire and ExpireUnreachable
+// override the configured ages; All expires every reflog.
+type ReflogExpireOptions struct {
+	Expire            string
+	ExpireUnreachable string
+	All               bool
+}
+
+// ReflogExpire drops old entries from the reflogs of refs (or of every ref
+// with All) and reports how many were removed.
+func ReflogExpire(refs []string, opts ReflogExpireOptions) error {
+	expire := opts.Expire
+	if expire == "" {
+		expire = configOrDefault("gc.reflogExpire", defaultReflogExpire)
+	}
+	unreachableExpire := opts.ExpireUnreachable
+	if unreachableExpire == "" {
+		if opts.Expire != "" {
+			unreachableExpire = opts.Expire
+		} else {
+			unreachableExpire = configOrDefault("gc.reflogExpireUnreachable", defaultReflogExpireUnreachable)
+		}
+	}
+	cutoff, err := parseExpiry(expire)
+	if err != nil {
+		return err
+	}
+	unreachableCutoff, err := parseExpiry(unreachableExpire)
+	if err != nil {
+		return err
+	}
+
+	if opts.All {
+		if refs, err = listReflogs(); err != nil {
+			return err
+		}
+	} else if len(refs) == 0 {
+		refs = []string{"HEAD"}
+	}
+	for _, name := range refs {
+		ref, err := reflogRef(name)
+		if err != nil {
+			return err
+		}
+		removed, err := expireReflog(ref, cutoff, unreachableCutoff)
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			fmt.Printf("Expired %d reflog entries of %s\n", removed, ref)
+		}
+	}
+	return nil
+}
+
+// expireReflog removes the entries of ref older than cutoff, or older than
+// unreachableCutoff when the entry's commit is no longer reachable from the
+// ref's current value.
+func expireReflog(ref string, cutoff, unreachableCutoff time.Time) (int, error) {
+	entries, err := readReflog(ref)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	var reachable map[string]bool
+	if tip, err := resolveReflogTip(ref); err == nil && tip != "" {
+		reachable, _ = ancestors(tip)
+	}
+	var kept []reflogEntry
+	for _, entry := range entries {
+		when, err := time.Parse(time.RFC3339, entry.Timestamp)
+		if err == nil {
+			limit := cutoff
+			if !reachable[entry.New] && unreachableCutoff.After(limit) {
+				limit = unreachableCutoff
+			}
+			if when.Before(limit) {
+				continue
+			}
+		}
+		kept = append(kept, entry)
+	}
+	removed := len(entries) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, writeReflog(ref, kept)
+}
+
+func resolveReflogTip(ref string) (string, error) {
+	if ref == "HEAD" {
+		return headCommit()
+	}
+	if !refExists(ref) {
+		return "", nil
+	}
+	hash, err := readRef(ref)
+	if err != nil {
+		return "", err
+	}
+	return peelTag(hash)
+}
+
+// ReflogDelete removes single entries given as <ref>@{<n>}.
+func ReflogDelete(selectors []string) error {
+	// Delete the highest indexes first so earlier deletions do not shift
+	// the entries later selectors refer to.
+	byRef := make(map[string][]int)
+	for _, selector := range selectors {
+		name, rest, ok := strings.Cut(selector, "@{")
+		n, err := strconv.Atoi(strings.TrimSuffix(rest, "}"))
+		if !ok || !strings.HasSuffix(rest, "}") || err != nil || n < 0 {
+			return fmt.Errorf("not a reflog entry: '%s'", selector)
+		}
+		ref, err := reflogRef(name)
+		if err != nil {
+			return err
+		}
+		byRef[ref] = append(byRef[ref], n)
+	}
+
+	for ref, indexes := range byRef {
+		entries, err := readReflog(ref)
+		if err != nil {
+			return err
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+		for _, n := range indexes {
+			if n >= len(entries) {
+				return fmt.Errorf("log for '%s' only has %d entries", ref, len(entries))
+			}
+			at := len(entries) - 1 - n
+			entries = append(entries[:at], entries[at+1:]...)
+		}
+		if err := writeReflog(ref, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func configOrDefault(key, defaultValue string) string {
+	if value, ok := getConfig(key); ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// parseExpiry turns an expiry such as "90.days.ago", "2.weeks", "now",
+// "never" or an RFC 3339 / YYYY-MM-DD date into a cutoff time. Entries
+// older than the cutoff expire; "never" yields the zero time so nothing
+// does.
+func parseExpiry(value string) (time.Time, error) {
+	now := time.Now()
+	switch strings.ToLower(value) {
+	case "now", "all":
+		return now.Add(time.Second), nil
+	case "never", "false":
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+
+	parts := strings.Split(strings.TrimSuffix(strings.ToLower(value), ".ago"), ".")
+	if len(parts) == 2 {
+		n, err := strconv.Atoi(parts[0])
+		if err == nil && n >= 0 {
+			switch strings.TrimSuffix(parts[1], "s") {
+			case "second":
+				return now.Add(-time.Duration(n) * time.Second), nil
+			case "minute":
+				return now.Add(-time.Duration(n) * time.Minute), nil
+			case "hour":
+				return now.Add(-time.Duration(n) * time.Hour), nil
+			case "day":
+				return now.AddDate(0, 0, -n), nil
+			case "week":
+				return now.AddDate(0, 0, -7*n), nil
+			case "month":
+				return now.AddDate(0, -n, 0), nil
+			case "year":
+				return now.AddDate(-n, 0, 0), nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry date '%s'", value)
+}
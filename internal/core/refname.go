@@ -0,0 +1,149 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkRefFormat reports whether ref is an acceptable reference name, using
+// the rules of git check-ref-format:
+//
+//   - components are separated by "/", none may be empty, start with "."
+//     or end with ".lock"
+//   - the name has at least two components unless allowOneLevel is set
+//   - it may not contain "..", "@{", a backslash, control characters, space
+//     or any of ~ ^ : ? * [
+//   - it may not start or end with "/", end with "." or be the single
+//     character "@"
+func checkRefFormat(ref string, allowOneLevel bool) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("'%s' is not a valid ref name: %s", ref, reason)
+	}
+
+	if ref == "" {
+		return invalid("it is empty")
+	}
+	if ref == "@" {
+		return invalid("it is a lone '@'")
+	}
+	if strings.HasPrefix(ref, "/") || strings.HasSuffix(ref, "/") {
+		return invalid("it starts or ends with '/'")
+	}
+	if strings.HasSuffix(ref, ".") {
+		return invalid("it ends with '.'")
+	}
+	if strings.Contains(ref, "..") {
+		return invalid("it contains '..'")
+	}
+	if strings.Contains(ref, "@{") {
+		return invalid("it contains '@{'")
+	}
+	for _, r := range ref {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return invalid("it contains a control character")
+		case strings.ContainsRune(" ~^:?*[\\", r):
+			return invalid(fmt.Sprintf("it contains '%c'", r))
+		}
+	}
+
+	components := strings.Split(ref, "/")
+	if len(components) < 2 && !allowOneLevel {
+		return invalid("it has only one level")
+	}
+	for _, component := range components {
+		switch {
+		case component == "":
+			return invalid("it contains '//'")
+		case strings.HasPrefix(component, "."):
+			return invalid(fmt.Sprintf("component '%s' starts with '.'", component))
+		case strings.HasSuffix(component, ".lock"):
+			return invalid(fmt.Sprintf("component '%s' ends with '.lock'", component))
+		}
+	}
+	return nil
+}
+
+// checkBranchName validates a short branch name such as "feature/login".
+// Besides the ref-name rules, branches may not be called HEAD or "@" (both
+// name the current commit) or start with "-", which would be read as an
+// option.
+func checkBranchName(name string) error {
+	if name == "" {
+		return fmt.Errorf("branch name cannot be empty")
+	}
+	if name == "HEAD" || name == "@" || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("'%s' is not a valid branch name", name)
+	}
+	if err := checkRefFormat("refs/heads/"+name, false); err != nil {
+		return fmt.Errorf("'%s' is not a valid branch name: %v", name, err)
+	}
+	return nil
+}
+
+// checkRefConflict makes sure ref can be stored as a file: no existing ref
+// may be a prefix directory of it ("feature" blocks "feature/login") and it
+// may not be a directory of other refs itself. Packed refs count too.
+func checkRefConflict(ref string) error {
+	packed, err := readPackedRefs()
+	if err != nil {
+		return err
+	}
+	components := strings.Split(ref, "/")
+	for i := 1; i < len(components); i++ {
+		prefix := strings.Join(components[:i], "/")
+		info, err := os.Stat(repoPath(filepath.FromSlash(prefix)))
+		if err == nil && !info.IsDir() {
+			return fmt.Errorf("'%s' exists; cannot create '%s'", prefix, ref)
+		}
+		if _, ok := packed[prefix]; ok {
+			return fmt.Errorf("'%s' exists; cannot create '%s'", prefix, ref)
+		}
+	}
+	nested, err := listRefs(ref + "/")
+	if err != nil {
+		return err
+	}
+	for _, other := range unionKeys(nested) {
+		return fmt.Errorf("'%s' exists; cannot create '%s'", other, ref)
+	}
+	return nil
+}
+
+// CheckRefFormatOptions mirrors the flags of git check-ref-format.
+type CheckRefFormatOptions struct {
+	Branch        bool
+	AllowOneLevel bool
+	Normalize     bool
+}
+
+// CheckRefFormat validates name and returns an error describing the first
+// rule it breaks. With Branch, name is a short branch name; with
+// Normalize, repeated and leading slashes are removed first and the
+// normalized name is printed.
+func CheckRefFormat(name string, opts CheckRefFormatOptions) error {
+	if opts.Normalize {
+		var parts []string
+		for _, part := range strings.Split(name, "/") {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		name = strings.Join(parts, "/")
+	}
+	var err error
+	if opts.Branch {
+		err = checkBranchName(name)
+	} else {
+		err = checkRefFormat(name, opts.AllowOneLevel)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Normalize || opts.Branch {
+		fmt.Println(name)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readHead returns the ref HEAD points at (for example "refs/heads/main").
+// When HEAD is detached the commit hash is returned and detached is true.
+func readHead() (ref string, detached bool, err error) {
+	return readHeadFile(repoPath("HEAD"))
+}
+
+// readHeadFile parses a HEAD file, which may belong to another worktree.
+func readHeadFile(path string) (ref string, detached bool, err error) {
+	headContent, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	headRef := strings.TrimSpace(string(headContent))
+	if strings.HasPrefix(headRef, "ref: ") {
+		return strings.TrimPrefix(headRef, "ref: "), false, nil
+	}
+	return headRef, true, nil
+}
+
+// readRef returns the commit a ref points at. An empty string means the ref
+// exists but has no commits yet, as with a freshly initialized main branch.
+// Loose refs take precedence over packed-refs.
+func readRef(ref string) (string, error) {
+	content, err := ioutil.ReadFile(looseRefPath(ref))
+	if err == nil {
+		return strings.TrimSpace(string(content)), nil
+	}
+	if packed, perr := readPackedRefs(); perr == nil {
+		if entry, ok := packed[ref]; ok {
+			return entry.Hash, nil
+		}
+	}
+	return "", fmt.Errorf("could not read ref '%s'", ref)
+}
+
+func looseRefPath(ref string) string {
+	return repoPath(filepath.FromSlash(ref))
+}
+
+func looseRefExists(ref string) bool {
+	info, err := os.Stat(looseRefPath(ref))
+	return err == nil && !info.IsDir()
+}
+
+// writeRef points ref at hash, creating the ref and any directories of a
+// hierarchical name such as refs/heads/feature/login. Invalid names and
+// names that clash with existing refs are rejected.
+func writeRef(ref, hash string) error {
+	if err := checkRefFormat(ref, false); err != nil {
+		return err
+	}
+	if err := checkRefConflict(ref); err != nil {
+		return err
+	}
+	refPath := looseRefPath(ref)
+	if err := os.MkdirAll(filepath.Dir(refPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(refPath, []byte(hash), 0644)
+}
+
+// deleteRef removes ref from both the loose and the packed store.
+func deleteRef(ref string) error {
+	loose := looseRefExists(ref)
+	if loose {
+		if err := removeLooseRef(ref); err != nil {
+			return err
+		}
+	}
+	packed, err := removePackedRef(ref)
+	if err != nil {
+		return err
+	}
+	if !loose && !packed {
+		return fmt.Errorf("ref '%s' does not exist", ref)
+	}
+	return nil
+}
+
+// removeLooseRef deletes the loose file of ref and any directories it
+// leaves empty, keeping the top-level refs/heads, refs/tags, ... directories
+// in place.
+func removeLooseRef(ref string) error {
+	refPath := looseRefPath(ref)
+	if err := os.Remove(refPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	pruneEmptyRefDirs(filepath.Dir(refPath))
+	return nil
+}
+
+// pruneEmptyRefDirs removes dir and its parents while they are empty,
+// stopping at the top-level refs/heads, refs/tags, ... directories.
+func pruneEmptyRefDirs(dir string) {
+	refsRoot := repoPath("refs")
+	for ; strings.HasPrefix(dir, refsRoot+string(filepath.Separator)) && filepath.Dir(dir) != refsRoot; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+// refExists reports whether ref has been created, even if it has no commits.
+func refExists(ref string) bool {
+	if looseRefExists(ref) {
+		return true
+	}
+	packed, err := readPackedRefs()
+	if err != nil {
+		return false
+	}
+	_, ok := packed[ref]
+	return ok
+}
+
+// resolveCommit turns a user-supplied revision into a commit hash, peeling
+// annotated tags. See resolveRevision for the accepted syntax.
+func resolveCommit(name string) (string, error) {
+	if name == "" {
+		name = "HEAD"
+	}
+	hash, err := resolveRevision(name)
+	if err != nil {
+		return "", err
+	}
+	if hash, err = peelTag(hash); err != nil {
+		return "", err
+	}
+	if objectType(hash) != "commit" {
+		return "", fmt.Errorf("'%s' does not name a commit", name)
+	}
+	return hash, nil
+}
+
+// minAbbrevLength is the shortest hash prefix accepted as a commit name.
+const minAbbrevLength = 4
+
+// resolveAbbreviatedCommit finds the single commit whose hash starts with
+// prefix. When several objects match and the choice is not narrowed down to
+// one commit, the error lists every candidate.
+func resolveAbbreviatedCommit(prefix string) (string, error) {
+	if len(prefix) < minAbbrevLength {
+		return "", fmt.Errorf("not a valid commit name: '%s' (abbreviated hashes need at least %d characters)", prefix, minAbbrevLength)
+	}
+	matches, err := findObjectsByPrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+
+	var commits []string
+	for _, hash := range matches {
+		if objectType(hash) == "commit" {
+			commits = append(commits, hash)
+		}
+	}
+	switch {
+	case len(commits) == 1:
+		return commits[0], nil
+	case len(matches) == 0:
+		return "", fmt.Errorf("not a valid commit name: '%s'", prefix)
+	case len(commits) == 0:
+		return "", fmt.Errorf("'%s' does not name a commit", prefix)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "short object ID %s is ambiguous; the candidates are:", prefix)
+	for _, hash := range matches {
+		kind := objectType(hash)
+		if kind == "commit" {
+			commit, _ := readCommit(hash)
+			fmt.Fprintf(&b, "\n  %s commit %s - %s", hash, commit.Timestamp, commit.Subject())
+		} else {
+			fmt.Fprintf(&b, "\n  %s %s", hash, kind)
+		}
+	}
+	return "", fmt.Errorf("%s", b.String())
+}
+
+func isHexPrefix(name string) bool {
+	if name == "" || len(name) > 40 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// listRefs returns every ref under prefix (for example "refs/heads/") mapped
+// to the commit it points at, from both the packed and the loose store.
+func listRefs(prefix string) (map[string]string, error) {
+	packed, err := readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+	refs, err := listLooseRefs(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for ref, entry := range packed {
+		if _, loose := refs[ref]; !loose && strings.HasPrefix(ref, prefix) {
+			refs[ref] = entry.Hash
+		}
+	}
+	return refs, nil
+}
+
+// listLooseRefs returns the refs under prefix that are stored as files.
+func listLooseRefs(prefix string) (map[string]string, error) {
+	refs := make(map[string]string)
+	root := repoPath(filepath.FromSlash(prefix))
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || path == root || strings.HasSuffix(path, ".lock") {
+			// path == root means prefix named a ref file, not a directory;
+			// .lock files belong to a ref transaction in progress.
+			return nil
+		}
+		rel, err := filepath.Rel(commonDir(), path)
+		if err != nil {
+			return err
+		}
+		ref := filepath.ToSlash(rel)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		refs[ref] = strings.TrimSpace(string(content))
+		return nil
+	})
+	return refs, err
+}
+
+// describeHead returns a short description of HEAD for status-like output:
+// the branch name, or "HEAD detached at <hash>".
+func describeHead() (string, error) {
+	ref, detached, err := readHead()
+	if err != nil {
+		return "", err
+	}
+	if detached {
+		return fmt.Sprintf("HEAD detached at %s", shortHash(ref)), nil
+	}
+	return strings.TrimPrefix(ref, "refs/heads/"), nil
+}
+
+func isFullHash(name string) bool {
+	return len(name) == 40 && isHexPrefix(name)
+}
+
+// headCommit resolves HEAD to a commit hash, which is empty on an unborn
+// branch.
+func headCommit() (string, error) {
+	ref, detached, err := readHead()
+	if err != nil {
+		return "", err
+	}
+	if detached {
+		return ref, nil
+	}
+	if !refExists(ref) {
+		return "", nil
+	}
+	return readRef(ref)
+}
+
+// updateRef points ref at hash and records the change in the ref's reflog
+// with reason, such as "commit: Fix typo".
+func updateRef(ref, hash, reason string) error {
+	tx := newRefTransaction()
+	tx.update(ref, hash, "", false, reason)
+	return tx.commit()
+}
+
+// updateHeadFrom moves whatever HEAD points at (the current branch, or HEAD
+// itself when detached) from oldHash to hash, recording the move in both
+// reflogs. It fails, changing nothing, unless HEAD still resolves to
+// oldHash ("" for an unborn branch), so commands that read HEAD, build on
+// it and then move it never silently overwrite a concurrent update.
+func updateHeadFrom(oldHash, hash, reason string) error {
+	tx := newRefTransaction()
+	tx.update("HEAD", hash, oldHash, true, reason)
+	return tx.commit()
+}
+
+// switchHead attaches HEAD to the branch ref, or detaches it at hash when
+// ref is empty, and records the move from oldHash to hash in HEAD's reflog.
+// HEAD is written through HEAD.lock like any ref a transaction updates, so
+// a concurrent writer fails instead of being overwritten.
+func switchHead(ref, oldHash, hash, reason string) error {
+	content := hash
+	if ref != "" {
+		if err := checkRefFormat(ref, false); err != nil {
+			return err
+		}
+		content = "ref: " + ref
+	}
+	lockPath := repoPath("HEAD.lock")
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("cannot lock HEAD: unable to create '%s': file exists; another process may be updating it", lockPath)
+		}
+		return fmt.Errorf("cannot lock HEAD: %v", err)
+	}
+	_, err = file.WriteString(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(lockPath, repoPath("HEAD"))
+	}
+	if err != nil {
+		os.Remove(lockPath)
+		return fmt.Errorf("could not update HEAD: %v", err)
+	}
+	return appendReflog("HEAD", oldHash, hash, reason)
+}
@@ -10,6 +10,7 @@ import (
 func InitializeRepository() {
 	os.Mkdir(".mygitserver", 0755)
 	os.MkdirAll(".mygitserver/refs/heads", 0755)
+	os.MkdirAll(".mygitserver/refs/tags", 0755)
 	os.Mkdir(".mygitserver/objects", 0755)
 
 	err := ioutil.WriteFile(filepath.Join(".mygitserver", "HEAD"), []byte("ref: refs/heads/main"), 0644)
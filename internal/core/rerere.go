@@ -0,0 +1,309 @@
+package core
+
+import (
+	"fmt"
+	"gitserver/internal/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With rerere.enabled set, conflicts are remembered together with the way
+// they were resolved, in an rr-cache shared by all worktrees:
+//
+//	rr-cache/<id>/preimage    the conflicted file, normalized
+//	rr-cache/<id>/postimage   the same file once resolved
+//
+// The id fingerprints the conflict hunks of a file, so that the same
+// conflict is recognised in a later merge, rebase or cherry-pick even when
+// the rest of the file has changed. The paths watched during the current
+// operation are listed in MERGE_RR as "<id>\t<path>" lines.
+
+type rerereEntry struct {
+	ID   string
+	Path string
+}
+
+func rerereEnabled() bool {
+	return getConfigBool("rerere.enabled", false)
+}
+
+// conflictMarkerSize is the configured marker length, falling back to the
+// default when the configuration is invalid.
+func conflictMarkerSize() int {
+	opts, err := newMergeFileOptions("", "", "")
+	if err != nil {
+		return defaultConflictMarkerSize
+	}
+	return opts.MarkerSize
+}
+
+// normalizeConflicts rewrites the conflict hunks of content without labels
+// or base sections and with the two sides in sorted order, so that a
+// conflict looks the same whichever side was merged into which. It returns
+// the normalized file and the id of its hunks; ok is false when content
+// has no complete hunks.
+func normalizeConflicts(content []byte, markerSize int) (normalized []byte, id string, ok bool) {
+	isMarker := func(line string, char byte) bool {
+		if len(line) < markerSize || line[:markerSize] != strings.Repeat(string(char), markerSize) {
+			return false
+		}
+		rest := line[markerSize:]
+		return rest == "" || rest[0] == ' ' || rest[0] == '\n'
+	}
+
+	const (
+		outside = iota
+		inOurs
+		inBase
+		inTheirs
+	)
+	var out, fingerprint strings.Builder
+	var ours, theirs strings.Builder
+	state, hunks := outside, 0
+	for _, line := range splitLines(content) {
+		switch {
+		case state == outside && isMarker(line, '<'):
+			state = inOurs
+			ours.Reset()
+			theirs.Reset()
+		case state == inOurs && isMarker(line, '|'):
+			state = inBase
+		case (state == inOurs || state == inBase) && isMarker(line, '='):
+			state = inTheirs
+		case state == inTheirs && isMarker(line, '>'):
+			a, b := ours.String(), theirs.String()
+			if b < a {
+				a, b = b, a
+			}
+			out.WriteString("<<<<<<<\n" + a + "=======\n" + b + ">>>>>>>\n")
+			fingerprint.WriteString(a + "\x00" + b + "\x00")
+			state = outside
+			hunks++
+		case state == inOurs:
+			ours.WriteString(ensureLineEnd(line))
+		case state == inTheirs:
+			theirs.WriteString(ensureLineEnd(line))
+		case state == outside:
+			out.WriteString(line)
+		}
+	}
+	if hunks == 0 || state != outside {
+		return nil, "", false
+	}
+	return []byte(out.String()), utils.GenerateHash(fingerprint.String()), true
+}
+
+func ensureLineEnd(line string) string {
+	if strings.HasSuffix(line, "\n") {
+		return line
+	}
+	return line + "\n"
+}
+
+func rerereDir(id string) string {
+	return repoPath("rr-cache", id)
+}
+
+func readMergeRR() []rerereEntry {
+	content, err := ioutil.ReadFile(repoPath("MERGE_RR"))
+	if err != nil {
+		return nil
+	}
+	var entries []rerereEntry
+	for _, line := range strings.Split(string(content), "\n") {
+		if id, path, ok := strings.Cut(line, "\t"); ok {
+			entries = append(entries, rerereEntry{ID: id, Path: path})
+		}
+	}
+	return entries
+}
+
+func writeMergeRR(entries []rerereEntry) error {
+	if len(entries) == 0 {
+		os.Remove(repoPath("MERGE_RR"))
+		return nil
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s\t%s\n", entry.ID, entry.Path)
+	}
+	return ioutil.WriteFile(repoPath("MERGE_RR"), []byte(b.String()), 0644)
+}
+
+// rerereConflicts runs after conflicts have been written to the working
+// tree. Conflicts with a recorded resolution are resolved with it (and
+// staged when rerere.autoUpdate is set); the others have their preimage
+// recorded and are watched for the resolution.
+func rerereConflicts(result *treeMergeResult) error {
+	if !rerereEnabled() {
+		return nil
+	}
+	markerSize := conflictMarkerSize()
+	entries := readMergeRR()
+	var staged []string
+	for _, conflict := range result.Conflicts {
+		normalized, id, ok := normalizeConflicts(result.Contents[conflict.Path], markerSize)
+		if !ok {
+			continue
+		}
+		if postimage, err := ioutil.ReadFile(filepath.Join(rerereDir(id), "postimage")); err == nil {
+			preimage, err := ioutil.ReadFile(filepath.Join(rerereDir(id), "preimage"))
+			if err != nil {
+				return err
+			}
+			if merged, conflicted := mergeFileContents(preimage, normalized, postimage, mergeFileOptions{}); !conflicted {
+				if err := writeWorkingContent(conflict.Path, merged); err != nil {
+					return err
+				}
+				fmt.Printf("Resolved '%s' using previous resolution.\n", conflict.Path)
+				staged = append(staged, conflict.Path)
+				continue
+			}
+		}
+		if err := os.MkdirAll(rerereDir(id), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(rerereDir(id), "preimage"), normalized, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Recorded preimage for '%s'\n", conflict.Path)
+		entries = append(entries, rerereEntry{ID: id, Path: conflict.Path})
+	}
+	if err := writeMergeRR(entries); err != nil {
+		return err
+	}
+	if len(staged) > 0 && getConfigBool("rerere.autoUpdate", false) {
+		if err := stageWorkingFiles(staged); err != nil {
+			return err
+		}
+		for _, path := range staged {
+			fmt.Printf("Staged '%s' using previous resolution.\n", path)
+		}
+	}
+	return nil
+}
+
+// rerereRecord records the resolution of every watched path whose working
+// copy no longer has conflict markers.
+func rerereRecord() error {
+	entries := readMergeRR()
+	if len(entries) == 0 {
+		return nil
+	}
+	markerSize := conflictMarkerSize()
+	var watching []rerereEntry
+	for _, entry := range entries {
+		content, err := ioutil.ReadFile(entry.Path)
+		if err != nil {
+			watching = append(watching, entry)
+			continue
+		}
+		if _, _, conflicted := normalizeConflicts(content, markerSize); conflicted {
+			watching = append(watching, entry)
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(rerereDir(entry.ID), "postimage"), content, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Recorded resolution for '%s'.\n", entry.Path)
+	}
+	return writeMergeRR(watching)
+}
+
+// rerereClear forgets the preimages of the current operation that never
+// got a resolution, as when it is aborted.
+func rerereClear() {
+	for _, entry := range readMergeRR() {
+		if _, err := os.Stat(filepath.Join(rerereDir(entry.ID), "postimage")); os.IsNotExist(err) {
+			os.RemoveAll(rerereDir(entry.ID))
+		}
+	}
+	os.Remove(repoPath("MERGE_RR"))
+}
+
+// Rerere records the resolutions of the conflicts resolved so far.
+func Rerere() error {
+	return rerereRecord()
+}
+
+// RerereStatus lists the paths whose resolution rerere is waiting for.
+func RerereStatus() error {
+	for _, entry := range readMergeRR() {
+		fmt.Println(entry.Path)
+	}
+	return nil
+}
+
+// RerereDiff shows how the watched paths have been changed since their
+// conflicts were recorded.
+func RerereDiff() error {
+	for _, entry := range readMergeRR() {
+		preimage, err := ioutil.ReadFile(filepath.Join(rerereDir(entry.ID), "preimage"))
+		if err != nil {
+			return fmt.Errorf("could not read preimage for '%s': %v", entry.Path, err)
+		}
+		current, err := ioutil.ReadFile(entry.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Print(unifiedDiff(splitLines(preimage), splitLines(current), "a/"+entry.Path, "b/"+entry.Path))
+	}
+	return nil
+}
+
+// RerereForget drops the recorded resolution of the conflicts in paths,
+// which must still be unmerged, and watches them again.
+func RerereForget(paths []string) error {
+	conflicts, err := readIndexConflicts()
+	if err != nil {
+		return err
+	}
+	entries := readMergeRR()
+	// The conflict is recreated the way the merge wrote it, so that its
+	// hunks, and with them its id, come out the same.
+	fileOpts, err := newMergeFileOptions("", "", "")
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		path = normalizePath(path)
+		stages, ok := conflicts[path]
+		if !ok {
+			return fmt.Errorf("path '%s' is not in a conflicted state", path)
+		}
+		var contents [3][]byte
+		for i, hash := range stages {
+			if contents[i], err = readBlob(hash); err != nil {
+				return err
+			}
+		}
+		merged, _ := mergeFileContents(contents[0], contents[1], contents[2], fileOpts)
+		normalized, id, ok := normalizeConflicts(merged, fileOpts.MarkerSize)
+		if !ok {
+			return fmt.Errorf("no remembered resolution for '%s'", path)
+		}
+		postimage := filepath.Join(rerereDir(id), "postimage")
+		if _, err := os.Stat(postimage); os.IsNotExist(err) {
+			return fmt.Errorf("no remembered resolution for '%s'", path)
+		}
+		if err := os.Remove(postimage); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(rerereDir(id), "preimage"), normalized, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Updated preimage for '%s'\n", path)
+		fmt.Printf("Forgot resolution for '%s'\n", path)
+
+		watched := false
+		for _, entry := range entries {
+			watched = watched || entry.Path == path
+		}
+		if !watched {
+			entries = append(entries, rerereEntry{ID: id, Path: path})
+		}
+	}
+	return writeMergeRR(entries)
+}
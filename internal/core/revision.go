@@ -0,0 +1,524 @@
+package core
+
+import (
+	"container/heap"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Revision expressions understood by resolveRevision:
+//
+//	HEAD, @              the current commit
+//	<ref>                refs/<ref>, refs/tags/<ref>, refs/heads/<ref> or
+//	                     refs/remotes/<ref>, tried in that order
+//	<hash>               a full or unambiguous abbreviated commit hash
+//	<rev>~<n>            the n-th first-parent ancestor (~ alone means ~1)
+//	<rev>^<n>            the n-th parent (^ alone means ^1, ^0 the commit)
+//	<rev>^{<type>}       rev peeled through annotated tags to a commit,
+//	                     tree or blob; ^{} peels to whatever is tagged and
+//	                     ^{tag} requires rev to be an annotated tag
+//	<ref>@{<n>}          the value ref had n updates ago, from its reflog
+//	<branch>@{upstream}  the branch's upstream, also written @{u}
+//	:/<regex>            the newest commit whose message matches regex
+//	<rev>:<path>         the blob at path in rev's tree
+//	:<path>              the blob staged for path in the index
+//
+// An omitted name before @{...} means the current branch.
+//
+// Commands that walk history also take ranges: "A..B" (reachable from B but
+// not from A), "A...B" (reachable from either but not from both) and "^A"
+// (exclude everything reachable from A).
+
+// resolveRevision turns a revision expression into an object hash.
+func resolveRevision(expr string) (string, error) {
+	if expr == "" {
+		return "", fmt.Errorf("empty revision")
+	}
+	if pattern, ok := strings.CutPrefix(expr, ":/"); ok {
+		return searchCommitMessage(pattern)
+	}
+	if path, ok := strings.CutPrefix(expr, ":"); ok {
+		index, err := readIndex()
+		if err != nil {
+			return "", err
+		}
+		blob, ok := index[normalizePath(path)]
+		if !ok {
+			return "", fmt.Errorf("path '%s' is not in the index", path)
+		}
+		return blob, nil
+	}
+	if rev, path, ok := strings.Cut(expr, ":"); ok {
+		commitHash, err := resolveCommit(rev)
+		if err != nil {
+			return "", err
+		}
+		tree, err := commitTree(commitHash)
+		if err != nil {
+			return "", err
+		}
+		blob, ok := tree[normalizePath(path)]
+		if !ok {
+			return "", fmt.Errorf("path '%s' does not exist in '%s'", path, rev)
+		}
+		return blob, nil
+	}
+
+	end := strings.IndexAny(expr, "~^")
+	if at := strings.Index(expr, "@{"); at >= 0 && (end < 0 || at < end) {
+		end = at
+	}
+	if end < 0 {
+		end = len(expr)
+	}
+	name, suffix := expr[:end], expr[end:]
+
+	var hash string
+	var err error
+	if strings.HasPrefix(suffix, "@{") {
+		close := strings.Index(suffix, "}")
+		if close < 0 {
+			return "", fmt.Errorf("unterminated @{...} in '%s'", expr)
+		}
+		hash, err = resolveAtSelector(name, suffix[2:close])
+		suffix = suffix[close+1:]
+	} else {
+		hash, err = resolveRevisionName(name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return applyAncestrySuffix(hash, suffix, expr)
+}
+
+// resolveRevisionName resolves a bare name: HEAD, a ref or a hash.
+func resolveRevisionName(name string) (string, error) {
+	if name == "HEAD" || name == "@" {
+		hash, err := headCommit()
+		if err == nil && hash == "" {
+			return "", fmt.Errorf("HEAD does not point to a commit yet")
+		}
+		return hash, err
+	}
+	if ref, ok := dwimRef(name); ok {
+		hash, err := readRef(ref)
+		if err == nil && hash == "" {
+			return "", fmt.Errorf("'%s' does not point to a commit yet", name)
+		}
+		return hash, err
+	}
+	if isHexPrefix(name) {
+		return resolveAbbreviatedCommit(name)
+	}
+	return "", fmt.Errorf("unknown revision '%s'", name)
+}
+
+// dwimRef finds the ref a short name refers to.
+func dwimRef(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	candidates := []string{
+		name,
+		"refs/" + name,
+		"refs/tags/" + name,
+		"refs/heads/" + name,
+		"refs/remotes/" + name,
+		"refs/remotes/" + name + "/HEAD",
+	}
+	for _, ref := range candidates {
+		if strings.HasPrefix(ref, "refs/") && checkRefFormat(ref, false) == nil && refExists(ref) {
+			return ref, true
+		}
+	}
+	return "", false
+}
+
+// resolveAtSelector handles <name>@{<selector>}.
+func resolveAtSelector(name, selector string) (string, error) {
+	switch strings.ToLower(selector) {
+	case "u", "upstream":
+		branch := name
+		if branch == "" || branch == "HEAD" || branch == "@" {
+			ref, detached, err := readHead()
+			if err != nil {
+				return "", err
+			}
+			if detached {
+				return "", fmt.Errorf("HEAD does not point to a branch")
+			}
+			branch = strings.TrimPrefix(ref, "refs/heads/")
+		}
+		branch = strings.TrimPrefix(branch, "refs/heads/")
+		upstream, err := branchUpstream(branch)
+		if err != nil {
+			return "", err
+		}
+		return resolveRevisionName(upstream)
+	}
+
+	n, err := strconv.Atoi(selector)
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("unsupported selector @{%s}", selector)
+	}
+	ref := "HEAD"
+	switch name {
+	case "":
+		headRef, detached, err := readHead()
+		if err != nil {
+			return "", err
+		}
+		if !detached {
+			ref = headRef
+		}
+	case "HEAD", "@":
+	default:
+		var ok bool
+		if ref, ok = dwimRef(name); !ok {
+			return "", fmt.Errorf("unknown revision '%s'", name)
+		}
+	}
+	return reflogValue(ref, n)
+}
+
+// branchUpstream returns the ref configured as branch's upstream through
+// branch.<name>.remote and branch.<name>.merge.
+func branchUpstream(branch string) (string, error) {
+	remote, hasRemote := getConfig("branch." + branch + ".remote")
+	merge, hasMerge := getConfig("branch." + branch + ".merge")
+	if !hasRemote || !hasMerge {
+		return "", fmt.Errorf("no upstream configured for branch '%s'", branch)
+	}
+	if remote == "." {
+		return merge, nil
+	}
+	return "refs/remotes/" + remote + "/" + strings.TrimPrefix(merge, "refs/heads/"), nil
+}
+
+// applyAncestrySuffix walks a chain of ~n and ^n operators from hash.
+func applyAncestrySuffix(hash, suffix, expr string) (string, error) {
+	for suffix != "" {
+		op := suffix[0]
+		suffix = suffix[1:]
+		if op != '~' && op != '^' {
+			return "", fmt.Errorf("invalid revision '%s'", expr)
+		}
+		if op == '^' && strings.HasPrefix(suffix, "{") {
+			close := strings.Index(suffix, "}")
+			if close < 0 {
+				return "", fmt.Errorf("invalid revision '%s'", expr)
+			}
+			switch want := suffix[1:close]; want {
+			case "tag":
+				if objectType(hash) != "tag" {
+					return "", fmt.Errorf("'%s' does not name a tag", expr)
+				}
+			case "", "commit", "tree", "blob":
+				peeled, err := peelTag(hash)
+				if err != nil {
+					return "", err
+				}
+				// A commit peels further to its tree.
+				if want == "tree" && objectType(peeled) == "commit" {
+					commit, err := readCommit(peeled)
+					if err != nil {
+						return "", err
+					}
+					peeled = commit.Tree
+				}
+				if want != "" && objectType(peeled) != want {
+					return "", fmt.Errorf("'%s' does not name a %s", expr, want)
+				}
+				hash = peeled
+			default:
+				return "", fmt.Errorf("unsupported peel '^{%s}' in '%s'", want, expr)
+			}
+			suffix = suffix[close+1:]
+			continue
+		}
+
+		peeled, err := peelTag(hash)
+		if err != nil {
+			return "", err
+		}
+		hash = peeled
+
+		digits := 0
+		for digits < len(suffix) && suffix[digits] >= '0' && suffix[digits] <= '9' {
+			digits++
+		}
+		n := 1
+		if digits > 0 {
+			n, _ = strconv.Atoi(suffix[:digits])
+			suffix = suffix[digits:]
+		}
+
+		if op == '~' {
+			for i := 0; i < n; i++ {
+				commit, err := readCommit(hash)
+				if err != nil {
+					return "", err
+				}
+				if len(commit.Parents) == 0 {
+					return "", fmt.Errorf("revision '%s' goes past the root commit", expr)
+				}
+				hash = commit.Parents[0]
+			}
+			continue
+		}
+
+		if n == 0 {
+			continue
+		}
+		commit, err := readCommit(hash)
+		if err != nil {
+			return "", err
+		}
+		if n > len(commit.Parents) {
+			return "", fmt.Errorf("commit %s has no parent %d in '%s'", shortHash(hash), n, expr)
+		}
+		hash = commit.Parents[n-1]
+	}
+	return hash, nil
+}
+
+// searchCommitMessage returns the newest commit reachable from HEAD or any
+// ref whose message matches pattern.
+func searchCommitMessage(pattern string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern in ':/%s': %v", pattern, err)
+	}
+
+	var starts []string
+	if head, err := headCommit(); err == nil && head != "" {
+		starts = append(starts, head)
+	}
+	refs, err := listRefs("refs/")
+	if err != nil {
+		return "", err
+	}
+	for ref, hash := range refs {
+		if hash != "" && !strings.HasPrefix(ref, "refs/notes/") {
+			starts = append(starts, hash)
+		}
+	}
+
+	commits, err := walkCommits(starts, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, hash := range commits {
+		commit, err := readCommit(hash)
+		if err != nil {
+			return "", err
+		}
+		if re.MatchString(commit.Message) {
+			return hash, nil
+		}
+	}
+	return "", fmt.Errorf("no commit message matches ':/%s'", pattern)
+}
+
+// resolveRevisionRange expands revision arguments into the commits to start
+// walking from and the commits whose history is excluded.
+func resolveRevisionRange(args []string) (include, exclude []string, err error) {
+	resolveOrHead := func(rev string) (string, error) {
+		if rev == "" {
+			rev = "HEAD"
+		}
+		return resolveCommit(rev)
+	}
+
+	for _, arg := range args {
+		if left, right, ok := strings.Cut(arg, "..."); ok {
+			a, err := resolveOrHead(left)
+			if err != nil {
+				return nil, nil, err
+			}
+			b, err := resolveOrHead(right)
+			if err != nil {
+				return nil, nil, err
+			}
+			bases, err := mergeBases(a, b)
+			if err != nil {
+				return nil, nil, err
+			}
+			include = append(include, a, b)
+			exclude = append(exclude, bases...)
+			continue
+		}
+		if left, right, ok := strings.Cut(arg, ".."); ok {
+			a, err := resolveOrHead(left)
+			if err != nil {
+				return nil, nil, err
+			}
+			b, err := resolveOrHead(right)
+			if err != nil {
+				return nil, nil, err
+			}
+			include = append(include, b)
+			exclude = append(exclude, a)
+			continue
+		}
+		if rev, ok := strings.CutPrefix(arg, "^"); ok {
+			hash, err := resolveCommit(rev)
+			if err != nil {
+				return nil, nil, err
+			}
+			exclude = append(exclude, hash)
+			continue
+		}
+		hash, err := resolveCommit(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		include = append(include, hash)
+	}
+	return include, exclude, nil
+}
+
+// walkCommits lists the commits reachable from include but not from
+// exclude, newest first, never showing a commit before its children.
+func walkCommits(include, exclude []string) ([]string, error) {
+	excluded := make(map[string]bool)
+	for _, hash := range exclude {
+		reachable, err := ancestors(hash)
+		if err != nil {
+			return nil, err
+		}
+		for commit := range reachable {
+			excluded[commit] = true
+		}
+	}
+
+	commits := make(map[string]*commitObject)
+	var order []string
+	queue := append([]string{}, include...)
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if current == "" || excluded[current] || commits[current] != nil {
+			continue
+		}
+		commit, err := readCommit(current)
+		if err != nil {
+			return nil, err
+		}
+		commits[current] = commit
+		order = append(order, current)
+		queue = append(queue, commit.Parents...)
+	}
+
+	children := make(map[string]int)
+	for _, commit := range commits {
+		for _, parent := range commit.Parents {
+			if commits[parent] != nil {
+				children[parent]++
+			}
+		}
+	}
+
+	position := make(map[string]int)
+	for i, hash := range order {
+		position[hash] = i
+	}
+	ready := &commitQueue{commits: commits, position: position}
+	for _, hash := range order {
+		if children[hash] == 0 {
+			heap.Push(ready, hash)
+		}
+	}
+
+	var result []string
+	for ready.Len() > 0 {
+		next := heap.Pop(ready).(string)
+		result = append(result, next)
+		for _, parent := range commits[next].Parents {
+			if commits[parent] == nil {
+				continue
+			}
+			children[parent]--
+			if children[parent] == 0 {
+				heap.Push(ready, parent)
+			}
+		}
+	}
+	return result, nil
+}
+
+// commitQueue is a heap of commit hashes ordered newest first; commits with
+// the same timestamp keep the order in which they were discovered.
+type commitQueue struct {
+	hashes   []string
+	commits  map[string]*commitObject
+	position map[string]int
+}
+
+func (q *commitQueue) Len() int { return len(q.hashes) }
+
+func (q *commitQueue) Less(i, j int) bool {
+	ti, tj := commitTime(q.commits[q.hashes[i]]), commitTime(q.commits[q.hashes[j]])
+	if !ti.Equal(tj) {
+		return ti.After(tj)
+	}
+	return q.position[q.hashes[i]] < q.position[q.hashes[j]]
+}
+
+func (q *commitQueue) Swap(i, j int) { q.hashes[i], q.hashes[j] = q.hashes[j], q.hashes[i] }
+
+func (q *commitQueue) Push(x any) { q.hashes = append(q.hashes, x.(string)) }
+
+func (q *commitQueue) Pop() any {
+	last := q.hashes[len(q.hashes)-1]
+	q.hashes = q.hashes[:len(q.hashes)-1]
+	return last
+}
+
+func commitTime(commit *commitObject) time.Time {
+	t, err := time.Parse(time.RFC3339, commit.Timestamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// RevParse prints the object hash for each revision argument. Range
+// arguments print the included commits followed by "^<hash>" for excluded
+// ones.
+func RevParse(args []string, short bool) error {
+	format := func(hash string) string {
+		if short {
+			return shortHash(hash)
+		}
+		return hash
+	}
+	for _, arg := range args {
+		// In <rev>:<path> and :/<text>, a ".." after the colon is part of the
+		// path or the text, not a range.
+		dots, colon := strings.Index(arg, ".."), strings.Index(arg, ":")
+		isRange := dots >= 0 && (colon < 0 || dots < colon)
+		if isRange || (strings.HasPrefix(arg, "^") && !strings.HasPrefix(arg, "^{")) {
+			include, exclude, err := resolveRevisionRange([]string{arg})
+			if err != nil {
+				return err
+			}
+			for _, hash := range include {
+				fmt.Println(format(hash))
+			}
+			for _, hash := range exclude {
+				fmt.Println("^" + format(hash))
+			}
+			continue
+		}
+		hash, err := resolveRevision(arg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(format(hash))
+	}
+	return nil
+}
@@ -0,0 +1,577 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Cherry-pick and revert apply commits one at a time through the
+// sequencer, whose state lives in the sequencer directory while it runs:
+//
+//	sequencer/head   the commit HEAD was at when the run started
+//	sequencer/todo   the commits left to apply, one "pick <hash> <subject>"
+//	                 or "revert <hash> <subject>" line each
+//	sequencer/opts   the options of the run as "key = value" lines
+//
+// A commit stopped by conflicts is recorded in CHERRY_PICK_HEAD or
+// REVERT_HEAD, with its prepared message in MERGE_MSG, and is no longer on
+// the todo list.
+
+// PickOptions controls CherryPick and Revert. RecordOrigin (-x) appends a
+// "(cherry picked from commit ...)" line to picked messages. NoCommit
+// applies the changes to the index and working tree without committing.
+// Mainline is the 1-based parent a merge commit is diffed against.
+type PickOptions struct {
+	RecordOrigin bool
+	NoCommit     bool
+	Mainline     int
+}
+
+type todoItem struct {
+	Action string // "pick" or "revert"
+	Hash   string
+}
+
+// CherryPick applies the changes introduced by each of the given commits,
+// or commit ranges, on top of HEAD, oldest first.
+func CherryPick(revisions []string, opts PickOptions) error {
+	return startSequencer("pick", revisions, opts)
+}
+
+// Revert records commits that undo the given commits, or commit ranges,
+// newest first.
+func Revert(revisions []string, opts PickOptions) error {
+	return startSequencer("revert", revisions, opts)
+}
+
+// sequencerCommand names the command behind an action, for messages.
+func sequencerCommand(action string) string {
+	if action == "revert" {
+		return "revert"
+	}
+	return "cherry-pick"
+}
+
+// sequencerCommits expands revisions into the commits to apply. Plain
+// commits are taken in the order given; with a range, the commits of the
+// walk are picked oldest first and reverted newest first.
+func sequencerCommits(action string, revisions []string) ([]string, error) {
+	isRange := false
+	for _, rev := range revisions {
+		if strings.Contains(rev, "..") || strings.HasPrefix(rev, "^") {
+			isRange = true
+		}
+	}
+	if !isRange {
+		var commits []string
+		for _, rev := range revisions {
+			hash, err := resolveCommit(rev)
+			if err != nil {
+				return nil, fmt.Errorf("bad revision '%s'", rev)
+			}
+			commits = append(commits, hash)
+		}
+		return commits, nil
+	}
+
+	include, exclude, err := resolveRevisionRange(revisions)
+	if err != nil {
+		return nil, err
+	}
+	commits, err := walkCommits(include, exclude)
+	if err != nil {
+		return nil, err
+	}
+	if action == "pick" {
+		for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+			commits[i], commits[j] = commits[j], commits[i]
+		}
+	}
+	return commits, nil
+}
+
+func startSequencer(action string, revisions []string, opts PickOptions) error {
+	if len(revisions) == 0 {
+		return fmt.Errorf("no commits given to %s", sequencerCommand(action))
+	}
+	if opts.Mainline < 0 {
+		return fmt.Errorf("invalid mainline parent %d", opts.Mainline)
+	}
+	if err := checkNoSequencerInProgress(); err != nil {
+		return err
+	}
+	if _, ok := mergeHeads(); ok {
+		return fmt.Errorf("you have not concluded your merge (MERGE_HEAD exists); please commit your changes or abort the merge")
+	}
+	verb := "cherry-picking"
+	if action == "revert" {
+		verb = "reverting"
+	}
+	if err := checkNoUnmergedPaths(verb); err != nil {
+		return err
+	}
+
+	commits, err := sequencerCommits(action, revisions)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return fmt.Errorf("empty commit set passed")
+	}
+	head, err := headCommit()
+	if err != nil {
+		return err
+	}
+	todo := make([]todoItem, len(commits))
+	for i, hash := range commits {
+		todo[i] = todoItem{Action: action, Hash: hash}
+	}
+
+	if err := os.MkdirAll(repoPath("sequencer"), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(repoPath("sequencer", "head"), []byte(head+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := writeSequencerOpts(opts); err != nil {
+		return err
+	}
+	return runSequencer(todo, opts)
+}
+
+// runSequencer applies the todo list in order, saving what is left before
+// each step so that a stop can be resumed.
+func runSequencer(todo []todoItem, opts PickOptions) error {
+	for len(todo) > 0 {
+		if err := writeSequencerTodo(todo); err != nil {
+			return err
+		}
+		item := todo[0]
+		stopped, err := applyTodoItem(item, opts)
+		if err != nil {
+			if stopped {
+				// The item is in CHERRY_PICK_HEAD or REVERT_HEAD now.
+				writeSequencerTodo(todo[1:])
+			}
+			return err
+		}
+		todo = todo[1:]
+	}
+	removeSequencer()
+	return nil
+}
+
+// applyTodoItem merges the change of one commit into the index and working
+// tree and commits it unless opts.NoCommit is set. stopped reports that the
+// item was applied with conflicts (or came out empty) and has been recorded
+// for --continue; otherwise an error leaves the item to be tried again.
+func applyTodoItem(item todoItem, opts PickOptions) (stopped bool, err error) {
+	commit, err := readCommit(item.Hash)
+	if err != nil {
+		return false, fmt.Errorf("could not read commit %s: %v", item.Hash, err)
+	}
+	parent, err := pickParent(item.Hash, commit, opts.Mainline)
+	if err != nil {
+		return false, err
+	}
+	head, err := headCommit()
+	if err != nil {
+		return false, err
+	}
+	headTree, err := commitTree(head)
+	if err != nil {
+		return false, err
+	}
+	index, err := readIndex()
+	if err != nil {
+		return false, fmt.Errorf("could not read index: %v", err)
+	}
+	// Without --no-commit the result is committed, so staged changes would
+	// be swept into it.
+	ours := index
+	if !opts.NoCommit {
+		for _, path := range unionKeys(index, headTree) {
+			if index[path] != headTree[path] {
+				return false, fmt.Errorf("your index contains uncommitted changes; commit or stash them before you %s", sequencerCommand(item.Action))
+			}
+		}
+		ours = headTree
+	}
+
+	parentTree, err := commitTree(parent)
+	if err != nil {
+		return false, err
+	}
+	pickedTree, err := commitTree(item.Hash)
+	if err != nil {
+		return false, err
+	}
+	short := shortHash(item.Hash) + "... " + commit.Subject()
+	parentLabel := "parent of " + short
+	baseTree, theirsTree := parentTree, pickedTree
+	fileOpts, err := newMergeFileOptions("HEAD", parentLabel, short)
+	if err != nil {
+		return false, err
+	}
+	if item.Action == "revert" {
+		baseTree, theirsTree = pickedTree, parentTree
+		fileOpts.BaseLabel, fileOpts.TheirsLabel = short, parentLabel
+	}
+	result, err := mergeTrees(baseTree, ours, theirsTree, fileOpts)
+	if err != nil {
+		return false, err
+	}
+	if err := checkMergeOverwrites(ours, result); err != nil {
+		return false, err
+	}
+	// Nothing is recorded for --continue yet, so the item stays on the todo
+	// list to be tried again.
+	if err := applyMergeResult(ours, result); err != nil {
+		return false, err
+	}
+
+	message := pickMessage(item, commit, parent, opts)
+	command := sequencerCommand(item.Action)
+	if len(result.Conflicts) > 0 {
+		if err := writePickState(item, message, result); err != nil {
+			return true, err
+		}
+		for _, conflict := range result.Conflicts {
+			fmt.Printf("CONFLICT (%s): Merge conflict in %s\n", conflict.Kind, conflict.Path)
+		}
+		if err := rerereConflicts(result); err != nil {
+			return true, err
+		}
+		return true, fmt.Errorf("could not apply %s; fix conflicts, mark them with 'mygitserver add', then run 'mygitserver %s --continue'", short, command)
+	}
+	if opts.NoCommit {
+		return false, nil
+	}
+	if treesEqual(result.Entries, headTree) {
+		if err := writePickState(item, message, result); err != nil {
+			return true, err
+		}
+		return true, fmt.Errorf("the %s of %s is empty; use 'mygitserver %s --skip' to drop it", command, short, command)
+	}
+	author := ""
+	if item.Action == "pick" {
+		author = commit.Author
+	}
+	return false, commitPicked(sequencerCommand(item.Action), message, author)
+}
+
+// pickParent returns the parent whose diff to commit is applied. Merge
+// commits need a mainline; a root commit is diffed against the empty tree.
+func pickParent(hash string, commit *commitObject, mainline int) (string, error) {
+	switch {
+	case len(commit.Parents) > 1 && mainline == 0:
+		return "", fmt.Errorf("commit %s is a merge but no -m option was given", shortHash(hash))
+	case mainline > len(commit.Parents) && mainline > 1:
+		return "", fmt.Errorf("commit %s does not have parent %d", shortHash(hash), mainline)
+	case len(commit.Parents) == 0:
+		return "", nil
+	case mainline > 0:
+		return commit.Parents[mainline-1], nil
+	}
+	return commit.Parents[0], nil
+}
+
+// pickMessage prepares the message of the commit made for item.
+func pickMessage(item todoItem, commit *commitObject, parent string, opts PickOptions) string {
+	if item.Action == "revert" {
+		message := fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s", commit.Subject(), item.Hash)
+		if len(commit.Parents) > 1 {
+			message += fmt.Sprintf(", reversing\nchanges made to %s", parent)
+		}
+		return message + ".\n"
+	}
+	message := strings.TrimRight(commit.Message, "\n") + "\n"
+	if opts.RecordOrigin {
+		// The line joins an existing trailer block rather than starting a
+		// paragraph of its own.
+		if _, trailers := splitTrailerBlock(message); len(trailers) == 0 {
+			message += "\n"
+		}
+		message += fmt.Sprintf("(cherry picked from commit %s)\n", item.Hash)
+	}
+	return message
+}
+
+// commitPicked commits the index on top of HEAD, logging the move as
+// "<reason>: <subject>". Picked commits keep their author; reverts are
+// authored by the current user.
+func commitPicked(reason, message, author string) error {
+	if err := rerereRecord(); err != nil {
+		return err
+	}
+	parent, err := headCommit()
+	if err != nil {
+		return err
+	}
+	index, err := readIndex()
+	if err != nil {
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	tree, err := writeTree(index)
+	if err != nil {
+		return fmt.Errorf("could not write tree: %v", err)
+	}
+	commit := &commitObject{Tree: tree, Author: author, Message: message}
+	if parent != "" {
+		commit.Parents = []string{parent}
+	}
+	hash, err := writeCommit(commit)
+	if err != nil {
+		return fmt.Errorf("could not write commit object: %v", err)
+	}
+	if err := updateHeadFrom(parent, hash, reason+": "+commit.Subject()); err != nil {
+		return fmt.Errorf("could not update HEAD: %v", err)
+	}
+	fmt.Printf("[%s] %s\n", shortHash(hash), commit.Subject())
+	return nil
+}
+
+func treesEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, hash := range a {
+		if b[path] != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// pickHeadFiles maps the state file of a stopped item to its action.
+var pickHeadFiles = map[string]string{"CHERRY_PICK_HEAD": "pick", "REVERT_HEAD": "revert"}
+
+func writePickState(item todoItem, message string, result *treeMergeResult) error {
+	name := "CHERRY_PICK_HEAD"
+	if item.Action == "revert" {
+		name = "REVERT_HEAD"
+	}
+	if err := ioutil.WriteFile(repoPath(name), []byte(item.Hash+"\n"), 0644); err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString(message)
+	if len(result.Conflicts) > 0 {
+		b.WriteString("\n# Conflicts:\n")
+		for _, conflict := range result.Conflicts {
+			fmt.Fprintf(&b, "#\t%s\n", conflict.Path)
+		}
+	}
+	return ioutil.WriteFile(repoPath("MERGE_MSG"), []byte(b.String()), 0644)
+}
+
+// pickHead returns the item stopped by conflicts, if any.
+func pickHead() (todoItem, bool) {
+	for name, action := range pickHeadFiles {
+		if content, err := ioutil.ReadFile(repoPath(name)); err == nil {
+			return todoItem{Action: action, Hash: strings.TrimSpace(string(content))}, true
+		}
+	}
+	return todoItem{}, false
+}
+
+func clearPickState() {
+	for name := range pickHeadFiles {
+		os.Remove(repoPath(name))
+	}
+	os.Remove(repoPath("MERGE_MSG"))
+	os.Remove(repoPath("MERGE_RR"))
+}
+
+func sequencerInProgress() bool {
+	_, err := os.Stat(repoPath("sequencer"))
+	return err == nil
+}
+
+func checkNoSequencerInProgress() error {
+	if sequencerInProgress() {
+		return fmt.Errorf("a cherry-pick or revert is already in progress; use --continue, --skip or --abort")
+	}
+	return nil
+}
+
+func removeSequencer() {
+	os.RemoveAll(repoPath("sequencer"))
+}
+
+func writeSequencerTodo(todo []todoItem) error {
+	var b strings.Builder
+	for _, item := range todo {
+		subject := ""
+		if commit, err := readCommit(item.Hash); err == nil {
+			subject = commit.Subject()
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", item.Action, item.Hash, subject)
+	}
+	return ioutil.WriteFile(repoPath("sequencer", "todo"), []byte(b.String()), 0644)
+}
+
+func writeSequencerOpts(opts PickOptions) error {
+	content := fmt.Sprintf("record-origin = %t\nno-commit = %t\nmainline = %d\n", opts.RecordOrigin, opts.NoCommit, opts.Mainline)
+	return ioutil.WriteFile(repoPath("sequencer", "opts"), []byte(content), 0644)
+}
+
+// readSequencer loads the todo list and options of the run in progress.
+func readSequencer() ([]todoItem, PickOptions, error) {
+	var opts PickOptions
+	if !sequencerInProgress() {
+		return nil, opts, fmt.Errorf("no cherry-pick or revert in progress")
+	}
+	content, err := ioutil.ReadFile(repoPath("sequencer", "todo"))
+	if err != nil {
+		return nil, opts, fmt.Errorf("could not read sequencer todo list: %v", err)
+	}
+	var todo []todoItem
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "pick" && fields[0] != "revert") {
+			continue
+		}
+		todo = append(todo, todoItem{Action: fields[0], Hash: fields[1]})
+	}
+
+	content, err = ioutil.ReadFile(repoPath("sequencer", "opts"))
+	if err != nil {
+		return nil, opts, fmt.Errorf("could not read sequencer options: %v", err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "record-origin":
+			opts.RecordOrigin = value == "true"
+		case "no-commit":
+			opts.NoCommit = value == "true"
+		case "mainline":
+			opts.Mainline, _ = strconv.Atoi(value)
+		}
+	}
+	return todo, opts, nil
+}
+
+// SequencerContinue commits the item stopped by conflicts, once they are
+// resolved, with its prepared message and carries on with the rest.
+func SequencerContinue() error {
+	todo, opts, err := readSequencer()
+	if err != nil {
+		return err
+	}
+	if err := checkNoUnmergedPaths("committing"); err != nil {
+		return err
+	}
+	if item, ok := pickHead(); ok {
+		if !opts.NoCommit {
+			empty, err := indexMatchesHead()
+			if err != nil {
+				return err
+			}
+			if empty {
+				command := sequencerCommand(item.Action)
+				return fmt.Errorf("the %s of %s is now empty; use 'mygitserver %s --skip' to drop it", command, shortHash(item.Hash), command)
+			}
+			content, err := ioutil.ReadFile(repoPath("MERGE_MSG"))
+			if err != nil {
+				return fmt.Errorf("could not read MERGE_MSG: %v", err)
+			}
+			message := cleanupMessage(string(content), true)
+			if message == "" {
+				return fmt.Errorf("aborting commit due to empty commit message")
+			}
+			author := ""
+			if item.Action == "pick" {
+				if commit, err := readCommit(item.Hash); err == nil {
+					author = commit.Author
+				}
+			}
+			if err := commitPicked(sequencerCommand(item.Action), message, author); err != nil {
+				return err
+			}
+		}
+		clearPickState()
+	}
+	return runSequencer(todo, opts)
+}
+
+// SequencerSkip drops the item that stopped the sequencer, resetting the
+// files it touched to HEAD, and carries on with the rest.
+func SequencerSkip() error {
+	todo, opts, err := readSequencer()
+	if err != nil {
+		return err
+	}
+	// The stopped item left the todo list when it stopped; without it, it
+	// has been committed already and there is nothing to skip.
+	if _, ok := pickHead(); !ok {
+		return fmt.Errorf("nothing to skip; have you committed already? try --continue")
+	}
+	if err := resetToCommit(""); err != nil {
+		return err
+	}
+	rerereClear()
+	clearPickState()
+	return runSequencer(todo, opts)
+}
+
+// SequencerAbort stops the sequencer and returns HEAD, the index and the
+// working tree to where they were before it started.
+func SequencerAbort() error {
+	if !sequencerInProgress() {
+		return fmt.Errorf("no cherry-pick or revert in progress")
+	}
+	content, err := ioutil.ReadFile(repoPath("sequencer", "head"))
+	if err != nil {
+		return fmt.Errorf("could not read sequencer head: %v", err)
+	}
+	if err := resetToCommit(strings.TrimSpace(string(content))); err != nil {
+		return err
+	}
+	rerereClear()
+	clearPickState()
+	removeSequencer()
+	return nil
+}
+
+// resetToCommit makes HEAD, the index and the working tree match target,
+// or HEAD itself when target is empty, discarding local changes.
+func resetToCommit(target string) error {
+	head, err := headCommit()
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		target = head
+	}
+	headTree, err := commitTree(head)
+	if err != nil {
+		return err
+	}
+	targetTree, err := commitTree(target)
+	if err != nil {
+		return err
+	}
+	index, err := readIndex()
+	if err != nil {
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	if err := resetWorkingTree(headTree, targetTree, index); err != nil {
+		return err
+	}
+	if target != head {
+		if err := updateHeadFrom(head, target, "reset: moving to "+target); err != nil {
+			return fmt.Errorf("could not update HEAD: %v", err)
+		}
+	}
+	fmt.Printf("HEAD is now at %s\n", shortHash(target))
+	return nil
+}
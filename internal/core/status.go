@@ -6,38 +6,157 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
+// statusSummary is the information shown by Status, also used to fill in
+// the commented part of the commit message template.
+type statusSummary struct {
+	Branch     string
+	Detached   bool
+	Tracking   []string
+	InProgress []string
+	Unmerged   []string
+	Staged     []string
+	Modified   []string
+	Untracked  []string
+}
+
 func Status() {
-	headContent, err := ioutil.ReadFile(".mygitserver/HEAD")
+	summary, err := collectStatus()
 	if err != nil {
-		fmt.Println("Error reading HEAD:", err)
+		fmt.Println("Error reading status:", err)
 		return
 	}
 
+	fmt.Println(summary.headLine())
+	for _, line := range summary.Tracking {
+		fmt.Println(line)
+	}
+	for _, line := range summary.InProgress {
+		fmt.Println(line)
+	}
+	fmt.Println()
+
+	if len(summary.Unmerged) > 0 {
+		fmt.Println("Unmerged paths:")
+		for _, file := range summary.Unmerged {
+			fmt.Println("\t", file)
+		}
+	}
+	if len(summary.Staged) > 0 {
+		fmt.Println("Staged changes:")
+		for _, file := range summary.Staged {
+			fmt.Println("\t", file)
+		}
+	}
+	if len(summary.Modified) > 0 {
+		fmt.Println("Modified (unstaged) changes:")
+		for _, file := range summary.Modified {
+			fmt.Println("\t", file)
+		}
+	}
+	if len(summary.Untracked) > 0 {
+		fmt.Println("Untracked files:")
+		for _, file := range summary.Untracked {
+			fmt.Println("\t", file)
+		}
+	}
+	if len(summary.Unmerged) == 0 && len(summary.Staged) == 0 && len(summary.Modified) == 0 && len(summary.Untracked) == 0 {
+		fmt.Println("No changes in the working directory.")
+	}
+}
+
+// headLine is the first line of status output.
+func (s *statusSummary) headLine() string {
+	if s.Detached {
+		return fmt.Sprintf("HEAD detached at %s", shortHash(s.Branch))
+	}
+	return fmt.Sprintf("On branch %s", s.Branch)
+}
+
+func collectStatus() (*statusSummary, error) {
+	headContent, err := ioutil.ReadFile(repoPath("HEAD"))
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &statusSummary{}
 	headRef := strings.TrimSpace(string(headContent))
-	var currentBranch string 
 	if strings.HasPrefix(headRef, "ref: ") {
-		currentBranch = strings.TrimPrefix(headRef, "ref: refs/heads/")
+		summary.Branch = strings.TrimPrefix(headRef, "ref: refs/heads/")
+		tracking, err := branchTracking(summary.Branch)
+		if err != nil {
+			return nil, err
+		}
+		if tracking != nil {
+			summary.Tracking = tracking.statusLines()
+		}
 	} else {
-		currentBranch = "detached"
+		summary.Branch = headRef
+		summary.Detached = true
 	}
 
-	fmt.Printf("On branch %s\n\n", currentBranch)
-
 	workingFiles, err := listWorkingDirectoryFiles(".")
 	if err != nil {
-		fmt.Println("Error reading working directory:", err)
-		return
+		return nil, err
 	}
 
 	stagedFiles := getStagedFiles()
+	conflicts, err := readIndexConflicts()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range unmergedPaths(conflicts) {
+		summary.Unmerged = append(summary.Unmerged, fmt.Sprintf("%-16s%s", conflicts[path].describe()+":", path))
+	}
+	if item, picking := pickHead(); picking {
+		command, doing := sequencerCommand(item.Action), "cherry-picking"
+		if item.Action == "revert" {
+			doing = "reverting"
+		}
+		summary.InProgress = append(summary.InProgress, fmt.Sprintf("You are currently %s commit %s.", doing, shortHash(item.Hash)))
+		if len(conflicts) > 0 {
+			summary.InProgress = append(summary.InProgress, fmt.Sprintf("  (fix conflicts and run \"mygitserver %s --continue\")", command))
+		} else {
+			summary.InProgress = append(summary.InProgress, fmt.Sprintf("  (all conflicts fixed: run \"mygitserver %s --continue\")", command))
+		}
+		summary.InProgress = append(summary.InProgress,
+			fmt.Sprintf("  (use \"mygitserver %s --skip\" to skip this patch)", command),
+			fmt.Sprintf("  (use \"mygitserver %s --abort\" to cancel the %s operation)", command, command))
+	} else if sequencerInProgress() {
+		summary.InProgress = append(summary.InProgress, "Cherry-pick or revert currently in progress.",
+			"  (run \"mygitserver cherry-pick --continue\" to continue)",
+			"  (use \"mygitserver cherry-pick --abort\" to cancel the operation)")
+	}
+	if rebaseInProgress() {
+		summary.InProgress = append(summary.InProgress, rebaseStatusLines(len(conflicts) > 0)...)
+	}
+	if _, merging := mergeHeads(); merging {
+		if len(conflicts) > 0 {
+			summary.InProgress = append(summary.InProgress, "You have unmerged paths.", "  (fix conflicts and run \"mygitserver merge --continue\")", "  (use \"mygitserver merge --abort\" to abort the merge)")
+		} else {
+			summary.InProgress = append(summary.InProgress, "All conflicts fixed but you are still merging.", "  (use \"mygitserver merge --continue\" to conclude merge)")
+		}
+	}
 
-	var modifiedFiles []string
-	var untrackedFiles []string
+	head, err := headCommit()
+	if err != nil {
+		return nil, err
+	}
+	headTree, err := commitTree(head)
+	if err != nil {
+		return nil, err
+	}
 
+	seen := make(map[string]bool)
 	for _, file := range workingFiles {
+		file = normalizePath(file)
+		seen[file] = true
+		if _, conflicted := conflicts[file]; conflicted {
+			continue
+		}
 		if hash, isStaged := stagedFiles[file]; isStaged {
 			currentHash, err := utils.GenerateFileHash(file)
 			if err != nil {
@@ -45,34 +164,26 @@ func Status() {
 				continue
 			}
 			if currentHash != hash {
-				modifiedFiles = append(modifiedFiles, file) // The file has been modified since staging
+				summary.Modified = append(summary.Modified, file) // The file has been modified since staging
 			}
 		} else {
-			untrackedFiles = append(untrackedFiles, file) // File is not tracked
+			summary.Untracked = append(summary.Untracked, file) // File is not tracked
 		}
 	}
 
-	if len(stagedFiles) > 0 {
-		fmt.Println("Staged changes:")
-		for file := range stagedFiles {
-			fmt.Println("\t", file)
+	for _, file := range unionKeys(stagedFiles, headTree) {
+		if _, conflicted := conflicts[file]; conflicted {
+			continue
 		}
-	}
-	if len(modifiedFiles) > 0 {
-		fmt.Println("Modified (unstaged) changes:")
-		for _, file := range modifiedFiles {
-			fmt.Println("\t", file)
+		if stagedFiles[file] != headTree[file] {
+			summary.Staged = append(summary.Staged, file)
 		}
-	}
-	if len(untrackedFiles) > 0 {
-		fmt.Println("Untracked files:")
-		for _, file := range untrackedFiles {
-			fmt.Println("\t", file)
+		if _, tracked := stagedFiles[file]; tracked && !seen[file] {
+			summary.Modified = append(summary.Modified, file) // Deleted from the working directory
 		}
 	}
-	if len(stagedFiles) == 0 && len(modifiedFiles) == 0 && len(untrackedFiles) == 0 {
-		fmt.Println("No changes in the working directory.")
-	}
+	sort.Strings(summary.Modified)
+	return summary, nil
 }
 
 func listWorkingDirectoryFiles(path string) ([]string, error) {
@@ -81,7 +192,17 @@ func listWorkingDirectoryFiles(path string) ([]string, error) {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() || strings.HasPrefix(path, ".mygitserver") {
+		if info.Name() == repoDirName {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			// A nested worktree (or repository) is not part of this one.
+			if _, err := os.Stat(filepath.Join(path, repoDirName)); err == nil && path != "." {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		files = append(files, path)
@@ -90,18 +211,12 @@ func listWorkingDirectoryFiles(path string) ([]string, error) {
 	return files, err
 }
 
+// getStagedFiles returns the index as a path-to-hash map.
 func getStagedFiles() map[string]string {
-	stagedFiles := make(map[string]string)
-	objectDir := filepath.Join(".mygitserver", "objects")
-
-	files, err := ioutil.ReadDir(objectDir)
+	stagedFiles, err := readIndex()
 	if err != nil {
-		fmt.Println("Error reading objects directory:", err)
-		return stagedFiles
-	}
-
-	for _, file := range files {
-		stagedFiles[file.Name()] = file.Name() // Store file hash for comparison
+		fmt.Println("Error reading index:", err)
+		return map[string]string{}
 	}
 	return stagedFiles
 }
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// mergeInput is what a merge strategy works from: HEAD, the commits being
+// merged into it, and the names they were given, which label conflicts.
+// FileOpts carries the conflict style, marker size and -X side; the
+// strategy fills in the labels.
+type mergeInput struct {
+	Head        string
+	HeadName    string
+	Remotes     []string
+	RemoteNames []string
+	FileOpts    mergeFileOptions
+}
+
+// mergeStrategy combines the commits of a merge into one tree. Strategies
+// are registered in mergeStrategies under the name "merge -s" selects them
+// by; a strategy that cannot handle a merge returns an error before
+// anything has been changed.
+type mergeStrategy interface {
+	merge(in mergeInput) (*treeMergeResult, error)
+}
+
+var mergeStrategies = map[string]mergeStrategy{
+	"ort":       recursiveStrategy{name: "ort"},
+	"recursive": recursiveStrategy{name: "recursive"},
+	"ours":      oursStrategy{},
+	"octopus":   octopusStrategy{},
+}
+
+// defaultMergeStrategy is used when no strategy is asked for: pull.twohead
+// (ort by default) for a single branch and pull.octopus (octopus) for more.
+func defaultMergeStrategy(remotes int) string {
+	if remotes > 1 {
+		return configOrDefault("pull.octopus", "octopus")
+	}
+	return configOrDefault("pull.twohead", "ort")
+}
+
+func lookupMergeStrategy(name string) (mergeStrategy, error) {
+	strategy, ok := mergeStrategies[name]
+	if !ok {
+		names := make([]string, 0, len(mergeStrategies))
+		for known := range mergeStrategies {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("could not find merge strategy '%s'; available strategies are: %s", name, strings.Join(names, " "))
+	}
+	return strategy, nil
+}
+
+// parseStrategyOptions turns the -X options into the side conflicting
+// hunks are resolved to.
+func parseStrategyOptions(options []string) (string, error) {
+	favor := ""
+	for _, option := range options {
+		switch option {
+		case favorOurs, favorTheirs:
+			favor = option
+		default:
+			return "", fmt.Errorf("unknown strategy option: -X%s", option)
+		}
+	}
+	return favor, nil
+}
+
+// recursiveStrategy is the default three-way merge of two heads. When the
+// heads have several merge bases, as after criss-cross merges, the bases
+// are first merged with each other into a virtual base.
+type recursiveStrategy struct {
+	name string
+}
+
+func (s recursiveStrategy) merge(in mergeInput) (*treeMergeResult, error) {
+	if len(in.Remotes) != 1 {
+		return nil, fmt.Errorf("the '%s' strategy can only merge one branch", s.name)
+	}
+	bases, err := mergeBases(in.Head, in.Remotes[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) == 0 {
+		return nil, fmt.Errorf("refusing to merge unrelated histories")
+	}
+	baseTree, baseLabel, err := virtualMergeBase(bases, in.FileOpts)
+	if err != nil {
+		return nil, err
+	}
+	oursTree, err := commitTree(in.Head)
+	if err != nil {
+		return nil, err
+	}
+	theirsTree, err := commitTree(in.Remotes[0])
+	if err != nil {
+		return nil, err
+	}
+	opts := in.FileOpts
+	opts.OursLabel, opts.BaseLabel, opts.TheirsLabel = in.HeadName, baseLabel, in.RemoteNames[0]
+	return mergeTrees(baseTree, oursTree, theirsTree, opts)
+}
+
+// virtualMergeBase returns the tree to merge against and its conflict
+// label. A single base is used as it is. Several are merged pairwise, each
+// pair against its own merge bases, and the result, conflict markers
+// included, is written as a commit that only serves as the base.
+func virtualMergeBase(bases []string, opts mergeFileOptions) (map[string]string, string, error) {
+	switch len(bases) {
+	case 0:
+		return map[string]string{}, "empty tree", nil
+	case 1:
+		tree, err := commitTree(bases[0])
+		return tree, shortHash(bases[0]), err
+	}
+
+	opts.OursLabel, opts.TheirsLabel = "Temporary merge branch 1", "Temporary merge branch 2"
+	opts.Favor = ""
+	merged := bases[0]
+	for _, next := range bases[1:] {
+		inner, err := mergeBases(merged, next)
+		if err != nil {
+			return nil, "", err
+		}
+		innerTree, innerLabel, err := virtualMergeBase(inner, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		mergedTree, err := commitTree(merged)
+		if err != nil {
+			return nil, "", err
+		}
+		nextTree, err := commitTree(next)
+		if err != nil {
+			return nil, "", err
+		}
+		opts.BaseLabel = innerLabel
+		result, err := mergeTrees(innerTree, mergedTree, nextTree, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		tree, err := result.virtualTree()
+		if err != nil {
+			return nil, "", err
+		}
+		treeHash, err := writeTree(tree)
+		if err != nil {
+			return nil, "", err
+		}
+		merged, err = writeCommit(&commitObject{
+			Tree:    treeHash,
+			Parents: []string{merged, next},
+			Message: "merged common ancestors\n",
+		})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	tree, err := commitTree(merged)
+	return tree, "merged common ancestors", err
+}
+
+// virtualTree turns a merge result into a tree by taking the working copy
+// contents of conflicted paths as they are.
+func (r *treeMergeResult) virtualTree() (map[string]string, error) {
+	tree := make(map[string]string, len(r.Entries)+len(r.Contents))
+	for path, hash := range r.Entries {
+		tree[path] = hash
+	}
+	for path, content := range r.Contents {
+		hash, err := writeObject(content)
+		if err != nil {
+			return nil, err
+		}
+		tree[path] = hash
+	}
+	return tree, nil
+}
+
+// oursStrategy records the merge but keeps HEAD's tree, discarding every
+// change from the other side.
+type oursStrategy struct{}
+
+func (oursStrategy) merge(in mergeInput) (*treeMergeResult, error) {
+	tree, err := commitTree(in.Head)
+	if err != nil {
+		return nil, err
+	}
+	return &treeMergeResult{
+		Entries:  tree,
+		Stages:   map[string]conflictStages{},
+		Contents: map[string][]byte{},
+	}, nil
+}
+
+// octopusStrategy merges any number of branches into HEAD in turn. It is
+// meant for branches that do not touch the same lines, and refuses the
+// whole merge as soon as one of them conflicts.
+type octopusStrategy struct{}
+
+func (octopusStrategy) merge(in mergeInput) (*treeMergeResult, error) {
+	current, err := commitTree(in.Head)
+	if err != nil {
+		return nil, err
+	}
+	for i, remote := range in.Remotes {
+		base, err := mergeBase(in.Head, remote)
+		if err != nil {
+			return nil, fmt.Errorf("refusing to merge unrelated histories")
+		}
+		baseTree, err := commitTree(base)
+		if err != nil {
+			return nil, err
+		}
+		theirsTree, err := commitTree(remote)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Trying simple merge with %s\n", in.RemoteNames[i])
+		opts := in.FileOpts
+		opts.OursLabel, opts.BaseLabel, opts.TheirsLabel = in.HeadName, shortHash(base), in.RemoteNames[i]
+		result, err := mergeTrees(baseTree, current, theirsTree, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Conflicts) > 0 {
+			for _, conflict := range result.Conflicts {
+				fmt.Printf("CONFLICT (%s): Merge conflict in %s\n", conflict.Kind, conflict.Path)
+			}
+			return nil, fmt.Errorf("merge with strategy octopus failed on '%s'; merge the branches one at a time", in.RemoteNames[i])
+		}
+		current = result.Entries
+	}
+	return &treeMergeResult{
+		Entries:  current,
+		Stages:   map[string]conflictStages{},
+		Contents: map[string][]byte{},
+	}, nil
+}
@@ -0,0 +1,391 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// signatureHeader starts the ASCII-armored signature appended to the message
+// of a signed tag.
+const signatureHeader = "-----BEGIN PGP SIGNATURE-----"
+
+// tagObject is an annotated tag. Like commits it is stored as "key: value"
+// header lines, a blank line and the message; a signed tag carries its
+// signature after the message.
+type tagObject struct {
+	Object    string
+	Type      string
+	Tag       string
+	Tagger    string
+	Timestamp string
+	Message   string
+	Signature string
+}
+
+// payload is the part of the tag covered by its signature.
+func (t *tagObject) payload() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "object: %s\n", t.Object)
+	fmt.Fprintf(&b, "type: %s\n", t.Type)
+	fmt.Fprintf(&b, "tag: %s\n", t.Tag)
+	fmt.Fprintf(&b, "tagger: %s\n", t.Tagger)
+	fmt.Fprintf(&b, "timestamp: %s\n", t.Timestamp)
+	b.WriteString("\n")
+	b.WriteString(t.Message)
+	return []byte(b.String())
+}
+
+func (t *tagObject) serialize() []byte {
+	return append(t.payload(), t.Signature...)
+}
+
+func parseTag(content []byte) (*tagObject, error) {
+	header, message, _ := strings.Cut(string(content), "\n\n")
+	if !strings.HasPrefix(header, "object: ") {
+		return nil, fmt.Errorf("not a tag object")
+	}
+	tag := &tagObject{Message: message}
+	if at := strings.Index(message, signatureHeader); at >= 0 && (at == 0 || message[at-1] == '\n') {
+		tag.Message, tag.Signature = message[:at], message[at:]
+	}
+	for _, line := range strings.Split(header, "\n") {
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag header line %q", line)
+		}
+		switch key {
+		case "object":
+			tag.Object = value
+		case "type":
+			tag.Type = value
+		case "tag":
+			tag.Tag = value
+		case "tagger":
+			tag.Tagger = value
+		case "timestamp":
+			tag.Timestamp = value
+		}
+	}
+	if tag.Object == "" || tag.Type == "" || tag.Tag == "" {
+		return nil, fmt.Errorf("tag object is missing its object, type or name")
+	}
+	return tag, nil
+}
+
+func readTag(hash string) (*tagObject, error) {
+	content, err := readObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return parseTag(content)
+}
+
+// peelTag follows annotated tags until it reaches an object that is not a
+// tag. Other objects are returned unchanged.
+func peelTag(hash string) (string, error) {
+	for depth := 0; objectType(hash) == "tag"; depth++ {
+		if depth > 100 {
+			return "", fmt.Errorf("tag chain starting at %s is too deep", shortHash(hash))
+		}
+		tag, err := readTag(hash)
+		if err != nil {
+			return "", err
+		}
+		hash = tag.Object
+	}
+	return hash, nil
+}
+
+// checkTagName validates the short name of a tag.
+func checkTagName(name string) error {
+	if name == "" {
+		return fmt.Errorf("tag name cannot be empty")
+	}
+	if strings.HasPrefix(name, "-") {
+		return fmt.Errorf("'%s' is not a valid tag name", name)
+	}
+	if err := checkRefFormat("refs/tags/"+name, false); err != nil {
+		return fmt.Errorf("'%s' is not a valid tag name: %v", name, err)
+	}
+	return nil
+}
+
+// TagOptions controls CreateTag. A tag is annotated when Annotate or Sign
+// is set or a message is given; otherwise it is a lightweight ref pointing
+// straight at the object. Force replaces an existing tag.
+type TagOptions struct {
+	Annotate bool
+	Sign     bool
+	Force    bool
+	Message  CommitOptions
+}
+
+// CreateTag tags target (HEAD when empty) as name.
+func CreateTag(name, target string, opts TagOptions) error {
+	if err := checkTagName(name); err != nil {
+		return err
+	}
+	ref := "refs/tags/" + name
+	previous := ""
+	if refExists(ref) {
+		if !opts.Force {
+			return fmt.Errorf("tag '%s' already exists", name)
+		}
+		previous, _ = readRef(ref)
+	}
+
+	if target == "" {
+		target = "HEAD"
+	}
+	object, err := resolveRevision(target)
+	if err != nil {
+		return err
+	}
+
+	hash := object
+	annotated := opts.Annotate || opts.Sign || len(opts.Message.Messages) > 0 || opts.Message.File != ""
+	if annotated {
+		message, err := tagMessage(name, opts.Message)
+		if err != nil {
+			return err
+		}
+		tag := &tagObject{
+			Object:    object,
+			Type:      objectType(object),
+			Tag:       name,
+			Tagger:    currentIdentity(),
+			Timestamp: time.Now().Format(time.RFC3339),
+			Message:   message,
+		}
+		if opts.Sign {
+			signature, err := signPayload(tag.payload())
+			if err != nil {
+				return err
+			}
+			tag.Signature = signature
+		}
+		if hash, err = writeObject(tag.serialize()); err != nil {
+			return fmt.Errorf("could not write tag object: %v", err)
+		}
+	}
+
+	if err := updateRef(ref, hash, "tag: tagging "+shortHash(object)); err != nil {
+		return fmt.Errorf("could not create tag: %v", err)
+	}
+	if previous != "" && previous != hash {
+		fmt.Printf("Updated tag '%s' (was %s)\n", name, shortHash(previous))
+	} else {
+		fmt.Printf("Tag '%s' created, pointing to %s\n", name, shortHash(object))
+	}
+	return nil
+}
+
+// tagMessage reads the annotation from -m/-F or, failing that, the editor.
+func tagMessage(name string, opts CommitOptions) (string, error) {
+	var message string
+	switch {
+	case len(opts.Messages) > 0:
+		message = cleanupMessage(strings.Join(opts.Messages, "\n\n"), false)
+	case opts.File != "":
+		content, err := readNoteInput(opts.File)
+		if err != nil {
+			return "", fmt.Errorf("could not read '%s': %v", opts.File, err)
+		}
+		message = cleanupMessage(content, false)
+	default:
+		buffer := fmt.Sprintf("\n#\n# Write a message for tag:\n#   %s\n# Lines starting with '#' will be ignored.\n", name)
+		edited, err := editBuffer("TAG_EDITMSG", buffer)
+		if err != nil {
+			return "", err
+		}
+		message = cleanupMessage(edited, true)
+	}
+	if message == "" {
+		return "", fmt.Errorf("aborting tag due to empty tag message")
+	}
+	return message, nil
+}
+
+// gpgProgram returns the signing program from gpg.program, "gpg" by
+// default. Like the editor it is run through the shell.
+func gpgProgram() string {
+	if program, ok := getConfig("gpg.program"); ok && program != "" {
+		return program
+	}
+	return "gpg"
+}
+
+// signPayload returns an armored detached signature for payload, made with
+// user.signingKey when it is configured.
+func signPayload(payload []byte) (string, error) {
+	program := gpgProgram()
+	args := []string{"--detach-sign", "--armor"}
+	if key, ok := getConfig("user.signingkey"); ok && key != "" {
+		args = append(args, "--local-user", key)
+	}
+	cmd := exec.Command("sh", append([]string{"-c", program + ` "$@"`, program}, args...)...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stderr = os.Stderr
+	signature, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed to sign the data: %v", program, err)
+	}
+	if !strings.HasPrefix(string(signature), signatureHeader) {
+		return "", fmt.Errorf("%s did not produce an armored signature", program)
+	}
+	return string(signature), nil
+}
+
+// verifyPayload checks signature against payload with the signing program.
+func verifyPayload(payload []byte, signature string) error {
+	sigFile, err := ioutil.TempFile("", "mygitserver-sig-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sigFile.Name())
+	if _, err := sigFile.WriteString(signature); err != nil {
+		sigFile.Close()
+		return err
+	}
+	sigFile.Close()
+
+	program := gpgProgram()
+	cmd := exec.Command("sh", "-c", program+` "$@"`, program, "--verify", sigFile.Name(), "-")
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("bad signature: %v", err)
+	}
+	return nil
+}
+
+// ListTags prints tag names matching any of patterns (all tags when there
+// are none), sorted. With lines > 0 the first lines of each annotation, or
+// of the tagged commit's message, are shown too.
+func ListTags(patterns []string, lines int) error {
+	tags, err := listRefs("refs/tags/")
+	if err != nil {
+		return fmt.Errorf("could not read tags: %v", err)
+	}
+	names := make([]string, 0, len(tags))
+	for ref := range tags {
+		name := strings.TrimPrefix(ref, "refs/tags/")
+		if matchesAnyPattern(name, patterns) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	width := 0
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	for _, name := range names {
+		if lines <= 0 {
+			fmt.Println(name)
+			continue
+		}
+		text := tagAnnotation(tags["refs/tags/"+name])
+		annotation := strings.Split(strings.TrimRight(text, "\n"), "\n")
+		if len(annotation) > lines {
+			annotation = annotation[:lines]
+		}
+		fmt.Printf("%-*s %s\n", width, name, strings.Join(annotation, "\n"+strings.Repeat(" ", width+1)))
+	}
+	return nil
+}
+
+func matchesAnyPattern(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tagAnnotation returns the message of an annotated tag or, for a
+// lightweight tag, the message of the commit it points at.
+func tagAnnotation(hash string) string {
+	switch objectType(hash) {
+	case "tag":
+		if tag, err := readTag(hash); err == nil {
+			return tag.Message
+		}
+	case "commit":
+		if commit, err := readCommit(hash); err == nil {
+			return commit.Message
+		}
+	}
+	return ""
+}
+
+// DeleteTags removes the named tags.
+func DeleteTags(names []string) error {
+	for _, name := range names {
+		if err := checkTagName(name); err != nil {
+			return err
+		}
+		ref := "refs/tags/" + name
+		if !refExists(ref) {
+			return fmt.Errorf("tag '%s' not found", name)
+		}
+		hash, err := readRef(ref)
+		if err != nil {
+			return err
+		}
+		if err := deleteRef(ref); err != nil {
+			return fmt.Errorf("could not delete tag '%s': %v", name, err)
+		}
+		if err := removeReflog(ref); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted tag '%s' (was %s)\n", name, shortHash(hash))
+	}
+	return nil
+}
+
+// VerifyTags checks that each named tag is a well-formed annotated tag
+// whose target exists with the recorded type, and verifies its signature.
+func VerifyTags(names []string) error {
+	for _, name := range names {
+		hash, err := resolveRevision(name)
+		if err != nil {
+			return err
+		}
+		if objectType(hash) != "tag" {
+			return fmt.Errorf("%s: cannot verify a non-tag object of type %s", name, objectType(hash))
+		}
+		tag, err := readTag(hash)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if _, err := readObject(tag.Object); err != nil {
+			return fmt.Errorf("%s: tagged object %s is missing", name, tag.Object)
+		}
+		if actual := objectType(tag.Object); actual != tag.Type {
+			return fmt.Errorf("%s: tagged object %s is a %s, not a %s", name, shortHash(tag.Object), actual, tag.Type)
+		}
+		if tag.Signature == "" {
+			return fmt.Errorf("%s: no signature found", name)
+		}
+		if err := verifyPayload(tag.payload(), tag.Signature); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fmt.Printf("Good signature on tag '%s'\n", name)
+	}
+	return nil
+}
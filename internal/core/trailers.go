@@ -0,0 +1,287 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Trailer is a "Key: value" line in the final paragraph of a commit message,
+// such as "Signed-off-by: Jane <jane@example.com>".
+type Trailer struct {
+	Key   string
+	Value string
+}
+
+func (t Trailer) String() string {
+	return t.Key + ": " + t.Value
+}
+
+// Ways AddTrailers can treat a trailer whose key is already present.
+const (
+	TrailerAddIfDifferentNeighbor = "addIfDifferentNeighbor"
+	TrailerAddIfDifferent         = "addIfDifferent"
+	TrailerAdd                    = "add"
+	TrailerReplace                = "replace"
+	TrailerDoNothing              = "doNothing"
+)
+
+// ParseTrailerArg parses the "key=value" or "key: value" form accepted by
+// --trailer.
+func ParseTrailerArg(arg string) (Trailer, error) {
+	sep := strings.IndexAny(arg, "=:")
+	if sep <= 0 {
+		return Trailer{}, fmt.Errorf("invalid trailer '%s': expected key=value", arg)
+	}
+	key := strings.TrimSpace(arg[:sep])
+	if !isTrailerKey(key) {
+		return Trailer{}, fmt.Errorf("invalid trailer key '%s'", key)
+	}
+	return Trailer{Key: key, Value: strings.TrimSpace(arg[sep+1:])}, nil
+}
+
+func isTrailerKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if !(r == '-' || r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// generatedTrailerPrefixes start the lines mygitserver itself adds to a
+// trailer block.
+var generatedTrailerPrefixes = []string{"Signed-off-by: ", "(cherry picked from commit "}
+
+// parseTrailerLine splits a "Key: value" line.
+func parseTrailerLine(line string) (Trailer, bool) {
+	key, value, ok := strings.Cut(line, ":")
+	if !ok || !isTrailerKey(key) || (value != "" && value[0] != ' ' && value[0] != '\t') {
+		return Trailer{}, false
+	}
+	return Trailer{Key: key, Value: strings.TrimSpace(value)}, true
+}
+
+// configuredTrailerKeys returns the lowercased keys of the trailers set up
+// with trailer.<token>.* in the config.
+func configuredTrailerKeys() map[string]bool {
+	keys := make(map[string]bool)
+	for _, entry := range loadConfig().entries {
+		if !strings.EqualFold(entry.Section, "trailer") || entry.Subsection == "" {
+			continue
+		}
+		key := entry.Subsection
+		if strings.EqualFold(entry.Name, "key") {
+			key = strings.TrimSuffix(strings.TrimSpace(entry.Value), ":")
+		}
+		keys[strings.ToLower(key)] = true
+	}
+	return keys
+}
+
+// splitTrailerBlock separates a message into the text before its trailer
+// block and the lines of the block itself. As in git, the last paragraph is
+// a trailer block when every line in it is a trailer, or when it holds a
+// trailer mygitserver generates or the config names and at least a quarter
+// of its lines are trailers. The subject paragraph is never treated as
+// trailers.
+func splitTrailerBlock(message string) (string, []string) {
+	trimmed := strings.TrimRight(message, "\n")
+	start := strings.LastIndex(trimmed, "\n\n")
+	if start < 0 {
+		return message, nil
+	}
+	lines := strings.Split(trimmed[start+2:], "\n")
+	var configured map[string]bool
+	trailers, others, recognized := 0, 0, false
+	for i, line := range lines {
+		if i > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			continue // continuation of the previous line
+		}
+		generated := false
+		for _, prefix := range generatedTrailerPrefixes {
+			generated = generated || strings.HasPrefix(line, prefix)
+		}
+		trailer, ok := parseTrailerLine(line)
+		switch {
+		case generated:
+			trailers++
+			recognized = true
+		case ok:
+			trailers++
+			if configured == nil {
+				configured = configuredTrailerKeys()
+			}
+			recognized = recognized || configured[strings.ToLower(trailer.Key)]
+		default:
+			others++
+		}
+	}
+	if trailers == 0 || (others > 0 && !(recognized && trailers*4 >= trailers+others)) {
+		return message, nil
+	}
+	return trimmed[:start+2], lines
+}
+
+// parseTrailerBlock turns the lines of a trailer block into trailers, with
+// folded continuation lines joined into a single value. Lines that are not
+// trailers, such as "(cherry picked from commit ...)", are kept verbatim as
+// entries with an empty Key.
+func parseTrailerBlock(lines []string) []Trailer {
+	var entries []Trailer
+	for _, line := range lines {
+		if len(entries) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			last := &entries[len(entries)-1]
+			if last.Key == "" {
+				last.Value += "\n" + line
+			} else {
+				last.Value += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		trailer, ok := parseTrailerLine(line)
+		if !ok {
+			trailer = Trailer{Value: line}
+		}
+		entries = append(entries, trailer)
+	}
+	return entries
+}
+
+// ParseTrailers returns the trailers found in the last paragraph of message,
+// with folded continuation lines joined into a single value.
+func ParseTrailers(message string) []Trailer {
+	_, lines := splitTrailerBlock(message)
+	var trailers []Trailer
+	for _, trailer := range parseTrailerBlock(lines) {
+		if trailer.Key != "" {
+			trailers = append(trailers, trailer)
+		}
+	}
+	return trailers
+}
+
+// FormatTrailers renders trailers one per line. An entry without a Key is
+// a line of the block that is not a trailer and is written as is.
+func FormatTrailers(trailers []Trailer) string {
+	var b strings.Builder
+	for _, trailer := range trailers {
+		if trailer.Key == "" {
+			b.WriteString(trailer.Value)
+		} else {
+			b.WriteString(trailer.String())
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// AddTrailers appends trailers to message, creating a trailer block if it
+// has none. ifExists decides what happens when a trailer with the same key
+// is already present; it defaults to TrailerAddIfDifferentNeighbor.
+func AddTrailers(message string, trailers []Trailer, ifExists string) (string, error) {
+	body, lines := splitTrailerBlock(message)
+	existing := parseTrailerBlock(lines)
+
+	for _, trailer := range trailers {
+		var err error
+		existing, err = applyTrailer(existing, trailer, ifExists)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(existing) == 0 {
+		return message, nil
+	}
+
+	body = strings.TrimRight(body, "\n")
+	if body == "" {
+		return FormatTrailers(existing), nil
+	}
+	return body + "\n\n" + FormatTrailers(existing), nil
+}
+
+func applyTrailer(existing []Trailer, trailer Trailer, ifExists string) ([]Trailer, error) {
+	sameKey := func(t Trailer) bool { return strings.EqualFold(t.Key, trailer.Key) }
+	same := func(t Trailer) bool { return sameKey(t) && t.Value == trailer.Value }
+
+	switch ifExists {
+	case "", TrailerAddIfDifferentNeighbor:
+		if len(existing) > 0 && same(existing[len(existing)-1]) {
+			return existing, nil
+		}
+	case TrailerAddIfDifferent:
+		for _, t := range existing {
+			if same(t) {
+				return existing, nil
+			}
+		}
+	case TrailerAdd:
+	case TrailerReplace:
+		kept := existing[:0]
+		for _, t := range existing {
+			if !sameKey(t) {
+				kept = append(kept, t)
+			}
+		}
+		existing = kept
+	case TrailerDoNothing:
+		for _, t := range existing {
+			if sameKey(t) {
+				return existing, nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown value '%s' for if-exists", ifExists)
+	}
+	return append(existing, trailer), nil
+}
+
+// InterpretTrailersOptions configures InterpretTrailers.
+type InterpretTrailersOptions struct {
+	Trailers     []Trailer
+	IfExists     string
+	OnlyTrailers bool
+}
+
+// InterpretTrailers reads each file (or standard input when none are given),
+// adds the requested trailers and prints the result.
+func InterpretTrailers(files []string, opts InterpretTrailersOptions) error {
+	var inputs []string
+	if len(files) == 0 {
+		content, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, string(content))
+	}
+	for _, file := range files {
+		var content []byte
+		var err error
+		if file == "-" {
+			content, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			content, err = ioutil.ReadFile(file)
+		}
+		if err != nil {
+			return fmt.Errorf("could not read '%s': %v", file, err)
+		}
+		inputs = append(inputs, string(content))
+	}
+
+	for _, input := range inputs {
+		output, err := AddTrailers(input, opts.Trailers, opts.IfExists)
+		if err != nil {
+			return err
+		}
+		if opts.OnlyTrailers {
+			output = FormatTrailers(ParseTrailers(output))
+		}
+		fmt.Print(output)
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// refUpdate is one step of a refTransaction. When CheckOld is set the ref
+// must currently point at Old, where an empty Old means the ref must not
+// exist. An empty New deletes the ref.
+type refUpdate struct {
+	Ref      string
+	Old      string
+	New      string
+	CheckOld bool
+	Reason   string
+	Verify   bool
+
+	// Filled in while the transaction commits.
+	current string
+	existed bool
+	logHead bool
+	lock    string
+}
+
+// refTransaction updates several refs atomically: every ref is locked
+// through a "<ref>.lock" file, all expected old values are verified, and
+// only then are the new values moved into place. If anything fails before
+// that point no ref changes; a failure while moving values into place rolls
+// back the refs already updated.
+type refTransaction struct {
+	updates []*refUpdate
+}
+
+func newRefTransaction() *refTransaction {
+	return &refTransaction{}
+}
+
+// update queues setting ref to newHash. checkOld makes the update
+// conditional on ref currently being oldHash.
+func (tx *refTransaction) update(ref, newHash, oldHash string, checkOld bool, reason string) {
+	tx.updates = append(tx.updates, &refUpdate{Ref: ref, New: newHash, Old: oldHash, CheckOld: checkOld, Reason: reason})
+}
+
+// create queues creating ref, which must not exist yet.
+func (tx *refTransaction) create(ref, newHash, reason string) {
+	tx.update(ref, newHash, "", true, reason)
+}
+
+// delete queues removing ref, optionally only if it is still oldHash.
+func (tx *refTransaction) delete(ref, oldHash string, checkOld bool, reason string) {
+	tx.update(ref, "", oldHash, checkOld, reason)
+}
+
+// verify queues a check that ref is oldHash without changing it.
+func (tx *refTransaction) verify(ref, oldHash string) {
+	tx.updates = append(tx.updates, &refUpdate{Ref: ref, Old: oldHash, CheckOld: true, Verify: true})
+}
+
+// commit applies every queued update or none of them.
+func (tx *refTransaction) commit() error {
+	defer tx.releaseLocks()
+
+	seen := make(map[string]bool)
+	for _, u := range tx.updates {
+		if err := tx.prepare(u); err != nil {
+			return err
+		}
+		if seen[u.Ref] {
+			return fmt.Errorf("multiple updates for ref '%s' not allowed", u.Ref)
+		}
+		seen[u.Ref] = true
+	}
+
+	for _, u := range tx.updates {
+		if err := tx.lock(u); err != nil {
+			return err
+		}
+	}
+	for _, u := range tx.updates {
+		if err := u.checkCurrent(); err != nil {
+			return err
+		}
+	}
+	for _, u := range tx.updates {
+		if !u.Verify && u.New != "" && !u.existed && u.Ref != "HEAD" {
+			if err := checkRefConflict(u.Ref); err != nil {
+				return fmt.Errorf("cannot lock ref '%s': %v", u.Ref, err)
+			}
+		}
+	}
+
+	var applied []*refUpdate
+	for _, u := range tx.updates {
+		if u.Verify || (u.New == u.current && u.existed) {
+			continue
+		}
+		if err := u.apply(); err != nil {
+			for i := len(applied) - 1; i >= 0; i-- {
+				applied[i].rollback()
+			}
+			return fmt.Errorf("could not update ref '%s': %v", u.Ref, err)
+		}
+		applied = append(applied, u)
+	}
+
+	for _, u := range applied {
+		if u.New == "" {
+			if err := removeReflog(u.Ref); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := appendReflog(u.Ref, u.current, u.New, u.Reason); err != nil {
+			return err
+		}
+		if u.logHead {
+			if err := appendReflog("HEAD", u.current, u.New, u.Reason); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prepare validates u and turns an update of an attached HEAD into an update
+// of the branch it points at.
+func (tx *refTransaction) prepare(u *refUpdate) error {
+	if u.Ref == "HEAD" {
+		ref, detached, err := readHead()
+		if err != nil {
+			return fmt.Errorf("could not read HEAD: %v", err)
+		}
+		if u.New == "" && !u.Verify {
+			return fmt.Errorf("cannot delete HEAD")
+		}
+		if !detached {
+			u.Ref, u.logHead = ref, true
+		}
+		return nil
+	}
+	return checkRefFormat(u.Ref, false)
+}
+
+// lock takes "<ref>.lock" with O_EXCL, so a second writer fails instead of
+// racing.
+func (tx *refTransaction) lock(u *refUpdate) error {
+	lockPath := looseRefPath(u.Ref) + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return fmt.Errorf("cannot lock ref '%s': %v", u.Ref, err)
+	}
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("cannot lock ref '%s': unable to create '%s': file exists; another process may be updating it", u.Ref, lockPath)
+		}
+		return fmt.Errorf("cannot lock ref '%s': %v", u.Ref, err)
+	}
+	u.lock = lockPath
+	if _, err := file.WriteString(u.New); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot lock ref '%s': %v", u.Ref, err)
+	}
+	return file.Close()
+}
+
+func (tx *refTransaction) releaseLocks() {
+	for _, u := range tx.updates {
+		if u.lock != "" {
+			os.Remove(u.lock)
+			pruneEmptyRefDirs(filepath.Dir(u.lock))
+			u.lock = ""
+		}
+	}
+}
+
+// checkCurrent reads the locked ref and compares it with the expected value.
+func (u *refUpdate) checkCurrent() error {
+	if u.Ref == "HEAD" {
+		ref, _, err := readHead()
+		if err != nil {
+			return err
+		}
+		u.current, u.existed = ref, true
+	} else if refExists(u.Ref) {
+		current, err := readRef(u.Ref)
+		if err != nil {
+			return err
+		}
+		u.current, u.existed = current, true
+	}
+	if !u.CheckOld {
+		return nil
+	}
+	// An unborn branch exists as an empty file but counts as absent.
+	switch {
+	case u.Old == "" && u.current != "":
+		return fmt.Errorf("cannot lock ref '%s': reference already exists", u.Ref)
+	case u.Old != "" && u.current == "":
+		return fmt.Errorf("cannot lock ref '%s': unable to resolve reference", u.Ref)
+	case u.Old != u.current:
+		return fmt.Errorf("cannot lock ref '%s': is at %s but expected %s", u.Ref, u.current, u.Old)
+	}
+	return nil
+}
+
+// apply moves the locked new value into place.
+func (u *refUpdate) apply() error {
+	if u.Ref == "HEAD" {
+		err := os.Rename(u.lock, repoPath("HEAD"))
+		if err == nil {
+			u.lock = ""
+		}
+		return err
+	}
+	if u.New == "" {
+		return deleteRef(u.Ref)
+	}
+	if err := os.Rename(u.lock, looseRefPath(u.Ref)); err != nil {
+		return err
+	}
+	u.lock = ""
+	return nil
+}
+
+// rollback restores the value u.Ref had before apply.
+func (u *refUpdate) rollback() {
+	switch {
+	case u.Ref == "HEAD":
+		ioutil.WriteFile(repoPath("HEAD"), []byte(u.current), 0644)
+	case !u.existed:
+		deleteRef(u.Ref)
+	default:
+		writeRef(u.Ref, u.current)
+	}
+}
+
+// UpdateRef sets ref to newValue, or deletes it when del is set. When oldValue
+// is given the update only happens if ref still has that value; "" or the
+// all-zero hash as oldValue means ref must not exist yet.
+func UpdateRef(ref, newValue string, oldValue *string, del bool, reason string) error {
+	tx := newRefTransaction()
+	newHash := ""
+	if !del {
+		var err error
+		if newHash, err = resolveRevision(newValue); err != nil {
+			return err
+		}
+	}
+	oldHash, checkOld, err := resolveOldValue(oldValue)
+	if err != nil {
+		return err
+	}
+	tx.update(ref, newHash, oldHash, checkOld, reason)
+	return tx.commit()
+}
+
+func resolveOldValue(oldValue *string) (string, bool, error) {
+	if oldValue == nil {
+		return "", false, nil
+	}
+	if *oldValue == "" || *oldValue == zeroHash {
+		return "", true, nil
+	}
+	hash, err := resolveRevision(*oldValue)
+	return hash, true, err
+}
+
+// UpdateRefStdin reads update-ref commands, one per line, and applies them
+// as a single transaction:
+//
+//	update <ref> <new> [<old>]
+//	create <ref> <new>
+//	delete <ref> [<old>]
+//	verify <ref> [<old>]
+//
+// Values are revisions; an <old> of the all-zero hash means the ref must not
+// exist.
+func UpdateRefStdin(input io.Reader, reason string) error {
+	tx := newRefTransaction()
+	scanner := bufio.NewScanner(input)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		command, args := fields[0], fields[1:]
+		invalid := func() error {
+			return fmt.Errorf("line %d: invalid '%s' command: %s", lineNo, command, line)
+		}
+		resolve := func(value string) (string, error) {
+			if value == zeroHash {
+				return "", nil
+			}
+			return resolveRevision(value)
+		}
+
+		switch command {
+		case "update":
+			if len(args) < 2 || len(args) > 3 {
+				return invalid()
+			}
+			newHash, err := resolve(args[1])
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			var old *string
+			if len(args) == 3 {
+				old = &args[2]
+			}
+			oldHash, checkOld, err := resolveOldValue(old)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			tx.update(args[0], newHash, oldHash, checkOld, reason)
+		case "create":
+			if len(args) != 2 {
+				return invalid()
+			}
+			newHash, err := resolve(args[1])
+			if err != nil || newHash == "" {
+				return fmt.Errorf("line %d: create %s needs a new value", lineNo, args[0])
+			}
+			tx.create(args[0], newHash, reason)
+		case "delete":
+			if len(args) < 1 || len(args) > 2 {
+				return invalid()
+			}
+			var old *string
+			if len(args) == 2 {
+				old = &args[1]
+			}
+			oldHash, checkOld, err := resolveOldValue(old)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			tx.delete(args[0], oldHash, checkOld, reason)
+		case "verify":
+			if len(args) < 1 || len(args) > 2 {
+				return invalid()
+			}
+			var old *string
+			if len(args) == 2 {
+				old = &args[1]
+			}
+			oldHash, _, err := resolveOldValue(old)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			tx.verify(args[0], oldHash)
+		default:
+			return fmt.Errorf("line %d: unknown command '%s'", lineNo, command)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return tx.commit()
+}
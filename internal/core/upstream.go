@@ -0,0 +1,206 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A branch's upstream is recorded the way git records it:
+//
+//	[branch "topic"]
+//		remote = origin
+//		merge = refs/heads/main
+//
+// naming refs/remotes/origin/main. A remote of "." makes merge a local
+// branch instead.
+
+// trackingInfo is how a branch relates to its upstream.
+type trackingInfo struct {
+	Upstream string // the upstream's short name, e.g. "origin/main"
+	Gone     bool   // the upstream ref no longer exists
+	Ahead    int    // commits on the branch but not the upstream
+	Behind   int    // commits on the upstream but not the branch
+}
+
+// shortRefName strips the refs/heads/, refs/remotes/ or refs/tags/ prefix.
+func shortRefName(ref string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/remotes/", "refs/tags/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix)
+		}
+	}
+	return ref
+}
+
+// aheadBehind counts the commits reachable from local but not upstream and
+// the other way round.
+func aheadBehind(local, upstream string) (int, int, error) {
+	fromLocal, err := ancestors(local)
+	if err != nil {
+		return 0, 0, err
+	}
+	fromUpstream, err := ancestors(upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+	ahead, behind := 0, 0
+	for hash := range fromLocal {
+		if !fromUpstream[hash] {
+			ahead++
+		}
+	}
+	for hash := range fromUpstream {
+		if !fromLocal[hash] {
+			behind++
+		}
+	}
+	return ahead, behind, nil
+}
+
+// branchTracking returns the tracking state of branch, or nil when it has
+// no upstream configured.
+func branchTracking(branch string) (*trackingInfo, error) {
+	ref, err := branchUpstream(branch)
+	if err != nil {
+		return nil, nil
+	}
+	info := &trackingInfo{Upstream: shortRefName(ref)}
+	upstream, err := readRef(ref)
+	if err != nil || upstream == "" {
+		info.Gone = true
+		return info, nil
+	}
+	local, err := readRef("refs/heads/" + branch)
+	if err != nil {
+		return nil, err
+	}
+	info.Ahead, info.Behind, err = aheadBehind(local, upstream)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// statusLines describes the tracking state in the words of "git status".
+func (t *trackingInfo) statusLines() []string {
+	commits := func(n int) string {
+		if n == 1 {
+			return "1 commit"
+		}
+		return fmt.Sprintf("%d commits", n)
+	}
+	switch {
+	case t.Gone:
+		return []string{fmt.Sprintf("Your branch is based on '%s', but the upstream is gone.", t.Upstream)}
+	case t.Ahead > 0 && t.Behind > 0:
+		return []string{
+			fmt.Sprintf("Your branch and '%s' have diverged,", t.Upstream),
+			fmt.Sprintf("and have %d and %d different commits each, respectively.", t.Ahead, t.Behind),
+		}
+	case t.Ahead > 0:
+		return []string{fmt.Sprintf("Your branch is ahead of '%s' by %s.", t.Upstream, commits(t.Ahead))}
+	case t.Behind > 0:
+		return []string{fmt.Sprintf("Your branch is behind '%s' by %s, and can be fast-forwarded.", t.Upstream, commits(t.Behind))}
+	}
+	return []string{fmt.Sprintf("Your branch is up to date with '%s'.", t.Upstream)}
+}
+
+// summary is the bracketed part of "branch -v" ("ahead 1, behind 2"); with
+// name the upstream is included as "branch -vv" shows it.
+func (t *trackingInfo) summary(name bool) string {
+	var parts []string
+	switch {
+	case t.Gone:
+		parts = append(parts, "gone")
+	default:
+		if t.Ahead > 0 {
+			parts = append(parts, fmt.Sprintf("ahead %d", t.Ahead))
+		}
+		if t.Behind > 0 {
+			parts = append(parts, fmt.Sprintf("behind %d", t.Behind))
+		}
+	}
+	text := strings.Join(parts, ", ")
+	if name {
+		if text == "" {
+			return "[" + t.Upstream + "]"
+		}
+		return "[" + t.Upstream + ": " + text + "]"
+	}
+	if text == "" {
+		return ""
+	}
+	return "[" + text + "]"
+}
+
+// currentBranchName returns the checked-out branch, failing on a detached
+// HEAD.
+func currentBranchName() (string, error) {
+	ref, detached, err := readHead()
+	if err != nil {
+		return "", fmt.Errorf("could not read HEAD: %v", err)
+	}
+	if detached {
+		return "", fmt.Errorf("HEAD is detached, not on any branch")
+	}
+	return strings.TrimPrefix(ref, "refs/heads/"), nil
+}
+
+// SetUpstream makes upstream, a remote-tracking branch such as
+// "origin/main" or a local branch, the upstream of branch (the current
+// branch when empty).
+func SetUpstream(branch, upstream string) error {
+	if branch == "" {
+		var err error
+		if branch, err = currentBranchName(); err != nil {
+			return err
+		}
+	}
+	if !refExists("refs/heads/" + branch) {
+		return fmt.Errorf("branch '%s' does not exist", branch)
+	}
+
+	var remote, merge string
+	ref, _ := dwimRef(upstream)
+	switch {
+	case strings.HasPrefix(ref, "refs/remotes/"):
+		name, rest, ok := strings.Cut(strings.TrimPrefix(ref, "refs/remotes/"), "/")
+		if !ok {
+			return fmt.Errorf("the requested upstream branch '%s' does not exist", upstream)
+		}
+		remote, merge = name, "refs/heads/"+rest
+	case strings.HasPrefix(ref, "refs/heads/"):
+		remote, merge = ".", ref
+	default:
+		return fmt.Errorf("the requested upstream branch '%s' does not exist", upstream)
+	}
+	if remote == "." && merge == "refs/heads/"+branch {
+		return fmt.Errorf("not setting branch '%s' as its own upstream", branch)
+	}
+
+	if err := setConfig("branch."+branch+".remote", remote, false); err != nil {
+		return err
+	}
+	if err := setConfig("branch."+branch+".merge", merge, false); err != nil {
+		return err
+	}
+	fmt.Printf("branch '%s' set up to track '%s'.\n", branch, shortRefName(ref))
+	return nil
+}
+
+// UnsetUpstream removes the upstream of branch (the current branch when
+// empty).
+func UnsetUpstream(branch string) error {
+	if branch == "" {
+		var err error
+		if branch, err = currentBranchName(); err != nil {
+			return err
+		}
+	}
+	if _, err := branchUpstream(branch); err != nil {
+		return fmt.Errorf("branch '%s' has no upstream information", branch)
+	}
+	unsetConfig("branch."+branch+".remote", false)
+	unsetConfig("branch."+branch+".merge", false)
+	return nil
+}
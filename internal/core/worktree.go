@@ -0,0 +1,429 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A repository has one main worktree, whose .mygitserver directory holds
+// everything, and any number of linked worktrees. A linked worktree's
+// .mygitserver is a file:
+//
+//	gitdir: <main>/.mygitserver/worktrees/<name>
+//
+// That administrative directory holds the worktree's own HEAD, index,
+// logs/HEAD and operation state (rebase, MERGE_HEAD, ...), plus:
+//
+//	gitdir     absolute path of the worktree's .mygitserver file
+//	commondir  path of the shared repository directory, relative to it
+//
+// Objects, refs, config and all other reflogs are shared through commondir.
+
+const repoDirName = ".mygitserver"
+
+// perWorktreeFiles are the repository files that every worktree has its own
+// copy of.
+var perWorktreeFiles = map[string]bool{
+	"HEAD":             true,
+	"index":            true,
+	"rebase":           true,
+	"rebase-todo":      true,
+	"sequencer":        true,
+	"ORIG_HEAD":        true,
+	"MERGE_HEAD":       true,
+	"MERGE_RR":         true,
+	"MERGE_MSG":        true,
+	"MERGE_MODE":       true,
+	"SQUASH_MSG":       true,
+	"CHERRY_PICK_HEAD": true,
+	"REVERT_HEAD":      true,
+}
+
+// gitDir returns the repository directory of the current worktree.
+func gitDir() string {
+	content, err := ioutil.ReadFile(repoDirName)
+	if err != nil {
+		// A directory (the main worktree) cannot be read as a file.
+		return repoDirName
+	}
+	dir, ok := strings.CutPrefix(strings.TrimSpace(string(content)), "gitdir: ")
+	if !ok {
+		return repoDirName
+	}
+	return dir
+}
+
+// commonDir returns the repository directory shared by all worktrees.
+func commonDir() string {
+	dir := gitDir()
+	content, err := ioutil.ReadFile(filepath.Join(dir, "commondir"))
+	if err != nil {
+		return dir
+	}
+	common := strings.TrimSpace(string(content))
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(dir, common)
+	}
+	return filepath.Clean(common)
+}
+
+// repoPath joins elem onto the repository directory it belongs to: the
+// current worktree's own directory for HEAD, the index, logs/HEAD and
+// operation state, the shared directory for everything else.
+func repoPath(elem ...string) string {
+	dir := commonDir()
+	if len(elem) > 0 {
+		first := strings.SplitN(filepath.ToSlash(elem[0]), "/", 2)[0]
+		perWorktree := perWorktreeFiles[first] || strings.HasSuffix(first, "_EDITMSG")
+		if first == "logs" {
+			rest := filepath.ToSlash(filepath.Join(elem...))
+			perWorktree = rest == "logs/HEAD"
+		}
+		if perWorktree {
+			dir = gitDir()
+		}
+	}
+	return filepath.Join(append([]string{dir}, elem...)...)
+}
+
+// worktreeInfo describes one worktree of the repository.
+type worktreeInfo struct {
+	Name     string // empty for the main worktree
+	Path     string // the working directory
+	GitDir   string // its repository directory
+	Head     string // the branch ref or, when Detached, the commit
+	Detached bool
+	Prunable string // why the worktree is stale, if it is
+}
+
+func (w *worktreeInfo) headCommit() string {
+	if w.Detached {
+		return w.Head
+	}
+	hash, _ := readRef(w.Head)
+	return hash
+}
+
+// listWorktrees returns the main worktree followed by the linked ones,
+// sorted by name.
+func listWorktrees() ([]*worktreeInfo, error) {
+	common, err := filepath.Abs(commonDir())
+	if err != nil {
+		return nil, err
+	}
+	main := &worktreeInfo{Path: filepath.Dir(common), GitDir: common}
+	main.Head, main.Detached, _ = readHeadFile(filepath.Join(common, "HEAD"))
+	worktrees := []*worktreeInfo{main}
+
+	entries, err := ioutil.ReadDir(filepath.Join(common, "worktrees"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		admin := filepath.Join(common, "worktrees", entry.Name())
+		wt := &worktreeInfo{Name: entry.Name(), GitDir: admin}
+		wt.Head, wt.Detached, _ = readHeadFile(filepath.Join(admin, "HEAD"))
+		if pointer, err := ioutil.ReadFile(filepath.Join(admin, "gitdir")); err != nil {
+			wt.Prunable = "gitdir file does not exist"
+		} else {
+			gitFile := strings.TrimSpace(string(pointer))
+			wt.Path = filepath.Dir(gitFile)
+			if _, err := os.Stat(gitFile); err != nil {
+				wt.Prunable = "gitdir file points to non-existent location"
+			}
+		}
+		worktrees = append(worktrees, wt)
+	}
+	return worktrees, nil
+}
+
+// currentWorktreeGitDir returns the absolute repository directory of the
+// worktree the command runs in.
+func currentWorktreeGitDir() string {
+	dir, err := filepath.Abs(gitDir())
+	if err != nil {
+		return gitDir()
+	}
+	return dir
+}
+
+// branchCheckedOutElsewhere returns the path of another worktree that has
+// ref checked out.
+func branchCheckedOutElsewhere(ref string) (string, bool) {
+	worktrees, err := listWorktrees()
+	if err != nil {
+		return "", false
+	}
+	current := currentWorktreeGitDir()
+	for _, wt := range worktrees {
+		if wt.GitDir != current && !wt.Detached && wt.Head == ref && wt.Prunable == "" {
+			return wt.Path, true
+		}
+	}
+	return "", false
+}
+
+// branchCheckedOut returns the path of any worktree, the current one
+// included, that has ref checked out.
+func branchCheckedOut(ref string) (string, bool) {
+	if head, detached, err := readHead(); err == nil && !detached && head == ref {
+		dir, _ := os.Getwd()
+		return dir, true
+	}
+	return branchCheckedOutElsewhere(ref)
+}
+
+// inWorktree runs fn with the working directory switched to path, so that
+// the usual cwd-relative code operates on that worktree.
+func inWorktree(path string, fn func() error) error {
+	previous, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(path); err != nil {
+		return err
+	}
+	defer os.Chdir(previous)
+	return fn()
+}
+
+// WorktreeAddOptions controls WorktreeAdd. NewBranch creates a branch at
+// the commit being checked out; Detach leaves HEAD detached even when a
+// branch is named; Force allows checking out a branch that is already
+// checked out in another worktree.
+type WorktreeAddOptions struct {
+	NewBranch string
+	Detach    bool
+	Force     bool
+}
+
+// WorktreeAdd creates a new worktree at path and checks out commitish
+// there. Without a commitish, a branch named after the directory is
+// checked out, and created from HEAD first if it does not exist.
+func WorktreeAdd(path, commitish string, opts WorktreeAddOptions) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if entries, err := ioutil.ReadDir(absPath); err == nil && len(entries) > 0 {
+		return fmt.Errorf("'%s' already exists", path)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	branch := ""
+	switch {
+	case opts.NewBranch != "":
+		if err := CreateBranchAt(opts.NewBranch, commitish); err != nil {
+			return err
+		}
+		branch = opts.NewBranch
+	case commitish == "" && !opts.Detach:
+		branch = filepath.Base(absPath)
+		if !refExists("refs/heads/" + branch) {
+			if err := CreateBranch(branch); err != nil {
+				return err
+			}
+		}
+	case !opts.Detach && checkBranchName(commitish) == nil && refExists("refs/heads/"+commitish):
+		branch = commitish
+	}
+
+	var commit string
+	if branch != "" {
+		ref := "refs/heads/" + branch
+		if where, ok := branchCheckedOut(ref); ok && !opts.Force {
+			return fmt.Errorf("'%s' is already checked out at '%s'", branch, where)
+		}
+		commit, err = readRef(ref)
+	} else {
+		commit, err = resolveCommit(commitish)
+	}
+	if err != nil {
+		return err
+	}
+
+	common, err := filepath.Abs(commonDir())
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(absPath)
+	admin := filepath.Join(common, "worktrees", name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(admin); os.IsNotExist(err) {
+			break
+		}
+		admin = filepath.Join(common, "worktrees", fmt.Sprintf("%s%d", name, i))
+	}
+	head := commit
+	if branch != "" {
+		head = "ref: refs/heads/" + branch
+	}
+
+	if err := os.MkdirAll(admin, 0755); err != nil {
+		return err
+	}
+	adminFiles := map[string]string{
+		"gitdir":    filepath.Join(absPath, repoDirName) + "\n",
+		"commondir": "../..\n",
+		"HEAD":      head,
+	}
+	for file, content := range adminFiles {
+		if err := ioutil.WriteFile(filepath.Join(admin, file), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(absPath, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(absPath, repoDirName), []byte("gitdir: "+admin+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if branch != "" {
+		fmt.Printf("Preparing worktree (checking out '%s')\n", branch)
+	} else {
+		fmt.Printf("Preparing worktree (detached HEAD %s)\n", shortHash(commit))
+	}
+	return inWorktree(absPath, func() error {
+		tree, err := commitTree(commit)
+		if err != nil {
+			return err
+		}
+		if err := resetWorkingTree(map[string]string{}, tree, map[string]string{}); err != nil {
+			return err
+		}
+		if err := appendReflog("HEAD", "", commit, "worktree add: "+path); err != nil {
+			return err
+		}
+		if commit != "" {
+			if c, err := readCommit(commit); err == nil {
+				fmt.Printf("HEAD is now at %s %s\n", shortHash(commit), c.Subject())
+			}
+		}
+		return nil
+	})
+}
+
+// WorktreeList prints every worktree with its HEAD commit and branch.
+func WorktreeList() error {
+	worktrees, err := listWorktrees()
+	if err != nil {
+		return err
+	}
+	width := 0
+	for _, wt := range worktrees {
+		if len(wt.Path) > width {
+			width = len(wt.Path)
+		}
+	}
+	for _, wt := range worktrees {
+		state := "(detached HEAD)"
+		if !wt.Detached {
+			state = "[" + strings.TrimPrefix(wt.Head, "refs/heads/") + "]"
+		}
+		hash := shortHash(wt.headCommit())
+		if hash == "" {
+			hash = strings.Repeat("0", 7)
+		}
+		line := fmt.Sprintf("%-*s  %s %s", width, wt.Path, hash, state)
+		if wt.Prunable != "" {
+			line += " prunable"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// findWorktree looks a linked worktree up by path or name.
+func findWorktree(target string) (*worktreeInfo, error) {
+	worktrees, err := listWorktrees()
+	if err != nil {
+		return nil, err
+	}
+	absTarget, _ := filepath.Abs(target)
+	for i, wt := range worktrees {
+		if wt.Path == absTarget || (wt.Name != "" && wt.Name == target) {
+			if i == 0 {
+				return nil, fmt.Errorf("'%s' is the main worktree", target)
+			}
+			return wt, nil
+		}
+	}
+	return nil, fmt.Errorf("'%s' is not a working tree", target)
+}
+
+// WorktreeRemove deletes a linked worktree and its administrative files.
+// A worktree with local changes or untracked files is only removed with
+// force.
+func WorktreeRemove(target string, force bool) error {
+	wt, err := findWorktree(target)
+	if err != nil {
+		return err
+	}
+	if wt.GitDir == currentWorktreeGitDir() {
+		return fmt.Errorf("cannot remove the current working tree")
+	}
+
+	if _, err := os.Stat(wt.Path); err == nil && !force {
+		dirty := false
+		err := inWorktree(wt.Path, func() error {
+			summary, err := collectStatus()
+			if err != nil {
+				return err
+			}
+			dirty = len(summary.Staged)+len(summary.Modified)+len(summary.Untracked) > 0
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return fmt.Errorf("'%s' contains modified or untracked files, use --force to delete it", target)
+		}
+	}
+
+	if wt.Path != "" {
+		if err := os.RemoveAll(wt.Path); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(wt.GitDir); err != nil {
+		return err
+	}
+	fmt.Printf("Removed worktree '%s'\n", wt.Path)
+	return nil
+}
+
+// WorktreePrune removes the administrative files of worktrees whose
+// directory has disappeared. With dryRun it only reports them; verbose
+// reports what is removed.
+func WorktreePrune(dryRun, verbose bool) error {
+	worktrees, err := listWorktrees()
+	if err != nil {
+		return err
+	}
+	for _, wt := range worktrees {
+		if wt.Prunable == "" {
+			continue
+		}
+		if dryRun || verbose {
+			fmt.Printf("Removing worktrees/%s: %s\n", wt.Name, wt.Prunable)
+		}
+		if dryRun {
+			continue
+		}
+		if err := os.RemoveAll(wt.GitDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/hex"
 	"io"
 	"os"
-	"strings"
 )
 
 func GenerateHash(data string) string {
@@ -14,10 +13,6 @@ func GenerateHash(data string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func JoinMessage(args []string) string {
-	return "Commit message: " + strings.Join(args, " ")
-}
-
 func GenerateFileHash(filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {